@@ -0,0 +1,26 @@
+// folder-link.js recarga la página de un enlace de carpeta (/f/...) cuando
+// cambia su contenido, salvo si hay archivos elegidos para subir
+"use strict";
+(function () {
+  var folder = document.getElementById("folder");
+  var status = document.getElementById("status");
+  var input = document.querySelector("input[type=file]");
+  var version = folder.dataset.version;
+
+  function check() {
+    if (document.hidden) return;
+    fetch(location.href, { headers: { Accept: "application/json" }, cache: "no-store" })
+      .then(function (res) { return res.ok ? res.json() : null; })
+      .then(function (data) {
+        if (!data || data.version === version) return;
+        if (input && input.files.length) {
+          status.textContent = "Hay cambios en la carpeta; se mostrarán al terminar de subir.";
+          return;
+        }
+        location.reload();
+      })
+      .catch(function () {});
+  }
+  setInterval(check, 15000);
+  document.addEventListener("visibilitychange", check);
+})();
@@ -0,0 +1,69 @@
+// lightbox.js abre los enlaces a.lightbox (imágenes) en un visor a pantalla
+// completa con anterior/siguiente, flechas del teclado y Esc. Las imágenes
+// llegan reducidas por /preview?w= y se precargan las de al lado; sin
+// JavaScript el enlace abre esa misma versión reducida
+"use strict";
+(function () {
+  var links = Array.prototype.slice.call(document.querySelectorAll("a.lightbox"));
+  if (!links.length) return;
+  var box = document.createElement("div");
+  box.className = "lightbox-view";
+  box.hidden = true;
+  box.innerHTML = '<img alt=""><p><a class="download" download>Descargar original</a> <span></span></p>' +
+    '<button type="button" class="prev" title="Anterior (←)">‹</button>' +
+    '<button type="button" class="next" title="Siguiente (→)">›</button>' +
+    '<button type="button" class="close" title="Cerrar (Esc)">×</button>';
+  document.body.appendChild(box);
+  var img = box.querySelector("img");
+  var caption = box.querySelector("span");
+  var download = box.querySelector("a.download");
+  var current = -1;
+  var preloaded = {};
+
+  function preload(i) {
+    if (i < 0 || i >= links.length || preloaded[i]) return;
+    preloaded[i] = new Image();
+    preloaded[i].src = links[i].href;
+  }
+  function show(i) {
+    if (i < 0 || i >= links.length) return;
+    current = i;
+    var a = links[i];
+    img.src = a.href;
+    img.alt = a.dataset.name || "";
+    caption.textContent = (a.dataset.name || "") + " · " + (i + 1) + " de " + links.length;
+    download.href = a.dataset.download || a.href;
+    box.hidden = false;
+    preload(i + 1);
+    preload(i - 1);
+  }
+  function close() {
+    box.hidden = true;
+    img.removeAttribute("src");
+    current = -1;
+  }
+
+  links.forEach(function (a, i) {
+    a.addEventListener("click", function (e) {
+      if (e.ctrlKey || e.metaKey || e.shiftKey || e.button !== 0) return;
+      e.preventDefault();
+      show(i);
+    });
+  });
+  box.querySelector(".prev").addEventListener("click", function () { show(current - 1); });
+  box.querySelector(".next").addEventListener("click", function () { show(current + 1); });
+  box.querySelector(".close").addEventListener("click", close);
+  box.addEventListener("click", function (e) { if (e.target === box) close(); });
+  // En fase de captura, para que los atajos del listado no se enteren
+  document.addEventListener("keydown", function (e) {
+    if (box.hidden) return;
+    switch (e.key) {
+    case "ArrowLeft": show(current - 1); break;
+    case "ArrowRight": case " ": show(current + 1); break;
+    case "Escape": close(); break;
+    default: return;
+    }
+    e.preventDefault();
+    e.stopPropagation();
+  }, true);
+})();
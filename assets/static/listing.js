@@ -0,0 +1,197 @@
+// listing.js añade al listado la selección múltiple y los atajos de teclado;
+// sin JavaScript las casillas y la barra de acciones siguen funcionando
+"use strict";
+if ("serviceWorker" in navigator) navigator.serviceWorker.register("/sw.js");
+(function () {
+  // El aviso de "Deshacer" desaparece al acabar el plazo, y la URL pierde el
+  // token para que recargar no lo vuelva a mostrar
+  var toast = document.getElementById("undo");
+  if (!toast) return;
+  var u = new URL(location.href);
+  u.searchParams.delete("undo");
+  history.replaceState(null, "", u.pathname + u.search + u.hash);
+  setTimeout(function () { toast.hidden = true; }, Number(toast.dataset.seconds) * 1000);
+})();
+(function () {
+  var boxes = Array.prototype.slice.call(document.querySelectorAll("input.sel"));
+  if (!boxes.length) return;
+  var rows = boxes.map(function (b) { return b.closest("tr"); });
+  var all = document.getElementById("select-all");
+  var count = document.getElementById("sel-count");
+  var del = document.getElementById("bulk-delete");
+  var zipBtn = document.getElementById("bulk-zip");
+  var zipChecked = false;
+  var last = -1, cursor = -1;
+  all.hidden = false;
+  document.getElementById("keys").hidden = false;
+
+  function update() {
+    var n = boxes.filter(function (b) { return b.checked; }).length;
+    count.textContent = n ? n + (n > 1 ? " seleccionados:" : " seleccionado:") : "Selección:";
+    all.checked = n === boxes.length;
+    all.indeterminate = n > 0 && n < boxes.length;
+    rows.forEach(function (r, i) { r.classList.toggle("selected", boxes[i].checked); });
+  }
+  function setAll(on) { boxes.forEach(function (b) { b.checked = on; }); update(); }
+  function move(to) {
+    if (cursor >= 0) rows[cursor].classList.remove("cursor");
+    cursor = Math.max(0, Math.min(rows.length - 1, to));
+    rows[cursor].classList.add("cursor");
+    rows[cursor].scrollIntoView({block: "nearest"});
+  }
+
+  boxes.forEach(function (b, i) {
+    b.addEventListener("click", function (e) {
+      // Mayús+clic marca (o desmarca) todo el rango desde el último clic
+      if (e.shiftKey && last >= 0) {
+        for (var j = Math.min(last, i); j <= Math.max(last, i); j++) boxes[j].checked = b.checked;
+      }
+      last = i;
+      update();
+    });
+  });
+  all.addEventListener("change", function () { setAll(all.checked); });
+  var bulk = document.getElementById("bulk");
+  bulk.addEventListener("submit", function (e) {
+    if (del && e.submitter === del && !confirm("¿Borrar los elementos seleccionados?")) e.preventDefault();
+    if (e.submitter !== zipBtn || zipChecked) { zipChecked = false; return; }
+    // Antes de un ZIP se pide la estimación para avisar de descargas enormes
+    e.preventDefault();
+    var q = new URLSearchParams();
+    boxes.forEach(function (b) { if (b.checked) q.append("paths", b.value); });
+    fetch("/zip/estimate?" + q).then(function (r) { return r.json(); }).then(function (est) {
+      if (!est.allowed) { alert("La selección ocupa " + est.human_size + ", más que el máximo permitido para ZIP."); return; }
+      if (est.bytes > (1 << 30) || est.files > 1000) {
+        if (!confirm("El ZIP tendrá " + est.files + " archivos (" + est.human_size + "). ¿Continuar?")) return;
+      }
+      zipChecked = true;
+      bulk.requestSubmit(zipBtn);
+    }, function () { zipChecked = true; bulk.requestSubmit(zipBtn); });
+  });
+
+  document.addEventListener("keydown", function (e) {
+    var t = e.target;
+    if (e.ctrlKey || e.metaKey || e.altKey || t.tagName === "TEXTAREA" || t.tagName === "SELECT") return;
+    if (t.tagName === "INPUT" && (t.type !== "checkbox" || e.key === " ")) return;
+    switch (e.key) {
+    case "j": case "ArrowDown": move(cursor + 1); break;
+    case "k": case "ArrowUp": move(cursor - 1); break;
+    case "x": case " ":
+      if (cursor < 0) return;
+      boxes[cursor].checked = !boxes[cursor].checked;
+      last = cursor;
+      update();
+      break;
+    case "a": setAll(boxes.some(function (b) { return !b.checked; })); break;
+    case "Escape": setAll(false); break;
+    case "Enter":
+      if (cursor < 0) return;
+      var link = rows[cursor].querySelector("a[href^='/?dir='], a[href^='/download/'], a[href^='/id/']");
+      if (link) link.click();
+      break;
+    case "Delete":
+      if (!del || !boxes.some(function (b) { return b.checked; })) return;
+      del.click();
+      break;
+    case "/":
+      var q = document.querySelector("input[name=q]");
+      if (q) q.focus();
+      break;
+    default:
+      return;
+    }
+    e.preventDefault();
+  });
+  update();
+})();
+// Con -lazy-stat los tamaños llegan después, en bloques de 200 rutas
+(function () {
+  var cells = Array.prototype.slice.call(document.querySelectorAll("td.lazy-size"));
+  for (var i = 0; i < cells.length; i += 200) (function (part) {
+    var q = new URLSearchParams();
+    part.forEach(function (c) { q.append("paths", c.dataset.path); });
+    fetch("/api/v1/stat?" + q).then(function (r) { return r.json(); }).then(function (stats) {
+      part.forEach(function (c) {
+        var s = stats[c.dataset.path];
+        c.textContent = s ? s.human_size : "-";
+        if (s) c.title = new Date(s.modified).toLocaleString();
+      });
+    }, function () {});
+  })(cells.slice(i, i + 200));
+})();
+// Vista continua: en carpetas paginadas muestra todo el listado en una lista
+// virtual que solo pinta las filas visibles y pide al API bloques de 200
+(function () {
+  var pager = document.getElementById("pager");
+  var btn = document.getElementById("continuous");
+  if (!pager || !btn) return;
+  var ROW = 28, BLOCK = 200;
+  var total = +pager.dataset.total, blocks = {}, seq = 0;
+  btn.hidden = false;
+  function human(n) {
+    var u = ["B", "KB", "MB", "GB", "TB"], i = 0;
+    while (n >= 1024 && i < u.length - 1) { n /= 1024; i++; }
+    return n.toFixed(1) + " " + u[i];
+  }
+  function load(b) {
+    if (blocks[b]) return blocks[b];
+    var q = new URLSearchParams({offset: b * BLOCK, limit: BLOCK});
+    if (pager.dataset.dir) q.set("dir", pager.dataset.dir);
+    if (pager.dataset.query) q.set("q", pager.dataset.query);
+    blocks[b] = fetch("/api/v1/files?" + q).then(function (r) {
+      if (!r.ok) throw new Error(r.status);
+      var t = r.headers.get("X-Total-Count");
+      if (t !== null) total = +t;
+      return r.json();
+    }).catch(function (e) { delete blocks[b]; throw e; });
+    return blocks[b];
+  }
+  btn.addEventListener("click", function () {
+    var box = document.createElement("div"), spacer = document.createElement("div");
+    box.className = "vlist";
+    spacer.style.height = total * ROW + "px";
+    box.appendChild(spacer);
+    var table = document.querySelector("table"), bulk = document.getElementById("bulk");
+    table.parentNode.insertBefore(box, table);
+    table.hidden = true;
+    pager.hidden = true;
+    if (bulk) bulk.hidden = true;
+    function row(f, i) {
+      var d = document.createElement("div"), a = document.createElement("a");
+      d.style.top = i * ROW + "px";
+      d.style.height = d.style.lineHeight = ROW + "px";
+      a.href = f.dir ? "/?dir=" + encodeURIComponent(f.path) : f.id ? "/id/" + f.id : "/download/" + f.path.split("/").map(encodeURIComponent).join("/");
+      a.textContent = (f.dir ? "📁 " : "") + f.name;
+      d.appendChild(a);
+      if (!f.dir) { var s = document.createElement("span"); s.textContent = human(f.size); d.appendChild(s); }
+      return d;
+    }
+    function render() {
+      // Cada pintado lleva un número; las respuestas de scrolls anteriores se descartan
+      var my = ++seq;
+      var first = Math.floor(box.scrollTop / ROW), last = Math.min(total, first + Math.ceil(box.clientHeight / ROW) + 10);
+      var wanted = [];
+      for (var b = Math.floor(first / BLOCK); b * BLOCK < last; b++) wanted.push(load(b).then(function (b) { return function (list) { return {b: b, list: list}; }; }(b)));
+      Promise.all(wanted).then(function (parts) {
+        if (my !== seq) return;
+        spacer.style.height = total * ROW + "px";
+        var frag = document.createDocumentFragment();
+        parts.forEach(function (p) {
+          p.list.forEach(function (f, j) {
+            var i = p.b * BLOCK + j;
+            if (i >= first && i < last) frag.appendChild(row(f, i));
+          });
+        });
+        while (spacer.nextSibling) box.removeChild(spacer.nextSibling);
+        box.appendChild(frag);
+      }, function () {});
+    }
+    var pending = false;
+    box.addEventListener("scroll", function () {
+      if (pending) return;
+      pending = true;
+      requestAnimationFrame(function () { pending = false; render(); });
+    });
+    render();
+  });
+})();
@@ -0,0 +1,140 @@
+// p2p.js es el cliente de las dos páginas de envío directo; va en un
+// archivo aparte porque la CSP no permite scripts en línea
+"use strict";
+(function () {
+  var $ = function (id) { return document.getElementById(id); };
+  var room = document.body.dataset.room, key = "";
+  var role = room ? "receiver" : "sender";
+  var ice = (document.body.dataset.ice || "").split(",").filter(Boolean).map(function (u) { return { urls: u }; });
+  var pc, channel, events, meta = {}, relayed = false;
+  var CHUNK = 64 * 1024;
+
+  function status(text) { $("status").textContent = text; }
+  function base() { return "/p2p/" + room + "/" + role; }
+  function signal(msg) {
+    return fetch(base() + "/signal?key=" + encodeURIComponent(key), { method: "POST", body: JSON.stringify(msg) });
+  }
+  function progress(done, total) {
+    $("progress").classList.remove("hidden");
+    $("progress").value = total ? done / total : 0;
+  }
+  function listen(handler) {
+    events = new EventSource(base() + "/events?key=" + encodeURIComponent(key));
+    events.onmessage = function (e) { handler(JSON.parse(e.data)); };
+  }
+  function newPeer() {
+    pc = new RTCPeerConnection({ iceServers: ice });
+    pc.onicecandidate = function (e) { if (e.candidate) signal({ type: "candidate", candidate: e.candidate }); };
+    return pc;
+  }
+
+  // --- Emisor ---
+  function startSender() {
+    var file = $("file").files[0];
+    if (!file) { status("Elige un archivo."); return; }
+    var headers = {};
+    if ($("password")) headers["X-Cerbero-Password"] = $("password").value;
+    fetch("/p2p", { method: "POST", headers: headers }).then(function (resp) {
+      if (!resp.ok) return resp.text().then(function (t) { throw new Error(t); });
+      return resp.json();
+    }).then(function (r) {
+      room = r.id; key = r.key;
+      $("pick").classList.add("hidden");
+      $("share").classList.remove("hidden");
+      $("url").value = r.url;
+      status("Esperando a quien recibe…");
+      listen(function (msg) { senderMessage(file, msg); });
+    }).catch(function (err) { status("No se pudo crear la sala: " + err.message); });
+  }
+
+  function senderMessage(file, msg) {
+    if (msg.type === "hello") {
+      signal({ type: "meta", name: file.name, size: file.size });
+      newPeer();
+      channel = pc.createDataChannel("file", { ordered: true });
+      channel.binaryType = "arraybuffer";
+      channel.bufferedAmountLowThreshold = 1 << 20;
+      channel.onopen = function () { sendFile(file); };
+      pc.oniceconnectionstatechange = function () { if (pc.iceConnectionState === "failed") relay(file); };
+      setTimeout(function () { if (channel.readyState !== "open") relay(file); }, 15000);
+      pc.createOffer().then(function (offer) { return pc.setLocalDescription(offer); })
+        .then(function () { signal({ type: "offer", sdp: pc.localDescription }); });
+    } else if (msg.type === "answer") {
+      pc.setRemoteDescription(msg.sdp);
+    } else if (msg.type === "candidate") {
+      pc.addIceCandidate(msg.candidate);
+    }
+  }
+
+  function sendFile(file) {
+    status("Conexión directa: enviando…");
+    var offset = 0;
+    function next() {
+      if (offset >= file.size) { channel.send("EOF"); status("Enviado."); return; }
+      if (channel.bufferedAmount > 8 << 20) { channel.onbufferedamountlow = function () { channel.onbufferedamountlow = null; next(); }; return; }
+      file.slice(offset, offset + CHUNK).arrayBuffer().then(function (buf) {
+        channel.send(buf);
+        offset += buf.byteLength;
+        progress(offset, file.size);
+        next();
+      });
+    }
+    next();
+  }
+
+  function relay(file) {
+    if (relayed) return;
+    relayed = true;
+    if (pc) pc.close();
+    status("Sin conexión directa: enviando a través del servidor…");
+    signal({ type: "relay" });
+    fetch("/p2p/" + room + "/relay?key=" + encodeURIComponent(key), {
+      method: "PUT", body: file,
+      headers: { "Content-Disposition": "attachment; filename*=UTF-8''" + encodeURIComponent(file.name) }
+    }).then(function (resp) { status(resp.ok ? "Enviado a través del servidor." : "El envío falló."); });
+  }
+
+  // --- Receptor ---
+  function startReceiver() {
+    var chunks = [], received = 0;
+    listen(function (msg) {
+      if (msg.type === "meta") {
+        meta = msg;
+        status("Recibiendo " + meta.name + "…");
+      } else if (msg.type === "offer") {
+        newPeer();
+        pc.ondatachannel = function (e) {
+          channel = e.channel;
+          channel.binaryType = "arraybuffer";
+          channel.onmessage = function (m) {
+            if (typeof m.data === "string") {
+              var link = $("save");
+              link.href = URL.createObjectURL(new Blob(chunks));
+              link.download = meta.name || "archivo";
+              link.classList.remove("hidden");
+              status("Recibido " + (meta.name || "") + " por conexión directa.");
+              events.close();
+              return;
+            }
+            chunks.push(m.data);
+            received += m.data.byteLength;
+            progress(received, meta.size);
+          };
+        };
+        pc.setRemoteDescription(msg.sdp).then(function () { return pc.createAnswer(); })
+          .then(function (answer) { return pc.setLocalDescription(answer); })
+          .then(function () { signal({ type: "answer", sdp: pc.localDescription }); });
+      } else if (msg.type === "candidate" && pc) {
+        pc.addIceCandidate(msg.candidate);
+      } else if (msg.type === "relay") {
+        if (pc) pc.close();
+        status("Sin conexión directa: descargando a través del servidor…");
+        window.location = "/p2p/" + room + "/relay";
+      }
+    });
+    events.onopen = function () { if (!meta.name) signal({ type: "hello" }); };
+  }
+
+  if (role === "sender") $("start").addEventListener("click", startSender);
+  else startReceiver();
+})();
@@ -0,0 +1,26 @@
+// Reproductor de /playlist: un clic en una pista la reproduce aquí en vez de
+// descargarla y, al terminar, sigue con la siguiente
+(function () {
+    var player = document.getElementById('player');
+    var links = Array.prototype.slice.call(document.querySelectorAll('#tracks a'));
+    if (!player || links.length === 0) return;
+    var current = -1;
+
+    function play(i) {
+        if (i < 0 || i >= links.length) return;
+        if (current >= 0) links[current].parentNode.classList.remove('playing');
+        current = i;
+        links[i].parentNode.classList.add('playing');
+        player.src = links[i].getAttribute('href');
+        player.play();
+        document.title = links[i].dataset.title + ' - Cerbero-Go';
+    }
+
+    links.forEach(function (a, i) {
+        a.addEventListener('click', function (e) {
+            e.preventDefault();
+            play(i);
+        });
+    });
+    player.addEventListener('ended', function () { play(current + 1); });
+})();
@@ -0,0 +1,72 @@
+// pwa-queue.js es la cola de IndexedDB que comparten el service worker y la página
+"use strict";
+function openQueue() {
+  return new Promise(function (ok, ko) {
+    var req = indexedDB.open("cerbero", 1);
+    req.onupgradeneeded = function () { req.result.createObjectStore("pending", {autoIncrement: true}); };
+    req.onsuccess = function () { ok(req.result); };
+    req.onerror = function () { ko(req.error); };
+  });
+}
+function withStore(mode, fn) {
+  return openQueue().then(function (db) {
+    return new Promise(function (ok, ko) {
+      var t = db.transaction("pending", mode);
+      var res = fn(t.objectStore("pending"));
+      t.oncomplete = function () { ok(res.result); };
+      t.onerror = function () { ko(t.error); };
+    });
+  });
+}
+function addPending(item) { return withStore("readwrite", function (s) { return s.add(item); }); }
+function removePending(key) { return withStore("readwrite", function (s) { return s.delete(key); }); }
+function listPending() {
+  return openQueue().then(function (db) {
+    return new Promise(function (ok, ko) {
+      var out = [];
+      var req = db.transaction("pending").objectStore("pending").openCursor();
+      req.onsuccess = function () {
+        var c = req.result;
+        if (!c) return ok(out);
+        out.push({key: c.key, item: c.value});
+        c.continue();
+      };
+      req.onerror = function () { ko(req.error); };
+    });
+  });
+}
+// flushPending sube los archivos en una sola petición (el límite por IP es de
+// una subida por segundo) y cada texto como nota; lo que falla sigue en cola
+function flushPending(password) {
+  return listPending().then(function (list) {
+    var files = list.filter(function (e) { return e.item.kind === "file"; });
+    var notes = list.filter(function (e) { return e.item.kind === "note"; });
+    var result = {sent: 0, status: 0};
+    var chain = Promise.resolve();
+    if (files.length) {
+      var fd = new FormData();
+      if (password) fd.append("password", password);
+      files.forEach(function (e) { fd.append("file", e.item.file, e.item.name); });
+      chain = fetch("/upload", {method: "POST", credentials: "same-origin", headers: {"Accept": "application/json"}, body: fd})
+        .then(function (r) {
+          result.status = r.status;
+          if (r.status !== 201) return;
+          result.sent += files.length;
+          return Promise.all(files.map(function (e) { return removePending(e.key); }));
+        });
+    }
+    notes.forEach(function (e) {
+      chain = chain.then(function () {
+        var headers = {"Content-Type": "application/json"};
+        if (password) headers["X-Cerbero-Password"] = password;
+        return fetch("/api/v1/notes", {method: "POST", credentials: "same-origin", headers: headers, body: JSON.stringify({content: e.item.text, format: "txt"})})
+          .then(function (r) {
+            if (r.status !== 201) { result.status = result.status || r.status; return; }
+            result.sent++;
+            return removePending(e.key);
+          });
+      });
+    });
+    return chain.then(function () { return result; }, function () { result.status = 0; return result; });
+  });
+}
@@ -0,0 +1,36 @@
+// pwa.js muestra y envía la cola de la página /share-target (necesita pwa-queue.js)
+"use strict";
+(function () {
+  var list = document.getElementById("pending");
+  var status = document.getElementById("status");
+  var form = document.getElementById("send");
+  var pw = form.querySelector("input[name=password]");
+
+  function render() {
+    return listPending().then(function (items) {
+      list.textContent = "";
+      items.forEach(function (e) {
+        var li = document.createElement("li");
+        li.textContent = e.item.kind === "file" ? e.item.name + " (" + Math.ceil(e.item.size / 1024) + " KB)" : "Nota: " + e.item.text.slice(0, 80);
+        list.appendChild(li);
+      });
+      form.hidden = items.length === 0;
+      if (!items.length && !status.textContent) status.textContent = "No hay nada pendiente.";
+      return items.length;
+    });
+  }
+  function send() {
+    status.textContent = "Enviando…";
+    return flushPending(pw ? pw.value : "").then(function (res) {
+      if (res.status === 401) status.textContent = "Clave errónea o necesaria: escríbela y vuelve a enviar.";
+      else if (res.status === 429) status.textContent = "Demasiadas peticiones; inténtalo en unos segundos.";
+      else if (res.status && res.status !== 201) status.textContent = "El servidor respondió " + res.status + "; queda en cola.";
+      else if (res.status === 0 && !res.sent) status.textContent = "Sin conexión: se enviará más tarde.";
+      else status.textContent = res.sent + " elemento(s) enviados.";
+      return render();
+    });
+  }
+  form.addEventListener("submit", function (e) { e.preventDefault(); send(); });
+  if ("serviceWorker" in navigator) navigator.serviceWorker.register("/sw.js");
+  render().then(function (n) { if (n && !pw) send(); });
+})();
@@ -0,0 +1,43 @@
+// sw.js es el service worker de la aplicación instalada; se sirve en /sw.js
+// detrás de pwa-queue.js para que su alcance sea todo el sitio
+self.addEventListener("install", function (e) {
+  e.waitUntil(caches.open("cerbero-v1").then(function (c) { return c.addAll(["/share-target"]); }));
+  self.skipWaiting();
+});
+self.addEventListener("activate", function (e) { e.waitUntil(self.clients.claim()); });
+
+self.addEventListener("fetch", function (e) {
+  var url = new URL(e.request.url);
+  if (url.origin !== location.origin) return;
+  if (url.pathname === "/share-target" && e.request.method === "POST") {
+    e.respondWith(receiveShare(e.request));
+  } else if ((url.pathname === "/share-target" || url.pathname.startsWith("/static/")) && e.request.method === "GET") {
+    // Sin conexión la página de la cola y sus scripts siguen abriéndose desde
+    // la caché; cada respuesta buena se guarda para la próxima vez
+    e.respondWith(fetch(e.request).then(function (res) {
+      if (res.ok) {
+        var copy = res.clone();
+        caches.open("cerbero-v1").then(function (c) { c.put(e.request, copy); });
+      }
+      return res;
+    }).catch(function () { return caches.match(e.request); }));
+  }
+});
+
+function receiveShare(request) {
+  return request.formData().then(function (form) {
+    var jobs = form.getAll("file").filter(function (f) { return f && f.name; }).map(function (f) {
+      return addPending({kind: "file", file: f, name: f.name, size: f.size, added: Date.now()});
+    });
+    var text = ["title", "text", "url"].map(function (k) { return form.get(k); }).filter(Boolean).join("\n");
+    if (text) jobs.push(addPending({kind: "note", text: text, added: Date.now()}));
+    return Promise.all(jobs);
+  }).then(function () {
+    if (self.registration.sync) return self.registration.sync.register("cerbero-upload").catch(function () {});
+  }).then(function () { return Response.redirect("/share-target", 303); });
+}
+
+// Al volver la conexión se reintenta (solo funciona sin clave o con sesión iniciada)
+self.addEventListener("sync", function (e) {
+  if (e.tag === "cerbero-upload") e.waitUntil(flushPending(""));
+});
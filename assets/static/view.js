@@ -0,0 +1,44 @@
+// view.js ordena la tabla de /view al pulsar una cabecera: primero de menor a
+// mayor, luego al revés. Las columnas con números se ordenan como números
+"use strict";
+(function () {
+  var table = document.getElementById("view-table");
+  if (!table) return;
+  var heads = Array.prototype.slice.call(table.tHead.rows[0].cells);
+  var body = table.tBodies[0];
+  var original = Array.prototype.slice.call(body.rows);
+
+  function number(s) {
+    s = s.trim().replace(/\s/g, "");
+    if (!/^[-+]?[\d.,]+(e[-+]?\d+)?%?$/i.test(s)) return NaN;
+    // 1.234,5 (coma decimal) o 1,234.5
+    if (/,\d{1,2}$/.test(s) || /^\d+,\d+$/.test(s)) s = s.replace(/\./g, "").replace(",", ".");
+    else s = s.replace(/,/g, "");
+    return parseFloat(s);
+  }
+
+  heads.forEach(function (th, col) {
+    th.addEventListener("click", function () {
+      var dir = th.classList.contains("asc") ? "desc" : "asc";
+      heads.forEach(function (h) { h.classList.remove("asc", "desc"); });
+      var rows = original.slice();
+      // La columna # vuelve al orden del archivo
+      if (col > 0) {
+        var cell = function (r) { return r.cells[col] ? r.cells[col].textContent : ""; };
+        var numeric = rows.every(function (r) { var v = cell(r); return v.trim() === "" || !isNaN(number(v)); });
+        var collator = new Intl.Collator(undefined, {numeric: true, sensitivity: "base"});
+        rows.sort(function (a, b) {
+          var x = cell(a), y = cell(b);
+          // Las vacías siempre al final
+          if ((x.trim() === "") !== (y.trim() === "")) return x.trim() === "" ? 1 : -1;
+          var c = numeric ? number(x) - number(y) : collator.compare(x, y);
+          return dir === "asc" ? c : -c;
+        });
+      } else if (dir === "desc") {
+        rows.reverse();
+      }
+      th.classList.add(dir);
+      rows.forEach(function (r) { body.appendChild(r); });
+    });
+  });
+})();
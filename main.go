@@ -1,20 +1,76 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/subtle"
+	"crypto/tls"
+	"embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"html/template"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
 	"log"
+	"maps"
+	"math"
+	"math/big"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime/debug"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // --- CONFIGURACIÓN Y SEGURIDAD ---
@@ -24,77 +80,173 @@ var (
 	maxUploadMB  int
 	password     string
 	enableDelete bool
+
+	uploadBufferMB      int
+	uploadBufferTotalMB int
+	tmpDir              string
+	lowMem              bool
+	rateLimits          string
+	transferHistory     int
+	jobWorkers          int
+	scheduleSpec        string
+	scrubMBps           int
+	reconcileInterval   time.Duration
+	snapshotFS          string
+	snapshotKeep        int
+	assetsDir           string
+	clientQuotaMB       int
+	userHomes           bool
+	homeQuotaMB         int
+	rootQuotaMB         int
+	redisURL            string
+	redisPrefix         string
+	tenantName          = os.Getenv(tenantEnv)
+	termsFile           string
+	showHidden          bool
+	excludePatterns     string
+	appendMaxMB         int
+	appendKeep          int
+	opaqueIDs           bool
+	undoSeconds         int
+
+	oidcIssuer       string
+	oidcClientID     string
+	oidcClientSecret string
+	oidcRedirectURL  string
+	oidcRolesClaim   string
+	oidcRoleMap      string
+	oidcDefaultRole  string
+
+	ldapURL          string
+	ldapBaseDN       string
+	ldapBindDN       string
+	ldapBindPassword string
+	ldapUserAttr     string
+	ldapRoleMap      string
+	ldapDefaultRole  string
+	ldapPoolSize     int
+
+	cspPolicy      string
+	frameOptions   string
+	referrerPolicy string
+	hstsMaxAge     int
+	forceDownload  bool
+	mimeTypes      string
+
+	stripExif     bool
+	keepOriginals bool
+
+	pdfPreviewCmd    string
+	officePreviewCmd string
+
+	maxNameLen   int
+	asciiNames   bool
+	rejectBadUTF bool
+	maxDirFiles  int
+	noSymlinks   bool
+	minFreeMB    int
+	zipMaxMB     int
+	listPageSize int
+	listCacheTTL time.Duration
+	statWorkers  int
+	lazyStat     bool
+
+	otlpEndpoint string
+	traceService string
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+	streamTimeout     time.Duration
+	maxHeaderKB       int
+
+	s3Listen    string
+	s3AccessKey string
+	s3SecretKey string
+	s3Bucket    string
+	s3Region    string
+
+	dropDirs     string
+	dropInterval time.Duration
+	dropCopy     bool
+
+	enableP2P bool
+	p2pICE    string
+
+	ipfsAPI        string
+	ipfsGateway    string
+	ipfsPinService string
+	ipfsPinToken   string
+
+	enableIndex   bool
+	indexInterval time.Duration
+	duInterval    time.Duration
+	pdfTextCmd    string
+	ocrCmd        string
 )
 
+// Política por defecto: sin scripts ni recursos externos, solo estilos inline
+// (los de las plantillas) y formularios hacia el propio servidor
+const defaultCSP = "default-src 'none'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+// Las descargas van además en un sandbox: un HTML subido no puede ejecutar
+// scripts ni actuar con el origen del servidor aunque el navegador lo muestre
+const downloadCSP = "default-src 'none'; style-src 'unsafe-inline'; img-src 'self' data:; media-src 'self'; sandbox"
+
+// Carpeta interna (dentro de rootDir) donde se guarda el estado del servidor
+const stateDirName = ".cerbero"
+
+var stateDir string
+
 type FileInfo struct {
 	Name      string
 	Size      int64
 	ModTime   time.Time
 	RelPath   string
 	HumanSize string
+	Pinned    bool
+	Preview   bool
+	MIME      string
+	Icon      string
+	Uploader  string
+	Message   string
+	IsDir     bool
+	CID       string
+	ExpiresIn string
+	Editable  bool
+	// Visibilidad guardada en los metadatos (public, password, private)
+	Visibility string
+	// Identificador opaco para el enlace de descarga (con -opaque-ids)
+	ID string
+	// Con -lazy-stat el tamaño y la fecha llegan después desde /api/v1/stat
+	SizePending bool
+	// Vídeos: se abren en /play/ y, si ffprobe los ha visto, duración y resolución
+	Playable bool
+	Video    string
+	// Imágenes que se abren en el visor a pantalla completa
+	Image bool
+	// Archivos con vista en /view (tablas...)
+	Viewable bool
 }
 
-type RequestTracker struct {
-	lastAccess map[string]time.Time
-	mu         sync.Mutex
-}
+// Funciones disponibles en las plantillas
+var templateFuncs = template.FuncMap{"pathEscape": escapePath, "ipfsURL": ipfsURL, "asset": assetURL, "humanSize": humanSize, "inc": func(i int) int { return i + 1 }}
+
+// Plantilla del listado (assets/templates/index.html, ver loadAssets)
+var pageTmpl *template.Template
+
+// Formulario de login (LDAP)
+var loginTmpl *template.Template
+
+// Página de ajustes: claves de API del usuario
+var settingsTmpl *template.Template
 
-var tracker = RequestTracker{lastAccess: make(map[string]time.Time)}
-
-// Plantilla HTML integrada
-var pageTmpl = template.Must(template.New("page").Parse(`
-<!DOCTYPE html>
-<html>
-<head>
-    <meta charset="utf-8">
-    <title>Cerbero-Go</title>
-    <meta name="viewport" content="width=device-width, initial-scale=1">
-    <style>
-        body { font-family: sans-serif; background: #f0f2f5; padding: 20px; }
-        .container { max-width: 800px; margin: auto; background: white; padding: 20px; border-radius: 8px; box-shadow: 0 2px 4px rgba(0,0,0,0.1); }
-        h1 { color: #1a73e8; border-bottom: 2px solid #eee; padding-bottom: 10px; }
-        .upload-section { background: #e8f0fe; padding: 15px; border-radius: 5px; margin-bottom: 20px; }
-        table { width: 100%; border-collapse: collapse; }
-        th, td { text-align: left; padding: 12px; border-bottom: 1px solid #ddd; }
-        .btn { padding: 6px 12px; border-radius: 4px; text-decoration: none; cursor: pointer; border: none; }
-        .btn-dl { background: #1a73e8; color: white; }
-        .btn-del { background: #d93025; color: white; }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <h1>Cerbero-Go <small style="font-size: 12px; color: #666;">v1.0</small></h1>
-        <div class="upload-section">
-            <form method="POST" action="/upload" enctype="multipart/form-data">
-                <input type="file" name="file" required>
-                {{if .PasswordEnabled}}<input type="password" name="password" placeholder="Contraseña">{{end}}
-                <button type="submit" class="btn btn-dl">Subir Archivo</button>
-            </form>
-        </div>
-        <table>
-            <thead><tr><th>Nombre</th><th>Tamaño</th><th>Acciones</th></tr></thead>
-            <tbody>
-                {{range .Files}}
-                <tr>
-                    <td>{{.Name}}</td>
-                    <td>{{.HumanSize}}</td>
-                    <td>
-                        <a href="/download/{{.RelPath}}" class="btn btn-dl">Descargar</a>
-                        {{if $.EnableDelete}}
-                        <form method="POST" action="/delete" style="display:inline;">
-                            <input type="hidden" name="path" value="{{.RelPath}}">
-                            {{if $.PasswordEnabled}}<input type="password" name="password" placeholder="Clave" style="width:60px;">{{end}}
-                            <button type="submit" class="btn btn-del">X</button>
-                        </form>
-                        {{end}}
-                    </td>
-                </tr>
-                {{end}}
-            </tbody>
-        </table>
-    </div>
-</body>
-</html>`))
+// Estado del índice de texto completo
+var indexStatusTmpl *template.Template
+
+// Resultado de una subida
+var uploadResultTmpl *template.Template
 
 // --- FUNCIONES DE APOYO ---
 
@@ -109,114 +261,14924 @@ func humanSize(n int64) string {
 	return fmt.Sprintf("%.1f %s", f, sizes[i])
 }
 
-func isRateLimited(ip string) bool {
-	tracker.mu.Lock()
-	defer tracker.mu.Unlock()
-	last, exists := tracker.lastAccess[ip]
-	if exists && time.Since(last) < 1*time.Second {
-		return true
+// writeJSONAtomic guarda v como JSON en path sin dejar nunca un fichero a
+// medias: escribe un .tmp, lo lleva a disco y lo renombra encima
+func writeJSONAtomic(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil { return err }
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil { return err }
+	_, err = f.Write(data)
+	if err == nil { err = f.Sync() }
+	if cerr := f.Close(); err == nil { err = cerr }
+	if err != nil { os.Remove(tmp); return err }
+	return os.Rename(tmp, path)
+}
+
+// --- NOMBRES DE ARCHIVO ---
+
+// Nombres reservados por Windows, con cualquier extensión ("nul.txt" también)
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Transliteración básica para -ascii-names
+var asciiFold = map[rune]string{
+	'á': "a", 'à': "a", 'â': "a", 'ä': "a", 'ã': "a", 'å': "a", 'Á': "A", 'À': "A", 'Â': "A", 'Ä': "A", 'Ã': "A", 'Å': "A",
+	'é': "e", 'è': "e", 'ê': "e", 'ë': "e", 'É': "E", 'È': "E", 'Ê': "E", 'Ë': "E",
+	'í': "i", 'ì': "i", 'î': "i", 'ï': "i", 'Í': "I", 'Ì': "I", 'Î': "I", 'Ï': "I",
+	'ó': "o", 'ò': "o", 'ô': "o", 'ö': "o", 'õ': "o", 'ø': "o", 'Ó': "O", 'Ò': "O", 'Ô': "O", 'Ö': "O", 'Õ': "O", 'Ø': "O",
+	'ú': "u", 'ù': "u", 'û': "u", 'ü': "u", 'Ú': "U", 'Ù': "U", 'Û': "U", 'Ü': "U",
+	'ñ': "n", 'Ñ': "N", 'ç': "c", 'Ç': "C", 'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE",
+}
+
+// escapePath codifica cada segmento de una ruta para usarla en una URL, de
+// modo que '#', '?' o '%' en un nombre no rompan el enlace
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, seg := range segments { segments[i] = url.PathEscape(seg) }
+	return strings.Join(segments, "/")
+}
+
+// Composición NFC de las letras latinas con diacríticos más habituales:
+// para cada marca combinante, las letras base y su forma precompuesta
+var nfcCompositions = map[rune][2]string{
+	'\u0300': {"AEIOUaeiou", "ÀÈÌÒÙàèìòù"},
+	'\u0301': {"AEIOUYaeiouyCNSZcnsz", "ÁÉÍÓÚÝáéíóúýĆŃŚŹćńśź"},
+	'\u0302': {"AEIOUaeiou", "ÂÊÎÔÛâêîôû"},
+	'\u0303': {"ANOano", "ÃÑÕãñõ"},
+	'\u0304': {"AEIOUaeiou", "ĀĒĪŌŪāēīōū"},
+	'\u0306': {"AGUagu", "ĂĞŬăğŭ"},
+	'\u0307': {"Zz", "Żż"},
+	'\u0308': {"AEIOUYaeiouy", "ÄËÏÖÜŸäëïöüÿ"},
+	'\u030A': {"AUau", "ÅŮåů"},
+	'\u030B': {"OUou", "ŐŰőű"},
+	'\u030C': {"CDENRSTZcdenrstz", "ČĎĚŇŘŠŤŽčďěňřšťž"},
+	'\u0327': {"CSTcst", "ÇŞŢçşţ"},
+	'\u0328': {"AEae", "ĄĘąę"},
+}
+
+// normalizeNFC compone letra + marca combinante en su carácter precompuesto.
+// No es un NFC completo, pero cubre los nombres que envían los Mac en
+// idiomas europeos, que es donde aparecen las diferencias en la práctica.
+func normalizeNFC(s string) string {
+	if !strings.ContainsFunc(s, func(r rune) bool { return r >= 0x300 && r <= 0x36F }) { return s }
+	out := make([]rune, 0, len(s))
+	for _, r := range s {
+		// Las letras base son ASCII, así que el índice en bytes coincide con el de runas
+		if comp, ok := nfcCompositions[r]; ok && len(out) > 0 {
+			if i := strings.IndexRune(comp[0], out[len(out)-1]); i >= 0 {
+				out[len(out)-1] = []rune(comp[1])[i]
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// sanitizeFilename normaliza el nombre enviado por el cliente antes de que
+// llegue al disco: sin rutas, sin caracteres de control ni prohibidos en
+// Windows, con UTF-8 válido, sin nombres reservados y con longitud acotada
+func sanitizeFilename(raw string) (string, error) {
+	// Algunos navegadores antiguos envían la ruta completa de Windows
+	if i := strings.LastIndexAny(raw, `/\`); i >= 0 { raw = raw[i+1:] }
+
+	if !utf8.ValidString(raw) {
+		if rejectBadUTF { return "", fmt.Errorf("UTF-8 inválido") }
+		raw = strings.ToValidUTF8(raw, "_")
+	}
+	raw = normalizeNFC(raw)
+
+	var b strings.Builder
+	for _, c := range raw {
+		switch {
+		case unicode.IsControl(c) || strings.ContainsRune(`<>:"|?*`, c):
+			b.WriteByte('_')
+		case asciiNames && c > unicode.MaxASCII:
+			if folded, ok := asciiFold[c]; ok {
+				b.WriteString(folded)
+			} else {
+				b.WriteByte('_')
+			}
+		default:
+			b.WriteRune(c)
+		}
+	}
+	// Windows no admite espacios ni puntos al final
+	name := strings.TrimRight(strings.TrimSpace(b.String()), ". ")
+	if name == "" || name == "." || name == ".." { return "", fmt.Errorf("nombre vacío") }
+
+	stem, _, _ := strings.Cut(name, ".")
+	if windowsReserved[strings.ToUpper(strings.TrimSpace(stem))] { name = "_" + name }
+
+	if len(name) > maxNameLen {
+		ext := filepath.Ext(name)
+		if len(ext) > maxNameLen/2 { ext = "" }
+		stem := strings.TrimSuffix(name, ext)
+		// Recorta por bytes sin partir un carácter multibyte
+		limit := maxNameLen - len(ext)
+		for len(stem) > limit {
+			_, size := utf8.DecodeLastRuneInString(stem)
+			stem = stem[:len(stem)-size]
+		}
+		name = stem + ext
+	}
+	return name, nil
+}
+
+// sanitizeRelPath limpia una ruta relativa (subida de carpetas) segmento a
+// segmento; ".." y los segmentos vacíos se rechazan en sanitizeFilename
+func sanitizeRelPath(raw string) (string, error) {
+	segments := strings.FieldsFunc(raw, func(c rune) bool { return c == '/' || c == '\\' })
+	if len(segments) == 0 { return "", fmt.Errorf("nombre vacío") }
+	for i, seg := range segments {
+		clean, err := sanitizeFilename(seg)
+		if err != nil { return "", err }
+		segments[i] = clean
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// rawFileName devuelve el filename tal como lo envió el navegador, con la
+// ruta relativa que multipart.Part.FileName() descarta
+func rawFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil { return part.FileName() }
+	return params["filename"]
+}
+
+// walkFiles recorre recursivamente los archivos bajo start (ruta absoluta),
+// saltando la carpeta de estado, los ocultos y los enlaces que salen de rootDir.
+// Recorre también las carpetas de -share sin clave que cuelgan de start
+func walkFiles(start string, fn func(rel string, info os.FileInfo)) error {
+	ignored := ignores.Current()
+	if mountOf(start) == nil {
+		under := relPath(start)
+		for _, m := range mounts {
+			if m.password == "" && (under == "." || strings.HasPrefix(m.name, under+"/")) { walkFiles(m.dir, fn) }
+		}
+	}
+	return filepath.WalkDir(start, func(p string, d os.DirEntry, err error) error {
+		if err != nil { return nil }
+		hidden := isHiddenName(d.Name()) || ignored.Match(relPath(p), d.IsDir())
+		// Una carpeta de -share tapa a la del mismo nombre
+		if mountOf(p) == nil && mountByName(relPath(p)) != nil { hidden = true }
+		if p != start && hidden {
+			if d.IsDir() { return filepath.SkipDir }
+			return nil
+		}
+		if d.IsDir() { return nil }
+		rel := relPath(p)
+		if d.Type()&os.ModeSymlink != 0 {
+			if _, err := securePath(rel); err != nil { return nil }
+		}
+		info, err := os.Stat(p)
+		if err != nil || info.IsDir() { return nil }
+		fn(rel, info)
+		return nil
+	})
+}
+
+// listingURL devuelve la URL del listado de una carpeta (ruta absoluta)
+func listingURL(dir string) string {
+	rel := relPath(dir)
+	if rel == "." { return "/" }
+	return "/?dir=" + url.QueryEscape(rel)
+}
+
+// relPath devuelve la ruta de un archivo relativa a rootDir, con "/"; lo que
+// está en una carpeta de -share cuelga de su nombre
+func relPath(abs string) string {
+	for _, m := range mounts {
+		if !within(m.dir, abs) { continue }
+		rel, _ := filepath.Rel(m.dir, abs)
+		if rel == "." { return m.name }
+		return m.name + "/" + filepath.ToSlash(rel)
+	}
+	rel, err := filepath.Rel(rootDir, abs)
+	if err != nil { return filepath.Base(abs) }
+	return filepath.ToSlash(rel)
+}
+
+// isInternalName reconoce la carpeta de estado y los temporales del servidor
+// (".cerbero-upload-*", ".cerbero-strip-*", ".cerbero-put-*"), que nunca se listan
+func isInternalName(name string) bool {
+	return strings.HasPrefix(name, stateDirName)
+}
+
+// Los archivos y carpetas que empiezan por punto (.git, .env, .trash,
+// .versions, .cache...) no se listan ni se sirven salvo con -show-hidden o
+// mientras un administrador los muestre desde el listado. La carpeta de
+// estado no se muestra nunca.
+var hiddenRevealed atomic.Bool
+
+// isHiddenName indica si una entrada se salta en listados, búsquedas y ZIP
+func isHiddenName(name string) bool {
+	return isInternalName(name) || strings.HasPrefix(name, ".") && !hiddenRevealed.Load()
+}
+
+// hasHiddenPart indica si algún tramo de la ruta relativa está oculto
+func hasHiddenPart(rel string) bool {
+	if rel == "." || hiddenRevealed.Load() { return false }
+	for _, part := range strings.Split(rel, "/") {
+		if strings.HasPrefix(part, ".") { return true }
 	}
-	tracker.lastAccess[ip] = time.Now()
 	return false
 }
 
+// checkDirCapacity aplica -max-files: una carpeta llena solo admite reemplazos
+func checkDirCapacity(target string) error {
+	if maxDirFiles <= 0 { return nil }
+	if _, err := os.Stat(target); err == nil { return nil }
+	entries, err := os.ReadDir(filepath.Dir(target))
+	if err != nil { return err }
+	count := 0
+	for _, e := range entries {
+		if !isInternalName(e.Name()) { count++ }
+	}
+	if count >= maxDirFiles { return fmt.Errorf("La carpeta ya tiene el máximo de %d archivos", maxDirFiles) }
+	return nil
+}
+
+func truncateRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n { return string(r[:n]) }
+	return s
+}
+
+// wantsJSON indica si el cliente prefiere JSON a HTML (clientes de API)
+func wantsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// errorMessage saca el mensaje de una respuesta de error del servidor, sea
+// {"code","message"} o texto plano; la usan los subcomandos cliente
+func errorMessage(body []byte) string {
+	var e struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &e) == nil && e.Message != "" { return e.Message + " (" + e.Code + ")" }
+	return strings.TrimSpace(string(body))
+}
+
+// baseURL reconstruye la URL pública a partir de la petición, respetando
+// X-Forwarded-Proto si hay un proxy TLS delante
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" { scheme = "https" }
+	return scheme + "://" + r.Host
+}
+
+var (
+	errForbidden = errors.New("acceso denegado")
+	errNotFound  = errors.New("no encontrado")
+)
+
+// realRoot es rootDir con los enlaces simbólicos resueltos (se fija al arrancar)
+var realRoot string
+
+// within indica si path está dentro de root (o es root), comparando rutas
+// relativas en vez de prefijos de texto ("/data" no contiene "/data-secreto")
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveExisting resuelve los enlaces simbólicos de la parte de la ruta que
+// ya existe y le añade el resto (para destinos que aún no se han creado)
+func resolveExisting(path string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			for i := len(rest) - 1; i >= 0; i-- { resolved = filepath.Join(resolved, rest[i]) }
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) { return "", err }
+		parent := filepath.Dir(path)
+		if parent == path { return "", err }
+		rest = append(rest, filepath.Base(path))
+		path = parent
+	}
+}
+
+// securePath traduce una ruta pedida por el cliente a una ruta dentro de
+// rootDir. Devuelve errForbidden si sale de la carpeta (también a través de
+// enlaces simbólicos), si toca la carpeta de estado o si es un enlace y
+// -no-symlinks está activo. No comprueba que exista: para eso, existingPath.
 func securePath(requestedPath string) (string, error) {
-	absRoot, _ := filepath.Abs(rootDir)
-	targetPath := filepath.Join(absRoot, filepath.Clean("/"+requestedPath))
-	if !strings.HasPrefix(targetPath, absRoot) {
-		return "", fmt.Errorf("acceso denegado")
+	// Las carpetas de -share tienen su propio encierro: nada de lo que se
+	// pida bajo /media puede salir de la carpeta montada como media
+	base, realBase, links := rootDir, realRoot, linksInside
+	if noSymlinks { links = linksNone }
+	clean := filepath.Clean("/" + requestedPath)
+	if m, rest := mountFor(clean); m != nil { base, realBase, clean, links = m.dir, m.real, rest, m.symlinks }
+	targetPath := filepath.Join(base, clean)
+	// Los clientes macOS envían los nombres descompuestos (NFD); en disco se
+	// guardan compuestos (NFC), salvo archivos copiados por fuera con NFD
+	if nfc := normalizeNFC(targetPath); nfc != targetPath {
+		if _, err := os.Lstat(targetPath); err != nil { targetPath = nfc }
 	}
+	if !within(base, targetPath) { return "", errForbidden }
+	// La carpeta de estado interno nunca se sirve ni se modifica desde la web
+	rel, _ := filepath.Rel(base, targetPath)
+	rel = filepath.ToSlash(rel)
+	if base == rootDir && (rel == stateDirName || strings.HasPrefix(rel, stateDirName+"/")) { return "", errForbidden }
+	if hasHiddenPart(rel) { return "", errForbidden }
+
+	resolved, err := resolveExisting(targetPath)
+	if err != nil { return "", errForbidden }
+	if !within(realBase, resolved) && !(links == linksAllowlist && allowedTarget(resolved)) { return "", errForbidden }
+	// Sin enlaces, la ruta resuelta debe ser exactamente la pedida
+	if links == linksNone && resolved != filepath.Join(realBase, filepath.FromSlash(rel)) { return "", errForbidden }
 	return targetPath, nil
 }
 
+// existingPath es securePath para rutas que deben existir
+func existingPath(requestedPath string) (string, error) {
+	path, err := securePath(requestedPath)
+	if err != nil { return "", err }
+	if _, err := os.Lstat(path); err != nil { return "", errNotFound }
+	return path, nil
+}
+
+// pathError responde 404 o 403 según el error de securePath/existingPath
+func pathError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errNotFound) {
+		http.Error(w, "No encontrado", 404)
+		return
+	}
+	http.Error(w, "Denegado", 403)
+}
+
 func checkPassword(r *http.Request) bool {
+	return passwordMatches(r, r.FormValue("password"))
+}
+
+// passwordMatches compara la clave compartida; cada fallo gasta un intento
+// de la clase "auth" y, agotados, la IP no puede entrar ni con la clave buena
+func passwordMatches(r *http.Request, sent string) bool {
 	if password == "" { return true }
-	sent := r.FormValue("password")
-	return subtle.ConstantTimeCompare([]byte(sent), []byte(password)) == 1
+	ip := clientIP(r)
+	if limiter.Exhausted("auth", ip) { return false }
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(password)) == 1 { return true }
+	limiter.Allow("auth", ip)
+	return false
 }
 
-// --- HANDLERS ---
+// currentUser identifica al usuario de la petición. Sin sesión iniciada
+// todo el mundo comparte la misma identidad vacía (modo monousuario).
+func currentUser(r *http.Request) string {
+	if k := apiKeyFor(r); k != nil { return k.User }
+	if s := sessionFor(r); s != nil { return s.User }
+	return ""
+}
 
-func renderIndex(w http.ResponseWriter, r *http.Request) {
-	entries, err := os.ReadDir(rootDir)
-	if err != nil {
-		http.Error(w, "Error leyendo carpeta", 500)
+// --- ROLES Y AUTORIZACIÓN ---
+
+const (
+	roleRead  = "read"
+	roleWrite = "write"
+	roleAdmin = "admin"
+)
+
+var roleRank = map[string]int{roleRead: 1, roleWrite: 2, roleAdmin: 3}
+
+func roleAllows(have, need string) bool {
+	return roleRank[have] >= roleRank[need]
+}
+
+// mapRole traduce grupos a un rol de Cerbero según un mapeo "grupo=rol,grupo=rol";
+// gana el rol más alto y, si ningún grupo coincide, se usa el rol por defecto
+func mapRole(groups []string, mapping, def string) string {
+	role := def
+	for _, pair := range strings.Split(mapping, ",") {
+		group, mapped, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok { continue }
+		for _, g := range groups {
+			if strings.EqualFold(g, group) && roleRank[mapped] > roleRank[role] { role = mapped }
+		}
+	}
+	return role
+}
+
+// loginEnabled indica si hay algún backend de autenticación configurado
+func loginEnabled() bool { return oidcEnabled() || ldapEnabled() }
+
+// authorized decide si la petición puede realizar una acción que requiere
+// el rol indicado: una sesión con rol suficiente o, si no, la clave compartida.
+// Con login activo y sin clave configurada, los anónimos no pueden modificar nada.
+func authorized(r *http.Request, need string) bool {
+	if ok, decided := authorizedByIdentity(r, need); decided { return ok }
+	return checkPassword(r)
+}
+
+// authorizedDelete decide si la petición puede borrar archivos: una clave de
+// API necesita el alcance delete; lo demás, el rol de administrador
+func authorizedDelete(r *http.Request) bool {
+	if bearerToken(r) != "" {
+		k := apiKeyFor(r)
+		return k != nil && slices.Contains(k.Scopes, scopeDelete)
+	}
+	return authorized(r, roleAdmin)
+}
+
+// authorizedByIdentity resuelve la autorización sin leer el cuerpo (clave de
+// API, sesión o ausencia de clave). decided=false significa que hace falta
+// comprobar la clave compartida enviada en el formulario.
+func authorizedByIdentity(r *http.Request, need string) (ok, decided bool) {
+	if bearerToken(r) != "" {
+		k := apiKeyFor(r)
+		return k != nil && k.Allows(need), true
+	}
+	if s := sessionFor(r); s != nil && roleAllows(s.Role, need) { return true, true }
+	if loginEnabled() && password == "" { return false, true }
+	if password == "" { return true, true }
+	if sent, ok := headerPassword(r); ok { return passwordMatches(r, sent), true }
+	return false, false
+}
+
+// identifiedAdmin indica si la petición viene de un administrador por su
+// identidad (sesión o clave de API). A diferencia de authorized no mira la
+// clave compartida, así que no lee el formulario ni cuenta intentos fallidos
+// en el límite de "auth". Se calcula una vez por petición: las listas de
+// control de acceso lo preguntan por cada entrada de un listado
+func identifiedAdmin(r *http.Request) bool {
+	if m, ok := r.Context().Value(adminMemoKey{}).(*adminMemo); ok {
+		m.once.Do(func() { m.ok = isIdentifiedAdmin(r) })
+		return m.ok
+	}
+	return isIdentifiedAdmin(r)
+}
+
+func isIdentifiedAdmin(r *http.Request) bool {
+	if bearerToken(r) != "" {
+		k := apiKeyFor(r)
+		return k != nil && k.Allows(roleAdmin)
+	}
+	s := sessionFor(r)
+	return s != nil && roleAllows(s.Role, roleAdmin)
+}
+
+type adminMemoKey struct{}
+
+type adminMemo struct {
+	once sync.Once
+	ok   bool
+}
+
+// memoIdentity prepara el hueco donde identifiedAdmin guarda su respuesta
+func memoIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminMemoKey{}, &adminMemo{})))
+	})
+}
+
+// headerPassword lee la clave compartida de X-Cerbero-Password o de HTTP Basic
+// (el usuario se ignora). Permite rechazar una subida antes de leer el cuerpo;
+// con "Expect: 100-continue" el cliente ni siquiera llega a enviarlo.
+func headerPassword(r *http.Request) (string, bool) {
+	if sent := r.Header.Get("X-Cerbero-Password"); sent != "" { return sent, true }
+	if _, sent, ok := r.BasicAuth(); ok { return sent, true }
+	return "", false
+}
+
+// --- SESIONES ---
+
+// Session viaja en una cookie firmada con HMAC; no hay estado en el servidor
+type Session struct {
+	User    string   `json:"u"`
+	Role    string   `json:"r"`
+	Groups  []string `json:"g,omitempty"` // para las listas de control de acceso
+	Expires int64    `json:"e"`
+}
+
+const sessionCookie = "cerbero_session"
+
+var sessionKey []byte
+
+// loadSessionKey reutiliza la clave guardada para que las sesiones sobrevivan
+// a un reinicio, o genera una nueva
+func loadSessionKey(path string) {
+	if key, err := os.ReadFile(path); err == nil && len(key) >= 32 {
+		sessionKey = key
 		return
 	}
+	sessionKey = make([]byte, 32)
+	rand.Read(sessionKey)
+	if err := os.WriteFile(path, sessionKey, 0600); err != nil {
+		log.Printf("No se pudo guardar la clave de sesión: %v", err)
+	}
+}
 
-	var files []FileInfo
-	for _, entry := range entries {
-		if entry.IsDir() { continue }
-		info, _ := entry.Info()
-		files = append(files, FileInfo{
-			Name:      entry.Name(),
-			Size:      info.Size(),
-			RelPath:   entry.Name(),
-			HumanSize: humanSize(info.Size()),
-			ModTime:   info.ModTime(),
-		})
+func signValue(payload []byte) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyValue(value string) ([]byte, bool) {
+	dot := strings.LastIndexByte(value, '.')
+	if dot < 0 { return nil, false }
+	payload, err1 := base64.RawURLEncoding.DecodeString(value[:dot])
+	sig, err2 := base64.RawURLEncoding.DecodeString(value[dot+1:])
+	if err1 != nil || err2 != nil { return nil, false }
+	mac := hmac.New(sha256.New, sessionKey)
+	mac.Write(payload)
+	return payload, hmac.Equal(sig, mac.Sum(nil))
+}
+
+func setSignedCookie(w http.ResponseWriter, r *http.Request, name string, v interface{}, ttl time.Duration) {
+	payload, _ := json.Marshal(v)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    signValue(payload),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func readSignedCookie(r *http.Request, name string, v interface{}) bool {
+	c, err := r.Cookie(name)
+	if err != nil { return false }
+	payload, ok := verifyValue(c.Value)
+	if !ok { return false }
+	return json.Unmarshal(payload, v) == nil
+}
+
+func clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1})
+}
+
+const sessionTTL = 12 * time.Hour
+
+func startSession(w http.ResponseWriter, r *http.Request, user, role string, groups []string) {
+	s := Session{User: user, Role: role, Groups: groups, Expires: time.Now().Add(sessionTTL).Unix()}
+	setSignedCookie(w, r, sessionCookie, s, sessionTTL)
+}
+
+func sessionFor(r *http.Request) *Session {
+	if sessionKey == nil { return nil }
+	var s Session
+	if !readSignedCookie(r, sessionCookie, &s) { return nil }
+	if time.Now().Unix() > s.Expires { return nil }
+	return &s
+}
+
+// --- AUTENTICACIÓN OIDC ---
+
+type oidcProvider struct {
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+	Issuer   string `json:"issuer"`
+
+	keys map[string]crypto.PublicKey
+	mu   sync.Mutex
+}
+
+var oidc oidcProvider
+
+// Estado temporal del login (state + nonce) guardado en cookie firmada
+type oidcLogin struct {
+	State string `json:"s"`
+	Nonce string `json:"n"`
+}
+
+const oidcLoginCookie = "cerbero_oidc"
+
+var oidcHTTP = &http.Client{Timeout: 15 * time.Second}
+
+func oidcEnabled() bool { return oidcIssuer != "" }
+
+func fetchJSON(u string, v interface{}) error {
+	resp, err := oidcHTTP.Get(u)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 { return fmt.Errorf("%s: HTTP %d", u, resp.StatusCode) }
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover carga el documento .well-known del proveedor la primera vez que hace falta
+func (p *oidcProvider) discover() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.AuthURL != "" { return nil }
+	if err := fetchJSON(strings.TrimSuffix(oidcIssuer, "/")+"/.well-known/openid-configuration", p); err != nil {
+		return err
 	}
+	if p.AuthURL == "" || p.TokenURL == "" || p.JWKSURL == "" {
+		p.AuthURL = ""
+		return fmt.Errorf("documento de descubrimiento OIDC incompleto")
+	}
+	return nil
+}
 
-	sort.Slice(files, func(i, j int) bool { return files[i].ModTime.After(files[j].ModTime) })
+// key devuelve la clave pública del kid indicado, recargando el JWKS si no la conoce
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok { return k, nil }
 
-	data := map[string]interface{}{
-		"Files":           files,
-		"EnableDelete":    enableDelete,
-		"PasswordEnabled": password != "",
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
 	}
-	pageTmpl.Execute(w, data)
+	if err := fetchJSON(p.JWKSURL, &set); err != nil { return nil, err }
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil { continue }
+			p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" { continue }
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil { continue }
+			p.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if k, ok := p.keys[kid]; ok { return k, nil }
+	return nil, fmt.Errorf("clave %q desconocida", kid)
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	host, _, _ := net.SplitHostPort(r.RemoteAddr)
-	if isRateLimited(host) { http.Error(w, "Límite excedido", 429); return }
-	if r.Method != "POST" { http.Error(w, "Error", 405); return }
-	if !checkPassword(r) { http.Error(w, "Clave errónea", 401); return }
+// verifyIDToken comprueba firma (RS256/ES256), emisor, audiencia, caducidad y nonce
+func (p *oidcProvider) verifyIDToken(raw, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 { return nil, fmt.Errorf("id_token mal formado") }
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(hb, &header) != nil { return nil, fmt.Errorf("cabecera inválida") }
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil { return nil, fmt.Errorf("firma inválida") }
 
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadMB)<<20)
-	file, header, err := r.FormFile("file")
-	if err != nil { http.Error(w, "Error", 400); return }
-	defer file.Close()
-
-	dstPath, _ := securePath(filepath.Base(header.Filename))
-	dst, _ := os.Create(dstPath)
-	defer dst.Close()
-	io.Copy(dst, file)
+	key, err := p.key(header.Kid)
+	if err != nil { return nil, err }
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("firma incorrecta")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("firma incorrecta")
+		}
+	default:
+		return nil, fmt.Errorf("algoritmo no soportado")
+	}
+
+	cb, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil { return nil, fmt.Errorf("claims inválidos") }
+	var claims map[string]interface{}
+	if err := json.Unmarshal(cb, &claims); err != nil { return nil, fmt.Errorf("claims inválidos") }
+
+	if iss, _ := claims["iss"].(string); iss != p.Issuer { return nil, fmt.Errorf("emisor inesperado") }
+	if !audienceMatches(claims["aud"], oidcClientID) { return nil, fmt.Errorf("audiencia inesperada") }
+	if exp, _ := claims["exp"].(float64); time.Now().Unix() > int64(exp) { return nil, fmt.Errorf("token caducado") }
+	if n, _ := claims["nonce"].(string); n != nonce { return nil, fmt.Errorf("nonce incorrecto") }
+	return claims, nil
+}
+
+func audienceMatches(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, _ := v.(string); s == clientID { return true }
+		}
+	}
+	return false
+}
+
+// oidcRoleValues extrae los valores del claim de roles/grupos configurado
+func oidcRoleValues(claims map[string]interface{}) []string {
+	var values []string
+	switch v := claims[oidcRolesClaim].(type) {
+	case string:
+		values = strings.Fields(strings.ReplaceAll(v, ",", " "))
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok { values = append(values, s) }
+		}
+	}
+	return values
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() { http.NotFound(w, r); return }
+	if err := oidc.discover(); err != nil {
+		log.Printf("OIDC: %v", err)
+		http.Error(w, "Proveedor de identidad no disponible", 502)
+		return
+	}
+	login := oidcLogin{State: randomToken(16), Nonce: randomToken(16)}
+	setSignedCookie(w, r, oidcLoginCookie, login, 10*time.Minute)
+
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", oidcClientID)
+	q.Set("redirect_uri", oidcRedirectURL)
+	q.Set("scope", "openid email profile")
+	q.Set("state", login.State)
+	q.Set("nonce", login.Nonce)
+	sep := "?"
+	if strings.Contains(oidc.AuthURL, "?") { sep = "&" }
+	http.Redirect(w, r, oidc.AuthURL+sep+q.Encode(), 302)
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() { http.NotFound(w, r); return }
+	// Tras un reinicio entre /oidc/login y la vuelta del proveedor, el
+	// descubrimiento (endpoint de tokens, claves) aún no se ha hecho
+	if err := oidc.discover(); err != nil {
+		log.Printf("OIDC: %v", err)
+		http.Error(w, "Proveedor de identidad no disponible", 502)
+		return
+	}
+	var login oidcLogin
+	if !readSignedCookie(r, oidcLoginCookie, &login) || r.URL.Query().Get("state") != login.State {
+		http.Error(w, "Estado de login inválido", 400)
+		return
+	}
+	clearCookie(w, oidcLoginCookie)
+	if e := r.URL.Query().Get("error"); e != "" { http.Error(w, "Login rechazado: "+e, 401); return }
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", r.URL.Query().Get("code"))
+	form.Set("redirect_uri", oidcRedirectURL)
+	req, _ := http.NewRequest("POST", oidc.TokenURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(oidcClientID), url.QueryEscape(oidcClientSecret))
+	resp, err := oidcHTTP.Do(req)
+	if err != nil { http.Error(w, "Error contactando al proveedor", 502); return }
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken string `json:"id_token"`
+	}
+	if resp.StatusCode != 200 || json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok) != nil || tok.IDToken == "" {
+		http.Error(w, "Intercambio de código fallido", 502)
+		return
+	}
+
+	claims, err := oidc.verifyIDToken(tok.IDToken, login.Nonce)
+	if err != nil {
+		log.Printf("OIDC: id_token rechazado: %v", err)
+		http.Error(w, "Token inválido", 401)
+		return
+	}
+	user, _ := claims["email"].(string)
+	if user == "" { user, _ = claims["preferred_username"].(string) }
+	if user == "" { user, _ = claims["sub"].(string) }
+
+	groups := oidcRoleValues(claims)
+	role := mapRole(groups, oidcRoleMap, oidcDefaultRole)
+	startSession(w, r, user, role, groups)
+	log.Printf("Login OIDC: %s (%s)", user, role)
 	http.Redirect(w, r, "/", 303)
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	rel := strings.TrimPrefix(r.URL.Path, "/download/")
-	abs, err := securePath(rel)
-	if err != nil { http.Error(w, "Denegado", 403); return }
-	http.ServeFile(w, r, abs)
+// loginHandler muestra el formulario de usuario/clave cuando hay LDAP; si solo
+// hay OIDC, redirige directamente al proveedor
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if !loginEnabled() { http.NotFound(w, r); return }
+	if !ldapEnabled() { http.Redirect(w, r, "/oidc/login", 302); return }
+
+	data := map[string]interface{}{"OIDCEnabled": oidcEnabled(), "Error": ""}
+	if r.Method == "POST" {
+		if rateLimited(w, r, "auth") { return }
+		user := strings.TrimSpace(r.FormValue("user"))
+		role, groups, err := ldapAuthenticate(user, r.FormValue("password"))
+		if err == nil {
+			startSession(w, r, user, role, groups)
+			log.Printf("Login LDAP: %s (%s)", user, role)
+			http.Redirect(w, r, "/", 303)
+			return
+		}
+		log.Printf("Login LDAP fallido para %q: %v", user, err)
+		w.WriteHeader(401)
+		data["Error"] = "Usuario o clave incorrectos"
+	}
+	loginTmpl.Execute(w, data)
 }
 
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
-	if !enableDelete { return }
-	if !checkPassword(r) { http.Error(w, "Clave errónea", 401); return }
-	path, err := securePath(r.FormValue("path"))
-	if err == nil { os.Remove(path) }
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	clearCookie(w, sessionCookie)
 	http.Redirect(w, r, "/", 303)
 }
 
-func main() {
-	flag.StringVar(&listenAddr, "listen", ":8080", "Puerto")
-	flag.StringVar(&rootDir, "root", "./shared", "Carpeta")
-	flag.IntVar(&maxUploadMB, "maxmb", 512, "Límite")
-	flag.StringVar(&password, "password", "", "Clave")
-	flag.BoolVar(&enableDelete, "delete", true, "Borrado")
-	flag.Parse()
+// --- AUTENTICACIÓN LDAP ---
 
-	abs, _ := filepath.Abs(rootDir)
-	rootDir = abs
-	os.MkdirAll(rootDir, 0755)
+// Cliente LDAPv3 mínimo (bind simple y búsqueda por igualdad) sobre BER,
+// suficiente para validar usuarios y leer sus grupos (memberOf).
+
+const (
+	ldapBindRequest    = 0x60
+	ldapBindResponse   = 0x61
+	ldapUnbindRequest  = 0x42
+	ldapSearchRequest  = 0x63
+	ldapSearchEntry    = 0x64
+	ldapSearchDone     = 0x65
+	ldapFilterAnd      = 0xa0
+	ldapFilterEquality = 0xa3
+	ldapFilterPresent  = 0x87
+)
+
+type ldapConn struct {
+	conn  net.Conn
+	msgID int
+}
+
+type ldapEntry struct {
+	DN    string
+	Attrs map[string][]string
+}
+
+// ldapPool reutiliza conexiones al servidor; cada uso empieza con un bind nuevo
+var ldapPool chan *ldapConn
+
+func ldapEnabled() bool { return ldapURL != "" }
+
+func berLength(n int) []byte {
+	if n < 0x80 { return []byte{byte(n)} }
+	var b []byte
+	for ; n > 0; n >>= 8 { b = append([]byte{byte(n)}, b...) }
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content { body = append(body, c...) }
+	return append(append([]byte{tag}, berLength(len(body))...), body...)
+}
+
+func berInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 { b = append([]byte{byte(v)}, b...) }
+	if b[0]&0x80 != 0 { b = append([]byte{0}, b...) }
+	return berTLV(tag, b)
+}
+
+func berString(tag byte, s string) []byte { return berTLV(tag, []byte(s)) }
+
+// berNext separa el primer elemento TLV de data y devuelve tag, contenido y resto
+func berNext(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 { return 0, nil, nil, fmt.Errorf("BER truncado") }
+	tag, l := data[0], int(data[1])
+	off := 2
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 4 || len(data) < 2+n { return 0, nil, nil, fmt.Errorf("longitud BER inválida") }
+		l = 0
+		for _, b := range data[2 : 2+n] { l = l<<8 | int(b) }
+		off += n
+	}
+	if l < 0 || len(data) < off+l { return 0, nil, nil, fmt.Errorf("BER truncado") }
+	return tag, data[off : off+l], data[off+l:], nil
+}
+
+func berToInt(b []byte) int {
+	v := 0
+	for _, x := range b { v = v<<8 | int(x) }
+	return v
+}
+
+func ldapDial() (*ldapConn, error) {
+	u, err := url.Parse(ldapURL)
+	if err != nil { return nil, err }
+	host := u.Host
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldaps":
+		if u.Port() == "" { host += ":636" }
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	case "ldap":
+		if u.Port() == "" { host += ":389" }
+		conn, err = dialer.Dial("tcp", host)
+	default:
+		return nil, fmt.Errorf("esquema LDAP no soportado: %s", u.Scheme)
+	}
+	if err != nil { return nil, err }
+	return &ldapConn{conn: conn}, nil
+}
 
-	http.HandleFunc("/", renderIndex)
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/download/", downloadHandler)
-	http.HandleFunc("/delete", deleteHandler)
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.msgID++
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(berTLV(0x30, berInt(0x02, c.msgID), op))
+	return c.msgID, err
+}
+
+// receive lee un LDAPMessage completo y devuelve el tag y contenido de la operación
+func (c *ldapConn) receive(id int) (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.conn, head); err != nil { return 0, nil, err }
+	l := int(head[1])
+	if l&0x80 != 0 {
+		ext := make([]byte, l&0x7f)
+		if len(ext) == 0 || len(ext) > 4 { return 0, nil, fmt.Errorf("longitud BER inválida") }
+		if _, err := io.ReadFull(c.conn, ext); err != nil { return 0, nil, err }
+		l = berToInt(ext)
+	}
+	if l > 4<<20 { return 0, nil, fmt.Errorf("respuesta LDAP demasiado grande") }
+	body := make([]byte, l)
+	if _, err := io.ReadFull(c.conn, body); err != nil { return 0, nil, err }
 
+	_, idBytes, rest, err := berNext(body)
+	if err != nil { return 0, nil, err }
+	if berToInt(idBytes) != id { return 0, nil, fmt.Errorf("respuesta LDAP inesperada") }
+	tag, op, _, err := berNext(rest)
+	return tag, op, err
+}
+
+// ldapResultCode lee el resultCode de un LDAPResult
+func ldapResultCode(op []byte) (int, string) {
+	_, code, rest, err := berNext(op)
+	if err != nil { return -1, "respuesta inválida" }
+	_, _, rest, _ = berNext(rest)
+	_, diag, _, _ := berNext(rest)
+	return berToInt(code), string(diag)
+}
+
+func (c *ldapConn) bind(dn, pass string) error {
+	id, err := c.send(berTLV(ldapBindRequest, berInt(0x02, 3), berString(0x04, dn), berString(0x80, pass)))
+	if err != nil { return err }
+	tag, op, err := c.receive(id)
+	if err != nil { return err }
+	if tag != ldapBindResponse { return fmt.Errorf("respuesta de bind inesperada") }
+	if code, diag := ldapResultCode(op); code != 0 { return fmt.Errorf("bind rechazado (%d) %s", code, diag) }
+	return nil
+}
+
+// searchOne busca una única entrada con (objectClass=*)&(attr=value) en el subárbol de base
+func (c *ldapConn) searchOne(base, attr, value string, attrs []string) (*ldapEntry, error) {
+	var attrList []byte
+	for _, a := range attrs { attrList = append(attrList, berString(0x04, a)...) }
+	filter := berTLV(ldapFilterAnd,
+		berString(ldapFilterPresent, "objectClass"),
+		berTLV(ldapFilterEquality, berString(0x04, attr), berString(0x04, value)))
+	id, err := c.send(berTLV(ldapSearchRequest,
+		berString(0x04, base), berInt(0x0a, 2), berInt(0x0a, 0),
+		berInt(0x02, 2), berInt(0x02, 10), berTLV(0x01, []byte{0}),
+		filter, berTLV(0x30, attrList)))
+	if err != nil { return nil, err }
+
+	var found []*ldapEntry
+	for {
+		tag, op, err := c.receive(id)
+		if err != nil { return nil, err }
+		switch tag {
+		case ldapSearchEntry:
+			_, dn, rest, err := berNext(op)
+			if err != nil { return nil, err }
+			entry := &ldapEntry{DN: string(dn), Attrs: make(map[string][]string)}
+			_, list, _, err := berNext(rest)
+			if err != nil { return nil, err }
+			for len(list) > 0 {
+				var item []byte
+				if _, item, list, err = berNext(list); err != nil { return nil, err }
+				_, name, vals, err := berNext(item)
+				if err != nil { return nil, err }
+				_, set, _, err := berNext(vals)
+				if err != nil { return nil, err }
+				for len(set) > 0 {
+					var v []byte
+					if _, v, set, err = berNext(set); err != nil { return nil, err }
+					key := strings.ToLower(string(name))
+					entry.Attrs[key] = append(entry.Attrs[key], string(v))
+				}
+			}
+			found = append(found, entry)
+		case ldapSearchDone:
+			if code, diag := ldapResultCode(op); code != 0 && code != 4 {
+				return nil, fmt.Errorf("búsqueda rechazada (%d) %s", code, diag)
+			}
+			if len(found) != 1 { return nil, fmt.Errorf("%d entradas para %s=%s", len(found), attr, value) }
+			return found[0], nil
+		}
+	}
+}
+
+func (c *ldapConn) close() {
+	c.send([]byte{ldapUnbindRequest, 0})
+	c.conn.Close()
+}
+
+// ldapGet devuelve una conexión del pool (que puede haber caducado) o una nueva
+func ldapGet() (*ldapConn, bool, error) {
+	select {
+	case c := <-ldapPool:
+		return c, true, nil
+	default:
+		c, err := ldapDial()
+		return c, false, err
+	}
+}
+
+func ldapPut(c *ldapConn) {
+	select {
+	case ldapPool <- c:
+	default:
+		c.close()
+	}
+}
+
+// ldapAuthenticate valida usuario y clave y devuelve el rol según sus grupos
+// y los nombres (CN) de esos grupos
+func ldapAuthenticate(user, pass string) (string, []string, error) {
+	// Una clave vacía sería un bind anónimo que muchos servidores aceptan
+	if user == "" || pass == "" { return "", nil, fmt.Errorf("credenciales vacías") }
+	c, pooled, err := ldapGet()
+	if err != nil { return "", nil, err }
+	err = c.bind(ldapBindDN, ldapBindPassword)
+	if err != nil && pooled {
+		// El servidor pudo cerrar la conexión inactiva: se reintenta con una nueva
+		c.conn.Close()
+		if c, err = ldapDial(); err != nil { return "", nil, err }
+		err = c.bind(ldapBindDN, ldapBindPassword)
+	}
+	ok := false
+	defer func() {
+		if ok { ldapPut(c) } else { c.conn.Close() }
+	}()
+	if err != nil { return "", nil, err }
+	entry, err := c.searchOne(ldapBaseDN, ldapUserAttr, user, []string{"memberOf"})
+	if err != nil { return "", nil, err }
+	if err := c.bind(entry.DN, pass); err != nil {
+		ok = true
+		return "", nil, err
+	}
+	ok = true
+
+	// Los grupos se comparan por su CN ("cn=admins,ou=grupos,..." -> "admins") o DN completo
+	var groups, names []string
+	for _, dn := range entry.Attrs["memberof"] {
+		groups = append(groups, dn)
+		first, _, _ := strings.Cut(dn, ",")
+		if _, cn, found := strings.Cut(first, "="); found { groups, names = append(groups, cn), append(names, cn) }
+	}
+	// En la sesión solo van los CN, para que la cookie no crezca con los DN
+	return mapRole(groups, ldapRoleMap, ldapDefaultRole), names, nil
+}
+
+// --- CLAVES DE API ---
+
+// Alcances de las claves de API y el rol mínimo de la sesión que puede darlos
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeDelete = "delete"
+)
+
+var scopeRole = map[string]string{scopeRead: roleRead, scopeWrite: roleWrite, scopeDelete: roleAdmin}
+
+// APIKey se guarda solo con el hash del token; el token en claro se muestra una vez
+type APIKey struct {
+	ID       string    `json:"id"`
+	User     string    `json:"user"`
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Allows indica si la clave basta para el rol pedido: write incluye read.
+// Ninguna clave es admin; delete solo abre los borrados (ver authorizedDelete)
+func (k *APIKey) Allows(need string) bool {
+	if need == roleAdmin { return false }
+	for _, sc := range k.Scopes {
+		if sc != scopeDelete && roleAllows(scopeRole[sc], need) { return true }
+	}
+	return false
+}
+
+type APIKeyStore struct {
+	path  string
+	keys  []*APIKey
+	saved map[string]time.Time
+	mu    sync.Mutex
+}
+
+var apiKeys = APIKeyStore{saved: make(map[string]time.Time)}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return fmt.Sprintf("%x", sum)
+}
+
+func (s *APIKeyStore) load(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &s.keys); err != nil { log.Printf("Ignorando %s: %v", path, err) }
+}
+
+func (s *APIKeyStore) save() error {
+	return writeJSONAtomic(s.path, s.keys)
+}
+
+// Create genera una clave nueva y devuelve el token en claro
+func (s *APIKeyStore) Create(user, name string, scopes []string) (string, error) {
+	token := "cbk_" + randomToken(24)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, &APIKey{
+		ID:      randomToken(6),
+		User:    user,
+		Name:    name,
+		Hash:    hashToken(token),
+		Scopes:  scopes,
+		Created: time.Now(),
+	})
+	return token, s.save()
+}
+
+func (s *APIKeyStore) Revoke(user, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, k := range s.keys {
+		if k.ID == id && k.User == user {
+			s.keys = append(s.keys[:i], s.keys[i+1:]...)
+			return s.save()
+		}
+	}
+	return fmt.Errorf("clave no encontrada")
+}
+
+func (s *APIKeyStore) ForUser(user string) []APIKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []APIKey
+	for _, k := range s.keys {
+		if k.User == user { out = append(out, *k) }
+	}
+	return out
+}
+
+// Lookup busca la clave por su token y anota el último uso. A disco solo se
+// vuelca como mucho una vez por minuto y clave para no escribir en cada petición.
+func (s *APIKeyStore) Lookup(token string) *APIKey {
+	hash := hashToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(k.Hash), []byte(hash)) != 1 { continue }
+		k.LastUsed = time.Now()
+		if time.Since(s.saved[k.ID]) > time.Minute {
+			s.saved[k.ID] = k.LastUsed
+			if err := s.save(); err != nil { log.Printf("Error guardando claves: %v", err) }
+		}
+		copied := *k
+		return &copied
+	}
+	return nil
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") { return strings.TrimSpace(auth[7:]) }
+	return ""
+}
+
+func apiKeyFor(r *http.Request) *APIKey {
+	token := bearerToken(r)
+	if token == "" { return nil }
+	return apiKeys.Lookup(token)
+}
+
+// settingsHandler permite a un usuario con sesión crear y revocar sus claves
+func settingsHandler(w http.ResponseWriter, r *http.Request) {
+	session := sessionFor(r)
+	if session == nil { http.Redirect(w, r, "/login", 303); return }
+
+	data := map[string]interface{}{"User": session.User, "NewToken": "", "Error": ""}
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			var scopes []string
+			for _, sc := range r.Form["scope"] {
+				// Nadie puede crear una clave con más permisos que su propio rol
+				if role, ok := scopeRole[sc]; ok && roleAllows(session.Role, role) { scopes = append(scopes, sc) }
+			}
+			name := strings.TrimSpace(r.FormValue("name"))
+			if name == "" || len(scopes) == 0 {
+				data["Error"] = "Indica un nombre y al menos un alcance permitido"
+				break
+			}
+			token, err := apiKeys.Create(session.User, name, scopes)
+			if err != nil { http.Error(w, "Error guardando", 500); return }
+			data["NewToken"] = token
+		case "revoke":
+			if err := apiKeys.Revoke(session.User, r.FormValue("id")); err != nil { http.Error(w, "No encontrado", 404); return }
+			http.Redirect(w, r, "/settings", 303)
+			return
+		}
+	}
+
+	var allowed []string
+	for _, sc := range []string{scopeRead, scopeWrite, scopeDelete} {
+		if roleAllows(session.Role, scopeRole[sc]) { allowed = append(allowed, sc) }
+	}
+	data["Keys"] = apiKeys.ForUser(session.User)
+	data["Scopes"] = allowed
+	settingsTmpl.Execute(w, data)
+}
+
+// --- ARCHIVOS FIJADOS ---
+
+// PinStore guarda, por usuario, los archivos fijados al inicio del listado
+type PinStore struct {
+	path   string
+	byUser map[string]map[string]bool
+	mu     sync.Mutex
+}
+
+var pins = PinStore{byUser: make(map[string]map[string]bool)}
+
+func (p *PinStore) load(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		log.Printf("Ignorando %s: %v", path, err)
+		return
+	}
+	for user, names := range raw {
+		set := make(map[string]bool)
+		for _, name := range names { set[name] = true }
+		p.byUser[user] = set
+	}
+}
+
+func (p *PinStore) save() error {
+	raw := make(map[string][]string)
+	for user, set := range p.byUser {
+		for name := range set { raw[user] = append(raw[user], name) }
+		sort.Strings(raw[user])
+	}
+	return writeJSONAtomic(p.path, raw)
+}
+
+func (p *PinStore) IsPinned(user, name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.byUser[user][name]
+}
+
+// Toggle fija o desfija un archivo y devuelve el nuevo estado
+func (p *PinStore) Toggle(user, name string) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	set := p.byUser[user]
+	if set == nil {
+		set = make(map[string]bool)
+		p.byUser[user] = set
+	}
+	if set[name] {
+		delete(set, name)
+	} else {
+		set[name] = true
+	}
+	return set[name], p.save()
+}
+
+// Rename sigue a un archivo o carpeta movidos en los fijados de todos los usuarios
+func (p *PinStore) Rename(old, new string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := false
+	for _, set := range p.byUser {
+		for name := range set {
+			if rest, ok := underPath(name, old); ok {
+				delete(set, name)
+				set[new+rest] = true
+				changed = true
+			}
+		}
+	}
+	if changed {
+		if err := p.save(); err != nil { log.Printf("Error guardando fijados: %v", err) }
+	}
+}
+
+// Forget quita un archivo de los fijados de todos los usuarios (al borrarlo)
+func (p *PinStore) Forget(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := false
+	for _, set := range p.byUser {
+		if set[name] {
+			delete(set, name)
+			changed = true
+		}
+	}
+	if changed {
+		if err := p.save(); err != nil { log.Printf("Error guardando fijados: %v", err) }
+	}
+}
+
+// --- CABECERAS DE SEGURIDAD ---
+
+// Extensiones que un navegador puede interpretar como documento activo
+var riskyExtensions = map[string]bool{
+	".html": true, ".htm": true, ".xhtml": true, ".xht": true, ".shtml": true,
+	".svg": true, ".svgz": true, ".xml": true, ".xsl": true,
+	".js": true, ".mjs": true, ".swf": true,
+}
+
+// isRiskyContent detecta HTML/SVG/JS por extensión o, si la extensión engaña,
+// por los primeros bytes del archivo
+func isRiskyContent(path string) bool {
+	if riskyExtensions[strings.ToLower(filepath.Ext(path))] { return true }
+	f, err := os.Open(path)
+	if err != nil { return false }
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	ctype := http.DetectContentType(head[:n])
+	return strings.HasPrefix(ctype, "text/html") || strings.HasPrefix(ctype, "text/xml")
+}
+
+// --- PÁGINAS DE ERROR ---
+
+// Códigos estables para los errores; los scripts deben mirar "code", no el
+// mensaje, que está en español y puede cambiar
+var errorCodes = map[int]string{
+	400: "bad_request", 401: "unauthorized", 403: "forbidden", 404: "not_found",
+	405: "method_not_allowed", 409: "conflict", 410: "gone", 412: "precondition_failed",
+	413: "too_large", 415: "unsupported_type", 416: "range_not_satisfiable",
+	422: "invalid_content", 429: "rate_limited", 500: "internal", 502: "bad_gateway",
+	451: "quarantined", 503: "unavailable", 507: "insufficient_storage",
+}
+
+// errorCodeHeader permite a un handler dar un código más preciso que el del
+// estado HTTP antes de llamar a http.Error (ver failWith)
+const errorCodeHeader = "X-Cerbero-Error"
+
+// failWith es http.Error con un código de error propio
+func failWith(w http.ResponseWriter, code, msg string, status int) {
+	w.Header().Set(errorCodeHeader, code)
+	http.Error(w, msg, status)
+}
+
+var errorTmpl *template.Template
+
+// errorWriter retiene las respuestas de http.Error (texto plano con estado
+// >= 400) para rehacerlas como página HTML o JSON según quién pregunta; el
+// resto pasa sin tocar, incluido el camino de sendfile
+type errorWriter struct {
+	http.ResponseWriter
+	held   int
+	body   bytes.Buffer
+}
+
+func (ew *errorWriter) WriteHeader(code int) {
+	if code >= 400 && ew.held == 0 && ew.Header().Get("Content-Type") == "text/plain; charset=utf-8" {
+		ew.held = code
+		return
+	}
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+func (ew *errorWriter) Write(p []byte) (int, error) {
+	if ew.held == 0 { return ew.ResponseWriter.Write(p) }
+	if ew.body.Len() < 4<<10 { ew.body.Write(p) }
+	return len(p), nil
+}
+
+func (ew *errorWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := ew.ResponseWriter.(io.ReaderFrom); ok && ew.held == 0 { return rf.ReadFrom(src) }
+	return io.Copy(struct{ io.Writer }{ew}, src)
+}
+
+func (ew *errorWriter) Unwrap() http.ResponseWriter { return ew.ResponseWriter }
+
+// errorPages convierte los errores en HTML para navegadores y en
+// {"code","message"} para /api/ y Accept: application/json. Los clientes
+// que no piden ninguno de los dos (curl, cerbero send) siguen recibiendo texto
+func errorPages(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asJSON := wantsJSON(r) || strings.HasPrefix(r.URL.Path, "/api/")
+		asHTML := !asJSON && strings.Contains(r.Header.Get("Accept"), "text/html")
+		if !asJSON && !asHTML { next.ServeHTTP(w, r); return }
+		ew := &errorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if ew.held == 0 { return }
+
+		h := w.Header()
+		code := h.Get(errorCodeHeader)
+		if code == "" { code = errorCodes[ew.held] }
+		if code == "" { code = "error" }
+		h.Del(errorCodeHeader)
+		// Lo que el handler preparó para el archivo no vale para la página de error
+		for _, k := range []string{"Content-Disposition", "ETag", "Digest", "Repr-Digest", "X-Cerbero-SHA256", "Trailer"} { h.Del(k) }
+		msg := strings.TrimSpace(ew.body.String())
+		if asJSON {
+			h.Set("Content-Type", "application/json")
+			w.WriteHeader(ew.held)
+			json.NewEncoder(w).Encode(map[string]string{"code": code, "message": msg})
+			return
+		}
+		if cspPolicy != "" { h.Set("Content-Security-Policy", cspPolicy) }
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(ew.held)
+		back := "/"
+		if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host && ref.Path != r.URL.Path { back = ref.RequestURI() }
+		errorTmpl.Execute(w, map[string]interface{}{"Status": ew.held, "Message": msg, "Code": code, "Back": back})
+	})
+}
+
+// securityHeaders añade las cabeceras de endurecimiento a todas las respuestas;
+// cada una se desactiva dejando su parámetro vacío (o a 0 en el caso de HSTS)
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		if cspPolicy != "" { h.Set("Content-Security-Policy", cspPolicy) }
+		if frameOptions != "" { h.Set("X-Frame-Options", frameOptions) }
+		if referrerPolicy != "" { h.Set("Referrer-Policy", referrerPolicy) }
+		// Detrás de un proxy TLS la conexión llega en claro; X-Forwarded-Proto
+		// solo puede falsearlo el propio cliente, así que basta para HSTS
+		if hstsMaxAge > 0 && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") {
+			h.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", hstsMaxAge))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// --- METADATOS DE ARCHIVOS ---
+
+// FileMeta guarda lo que no se puede deducir del sistema de archivos
+type FileMeta struct {
+	MIME     string `json:"mime,omitempty"`
+	Uploader string `json:"uploader,omitempty"`
+	Message  string `json:"message,omitempty"`
+	// SHA-256 del contenido, válido mientras el tamaño y la fecha coincidan
+	SHA256    string `json:"sha256,omitempty"`
+	HashSize  int64  `json:"hash_size,omitempty"`
+	HashMTime int64  `json:"hash_mtime,omitempty"`
+	CID       string `json:"cid,omitempty"`
+	// Momento (Unix) en que el limpiador borra el archivo; 0 = nunca
+	Expires int64 `json:"expires,omitempty"`
+	// Quién puede verlo: "" o "public", "password" o "private"
+	Visibility string `json:"visibility,omitempty"`
+	// Identificador opaco y estable para /id/{id} (con -opaque-ids)
+	ID string `json:"id,omitempty"`
+	// Vídeos: duración en segundos y resolución, según ffprobe
+	Duration float64 `json:"duration,omitempty"`
+	Width    int     `json:"width,omitempty"`
+	Height   int     `json:"height,omitempty"`
+	// Carpeta de .cerbero/hls con la versión para streaming: "tamaño-fecha-azar"
+	HLS string `json:"hls,omitempty"`
+	// Fotos: fecha de captura del EXIF (Unix); 0 = sin leer, -1 = no la trae
+	Taken int64 `json:"taken,omitempty"`
+}
+
+// MetaStore persiste los metadatos por nombre de archivo en un único JSON
+type MetaStore struct {
+	path  string
+	files map[string]*FileMeta
+	dirty bool
+	mu    sync.Mutex
+}
+
+var meta = MetaStore{files: make(map[string]*FileMeta)}
+
+func (m *MetaStore) load(path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &m.files); err != nil {
+		log.Printf("Ignorando %s: %v", path, err)
+		m.files = make(map[string]*FileMeta)
+	}
+}
+
+func (m *MetaStore) save() error {
+	if err := writeJSONAtomic(m.path, m.files); err != nil { return err }
+	m.dirty = false
+	return nil
+}
+
+// Get devuelve una copia de los metadatos (vacíos si el archivo no tiene)
+func (m *MetaStore) Get(name string) (FileMeta, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if fm, ok := m.files[name]; ok { return *fm, true }
+	return FileMeta{}, false
+}
+
+// Update modifica los metadatos de un archivo y los guarda
+func (m *MetaStore) Update(name string, fn func(*FileMeta)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fm := m.files[name]
+	if fm == nil {
+		fm = &FileMeta{}
+		m.files[name] = fm
+	}
+	fn(fm)
+	return m.save()
+}
+
+// Fill completa metadatos solo en memoria; Flush los guarda después de una vez.
+// Sirve para rellenar muchos archivos sin reescribir el JSON por cada uno.
+func (m *MetaStore) Fill(name string, fn func(*FileMeta)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fm := m.files[name]
+	if fm == nil {
+		fm = &FileMeta{}
+		m.files[name] = fm
+	}
+	fn(fm)
+	m.dirty = true
+}
+
+func (m *MetaStore) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirty { return }
+	if err := m.save(); err != nil {
+		log.Printf("Error guardando metadatos: %v", err)
+		return
+	}
+	m.dirty = false
+}
+
+// knownSHA256 devuelve el SHA-256 guardado solo si sigue siendo válido, sin calcularlo
+func knownSHA256(rel string, info os.FileInfo) (string, bool) {
+	if fm, ok := meta.Get(rel); ok && fm.SHA256 != "" && fm.HashSize == info.Size() && fm.HashMTime == info.ModTime().UnixNano() {
+		return fm.SHA256, true
+	}
+	return "", false
+}
+
+// cachedSHA256 devuelve el SHA-256 guardado si el archivo no cambió desde que
+// se calculó, o lo calcula y lo deja pendiente de Flush
+func cachedSHA256(rel string, info os.FileInfo) (string, error) {
+	if sum, ok := knownSHA256(rel, info); ok { return sum, nil }
+	sum, err := fileSHA256(absPath(rel))
+	if err != nil { return "", err }
+	meta.Fill(rel, func(m *FileMeta) { m.SHA256, m.HashSize, m.HashMTime = sum, info.Size(), info.ModTime().UnixNano() })
+	return sum, nil
+}
+
+// Expired devuelve los archivos cuya caducidad ya pasó
+func (m *MetaStore) Expired(now time.Time) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name, fm := range m.files {
+		if fm.Expires > 0 && fm.Expires <= now.Unix() { names = append(names, name) }
+	}
+	return names
+}
+
+// Rename mueve los metadatos de un archivo, o de todo lo que hay bajo una
+// carpeta, a su nueva ruta
+func (m *MetaStore) Rename(old, new string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	moved := make(map[string]*FileMeta)
+	for name, fm := range m.files {
+		if rest, ok := underPath(name, old); ok {
+			moved[new+rest] = fm
+			delete(m.files, name)
+		}
+	}
+	if len(moved) == 0 { return }
+	for name, fm := range moved { m.files[name] = fm }
+	if err := m.save(); err != nil { log.Printf("Error guardando metadatos: %v", err) }
+}
+
+func (m *MetaStore) Delete(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok { return }
+	delete(m.files, name)
+	if err := m.save(); err != nil { log.Printf("Error guardando metadatos: %v", err) }
+}
+
+// Tipos que el sniffing de contenido no distingue bien y conviene fijar por extensión
+var extensionMIME = map[string]string{
+	".md":   "text/markdown; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".log":  "text/plain; charset=utf-8",
+	".yaml": "application/yaml",
+	".yml":  "application/yaml",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".mkv":  "video/x-matroska",
+	".flac": "audio/flac",
+	".7z":   "application/x-7z-compressed",
+	".iso":  "application/x-iso9660-image",
+}
+
+func mimeByExtension(name string) string {
+	if t := extensionMIME[strings.ToLower(filepath.Ext(name))]; t != "" { return t }
+	return mime.TypeByExtension(filepath.Ext(name))
+}
+
+// detectContentType combina el sniffing de los primeros 512 bytes con la
+// extensión: el contenido manda, salvo cuando solo sabe decir "binario" o "texto"
+func detectContentType(path string) string { return sniffContentType(path, path) }
+
+// sniffContentType es detectContentType para un archivo cuyo nombre real es
+// otro (el temporal de una subida)
+func sniffContentType(path, name string) string {
+	byExt := mimeByExtension(name)
+	f, err := os.Open(path)
+	if err != nil { return byExt }
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	sniffed := http.DetectContentType(head[:n])
+
+	generic := sniffed == "application/octet-stream" || strings.HasPrefix(sniffed, "text/plain") || sniffed == "application/zip"
+	if generic && byExt != "" { return byExt }
+	return sniffed
+}
+
+// Tipos por extensión configurados con -mime-types; mandan sobre lo guardado
+var mimeOverrides = map[string]string{}
+
+func parseMIMEOverrides(spec string) error {
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" { continue }
+		ext, typ, ok := strings.Cut(pair, "=")
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if !ok || ext == "" || strings.TrimSpace(typ) == "" { return fmt.Errorf("entrada no válida: %q", pair) }
+		if _, _, err := mime.ParseMediaType(typ); err != nil { return fmt.Errorf("%s: %v", typ, err) }
+		if !strings.HasPrefix(ext, ".") { ext = "." + ext }
+		mimeOverrides[ext] = strings.TrimSpace(typ)
+	}
+	return nil
+}
+
+// withCharset añade charset=utf-8 a los tipos de texto que no lo indican, para
+// que el navegador no tenga que adivinarlo
+func withCharset(t string) string {
+	base, params, err := mime.ParseMediaType(t)
+	if err != nil || params["charset"] != "" { return t }
+	switch {
+	case strings.HasPrefix(base, "text/"), base == "application/json", base == "application/javascript", base == "application/xml", base == "application/yaml":
+		return t + "; charset=utf-8"
+	}
+	return t
+}
+
+// fileMIME devuelve el tipo guardado o lo detecta la primera vez (archivos
+// copiados a la carpeta por fuera de Cerbero); hay que llamar a meta.Flush después
+func fileMIME(name string) string {
+	if t := mimeOverrides[strings.ToLower(path.Ext(name))]; t != "" { return t }
+	if fm, ok := meta.Get(name); ok && fm.MIME != "" { return fm.MIME }
+	detected := detectContentType(absPath(name))
+	meta.Fill(name, func(m *FileMeta) { m.MIME = detected })
+	return detected
+}
+
+// mimeIcon elige un icono para el listado según la familia del tipo
+func mimeIcon(mimeType string) string {
+	base, _, _ := strings.Cut(mimeType, ";")
+	switch {
+	case strings.HasPrefix(base, "image/"):
+		return "🖼️"
+	case strings.HasPrefix(base, "video/"):
+		return "🎬"
+	case strings.HasPrefix(base, "audio/"):
+		return "🎵"
+	case base == "application/pdf":
+		return "📕"
+	case strings.Contains(base, "zip") || strings.Contains(base, "tar") || strings.Contains(base, "compressed") || strings.Contains(base, "gzip"):
+		return "📦"
+	case strings.Contains(base, "spreadsheet") || base == "text/csv":
+		return "📊"
+	case strings.Contains(base, "wordprocessing") || strings.Contains(base, "opendocument.text"):
+		return "📝"
+	}
+	// Texto y cualquier otro tipo: un archivo genérico (📁 es para las carpetas)
+	return "📄"
+}
+
+// --- METADATOS DE IMÁGENES ---
+
+// stripJPEG copia un JPEG descartando los segmentos APP1 (EXIF/XMP), APP13
+// (IPTC) y comentarios. JFIF, el perfil ICC y Adobe se conservan. La
+// orientación EXIF se pierde, así que algunas fotos pueden verse giradas.
+func stripJPEG(src io.Reader, dst io.Writer) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(src, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return fmt.Errorf("no es un JPEG")
+	}
+	if _, err := dst.Write(soi[:]); err != nil { return err }
+	for {
+		var m [2]byte
+		if _, err := io.ReadFull(src, m[:]); err != nil { return err }
+		if m[0] != 0xFF { return fmt.Errorf("marcador JPEG inválido") }
+		// Inicio de los datos de imagen: el resto se copia tal cual
+		if m[1] == 0xDA {
+			if _, err := dst.Write(m[:]); err != nil { return err }
+			_, err := io.Copy(dst, src)
+			return err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(src, l[:]); err != nil { return err }
+		size := int(l[0])<<8 | int(l[1])
+		if size < 2 { return fmt.Errorf("segmento JPEG inválido") }
+		if m[1] == 0xE1 || m[1] == 0xED || m[1] == 0xFE {
+			if _, err := io.CopyN(io.Discard, src, int64(size-2)); err != nil { return err }
+			continue
+		}
+		if _, err := dst.Write(append(m[:], l[:]...)); err != nil { return err }
+		if _, err := io.CopyN(dst, src, int64(size-2)); err != nil { return err }
+	}
+}
+
+// stripPNG copia un PNG descartando los chunks de texto, EXIF y fecha
+func stripPNG(src io.Reader, dst io.Writer) error {
+	sig := make([]byte, 8)
+	if _, err := io.ReadFull(src, sig); err != nil || string(sig) != "\x89PNG\r\n\x1a\n" {
+		return fmt.Errorf("no es un PNG")
+	}
+	if _, err := dst.Write(sig); err != nil { return err }
+	drop := map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(src, head); err != nil { return err }
+		size := int64(head[0])<<24 | int64(head[1])<<16 | int64(head[2])<<8 | int64(head[3])
+		kind := string(head[4:8])
+		// Datos + CRC de 4 bytes
+		if drop[kind] {
+			if _, err := io.CopyN(io.Discard, src, size+4); err != nil { return err }
+			continue
+		}
+		if _, err := dst.Write(head); err != nil { return err }
+		if _, err := io.CopyN(dst, src, size+4); err != nil { return err }
+		if kind == "IEND" { return nil }
+	}
+}
+
+// stripImageMetadata reescribe en su sitio un JPEG/PNG sin metadatos. Con
+// -keep-originals el original se mueve a la cuarentena de la carpeta de estado.
+func stripImageMetadata(path string) error {
+	var strip func(io.Reader, io.Writer) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg":
+		strip = stripJPEG
+	case ".png":
+		strip = stripPNG
+	default:
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil { return err }
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".cerbero-strip-*")
+	if err != nil { return err }
+	defer os.Remove(tmp.Name())
+	if err := strip(bufio.NewReader(src), tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil { return err }
+
+	if keepOriginals {
+		quarantine := filepath.Join(stateDir, "quarantine")
+		os.MkdirAll(quarantine, 0700)
+		name := time.Now().Format("20060102-150405") + "-" + filepath.Base(path)
+		if err := os.Rename(path, filepath.Join(quarantine, name)); err != nil { return err }
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// --- VISTAS PREVIAS DE DOCUMENTOS ---
+
+// Limita las conversiones externas simultáneas (pdftoppm, LibreOffice...)
+var previewSlots = make(chan struct{}, 2)
+
+// Evita generar dos veces la misma vista previa a la vez
+var previewLocks sync.Map
+
+var officeExtensions = map[string]bool{
+	".doc": true, ".docx": true, ".odt": true, ".rtf": true,
+	".xls": true, ".xlsx": true, ".ods": true,
+	".ppt": true, ".pptx": true, ".odp": true,
+}
+
+// previewCommand devuelve el comando configurado para el tipo de archivo, o ""
+func previewCommand(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".pdf" { return pdfPreviewCmd }
+	if officeExtensions[ext] { return officePreviewCmd }
+	return ""
+}
+
+// generatePreview ejecuta el conversor sustituyendo {in} y {out}; el comando
+// debe dejar un PNG en {out} o en {out}.png (como hace pdftoppm)
+func generatePreview(cmdTemplate, in, out string) error {
+	previewSlots <- struct{}{}
+	defer func() { <-previewSlots }()
+
+	tmp := out + ".tmp"
+	var args []string
+	for _, a := range strings.Fields(cmdTemplate) {
+		a = strings.ReplaceAll(a, "{in}", in)
+		args = append(args, strings.ReplaceAll(a, "{out}", tmp))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	for _, candidate := range []string{tmp, tmp + ".png"} {
+		if _, err := os.Stat(candidate); err == nil { return os.Rename(candidate, out) }
+	}
+	return fmt.Errorf("el conversor no generó ninguna imagen")
+}
+
+// previewGenerator devuelve cómo sacar la vista previa de abs (conversor de
+// documentos o cartel de vídeo), o nil si no tiene
+func previewGenerator(abs string) func(out string) error {
+	if cmd := previewCommand(abs); cmd != "" { return func(out string) error { return generatePreview(cmd, abs, out) } }
+	if hasVideoPoster(abs) { return func(out string) error { return videoPoster(abs, out) } }
+	if isPhoto(abs) && !lowMem { return func(out string) error { return imageThumbnail(abs, out) } }
+	return nil
+}
+
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "download") { return }
+	if opaqueDenied(w, r) { return }
+	abs, err := existingPath(r.PathValue("path"))
+	if errors.Is(err, errNotFound) && reports.Quarantined(r.PathValue("path")) { quarantineError(w); return }
+	if err != nil { pathError(w, err); return }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+	if aclDenied(w, r, abs, aclRead) { return }
+	generate := previewGenerator(abs)
+	if generate == nil { http.NotFound(w, r); return }
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() { http.NotFound(w, r); return }
+	if downloadHookDenied(w, r, abs, info) { return }
+	// Las imágenes admiten ?w= para el visor; las fotos en JPEG salen en JPEG
+	contentType, out := "image/png", ""
+	if width := previewWidth(r); isPhoto(abs) && width != thumbnailSize {
+		ext := ".png"
+		if e := strings.ToLower(filepath.Ext(abs)); e == ".jpg" || e == ".jpeg" { contentType, ext = "image/jpeg", ".jpg" }
+		out, err = cachedVariant(abs, info, "ancho|"+strconv.Itoa(width), ext, func(out string) error { return resizeImage(abs, out, width) })
+	} else {
+		out, err = cachedPreview(abs, info, generate)
+	}
+	if err != nil { http.Error(w, "Vista previa no disponible", 500); return }
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeFile(w, r, out)
+}
+
+// cachedPreview devuelve el PNG guardado de un archivo o lo genera con
+// generate la primera vez. La clave incluye tamaño y fecha: si el archivo
+// cambia, la vista previa también
+func cachedPreview(abs string, info os.FileInfo, generate func(out string) error) (string, error) {
+	return cachedVariant(abs, info, "", ".png", generate)
+}
+
+// cachedVariant es cachedPreview para otras versiones del mismo archivo
+// (variant las distingue) guardadas con la extensión ext
+func cachedVariant(abs string, info os.FileInfo, variant, ext string, generate func(out string) error) (string, error) {
+	id := fmt.Sprintf("%s|%d|%d", abs, info.Size(), info.ModTime().UnixNano())
+	if variant != "" { id += "|" + variant }
+	key := sha256.Sum256([]byte(id))
+	dir := filepath.Join(stateDir, "previews")
+	os.MkdirAll(dir, 0700)
+	out := filepath.Join(dir, fmt.Sprintf("%x%s", key[:16], ext))
+
+	lock, _ := previewLocks.LoadOrStore(out, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	if _, err := os.Stat(out); err == nil { return out, nil }
+	if err := generate(out); err != nil {
+		log.Printf("Vista previa de %s: %v", abs, err)
+		return "", err
+	}
+	return out, nil
+}
+
+// Lado mayor de las miniaturas de imágenes y tamaño a partir del cual no se
+// decodifican (la memoria necesaria crece con los píxeles)
+const (
+	thumbnailSize      = 600
+	maxThumbnailPixels = 40_000_000
+)
+
+// imageThumbnail reduce una imagen PNG, JPEG o GIF a una miniatura PNG
+func imageThumbnail(in, out string) error { return resizeImage(in, out, thumbnailSize) }
+
+// previewWidths son los anchos de /preview?w=: la miniatura y los tamaños de
+// pantalla del visor de imágenes. Se limitan para no guardar mil variantes
+var previewWidths = []int{thumbnailSize, 1280, 1920, 2560}
+
+// previewWidth elige el menor ancho permitido que cubre el pedido
+func previewWidth(r *http.Request) int {
+	w, _ := strconv.Atoi(r.URL.Query().Get("w"))
+	for _, allowed := range previewWidths {
+		if w <= allowed { return allowed }
+	}
+	return previewWidths[len(previewWidths)-1]
+}
+
+// resizeImage reduce la imagen in para que su lado mayor no pase de size,
+// promediando los píxeles que caen en cada uno, y la guarda en out: JPEG si
+// out acaba en .jpg y PNG en otro caso
+func resizeImage(in, out string, size int) error {
+	previewSlots <- struct{}{}
+	defer func() { <-previewSlots }()
+
+	f, err := os.Open(in)
+	if err != nil { return err }
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil { return err }
+	if cfg.Width*cfg.Height > maxThumbnailPixels { return fmt.Errorf("imagen demasiado grande (%dx%d)", cfg.Width, cfg.Height) }
+	if _, err := f.Seek(0, io.SeekStart); err != nil { return err }
+	src, _, err := image.Decode(f)
+	if err != nil { return err }
+
+	b := src.Bounds()
+	scale := math.Max(1, float64(max(b.Dx(), b.Dy()))/float64(size))
+	w, h := max(1, int(float64(b.Dx())/scale)), max(1, int(float64(b.Dy())/scale))
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0, y1 := b.Min.Y+int(float64(y)*scale), b.Min.Y+max(int(float64(y+1)*scale), int(float64(y)*scale)+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := b.Min.X+int(float64(x)*scale), b.Min.X+max(int(float64(x+1)*scale), int(float64(x)*scale)+1)
+			var sr, sg, sb, sa, n uint64
+			for sy := y0; sy < min(y1, b.Max.Y); sy++ {
+				for sx := x0; sx < min(x1, b.Max.X); sx++ {
+					r, g, bl, a := src.At(sx, sy).RGBA()
+					sr, sg, sb, sa, n = sr+uint64(r), sg+uint64(g), sb+uint64(bl), sa+uint64(a), n+1
+				}
+			}
+			if n == 0 { continue }
+			dst.Set(x, y, color.RGBA64{uint16(sr / n), uint16(sg / n), uint16(sb / n), uint16(sa / n)})
+		}
+	}
+	tmp := out + ".tmp"
+	tf, err := os.Create(tmp)
+	if err != nil { return err }
+	if strings.HasSuffix(out, ".jpg") {
+		err = jpeg.Encode(tf, dst, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(tf, dst)
+	}
+	if cerr := tf.Close(); err == nil { err = cerr }
+	if err != nil { os.Remove(tmp); return err }
+	return os.Rename(tmp, out)
+}
+
+// --- MARCAS DE AGUA ---
+// Con -watermark-text o -watermark-image, las imágenes JPEG y PNG que se
+// descargan por un enlace (/s/, /f/) sin identificarse llevan encima una marca
+// semitransparente: el texto repetido en filas o el PNG en el centro. La copia
+// marcada se guarda junto a las vistas previas y se rehace si cambian el
+// archivo o la marca. Quien entra con sesión, clave de API o la clave
+// compartida recibe el original
+
+var (
+	watermarkText    string
+	watermarkImage   string
+	watermarkOpacity float64
+	watermarkPNG     image.Image
+	watermarkSig     string // entra en la clave de la caché
+)
+
+// watermarkFont es una fuente de 5x7 píxeles: cada fila es un byte y el bit 4
+// es la columna de la izquierda. El texto se pasa a mayúsculas y sin tildes
+var watermarkFont = map[rune][7]byte{
+	' ': {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+	'A': {0x0e, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'B': {0x1e, 0x11, 0x11, 0x1e, 0x11, 0x11, 0x1e},
+	'C': {0x0e, 0x11, 0x10, 0x10, 0x10, 0x11, 0x0e},
+	'D': {0x1e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x1e},
+	'E': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x1f},
+	'F': {0x1f, 0x10, 0x10, 0x1e, 0x10, 0x10, 0x10},
+	'G': {0x0e, 0x11, 0x10, 0x17, 0x11, 0x11, 0x0f},
+	'H': {0x11, 0x11, 0x11, 0x1f, 0x11, 0x11, 0x11},
+	'I': {0x0e, 0x04, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'J': {0x07, 0x02, 0x02, 0x02, 0x02, 0x12, 0x0c},
+	'K': {0x11, 0x12, 0x14, 0x18, 0x14, 0x12, 0x11},
+	'L': {0x10, 0x10, 0x10, 0x10, 0x10, 0x10, 0x1f},
+	'M': {0x11, 0x1b, 0x15, 0x15, 0x11, 0x11, 0x11},
+	'N': {0x11, 0x11, 0x19, 0x15, 0x13, 0x11, 0x11},
+	'O': {0x0e, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'P': {0x1e, 0x11, 0x11, 0x1e, 0x10, 0x10, 0x10},
+	'Q': {0x0e, 0x11, 0x11, 0x11, 0x15, 0x12, 0x0d},
+	'R': {0x1e, 0x11, 0x11, 0x1e, 0x14, 0x12, 0x11},
+	'S': {0x0f, 0x10, 0x10, 0x0e, 0x01, 0x01, 0x1e},
+	'T': {0x1f, 0x04, 0x04, 0x04, 0x04, 0x04, 0x04},
+	'U': {0x11, 0x11, 0x11, 0x11, 0x11, 0x11, 0x0e},
+	'V': {0x11, 0x11, 0x11, 0x11, 0x11, 0x0a, 0x04},
+	'W': {0x11, 0x11, 0x11, 0x15, 0x15, 0x15, 0x0a},
+	'X': {0x11, 0x11, 0x0a, 0x04, 0x0a, 0x11, 0x11},
+	'Y': {0x11, 0x11, 0x0a, 0x04, 0x04, 0x04, 0x04},
+	'Z': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x10, 0x1f},
+	'0': {0x0e, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0e},
+	'1': {0x04, 0x0c, 0x04, 0x04, 0x04, 0x04, 0x0e},
+	'2': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1f},
+	'3': {0x1f, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0e},
+	'4': {0x02, 0x06, 0x0a, 0x12, 0x1f, 0x02, 0x02},
+	'5': {0x1f, 0x10, 0x1e, 0x01, 0x01, 0x11, 0x0e},
+	'6': {0x06, 0x08, 0x10, 0x1e, 0x11, 0x11, 0x0e},
+	'7': {0x1f, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0e, 0x11, 0x11, 0x0e, 0x11, 0x11, 0x0e},
+	'9': {0x0e, 0x11, 0x11, 0x0f, 0x01, 0x02, 0x0c},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0c, 0x0c},
+	',': {0x00, 0x00, 0x00, 0x00, 0x0c, 0x04, 0x08},
+	'-': {0x00, 0x00, 0x00, 0x1f, 0x00, 0x00, 0x00},
+	'_': {0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x1f},
+	':': {0x00, 0x0c, 0x0c, 0x00, 0x0c, 0x0c, 0x00},
+	'/': {0x00, 0x01, 0x02, 0x04, 0x08, 0x10, 0x00},
+	'@': {0x0e, 0x11, 0x01, 0x0d, 0x15, 0x15, 0x0e},
+	'&': {0x0c, 0x12, 0x14, 0x08, 0x15, 0x12, 0x0d},
+	'(': {0x02, 0x04, 0x08, 0x08, 0x08, 0x04, 0x02},
+	')': {0x08, 0x04, 0x02, 0x02, 0x02, 0x04, 0x08},
+	'!': {0x04, 0x04, 0x04, 0x04, 0x04, 0x00, 0x04},
+	'?': {0x0e, 0x11, 0x01, 0x02, 0x04, 0x00, 0x04},
+	'\'': {0x0c, 0x04, 0x08, 0x00, 0x00, 0x00, 0x00},
+	'#': {0x0a, 0x0a, 0x1f, 0x0a, 0x1f, 0x0a, 0x0a},
+	'+': {0x00, 0x04, 0x04, 0x1f, 0x04, 0x04, 0x00},
+}
+
+var watermarkFold = strings.NewReplacer("©", "(C)", "·", "-", "Á", "A", "À", "A", "Ä", "A", "Â", "A", "É", "E", "È", "E", "Ë", "E", "Ê", "E",
+	"Í", "I", "Ì", "I", "Ï", "I", "Î", "I", "Ó", "O", "Ò", "O", "Ö", "O", "Ô", "O", "Ú", "U", "Ù", "U", "Ü", "U", "Û", "U", "Ñ", "N", "Ç", "C")
+
+// loadWatermark prepara la marca configurada; se llama una vez al arrancar
+func loadWatermark() error {
+	if watermarkOpacity <= 0 || watermarkOpacity > 1 { return fmt.Errorf("-watermark-opacity debe estar entre 0 y 1") }
+	watermarkText = watermarkFold.Replace(strings.ToUpper(strings.TrimSpace(watermarkText)))
+	for _, c := range watermarkText {
+		if _, ok := watermarkFont[c]; !ok { return fmt.Errorf("-watermark-text: el carácter %q no se puede dibujar", c) }
+	}
+	sig := fmt.Sprintf("%s|%g", watermarkText, watermarkOpacity)
+	if watermarkImage != "" {
+		f, err := os.Open(watermarkImage)
+		if err != nil { return err }
+		defer f.Close()
+		if watermarkPNG, err = png.Decode(f); err != nil { return fmt.Errorf("%s: %v", watermarkImage, err) }
+		info, _ := f.Stat()
+		sig += fmt.Sprintf("|%s|%d", watermarkImage, info.ModTime().UnixNano())
+	}
+	watermarkSig = sig
+	return nil
+}
+
+func watermarkEnabled() bool { return watermarkText != "" || watermarkPNG != nil }
+
+// watermarkFor indica si abs debe servirse con marca a esta petición
+func watermarkFor(r *http.Request, abs string) bool {
+	if !watermarkEnabled() { return false }
+	switch strings.ToLower(filepath.Ext(abs)) {
+	case ".jpg", ".jpeg", ".png":
+	default:
+		return false
+	}
+	if apiKeyFor(r) != nil || sessionFor(r) != nil { return false }
+	sent, ok := headerPassword(r)
+	return !ok || password == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(password)) != 1
+}
+
+// watermarkedCopy devuelve la copia marcada de abs, generándola si hace falta
+func watermarkedCopy(abs string, info os.FileInfo) (string, error) {
+	return cachedVariant(abs, info, "marca|"+watermarkSig, strings.ToLower(filepath.Ext(abs)), func(out string) error { return drawWatermark(abs, out) })
+}
+
+// watermarkedThumbnail es la miniatura de un enlace, también marcada
+func watermarkedThumbnail(abs string, info os.FileInfo) (string, error) {
+	thumb, err := shareThumbnail(abs, info)
+	if err != nil { return "", err }
+	return cachedVariant(abs, info, "miniatura-marca|"+watermarkSig, ".png", func(out string) error { return drawWatermark(thumb, out) })
+}
+
+// serveWatermarked sirve la copia marcada; no lleva Digest porque el
+// SHA-256 guardado es el del original
+func serveWatermarked(w http.ResponseWriter, r *http.Request, abs string, info os.FileInfo) {
+	marked, err := watermarkedCopy(abs, info)
+	if err != nil { http.Error(w, "No se pudo preparar la imagen", 500); return }
+	w.Header().Set("Content-Type", fileMIME(relPath(abs)))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeFile(w, r, marked)
+}
+
+// drawWatermark lee la imagen in, le pone la marca y la guarda en out, en
+// JPEG o PNG según su extensión
+func drawWatermark(in, out string) error {
+	previewSlots <- struct{}{}
+	defer func() { <-previewSlots }()
+
+	f, err := os.Open(in)
+	if err != nil { return err }
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil { return err }
+	if cfg.Width*cfg.Height > maxThumbnailPixels { return fmt.Errorf("imagen demasiado grande (%dx%d)", cfg.Width, cfg.Height) }
+	if _, err := f.Seek(0, io.SeekStart); err != nil { return err }
+	src, _, err := image.Decode(f)
+	if err != nil { return err }
+
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	alpha := uint8(watermarkOpacity * 255)
+	if watermarkPNG != nil { drawWatermarkImage(dst, alpha) }
+	if watermarkText != "" { drawWatermarkText(dst, alpha) }
+
+	tmp := out + ".tmp"
+	tf, err := os.Create(tmp)
+	if err != nil { return err }
+	if ext := filepath.Ext(out); ext == ".jpg" || ext == ".jpeg" {
+		err = jpeg.Encode(tf, dst, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(tf, dst)
+	}
+	if cerr := tf.Close(); err == nil { err = cerr }
+	if err != nil { os.Remove(tmp); return err }
+	return os.Rename(tmp, out)
+}
+
+// drawWatermarkImage pone el PNG en el centro, a un tercio del ancho
+func drawWatermarkImage(dst *image.RGBA, alpha uint8) {
+	mb, db := watermarkPNG.Bounds(), dst.Bounds()
+	scale := float64(mb.Dx()) / math.Max(1, float64(db.Dx())/3)
+	w, h := max(1, int(float64(mb.Dx())/scale)), max(1, int(float64(mb.Dy())/scale))
+	mark := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			mark.Set(x, y, watermarkPNG.At(mb.Min.X+int(float64(x)*scale), mb.Min.Y+int(float64(y)*scale)))
+		}
+	}
+	at := image.Pt((db.Dx()-w)/2, (db.Dy()-h)/2)
+	draw.DrawMask(dst, mark.Bounds().Add(at), mark, image.Point{}, image.NewUniform(color.Alpha{alpha}), image.Point{}, draw.Over)
+}
+
+// drawWatermarkText repite el texto en filas desplazadas, en blanco con una
+// sombra oscura para que se vea sobre cualquier fondo. Cada copia ocupa más o
+// menos un tercio del ancho
+func drawWatermarkText(dst *image.RGBA, alpha uint8) {
+	db := dst.Bounds()
+	n := utf8.RuneCountInString(watermarkText)
+	px := max(1, min(db.Dx()/(3*6*n), db.Dy()/(7*6)))
+	textW, lineH := 6*n*px, 7*px
+	light := image.NewUniform(color.NRGBA{255, 255, 255, alpha})
+	dark := image.NewUniform(color.NRGBA{0, 0, 0, alpha / 2})
+	shadow := max(1, px/3)
+	for row, y := 0, lineH; y < db.Dy(); row, y = row+1, y+4*lineH {
+		for x := -(row % 2) * (textW + 3*6*px) / 2; x < db.Dx(); x += textW + 3*6*px {
+			drawWatermarkLine(dst, x+shadow, y+shadow, px, dark)
+			drawWatermarkLine(dst, x, y, px, light)
+		}
+	}
+}
+
+func drawWatermarkLine(dst *image.RGBA, x, y, px int, c image.Image) {
+	for _, ch := range watermarkText {
+		glyph := watermarkFont[ch]
+		for gy, bits := range glyph {
+			for gx := 0; gx < 5; gx++ {
+				if bits&(0x10>>gx) == 0 { continue }
+				r := image.Rect(x+gx*px, y+gy*px, x+(gx+1)*px, y+(gy+1)*px)
+				draw.Draw(dst, r, c, image.Point{}, draw.Over)
+			}
+		}
+		x += 6 * px
+	}
+}
+
+// --- VÍDEOS (ffprobe y ffmpeg) ---
+// Si ffprobe está instalado (-ffprobe), al subir un vídeo un trabajo de la cola
+// apunta en los metadatos su duración y resolución; con ffmpeg (-ffmpeg) saca
+// además un fotograma como cartel, que hace de miniatura en el listado y en los
+// enlaces. /play/ muestra el vídeo en el navegador con esos datos.
+
+var (
+	ffprobePath string
+	ffmpegPath  string
+)
+
+var videoExtensions = map[string]bool{
+	".mp4": true, ".m4v": true, ".mov": true, ".mkv": true, ".webm": true,
+	".avi": true, ".ogv": true, ".mpg": true, ".mpeg": true, ".3gp": true,
+}
+
+// CSP de /play/: la de por defecto, más el propio vídeo
+const playCSP = "default-src 'none'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; media-src 'self'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+// resolveVideoTools busca ffprobe y ffmpeg al arrancar; si no están, la
+// función se queda apagada sin más
+func resolveVideoTools() {
+	tools := []struct {
+		path *string
+		lost string
+	}{{&ffprobePath, "sin duración ni resolución de los vídeos"}, {&ffmpegPath, "sin carteles de los vídeos"}}
+	for _, t := range tools {
+		if *t.path == "" { continue }
+		found, err := exec.LookPath(*t.path)
+		if err != nil { log.Printf("%s no está disponible: %s", *t.path, t.lost) }
+		*t.path = found
+	}
+}
+
+func isVideo(name string) bool { return videoExtensions[strings.ToLower(filepath.Ext(name))] }
+
+func hasVideoPoster(name string) bool { return ffmpegPath != "" && isVideo(name) }
+
+// videoInfo es lo que se saca de ffprobe
+type videoInfo struct {
+	Duration      float64
+	Width, Height int
+}
+
+// probeVideo pregunta a ffprobe por el primer flujo de vídeo. Los móviles
+// graban en horizontal y guardan un giro: con 90 o 270 grados se cambian
+// ancho y alto, que es como se ve
+func probeVideo(ctx context.Context, abs string) (videoInfo, error) {
+	out, err := exec.CommandContext(ctx, ffprobePath, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", "-select_streams", "v:0", abs).Output()
+	if err != nil { return videoInfo{}, fmt.Errorf("ffprobe: %v", err) }
+	var probe struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			Width    int               `json:"width"`
+			Height   int               `json:"height"`
+			Tags     map[string]string `json:"tags"`
+			SideData []struct {
+				Rotation float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil { return videoInfo{}, fmt.Errorf("ffprobe: %v", err) }
+	var v videoInfo
+	v.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	if len(probe.Streams) == 0 { return v, nil }
+	s := probe.Streams[0]
+	v.Width, v.Height = s.Width, s.Height
+	rotation, _ := strconv.ParseFloat(s.Tags["rotate"], 64)
+	for _, sd := range s.SideData {
+		if sd.Rotation != 0 { rotation = sd.Rotation }
+	}
+	if r := int(math.Abs(rotation)) % 180; r == 90 { v.Width, v.Height = v.Height, v.Width }
+	return v, nil
+}
+
+// videoPoster saca el cartel: un fotograma al 10 % del vídeo (como mucho a
+// los 10 s), porque el primero suele ser negro
+func videoPoster(abs, out string) error {
+	at := 0.0
+	if fm, ok := meta.Get(relPath(abs)); ok { at = min(fm.Duration/10, 10) }
+	cmd := fmt.Sprintf("%s -v error -ss %.2f -i {in} -frames:v 1 -vf scale='min(800,iw)':-2 -f image2 -c:v png -y {out}", ffmpegPath, at)
+	return generatePreview(cmd, abs, out)
+}
+
+// videoJob es el trabajo "video" de la cola; target es la ruta relativa
+func videoJob(ctx context.Context, target string) error {
+	if ffprobePath == "" { return nil }
+	abs, err := existingPath(target)
+	if err != nil { return nil }
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() { return nil }
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	v, err := probeVideo(ctx, abs)
+	if err != nil { return err }
+	err = meta.Update(target, func(m *FileMeta) { m.Duration, m.Width, m.Height = v.Duration, v.Width, v.Height })
+	if err != nil { return err }
+	if hasVideoPoster(abs) {
+		if _, err := cachedPreview(abs, info, func(out string) error { return videoPoster(abs, out) }); err != nil { return err }
+	}
+	contentChanged()
+	return nil
+}
+
+// videoSummary resume duración y resolución para el listado: "3:07 · 1920×1080"
+func videoSummary(fm FileMeta) string {
+	var parts []string
+	if fm.Duration > 0 {
+		s := int(fm.Duration + 0.5)
+		if s >= 3600 {
+			parts = append(parts, fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d:%02d", s/60, s%60))
+		}
+	}
+	if fm.Width > 0 && fm.Height > 0 { parts = append(parts, fmt.Sprintf("%d×%d", fm.Width, fm.Height)) }
+	return strings.Join(parts, " · ")
+}
+
+var playPageTmpl *template.Template
+
+// playHandler es /play/{path}: el vídeo en una página, con su cartel y datos
+func playHandler(w http.ResponseWriter, r *http.Request) {
+	if opaqueDenied(w, r) { return }
+	abs, err := existingPath(r.PathValue("path"))
+	if err != nil { pathError(w, err); return }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+	if aclDenied(w, r, abs, aclRead) { return }
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() || !isVideo(abs) { http.NotFound(w, r); return }
+	rel := relPath(abs)
+	fm, _ := meta.Get(rel)
+	_, hls := hlsReady(rel, info)
+	dir := path.Dir(rel)
+	if dir == "." { dir = "" }
+	if cspPolicy != "" { w.Header().Set("Content-Security-Policy", playCSP) }
+	playPageTmpl.Execute(w, map[string]interface{}{
+		"Name": filepath.Base(abs), "RelPath": rel, "Dir": dir, "Size": humanSize(info.Size()),
+		"Summary": videoSummary(fm), "Poster": hasVideoPoster(abs), "HLS": hls,
+	})
+}
+
+// --- HLS (STREAMING ADAPTATIVO) ---
+// Con -hls, los vídeos de más de -hls-min-mb se convierten con ffmpeg, en un
+// trabajo "hls" de la cola, a HLS en las alturas indicadas. /play/ ofrece esa
+// versión antes que el original, así que un móvil con mala conexión baja de
+// calidad en vez de descargar un 4K entero. Se guarda en .cerbero/hls/, en una
+// carpeta cuyo nombre lleva el tamaño y la fecha del vídeo: si el archivo
+// cambia deja de servirse, y se borra con él.
+
+var (
+	hlsSpec    string
+	hlsMinMB   int64
+	hlsHeights []int
+)
+
+// Kbit/s de vídeo por altura; las que no están van en proporción a 720p
+var hlsBitrates = map[int]int{2160: 16000, 1440: 9000, 1080: 5000, 720: 2800, 480: 1400, 360: 800, 240: 400}
+
+// Los trabajos de conversión pueden durar mucho más que los demás
+const hlsJobTimeout = 6 * time.Hour
+
+func parseHLS() error {
+	for _, part := range strings.Split(hlsSpec, ",") {
+		if part = strings.TrimSuffix(strings.TrimSpace(part), "p"); part == "" { continue }
+		h, err := strconv.Atoi(part)
+		if err != nil || h < 144 || h > 4320 || h%2 != 0 { return fmt.Errorf("altura no válida: %q", part) }
+		hlsHeights = append(hlsHeights, h)
+	}
+	slices.Sort(hlsHeights)
+	slices.Reverse(hlsHeights)
+	hlsHeights = slices.Compact(hlsHeights)
+	return nil
+}
+
+func hlsEnabled() bool { return len(hlsHeights) > 0 && ffmpegPath != "" }
+
+func hlsBitrate(h int) int {
+	if rate, ok := hlsBitrates[h]; ok { return rate }
+	return 2800 * h * h / (720 * 720)
+}
+
+// hlsLadder elige las alturas que tiene sentido sacar de un vídeo cuyo lado
+// corto mide short: ninguna mayor que el original, y al menos una. En un vídeo
+// vertical la "altura" es su ancho, como se entiende 1080p en un móvil
+func hlsLadder(short int) []int {
+	if short <= 0 { return hlsHeights }
+	var out []int
+	for _, h := range hlsHeights {
+		if h <= short { out = append(out, h) }
+	}
+	if len(out) == 0 { out = []int{short &^ 1} }
+	return out
+}
+
+func hlsDir(key string) string { return filepath.Join(stateDir, "hls", key) }
+
+// hlsReady devuelve la carpeta HLS de rel si existe y es de su contenido actual
+func hlsReady(rel string, info os.FileInfo) (string, bool) {
+	fm, ok := meta.Get(rel)
+	if !ok || !strings.HasPrefix(fm.HLS, fmt.Sprintf("%d-%d-", info.Size(), info.ModTime().UnixNano())) { return "", false }
+	dir := hlsDir(fm.HLS)
+	if _, err := os.Stat(filepath.Join(dir, "master.m3u8")); err != nil { return "", false }
+	return dir, true
+}
+
+// forgetHLS borra la versión HLS de un archivo que desaparece
+func forgetHLS(rel string) {
+	if fm, ok := meta.Get(rel); ok && fm.HLS != "" { os.RemoveAll(hlsDir(fm.HLS)) }
+}
+
+// hlsJob es el trabajo "hls" de la cola; target es la ruta relativa del vídeo
+func hlsJob(ctx context.Context, target string) error {
+	if !hlsEnabled() { return nil }
+	abs, err := existingPath(target)
+	if err != nil { return nil }
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() { return nil }
+	if _, ok := hlsReady(target, info); ok { return nil }
+	fm, _ := meta.Get(target)
+	v := videoInfo{Duration: fm.Duration, Width: fm.Width, Height: fm.Height}
+	if v.Height == 0 && ffprobePath != "" {
+		if probed, err := probeVideo(ctx, abs); err == nil { v = probed }
+	}
+	portrait := v.Width > 0 && v.Width < v.Height
+	heights := hlsLadder(min(v.Width, v.Height))
+
+	key := fmt.Sprintf("%d-%d-%s", info.Size(), info.ModTime().UnixNano(), randomToken(6))
+	tmp := hlsDir(key) + ".tmp"
+	defer os.RemoveAll(tmp)
+	master := "#EXTM3U\n#EXT-X-VERSION:3\n"
+	for i, h := range heights {
+		dir := filepath.Join(tmp, fmt.Sprintf("%dp", h))
+		if err := os.MkdirAll(dir, 0700); err != nil { return err }
+		rate := hlsBitrate(h)
+		scale, width, height := fmt.Sprintf("scale=-2:%d", h), 0, h
+		if v.Height > 0 { width = (v.Width*h/v.Height + 1) &^ 1 }
+		if portrait { scale, width, height = fmt.Sprintf("scale=%d:-2", h), h, (v.Height*h/v.Width+1)&^1 }
+		// Fotogramas clave cada 6 s en todas las alturas, para que el
+		// reproductor pueda cambiar de una a otra entre segmentos
+		args := []string{"-v", "error", "-nostdin", "-progress", "pipe:1", "-i", abs,
+			"-map", "0:v:0", "-map", "0:a:0?", "-vf", scale,
+			"-c:v", "libx264", "-preset", "veryfast", "-b:v", fmt.Sprintf("%dk", rate),
+			"-maxrate", fmt.Sprintf("%dk", rate*107/100), "-bufsize", fmt.Sprintf("%dk", rate*3/2),
+			"-force_key_frames", "expr:gte(t,n_forced*6)", "-c:a", "aac", "-b:a", "128k", "-ac", "2",
+			"-f", "hls", "-hls_time", "6", "-hls_playlist_type", "vod",
+			"-hls_segment_filename", filepath.Join(dir, "seg%05d.ts"), filepath.Join(dir, "index.m3u8")}
+		report := func(done float64) { jobProgress(ctx, (float64(i)+done)/float64(len(heights))) }
+		if err := runFFmpeg(ctx, args, v.Duration, report); err != nil { return fmt.Errorf("%dp: %v", h, err) }
+		master += fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", (rate+128)*1000)
+		if width > 0 { master += fmt.Sprintf(",RESOLUTION=%dx%d", width, height) }
+		master += fmt.Sprintf("\n%dp/index.m3u8\n", h)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "master.m3u8"), []byte(master), 0600); err != nil { return err }
+	if err := os.Rename(tmp, hlsDir(key)); err != nil { return err }
+	var old string
+	err = meta.Update(target, func(m *FileMeta) { old, m.HLS = m.HLS, key })
+	if old != "" { os.RemoveAll(hlsDir(old)) }
+	if err != nil { os.RemoveAll(hlsDir(key)); return err }
+	log.Printf("HLS de %s listo: %v", target, heights)
+	return nil
+}
+
+// runFFmpeg ejecuta ffmpeg con -progress pipe:1 y va avisando de la fracción
+// hecha si se conoce la duración
+func runFFmpeg(ctx context.Context, args []string, duration float64, report func(float64)) error {
+	cmd := exec.CommandContext(ctx, ffmpegPath, args...)
+	stderr := &limitedBuffer{buf: &bytes.Buffer{}, n: 4 << 10}
+	cmd.Stderr = stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil { return err }
+	if err := cmd.Start(); err != nil { return err }
+	lines := bufio.NewScanner(out)
+	for lines.Scan() {
+		us, ok := strings.CutPrefix(lines.Text(), "out_time_us=")
+		if !ok || duration <= 0 { continue }
+		if n, err := strconv.ParseFloat(us, 64); err == nil { report(min(n/1e6/duration, 1)) }
+	}
+	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.buf.String()); msg != "" { return fmt.Errorf("%v: %s", err, msg) }
+		return err
+	}
+	return nil
+}
+
+// hlsPath separa /hls/{vídeo}/master.m3u8 y /hls/{vídeo}/720p/archivo en el
+// vídeo y el archivo de su carpeta HLS
+func hlsPath(p string) (video, file string, ok bool) {
+	if v, ok := strings.CutSuffix(p, "/master.m3u8"); ok { return v, "master.m3u8", true }
+	i := strings.LastIndex(p, "/")
+	if i < 0 { return "", "", false }
+	j := strings.LastIndex(p[:i], "/")
+	if j < 0 { return "", "", false }
+	rendition, name := p[j+1:i], p[i+1:]
+	h, err := strconv.Atoi(strings.TrimSuffix(rendition, "p"))
+	if err != nil || h <= 0 || !strings.HasSuffix(rendition, "p") { return "", "", false }
+	if name != "index.m3u8" && (!strings.HasPrefix(name, "seg") || !strings.HasSuffix(name, ".ts")) { return "", "", false }
+	return p[:j], rendition + "/" + name, true
+}
+
+// hlsHandler sirve las listas y segmentos HLS con los mismos permisos que el
+// vídeo original. No pasa por el límite de descargas: cada segmento es una
+// petición
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "download") { return }
+	if opaqueDenied(w, r) { return }
+	video, file, ok := hlsPath(r.PathValue("path"))
+	if !ok { http.NotFound(w, r); return }
+	abs, err := existingPath(video)
+	if err != nil { pathError(w, err); return }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+	if aclDenied(w, r, abs, aclRead) { return }
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() { http.NotFound(w, r); return }
+	if downloadHookDenied(w, r, abs, info) { return }
+	dir, ok := hlsReady(relPath(abs), info)
+	if !ok { http.NotFound(w, r); return }
+	if strings.HasSuffix(file, ".m3u8") {
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeFile(w, r, filepath.Join(dir, filepath.FromSlash(file)))
+}
+
+// --- LISTAS DE REPRODUCCIÓN ---
+// Una carpeta con música tiene una lista de reproducción: /playlist?dir=... (o
+// /f/{token}/playlist en un enlace de carpeta) con un reproductor que pasa de
+// una pista a la siguiente, y la misma lista en M3U (/playlist.m3u) para
+// abrirla en VLC, un equipo de música o el móvil. Título, artista, álbum y
+// número de pista salen de las etiquetas ID3; sin ellas, del nombre.
+
+var audioExtensions = map[string]bool{
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".oga": true,
+	".opus": true, ".flac": true, ".wav": true,
+}
+
+func isAudio(name string) bool { return audioExtensions[strings.ToLower(filepath.Ext(name))] }
+
+// CSP de la lista: la de por defecto, más su script y el audio
+const playlistCSP = "default-src 'none'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; media-src 'self'; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+type id3Tags struct {
+	Title, Artist, Album string
+	Track                int
+}
+
+// readID3 lee las etiquetas ID3v2 (2.2 a 2.4) del principio del archivo y,
+// si no traen título, la ID3v1 de los últimos 128 bytes
+func readID3(p string) id3Tags {
+	var t id3Tags
+	f, err := os.Open(p)
+	if err != nil { return t }
+	defer f.Close()
+	var head [10]byte
+	if _, err := io.ReadFull(f, head[:]); err == nil && string(head[:3]) == "ID3" && head[3] >= 2 && head[3] <= 4 {
+		r := bufio.NewReader(io.LimitReader(f, int64(syncsafe(head[6:10]))))
+		// La cabecera extendida no trae nada que interese
+		if head[3] >= 3 && head[5]&0x40 != 0 {
+			var ext [4]byte
+			if _, err := io.ReadFull(r, ext[:]); err != nil { return t }
+			n := int64(binary.BigEndian.Uint32(ext[:]))
+			if head[3] == 4 { n = int64(syncsafe(ext[:])) - 4 }
+			io.CopyN(io.Discard, r, n)
+		}
+		readID3Frames(r, head[3], &t)
+	}
+	if t.Title != "" { return t }
+	var v1 [128]byte
+	if _, err := f.Seek(-128, io.SeekEnd); err != nil { return t }
+	if _, err := io.ReadFull(f, v1[:]); err != nil || string(v1[:3]) != "TAG" { return t }
+	field := func(b []byte) string { return strings.TrimSpace(latin1(bytes.TrimRight(b, "\x00 "))) }
+	t.Title, t.Artist, t.Album = field(v1[3:33]), field(v1[33:63]), field(v1[63:93])
+	// ID3v1.1: la pista va en el último byte del comentario
+	if v1[125] == 0 && v1[126] != 0 { t.Track = int(v1[126]) }
+	return t
+}
+
+// syncsafe lee un entero de 28 bits repartido en 4 bytes de 7
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func readID3Frames(r *bufio.Reader, version byte, t *id3Tags) {
+	idLen, headLen := 4, 10
+	if version == 2 { idLen, headLen = 3, 6 }
+	head := make([]byte, headLen)
+	for {
+		if _, err := io.ReadFull(r, head); err != nil || head[0] == 0 { return }
+		id := string(head[:idLen])
+		var size int
+		var flags uint16
+		switch version {
+		case 2:
+			size = int(head[3])<<16 | int(head[4])<<8 | int(head[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(head[4:8]))
+			// Comprimido o cifrado
+			if f := binary.BigEndian.Uint16(head[8:10]); f&0x00c0 != 0 { flags = 1 }
+		default:
+			size = syncsafe(head[4:8])
+			if f := binary.BigEndian.Uint16(head[8:10]); f&0x000f != 0 { flags = 1 }
+		}
+		if size < 0 { return }
+		wanted := false
+		switch id {
+		case "TIT2", "TT2", "TPE1", "TP1", "TALB", "TAL", "TRCK", "TRK":
+			wanted = flags == 0 && size > 1 && size <= 4096
+		}
+		if !wanted {
+			if _, err := r.Discard(size); err != nil { return }
+			continue
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil { return }
+		text := id3Text(data)
+		switch id {
+		case "TIT2", "TT2":
+			t.Title = text
+		case "TPE1", "TP1":
+			t.Artist = text
+		case "TALB", "TAL":
+			t.Album = text
+		case "TRCK", "TRK":
+			// "3" o "3/12"
+			num, _, _ := strings.Cut(text, "/")
+			t.Track, _ = strconv.Atoi(strings.TrimSpace(num))
+		}
+	}
+}
+
+// id3Text decodifica un marco de texto: el primer byte dice la codificación
+// (ISO-8859-1, UTF-16 con BOM, UTF-16BE o UTF-8). Si hay varios valores
+// separados por NUL se queda con el primero
+func id3Text(b []byte) string {
+	enc, b := b[0], b[1:]
+	var s string
+	switch enc {
+	case 1, 2:
+		bigEndian := enc == 2
+		if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff { bigEndian, b = true, b[2:] } else if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe { b = b[2:] }
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			u := uint16(b[i]) | uint16(b[i+1])<<8
+			if bigEndian { u = uint16(b[i])<<8 | uint16(b[i+1]) }
+			if u == 0 { break }
+			units = append(units, u)
+		}
+		s = string(utf16.Decode(units))
+	case 3:
+		s, _, _ = strings.Cut(string(b), "\x00")
+	default:
+		s = latin1(b)
+		s, _, _ = strings.Cut(s, "\x00")
+	}
+	return strings.TrimSpace(strings.ToValidUTF8(s, ""))
+}
+
+func latin1(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b { runes[i] = rune(c) }
+	return string(runes)
+}
+
+// audioTrack es una pista de la lista; Path es relativa a la carpeta de la
+// lista y Src, la URL desde la que se reproduce
+type audioTrack struct {
+	Name   string `json:"name"`
+	Title  string `json:"title"`
+	Artist string `json:"artist,omitempty"`
+	Album  string `json:"album,omitempty"`
+	Track  int    `json:"track,omitempty"`
+	Size   int64  `json:"size"`
+	Src    string `json:"url"`
+}
+
+// audioTracks reúne las pistas de la carpeta abs (sin subcarpetas), ordenadas
+// por número de pista y luego por nombre. src da la URL de cada archivo a
+// partir de su ruta relativa a la raíz; skip descarta los que no se enseñan
+func audioTracks(abs string, src func(rel string) string, skip func(rel string) bool) ([]audioTrack, error) {
+	infos, err := listCache.ReadDir(abs)
+	if err != nil { return nil, err }
+	ignored := ignores.Current()
+	var tracks []audioTrack
+	for _, info := range infos {
+		if info.IsDir() || isHiddenName(info.Name()) || !isAudio(info.Name()) { continue }
+		rel := relPath(filepath.Join(abs, info.Name()))
+		if ignored.Match(rel, false) || skip(rel) { continue }
+		tags := readID3(filepath.Join(abs, info.Name()))
+		t := audioTrack{Name: info.Name(), Title: tags.Title, Artist: tags.Artist, Album: tags.Album, Track: tags.Track, Size: info.Size(), Src: src(rel)}
+		if t.Title == "" { t.Title = strings.TrimSuffix(t.Name, filepath.Ext(t.Name)) }
+		tracks = append(tracks, t)
+	}
+	sort.SliceStable(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		if (a.Track == 0) != (b.Track == 0) { return a.Track != 0 }
+		if a.Track != b.Track { return a.Track < b.Track }
+		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+	})
+	return tracks, nil
+}
+
+var playlistTmpl *template.Template
+
+// writePlaylist responde con la página o, si m3u, con la lista en M3U
+// extendido y URLs absolutas
+func writePlaylist(w http.ResponseWriter, r *http.Request, title string, tracks []audioTrack, m3u bool, m3uURL, back string) {
+	if m3u {
+		w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": title + ".m3u"}))
+		fmt.Fprintf(w, "#EXTM3U\n#PLAYLIST:%s\n", title)
+		for _, t := range tracks {
+			label := t.Title
+			if t.Artist != "" { label = t.Artist + " - " + t.Title }
+			fmt.Fprintf(w, "#EXTINF:-1,%s\n%s%s\n", strings.ReplaceAll(label, "\n", " "), baseURL(r), t.Src)
+		}
+		return
+	}
+	if cspPolicy != "" { w.Header().Set("Content-Security-Policy", playlistCSP) }
+	playlistTmpl.Execute(w, map[string]interface{}{"Title": title, "Tracks": tracks, "M3U": m3uURL, "Back": back})
+}
+
+// playlistHandler es /playlist?dir=... y /playlist.m3u?dir=...
+func playlistHandler(w http.ResponseWriter, r *http.Request) {
+	if opaqueDenied(w, r) { return }
+	if m := lockedDir(r); m != nil { mountLocked(w, r, m); return }
+	if listingDenied(w, r) { return }
+	dir := strings.Trim(path.Clean("/"+r.URL.Query().Get("dir")), "/")
+	abs, err := existingPath(dir)
+	if err != nil { pathError(w, err); return }
+	tracks, err := audioTracks(abs, func(rel string) string { return "/download/" + escapePath(rel) }, func(rel string) bool { return !aclAllows(r, rel, aclRead) })
+	if err != nil { http.Error(w, "Error leyendo carpeta", 500); return }
+	title, query := path.Base("/"+dir), ""
+	if dir != "" { query = "?dir=" + url.QueryEscape(dir) }
+	if title == "/" { title = "Cerbero-Go" }
+	writePlaylist(w, r, title, tracks, strings.HasSuffix(r.URL.Path, ".m3u"), "/playlist.m3u"+query, "/"+query)
+}
+
+// folderLinkPlaylistHandler es lo mismo dentro de un enlace de carpeta: las
+// pistas se sirven por el enlace, así que el M3U vale para quien no tiene cuenta
+func folderLinkPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	fl, ok := folderLinkFor(w, r)
+	if !ok { return }
+	sub := strings.Trim(path.Clean("/"+r.URL.Query().Get("dir")), "/")
+	_, abs, err := folderLinkPath(fl, sub)
+	if err != nil { pathError(w, err); return }
+	base := strings.Trim(fl.Dir, "/")
+	src := func(rel string) string {
+		inLink := strings.TrimPrefix(strings.TrimPrefix(rel, base), "/")
+		return "/f/" + fl.Token + "/dl/" + escapePath(inLink)
+	}
+	tracks, err := audioTracks(abs, src, func(string) bool { return false })
+	if err != nil { http.Error(w, "Error leyendo carpeta", 500); return }
+	title := fl.Title
+	if title == "" { title = path.Base("/" + path.Join(fl.Dir, sub)) }
+	if title == "/" { title = "Carpeta compartida" }
+	query := ""
+	if sub != "" { query = "?dir=" + url.QueryEscape(sub) }
+	w.Header().Set("Cache-Control", "no-store")
+	writePlaylist(w, r, title, tracks, strings.HasSuffix(r.URL.Path, ".m3u"), "/f/"+fl.Token+"/playlist.m3u"+query, "/f/"+fl.Token+query)
+}
+
+// hasAudio indica si entre los archivos hay alguno de audio, para ofrecer la lista
+func hasAudio(files []FileInfo) bool {
+	return slices.ContainsFunc(files, func(f FileInfo) bool { return !f.IsDir && isAudio(f.Name) })
+}
+
+// --- LÍNEA DE TIEMPO DE FOTOS ---
+// /photos?dir=... enseña las fotos de una carpeta y sus subcarpetas por día
+// de captura, de la más reciente a la más antigua: para usar Cerbero como
+// sitio donde volcar las fotos del móvil. La fecha es la DateTimeOriginal del
+// EXIF (se lee al subir, antes de -strip-exif, y se guarda en los
+// metadatos); sin ella, la de modificación del archivo. Las miniaturas son
+// las de /preview y el navegador las pide según se desplaza.
+
+var photoExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
+
+func isPhoto(name string) bool { return photoExtensions[strings.ToLower(filepath.Ext(name))] }
+
+// exifTakenAt devuelve la fecha de captura del EXIF de un JPEG o PNG, o el
+// tiempo cero si no la trae
+func exifTakenAt(p string) time.Time {
+	f, err := os.Open(p)
+	if err != nil { return time.Time{} }
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var tiff []byte
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".jpg", ".jpeg":
+		tiff = jpegExif(r)
+	case ".png":
+		tiff = pngExif(r)
+	}
+	if tiff == nil { return time.Time{} }
+	return parseExifDate(tiff)
+}
+
+// jpegExif busca el segmento APP1 "Exif" antes de los datos de imagen
+func jpegExif(r *bufio.Reader) []byte {
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} { return nil }
+	for {
+		var m [4]byte
+		if _, err := io.ReadFull(r, m[:]); err != nil || m[0] != 0xFF || m[1] == 0xDA { return nil }
+		size := int(m[2])<<8 | int(m[3])
+		if size < 2 { return nil }
+		if m[1] != 0xE1 {
+			if _, err := r.Discard(size - 2); err != nil { return nil }
+			continue
+		}
+		data := make([]byte, size-2)
+		if _, err := io.ReadFull(r, data); err != nil { return nil }
+		if bytes.HasPrefix(data, []byte("Exif\x00\x00")) { return data[6:] }
+	}
+}
+
+// pngExif devuelve el chunk eXIf, que va antes de los datos de imagen
+func pngExif(r *bufio.Reader) []byte {
+	sig := make([]byte, 8)
+	if _, err := io.ReadFull(r, sig); err != nil || string(sig) != "\x89PNG\r\n\x1a\n" { return nil }
+	for {
+		var head [8]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil { return nil }
+		size := int(binary.BigEndian.Uint32(head[:4]))
+		switch string(head[4:]) {
+		case "IDAT", "IEND":
+			return nil
+		case "eXIf":
+			if size > 1<<20 { return nil }
+			data := make([]byte, size)
+			if _, err := io.ReadFull(r, data); err != nil { return nil }
+			return data
+		}
+		if _, err := r.Discard(size + 4); err != nil { return nil }
+	}
+}
+
+// parseExifDate lee DateTimeOriginal (y su zona, OffsetTimeOriginal) del IFD
+// EXIF; si no está, la DateTime del IFD0. Sin zona se toma la hora local
+func parseExifDate(tiff []byte) time.Time {
+	if len(tiff) < 8 { return time.Time{} }
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return time.Time{}
+	}
+	// ifd devuelve las etiquetas ASCII y los punteros de un IFD
+	ifd := func(off uint32) (ascii map[uint16]string, exifIFD uint32) {
+		ascii = map[uint16]string{}
+		if int(off)+2 > len(tiff) { return ascii, 0 }
+		n := int(order.Uint16(tiff[off:]))
+		for i := 0; i < n; i++ {
+			e := int(off) + 2 + i*12
+			if e+12 > len(tiff) { break }
+			tag, kind, count := order.Uint16(tiff[e:]), order.Uint16(tiff[e+2:]), order.Uint32(tiff[e+4:])
+			switch {
+			case tag == 0x8769:
+				exifIFD = order.Uint32(tiff[e+8:])
+			case kind == 2 && count > 4 && count < 64:
+				start := order.Uint32(tiff[e+8:])
+				if int(start)+int(count) <= len(tiff) { ascii[tag] = strings.TrimRight(string(tiff[start:start+count]), "\x00 ") }
+			case kind == 2 && count <= 4:
+				ascii[tag] = strings.TrimRight(string(tiff[e+8:e+8+int(count)]), "\x00 ")
+			}
+		}
+		return ascii, exifIFD
+	}
+	ifd0, exifOff := ifd(order.Uint32(tiff[4:]))
+	value, zone := ifd0[0x0132], ""
+	if exifOff != 0 {
+		exif, _ := ifd(exifOff)
+		if v := exif[0x9003]; v != "" { value, zone = v, exif[0x9011] }
+	}
+	if value == "" { return time.Time{} }
+	if zone != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", value+zone); err == nil { return t }
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", value, time.Local)
+	// Las cámaras sin fecha configurada escriben ceros
+	if err != nil || t.Year() < 1900 { return time.Time{} }
+	return t
+}
+
+// exifTakenUnix es el valor de FileMeta.Taken: la fecha en Unix o -1 si la
+// foto no la trae, para no volver a buscarla
+func exifTakenUnix(p string) int64 {
+	if t := exifTakenAt(p); !t.IsZero() { return t.Unix() }
+	return -1
+}
+
+// photoTakenAt es la fecha con la que se ordena la foto; si aún no se había
+// leído el EXIF (fotos de antes o que llegaron por otra vía), se lee y se anota
+// en memoria: quien recorre las fotos llama a meta.Flush al terminar
+func photoTakenAt(rel string, info os.FileInfo) time.Time {
+	fm, _ := meta.Get(rel)
+	if fm.Taken == 0 {
+		abs, err := securePath(rel)
+		if err != nil { return info.ModTime() }
+		fm.Taken = exifTakenUnix(abs)
+		meta.Fill(rel, func(m *FileMeta) { m.Taken = fm.Taken })
+	}
+	if fm.Taken > 0 { return time.Unix(fm.Taken, 0) }
+	return info.ModTime()
+}
+
+type timelinePhoto struct {
+	Name    string    `json:"name"`
+	RelPath string    `json:"path"`
+	Taken   time.Time `json:"taken"`
+}
+
+type timelineDay struct {
+	Date   string          `json:"date"`
+	Label  string          `json:"-"`
+	Photos []timelinePhoto `json:"photos"`
+}
+
+var spanishMonths = []string{"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"}
+
+// photoTimeline agrupa por día las fotos ya ordenadas de la más reciente a la
+// más antigua
+func photoTimeline(photos []timelinePhoto) []timelineDay {
+	var days []timelineDay
+	for _, p := range photos {
+		date := p.Taken.Format("2006-01-02")
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			label := fmt.Sprintf("%d de %s de %d", p.Taken.Day(), spanishMonths[p.Taken.Month()-1], p.Taken.Year())
+			days = append(days, timelineDay{Date: date, Label: label})
+		}
+		days[len(days)-1].Photos = append(days[len(days)-1].Photos, p)
+	}
+	return days
+}
+
+// CSP de la línea de tiempo: la de por defecto, más su hoja de estilos y el
+// script del visor
+const photosCSP = "default-src 'none'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+var photosTmpl *template.Template
+
+// photosHandler es /photos?dir=...; se pagina como el listado, con
+// -page-size fotos por página. Con Accept: application/json devuelve los días
+func photosHandler(w http.ResponseWriter, r *http.Request) {
+	if opaqueDenied(w, r) { return }
+	if m := lockedDir(r); m != nil { mountLocked(w, r, m); return }
+	if listingDenied(w, r) { return }
+	dir := strings.Trim(path.Clean("/"+r.URL.Query().Get("dir")), "/")
+	abs, err := existingPath(dir)
+	if err != nil { pathError(w, err); return }
+	var photos []timelinePhoto
+	walkFiles(abs, func(rel string, info os.FileInfo) {
+		if !isPhoto(rel) || !aclAllows(r, rel, aclRead) { return }
+		photos = append(photos, timelinePhoto{Name: info.Name(), RelPath: rel, Taken: photoTakenAt(rel, info)})
+	})
+	meta.Flush()
+	sort.SliceStable(photos, func(i, j int) bool { return photos[i].Taken.After(photos[j].Taken) })
+
+	pages := max(1, (len(photos)+listPageSize-1)/listPageSize)
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	page = max(1, min(page, pages))
+	start := (page - 1) * listPageSize
+	days := photoTimeline(photos[min(start, len(photos)):min(start+listPageSize, len(photos))])
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"dir": dir, "total": len(photos), "page": page, "pages": pages, "days": days})
+		return
+	}
+	pageURL := func(n int) string {
+		q := url.Values{"page": {strconv.Itoa(n)}}
+		if dir != "" { q.Set("dir", dir) }
+		return "/photos?" + q.Encode()
+	}
+	data := map[string]interface{}{"Dir": dir, "Total": len(photos), "Days": days, "Page": page, "Pages": pages, "PrevURL": "", "NextURL": ""}
+	if page > 1 { data["PrevURL"] = pageURL(page - 1) }
+	if page < pages { data["NextURL"] = pageURL(page + 1) }
+	if cspPolicy != "" { w.Header().Set("Content-Security-Policy", photosCSP) }
+	photosTmpl.Execute(w, data)
+}
+
+// hasPhotos indica si entre los archivos hay alguna foto, para ofrecer la línea de tiempo
+func hasPhotos(files []FileInfo) bool {
+	return slices.ContainsFunc(files, func(f FileInfo) bool { return !f.IsDir && isPhoto(f.Name) })
+}
+
+// --- ÍNDICE DE TEXTO COMPLETO ---
+
+// Límite de texto extraído por archivo, para que un log enorme no llene la memoria
+const maxIndexedText = 8 << 20
+
+var plainTextExtensions = map[string]bool{
+	".txt": true, ".md": true, ".csv": true, ".tsv": true, ".log": true, ".json": true,
+	".xml": true, ".yaml": true, ".yml": true, ".ini": true, ".conf": true, ".html": true, ".htm": true,
+}
+
+var ocrExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".tif": true, ".tiff": true}
+
+// indexedDoc es lo que se guarda en disco por archivo: con tamaño y fecha se
+// sabe si hay que volver a extraer el texto
+type indexedDoc struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Terms   []string  `json:"terms"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type TextIndex struct {
+	path     string
+	docs     map[string]*indexedDoc
+	terms    map[string]map[string]bool
+	pending  int
+	lastRun  time.Time
+	duration time.Duration
+	running  bool
+	trigger  chan struct{}
+	mu       sync.Mutex
+}
+
+var textIndex = TextIndex{
+	docs:    make(map[string]*indexedDoc),
+	terms:   make(map[string]map[string]bool),
+	trigger: make(chan struct{}, 1),
+}
+
+// tokenize separa en palabras en minúsculas de al menos 2 caracteres, sin repetir
+func tokenize(text string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len([]rune(word)) < 2 || len(word) > 64 || seen[word] { continue }
+		seen[word] = true
+		out = append(out, word)
+	}
+	return out
+}
+
+// runExtractor ejecuta un comando externo con {in} y devuelve su salida estándar
+func runExtractor(cmdTemplate, in string) (string, error) {
+	var args []string
+	for _, a := range strings.Fields(cmdTemplate) { args = append(args, strings.ReplaceAll(a, "{in}", in)) }
+	if len(args) == 0 { return "", errors.New("extractor vacío") }
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	out, err := cmd.StdoutPipe()
+	if err != nil { return "", err }
+	if err := cmd.Start(); err != nil { return "", err }
+	data, _ := io.ReadAll(io.LimitReader(out, maxIndexedText))
+	io.Copy(io.Discard, out)
+	return string(data), cmd.Wait()
+}
+
+// xmlText quita las etiquetas de un XML dejando solo el texto
+func xmlText(r io.Reader) string {
+	var b strings.Builder
+	dec := xml.NewDecoder(io.LimitReader(r, maxIndexedText))
+	for {
+		tok, err := dec.Token()
+		if err != nil { break }
+		if cd, ok := tok.(xml.CharData); ok {
+			b.Write(cd)
+			b.WriteByte(' ')
+		}
+	}
+	return b.String()
+}
+
+// extractZipXML lee el texto de los documentos OOXML/ODF (son zips con XML dentro)
+func extractZipXML(path string) (string, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil { return "", err }
+	defer zr.Close()
+	var b strings.Builder
+	for _, f := range zr.File {
+		name := f.Name
+		if name == "word/document.xml" || name == "content.xml" || name == "xl/sharedStrings.xml" ||
+			(strings.HasPrefix(name, "ppt/slides/slide") && strings.HasSuffix(name, ".xml")) {
+			rc, err := f.Open()
+			if err != nil { continue }
+			b.WriteString(xmlText(rc))
+			rc.Close()
+		}
+	}
+	return b.String(), nil
+}
+
+// extractText devuelve el texto de un archivo según su tipo; ok=false si no se indexa
+func extractText(path string) (string, bool, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch {
+	case plainTextExtensions[ext]:
+		f, err := os.Open(path)
+		if err != nil { return "", true, err }
+		defer f.Close()
+		data, err := io.ReadAll(io.LimitReader(f, maxIndexedText))
+		return string(data), true, err
+	case ext == ".docx" || ext == ".xlsx" || ext == ".pptx" || ext == ".odt" || ext == ".ods" || ext == ".odp":
+		text, err := extractZipXML(path)
+		return text, true, err
+	case ext == ".pdf" && pdfTextCmd != "":
+		text, err := runExtractor(pdfTextCmd, path)
+		return text, true, err
+	case ocrExtensions[ext] && ocrCmd != "":
+		text, err := runExtractor(ocrCmd, path)
+		return text, true, err
+	}
+	return "", false, nil
+}
+
+func (t *TextIndex) load(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &t.docs); err != nil {
+		log.Printf("Ignorando %s: %v", path, err)
+		t.docs = make(map[string]*indexedDoc)
+	}
+	t.rebuild()
+}
+
+// rebuild regenera el índice invertido a partir de los documentos; con el mutex tomado
+func (t *TextIndex) rebuild() {
+	t.terms = make(map[string]map[string]bool)
+	for name, doc := range t.docs {
+		for _, term := range doc.Terms {
+			if t.terms[term] == nil { t.terms[term] = make(map[string]bool) }
+			t.terms[term][name] = true
+		}
+	}
+}
+
+func (t *TextIndex) save() error {
+	data, err := json.Marshal(t.docs)
+	if err != nil { return err }
+	tmp := t.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil { return err }
+	return os.Rename(tmp, t.path)
+}
+
+// Trigger pide una pasada de indexado sin esperar a que termine
+func (t *TextIndex) Trigger() {
+	if !enableIndex { return }
+	select {
+	case t.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Reindex vuelve a extraer el texto de todos los archivos (por ejemplo tras
+// cambiar -pdf-text-cmd); mientras tanto se sigue buscando en el índice viejo
+func (t *TextIndex) Reindex(ctx context.Context) error {
+	if !enableIndex { return errors.New("el índice está desactivado (-index)") }
+	t.mu.Lock()
+	for _, doc := range t.docs { doc.Size = -1 }
+	t.mu.Unlock()
+	t.Trigger()
+	return nil
+}
+
+// run indexa en segundo plano al arrancar, cada indexInterval y tras cada subida
+func (t *TextIndex) run() {
+	ticker := time.NewTicker(indexInterval)
+	defer ticker.Stop()
+	for {
+		t.scan()
+		select {
+		case <-ticker.C:
+		case <-t.trigger:
+		}
+	}
+}
+
+// scan extrae el texto de los archivos nuevos o modificados y olvida los
+// borrados. Recorre todo el árbol (subcarpetas y carpetas de -share) y guarda
+// cada documento por su ruta relativa, la misma que usa el listado
+func (t *TextIndex) scan() {
+	start := time.Now()
+	type pendingDoc struct {
+		rel  string
+		info os.FileInfo
+	}
+	var found []pendingDoc
+	walkFiles(rootDir, func(rel string, info os.FileInfo) { found = append(found, pendingDoc{rel, info}) })
+
+	t.mu.Lock()
+	t.running = true
+	var todo []pendingDoc
+	present := make(map[string]bool)
+	for _, p := range found {
+		present[p.rel] = true
+		if doc := t.docs[p.rel]; doc != nil && doc.Size == p.info.Size() && doc.ModTime.Equal(p.info.ModTime()) { continue }
+		todo = append(todo, p)
+	}
+	changed := false
+	for name := range t.docs {
+		if !present[name] {
+			delete(t.docs, name)
+			changed = true
+		}
+	}
+	t.pending = len(todo)
+	t.mu.Unlock()
+
+	// La extracción se hace sin el mutex para no bloquear las búsquedas
+	for _, p := range todo {
+		text, ok, err := extractText(absPath(p.rel))
+		doc := &indexedDoc{Size: p.info.Size(), ModTime: p.info.ModTime()}
+		if err != nil { doc.Error = err.Error() }
+		if ok { doc.Terms = tokenize(text) }
+		t.mu.Lock()
+		t.docs[p.rel] = doc
+		t.pending--
+		t.mu.Unlock()
+		changed = true
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if changed {
+		t.rebuild()
+		if err := t.save(); err != nil { log.Printf("Error guardando el índice: %v", err) }
+	}
+	t.running = false
+	t.lastRun = start
+	t.duration = time.Since(start)
+}
+
+// Search devuelve los archivos que contienen todas las palabras de la consulta
+// (por prefijo, para que "factur" encuentre "facturas")
+func (t *TextIndex) Search(query string) map[string]bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var result map[string]bool
+	for _, word := range tokenize(query) {
+		hits := make(map[string]bool)
+		for term, names := range t.terms {
+			if !strings.HasPrefix(term, word) { continue }
+			for name := range names { hits[name] = true }
+		}
+		if result == nil {
+			result = hits
+			continue
+		}
+		for name := range result {
+			if !hits[name] { delete(result, name) }
+		}
+	}
+	return result
+}
+
+func indexStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !enableIndex { http.NotFound(w, r); return }
+	// Enseña todos los nombres indexados y los errores de los extractores
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	textIndex.mu.Lock()
+	type row struct {
+		Name  string
+		Terms int
+		Error string
+	}
+	var rows []row
+	for name, doc := range textIndex.docs {
+		// Lo que este administrador no puede ver (permisos o visibilidad) tampoco se nombra
+		if !aclAllows(r, name, aclRead) { continue }
+		rows = append(rows, row{Name: name, Terms: len(doc.Terms), Error: doc.Error})
+	}
+	data := map[string]interface{}{
+		"Running":  textIndex.running,
+		"Pending":  textIndex.pending,
+		"LastRun":  textIndex.lastRun,
+		"Duration": textIndex.duration.Round(time.Millisecond),
+		"Terms":    len(textIndex.terms),
+	}
+	textIndex.mu.Unlock()
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+	data["Docs"] = rows
+	indexStatusTmpl.Execute(w, data)
+}
+
+// --- CARPETAS DE ENTRADA ---
+
+// dropFolder es una carpeta local (por ejemplo un recurso samba donde escribe
+// un escáner) cuyos archivos nuevos se mueven a rootDir, a la subcarpeta Target
+type dropFolder struct {
+	Source string
+	Target string
+}
+
+var dropFolders []dropFolder
+
+// DropState lleva la cuenta entre pasadas: Seen es la firma (tamaño y fecha)
+// vista en la pasada anterior y Copied lo ya copiado con -drop-copy, que se
+// guarda en disco para no repetir copias al reiniciar. Solo lo usa la
+// goroutine de ingesta.
+type DropState struct {
+	path   string
+	Copied map[string]string
+	seen   map[string]string
+}
+
+var dropState = DropState{Copied: make(map[string]string), seen: make(map[string]string)}
+
+func (d *DropState) load(path string) {
+	d.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &d.Copied); err != nil {
+		log.Printf("Ignorando %s: %v", path, err)
+		d.Copied = make(map[string]string)
+	}
+}
+
+func (d *DropState) save() error {
+	return writeJSONAtomic(d.path, d.Copied)
+}
+
+func (d *DropState) run() {
+	for {
+		d.scan()
+		time.Sleep(dropInterval)
+	}
+}
+
+// scan ingiere los archivos que no cambiaron desde la pasada anterior: así no
+// se recoge un archivo que todavía se está copiando a la carpeta de entrada
+func (d *DropState) scan() {
+	seen := make(map[string]string)
+	ingested := 0
+	for _, folder := range dropFolders {
+		filepath.WalkDir(folder.Source, func(p string, e os.DirEntry, err error) error {
+			if err != nil || p == folder.Source { return nil }
+			// Ocultos y temporales (.DS_Store, ._foto.jpg, .~lock) no se ingieren
+			if strings.HasPrefix(e.Name(), ".") || strings.HasPrefix(e.Name(), "~$") {
+				if e.IsDir() { return filepath.SkipDir }
+				return nil
+			}
+			if !e.Type().IsRegular() { return nil }
+			info, err := e.Info()
+			if err != nil { return nil }
+			sig := fmt.Sprintf("%d|%d", info.Size(), info.ModTime().UnixNano())
+			seen[p] = sig
+			if d.seen[p] != sig || d.Copied[p] == sig { return nil }
+			rel, _ := filepath.Rel(folder.Source, p)
+			name, err := ingestFile(folder, p, filepath.ToSlash(rel))
+			if err != nil {
+				log.Printf("Carpeta de entrada: %s: %v", p, err)
+				return nil
+			}
+			log.Printf("Carpeta de entrada: %s -> %s", p, name)
+			ingested++
+			if dropCopy { d.Copied[p] = sig }
+			return nil
+		})
+	}
+	d.seen = seen
+	if dropCopy {
+		for p := range d.Copied {
+			if _, ok := seen[p]; !ok { delete(d.Copied, p) }
+		}
+		if err := d.save(); err != nil { log.Printf("Error guardando %s: %v", d.path, err) }
+	}
+	if ingested > 0 { contentChanged() }
+}
+
+// ingestFile copia src a rootDir con las mismas comprobaciones que una subida.
+// Si el nombre ya existe con otro contenido se añade " (n)": un escáner que
+// repite "scan001.pdf" cada día no pisa los anteriores.
+func ingestFile(folder dropFolder, src, rel string) (string, error) {
+	name, err := sanitizeRelPath(rel)
+	if err != nil { return "", err }
+	if folder.Target != "" { name = folder.Target + "/" + name }
+	in, err := os.Open(src)
+	if err != nil { return "", err }
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil { return "", err }
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	var dstPath string
+	for n := 1; ; n++ {
+		if dstPath, err = securePath(name); err != nil { return "", err }
+		existing, err := os.Stat(dstPath)
+		if err != nil { break }
+		if !existing.IsDir() && existing.Size() == info.Size() {
+			local, err1 := cachedSHA256(relPath(dstPath), existing)
+			incoming, err2 := fileSHA256(src)
+			if err1 == nil && err2 == nil && local == incoming {
+				// Ya está: solo queda retirarlo de la carpeta de entrada
+				meta.Flush()
+				if !dropCopy { os.Remove(src) }
+				return name, nil
+			}
+		}
+		name = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+	// Si una subida escribe justo ese nombre, el archivo se reintenta en la siguiente pasada
+	unlock, err := pathLocks.TryLock(dstPath)
+	if err != nil { return "", err }
+	defer unlock()
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil { return "", err }
+	if err := checkDirCapacity(dstPath); err != nil { return "", err }
+	if err := checkFreeSpace(filepath.Dir(dstPath), info.Size()); err != nil { return "", err }
+
+	ctx, span := startSpan(context.WithValue(context.Background(), hookActorKey{}, hookActor{User: "entrada:" + filepath.Base(folder.Source)}), "drop.ingest")
+	defer span.End()
+	span.SetAttr("file.name", name)
+	sum, err := receiveFile(ctx, in, dstPath)
+	if err != nil { return "", err }
+	uploader := "entrada:" + filepath.Base(folder.Source)
+	stored, sum, err := recordUpload(ctx, dstPath, uploader, "", sum)
+	if err != nil { return "", err }
+	firePostHooks(hookEvent{Event: hookPostUpload, Path: relPath(dstPath), File: dstPath, Size: stored.Size(), SHA256: sum, User: uploader})
+	if !dropCopy { in.Close(); return name, os.Remove(src) }
+	return name, nil
+}
+
+// --- PUBLICACIÓN EN IPFS ---
+
+// Con -ipfs-api cada archivo recibido se añade (y fija) en un nodo IPFS local
+// mediante la API RPC de Kubo; el CID se guarda en los metadatos. Con
+// -ipfs-pin-service se pide además a un servicio remoto que lo fije (IPFS
+// Pinning Service API), para que siga disponible con el nodo local apagado.
+
+func ipfsEnabled() bool { return ipfsAPI != "" }
+
+var ipfsClient = &http.Client{Timeout: 30 * time.Minute}
+
+// ipfsAdd sube el archivo al nodo con /api/v0/add y devuelve su CID (v1)
+func ipfsAdd(ctx context.Context, abs string) (string, error) {
+	f, err := os.Open(abs)
+	if err != nil { return "", err }
+	defer f.Close()
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", filepath.Base(abs))
+		if err == nil { _, err = io.Copy(part, f) }
+		if err == nil { err = mw.Close() }
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(ipfsAPI, "/")+"/api/v0/add?pin=true&cid-version=1&quieter=true", pr)
+	if err != nil { return "", err }
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := ipfsClient.Do(req)
+	if err != nil { return "", err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var out struct{ Hash string }
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil { return "", err }
+	if out.Hash == "" { return "", errors.New("el nodo no devolvió un CID") }
+	return out.Hash, nil
+}
+
+// ipfsRemotePin pide al servicio de fijado que conserve el CID
+func ipfsRemotePin(ctx context.Context, cid, name string) error {
+	body, _ := json.Marshal(map[string]string{"cid": cid, "name": name})
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimRight(ipfsPinService, "/")+"/pins", bytes.NewReader(body))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+ipfsPinToken)
+	resp, err := ipfsClient.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 && resp.StatusCode != 202 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// publishIPFS es el trabajo "ipfs" que se encola tras cada subida: un nodo
+// lento o caído no debe retrasar ni hacer fallar la subida, y la cola lo
+// reintenta más tarde
+func publishIPFS(ctx context.Context, rel string) error {
+	abs := absPath(rel)
+	if _, err := os.Stat(abs); err != nil { return nil }
+	ctx, span := startSpan(ctx, "ipfs.add")
+	defer span.End()
+	span.SetAttr("file.name", rel)
+	cid, err := ipfsAdd(ctx, abs)
+	if err == nil && ipfsPinService != "" { err = ipfsRemotePin(ctx, cid, rel) }
+	if cid != "" {
+		span.SetAttr("ipfs.cid", cid)
+		if err := meta.Update(rel, func(m *FileMeta) { m.CID = cid }); err != nil { log.Printf("Error guardando metadatos: %v", err) }
+	}
+	if err != nil {
+		span.SetError(err)
+		log.Printf("IPFS: %s: %v", rel, err)
+	}
+	return err
+}
+
+// ipfsURL marca el enlace ipfs:// como seguro para html/template, que por
+// defecto solo deja pasar http, https y mailto
+func ipfsURL(cid string) template.URL { return template.URL("ipfs://" + url.PathEscape(cid)) }
+
+// --- TRABAJOS EN SEGUNDO PLANO ---
+
+// Lo que no debe hacer esperar a una petición (por ahora, publicar en IPFS)
+// se encola como trabajo. La cola se guarda en .cerbero/jobs.json, así que lo
+// pendiente sobrevive a un reinicio; -job-workers limita cuántos corren a la
+// vez y cada fallo se reintenta con esperas crecientes hasta maxJobAttempts
+// intentos. /api/v1/jobs muestra el estado a los administradores.
+
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+
+	maxJobAttempts = 5
+	jobTimeout     = 30 * time.Minute
+	// Los trabajos terminados se conservan un tiempo para poder consultarlos
+	jobRetention = 7 * 24 * time.Hour
+)
+
+// Job es un trabajo de la cola; Target es la ruta relativa sobre la que actúa
+type Job struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Target   string    `json:"target"`
+	State    string    `json:"state"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Created  time.Time `json:"created"`
+	// Antes de este momento no se vuelve a intentar (tras un fallo)
+	NextTry  time.Time `json:"next_try,omitzero"`
+	Finished time.Time `json:"finished,omitzero"`
+	// De 0 a 1, en los trabajos que saben cuánto llevan (hls)
+	Progress float64 `json:"progress,omitempty"`
+}
+
+// jobRunners ejecuta cada tipo de trabajo; un error hace que se reintente
+var jobRunners = map[string]func(ctx context.Context, target string) error{
+	"ipfs":     publishIPFS,
+	"backfill": backfillJob,
+	"hook":     runHookJob,
+	"video":    videoJob,
+	"hls":      hlsJob,
+}
+
+// jobIDKey lleva en el contexto el trabajo en marcha, para jobProgress
+type jobIDKey struct{}
+
+// jobProgress anota cuánto lleva el trabajo en marcha; no se guarda en disco
+// cada vez, solo con el siguiente cambio de estado
+func jobProgress(ctx context.Context, done float64) {
+	id, _ := ctx.Value(jobIDKey{}).(string)
+	if id == "" { return }
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+	for _, j := range jobs.jobs {
+		if j.ID == id { j.Progress = math.Round(done*1000) / 1000 }
+	}
+}
+
+type JobQueue struct {
+	path string
+	jobs []*Job
+	wake chan struct{}
+	mu   sync.Mutex
+}
+
+var jobs = JobQueue{wake: make(chan struct{}, 1)}
+
+// load recupera la cola; lo que estaba en marcha al pararse vuelve a la cola
+func (q *JobQueue) load(path string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &q.jobs); err != nil { log.Printf("Ignorando %s: %v", path, err) }
+	for _, j := range q.jobs {
+		if j.State == jobRunning { j.State = jobQueued }
+	}
+}
+
+// save olvida los trabajos terminados hace más de jobRetention antes de
+// guardar la cola; se llama con el mutex tomado
+func (q *JobQueue) save() error {
+	cutoff := time.Now().Add(-jobRetention)
+	q.jobs = slices.DeleteFunc(q.jobs, func(j *Job) bool { return !j.Finished.IsZero() && j.Finished.Before(cutoff) })
+	if q.path == "" { return nil }
+	return writeJSONAtomic(q.path, q.jobs)
+}
+
+// signal despierta a un trabajador si hay alguno esperando
+func (q *JobQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue añade un trabajo; si ya hay uno igual esperando, devuelve ese
+func (q *JobQueue) Enqueue(kind, target string) Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if j.Kind == kind && j.Target == target && j.State == jobQueued { return *j }
+	}
+	j := &Job{ID: randomToken(9), Kind: kind, Target: target, State: jobQueued, Created: time.Now()}
+	q.jobs = append(q.jobs, j)
+	if err := q.save(); err != nil { log.Printf("Error guardando la cola de trabajos: %v", err) }
+	q.signal()
+	return *j
+}
+
+// next toma el primer trabajo que ya toca ejecutar y lo marca en marcha
+func (q *JobQueue) next() *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for _, j := range q.jobs {
+		if j.State != jobQueued || j.NextTry.After(now) { continue }
+		j.State = jobRunning
+		j.Attempts++
+		j.Progress = 0
+		if err := q.save(); err != nil { log.Printf("Error guardando la cola de trabajos: %v", err) }
+		return j
+	}
+	return nil
+}
+
+// finish anota el resultado; tras un fallo espera 30 s, 1 min, 2 min... antes
+// del siguiente intento
+func (q *JobQueue) finish(j *Job, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch {
+	case err == nil:
+		j.State, j.Error, j.Finished = jobDone, "", time.Now()
+		if j.Progress > 0 { j.Progress = 1 }
+	case j.Attempts >= maxJobAttempts:
+		j.State, j.Error, j.Finished = jobFailed, err.Error(), time.Now()
+		log.Printf("Trabajo %s (%s %s) abandonado tras %d intentos: %v", j.ID, j.Kind, j.Target, j.Attempts, err)
+	default:
+		j.State, j.Error = jobQueued, err.Error()
+		j.NextTry = time.Now().Add(30 * time.Second << (j.Attempts - 1))
+	}
+	if err := q.save(); err != nil { log.Printf("Error guardando la cola de trabajos: %v", err) }
+}
+
+// Start lanza los trabajadores
+func (q *JobQueue) Start(workers int) {
+	for range workers {
+		go func() {
+			for {
+				j := q.next()
+				if j == nil {
+					select {
+					case <-q.wake:
+					case <-time.After(5 * time.Second):
+					}
+					continue
+				}
+				// Si queda más trabajo, que otro trabajador lo vaya cogiendo
+				q.signal()
+				run := jobRunners[j.Kind]
+				if run == nil { q.finish(j, fmt.Errorf("tipo de trabajo desconocido: %s", j.Kind)); continue }
+				timeout := jobTimeout
+				if j.Kind == "hls" { timeout = hlsJobTimeout }
+				ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), jobIDKey{}, j.ID), timeout)
+				err := run(ctx, j.Target)
+				cancel()
+				q.finish(j, err)
+			}
+		}()
+	}
+}
+
+// List devuelve los trabajos del más nuevo al más antiguo, filtrados por estado
+func (q *JobQueue) List(state string) []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := []Job{}
+	for i := len(q.jobs) - 1; i >= 0; i-- {
+		if state == "" || q.jobs[i].State == state { out = append(out, *q.jobs[i]) }
+	}
+	return out
+}
+
+// Retry vuelve a poner en cola un trabajo que falló
+func (q *JobQueue) Retry(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, j := range q.jobs {
+		if j.ID != id || j.State != jobFailed { continue }
+		j.State, j.Attempts, j.NextTry, j.Finished = jobQueued, 0, time.Time{}, time.Time{}
+		if err := q.save(); err != nil { log.Printf("Error guardando la cola de trabajos: %v", err) }
+		q.signal()
+		return *j, true
+	}
+	return Job{}, false
+}
+
+// jobsHandler es GET /api/v1/jobs[?state=queued|running|done|failed],
+// GET /api/v1/jobs/{id} y POST /api/v1/jobs/{id}/retry
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	id := r.PathValue("id")
+	if r.Method == "POST" {
+		j, ok := jobs.Retry(id)
+		if !ok { failWith(w, "not_found", "No hay ningún trabajo fallido con ese ID", 404); return }
+		audit(r, "job_retry", map[string]string{"id": id, "kind": j.Kind, "target": j.Target})
+		json.NewEncoder(w).Encode(j)
+		return
+	}
+	if id == "" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"workers": max(jobWorkers, 1), "jobs": jobs.List(r.URL.Query().Get("state"))})
+		return
+	}
+	for _, j := range jobs.List("") {
+		if j.ID == id { json.NewEncoder(w).Encode(j); return }
+	}
+	failWith(w, "not_found", "No hay ningún trabajo con ese ID", 404)
+}
+
+// --- TAREAS PROGRAMADAS ---
+
+// -schedule dice cuándo se ejecuta cada tarea de mantenimiento, con la
+// sintaxis de cron (minuto hora día mes día-de-la-semana), @hourly, @daily,
+// @weekly, @monthly o @every 90m, separadas por ";":
+//
+//	-schedule "expire=@every 1m;trash=@hourly;reindex=0 3 * * *"
+//
+// Cada tarea corre sola (si la anterior no ha acabado se salta la vuelta) y
+// su último resultado se guarda en .cerbero/schedule.json y se ve en /schedule.
+
+const defaultSchedule = "expire=@every 1m;trash=@hourly"
+
+// maintenanceTasks son las tareas que se pueden programar
+var maintenanceTasks = map[string]func(ctx context.Context) error{
+	// Borra los archivos caducados
+	"expire": func(ctx context.Context) error { removeExpired(); return nil },
+	// Vacía lo que quedó en la papelera de borrados y lotes interrumpidos
+	"trash": sweepTrash,
+	// Vuelve a extraer el texto de todo el índice (-index)
+	"reindex": textIndex.Reindex,
+	// Comprueba el SHA-256 de cada archivo contra el guardado
+	"scrub": runScrub,
+	// Recalcula el tamaño de las carpetas (-du-interval)
+	"du": func(ctx context.Context) error {
+		if duInterval <= 0 { return errors.New("el cálculo de tamaños está desactivado (-du-interval 0)") }
+		dirSizes.Trigger()
+		return nil
+	},
+}
+
+// cronSpec es un horario ya interpretado: cada campo es un conjunto de bits
+type cronSpec struct {
+	every                         time.Duration
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// parseCronField interpreta "*", "*/15", "1-5", "0,30" o "8-18/2" entre lo y hi
+func parseCronField(field string, lo, hi int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 { return 0, fmt.Errorf("paso no válido en %q", part) }
+			step = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = strconv.Atoi(a); err != nil { return 0, fmt.Errorf("valor no válido en %q", part) }
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(b); err != nil { return 0, fmt.Errorf("valor no válido en %q", part) }
+			} else if hasStep {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to { return 0, fmt.Errorf("%q fuera de %d-%d", part, lo, hi) }
+		for v := from; v <= to; v += step { bits |= 1 << v }
+	}
+	return bits, nil
+}
+
+func parseCron(spec string) (cronSpec, error) {
+	spec = strings.TrimSpace(spec)
+	switch spec {
+	case "@hourly":
+		spec = "0 * * * *"
+	case "@daily", "@midnight":
+		spec = "0 0 * * *"
+	case "@weekly":
+		spec = "0 0 * * 0"
+	case "@monthly":
+		spec = "0 0 1 * *"
+	}
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil || every < time.Minute { return cronSpec{}, errors.New("@every necesita una duración de al menos 1m") }
+		return cronSpec{every: every}, nil
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 { return cronSpec{}, errors.New("se esperaban 5 campos: minuto hora día mes día-de-la-semana") }
+	var c cronSpec
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil { return c, err }
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil { return c, err }
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil { return c, err }
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil { return c, err }
+	if c.dow, err = parseCronField(fields[4], 0, 7); err != nil { return c, err }
+	// El 7 también es domingo
+	if c.dow&(1<<7) != 0 { c.dow |= 1 }
+	c.anyDom, c.anyDow = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+// dayMatches sigue a cron: si se restringen día del mes y de la semana,
+// basta con que coincida uno de los dos
+func (c cronSpec) dayMatches(t time.Time) bool {
+	if c.month&(1<<int(t.Month())) == 0 { return false }
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	if !c.anyDom && !c.anyDow { return dom || dow }
+	return dom && dow
+}
+
+// Next devuelve la primera vez que toca después de t (cero si nunca)
+func (c cronSpec) Next(t time.Time) time.Time {
+	if c.every > 0 { return t.Add(c.every) }
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// taskStatus es el último resultado de una tarea, lo que se guarda en disco
+type taskStatus struct {
+	LastRun  time.Time     `json:"last_run,omitzero"`
+	Duration time.Duration `json:"duration_ns"`
+	Error    string        `json:"error,omitempty"`
+	Runs     int           `json:"runs"`
+}
+
+type scheduledTask struct {
+	Name    string
+	Spec    string
+	Next    time.Time
+	Running bool
+	taskStatus
+	cron    cronSpec
+	run     func(ctx context.Context) error
+	trigger chan struct{}
+}
+
+type Scheduler struct {
+	path  string
+	tasks []*scheduledTask
+	mu    sync.Mutex
+}
+
+var scheduler Scheduler
+
+// Configure interpreta -schedule; una tarea desconocida o un horario mal
+// escrito impiden arrancar
+func (s *Scheduler) Configure(spec string) error {
+	for _, entry := range strings.Split(spec, ";") {
+		if strings.TrimSpace(entry) == "" { continue }
+		name, when, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok { return fmt.Errorf("%q: se esperaba tarea=horario", entry) }
+		run := maintenanceTasks[name]
+		if run == nil { return fmt.Errorf("tarea desconocida: %s", name) }
+		c, err := parseCron(when)
+		if err != nil { return fmt.Errorf("%s: %v", name, err) }
+		if slices.ContainsFunc(s.tasks, func(t *scheduledTask) bool { return t.Name == name }) { return fmt.Errorf("tarea repetida: %s", name) }
+		s.tasks = append(s.tasks, &scheduledTask{Name: name, Spec: strings.TrimSpace(when), cron: c, run: run, trigger: make(chan struct{}, 1)})
+	}
+	return nil
+}
+
+// load recupera el último resultado de cada tarea
+func (s *Scheduler) load(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	var saved map[string]taskStatus
+	if err := json.Unmarshal(data, &saved); err != nil { log.Printf("Ignorando %s: %v", path, err); return }
+	for _, t := range s.tasks { t.taskStatus = saved[t.Name] }
+}
+
+func (s *Scheduler) save() error {
+	saved := make(map[string]taskStatus, len(s.tasks))
+	for _, t := range s.tasks { saved[t.Name] = t.taskStatus }
+	return writeJSONAtomic(s.path, saved)
+}
+
+// Start lanza un bucle por tarea que duerme hasta su siguiente hora
+func (s *Scheduler) Start() {
+	for _, t := range s.tasks {
+		go func() {
+			for {
+				s.mu.Lock()
+				t.Next = t.cron.Next(time.Now())
+				next := t.Next
+				s.mu.Unlock()
+				if next.IsZero() { return }
+				timer := time.NewTimer(time.Until(next))
+				select {
+				case <-timer.C:
+				case <-t.trigger:
+					timer.Stop()
+				}
+				s.execute(t)
+			}
+		}()
+	}
+}
+
+func (s *Scheduler) execute(t *scheduledTask) {
+	s.mu.Lock()
+	t.Running = true
+	s.mu.Unlock()
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), jobTimeout)
+	err := t.run(ctx)
+	cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.Running = false
+	t.LastRun, t.Duration, t.Error = start, time.Since(start), ""
+	t.Runs++
+	if err != nil {
+		t.Error = err.Error()
+		log.Printf("Tarea %s: %v", t.Name, err)
+	}
+	if err := s.save(); err != nil { log.Printf("Error guardando las tareas: %v", err) }
+}
+
+// RunNow adelanta la tarea; false si no está programada
+func (s *Scheduler) RunNow(name string) bool {
+	for _, t := range s.tasks {
+		if t.Name != name { continue }
+		select {
+		case t.trigger <- struct{}{}:
+		default:
+		}
+		return true
+	}
+	return false
+}
+
+// Status devuelve una copia del estado de las tareas para mostrarlo
+func (s *Scheduler) Status() []scheduledTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]scheduledTask, len(s.tasks))
+	for i, t := range s.tasks { out[i] = *t }
+	return out
+}
+
+var scheduleTmpl *template.Template
+
+// scheduleHandler muestra las tareas y su último resultado a los
+// administradores (en JSON con Accept: application/json o en
+// /api/v1/schedule); POST con task=nombre la ejecuta ya
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	if r.Method == "POST" {
+		name := r.FormValue("task")
+		if !scheduler.RunNow(name) { failWith(w, "not_found", "Esa tarea no está programada", 404); return }
+		audit(r, "task_run", map[string]string{"task": name})
+		if wantsJSON(r) { w.WriteHeader(202); return }
+		http.Redirect(w, r, "/schedule", 303)
+		return
+	}
+	tasks := scheduler.Status()
+	if wantsJSON(r) || strings.HasPrefix(r.URL.Path, "/api/") {
+		type row struct {
+			Name    string    `json:"name"`
+			Spec    string    `json:"schedule"`
+			Next    time.Time `json:"next,omitzero"`
+			Running bool      `json:"running"`
+			taskStatus
+		}
+		out := make([]row, len(tasks))
+		for i, t := range tasks { out[i] = row{t.Name, t.Spec, t.Next, t.Running, t.taskStatus} }
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{"tasks": out})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	snap := scrub.Snapshot()
+	scheduleTmpl.Execute(w, map[string]interface{}{"Tasks": tasks, "Scrub": &snap})
+}
+
+// --- VERIFICACIÓN DE INTEGRIDAD ---
+
+// La tarea "scrub" de -schedule vuelve a leer cada archivo y compara su
+// SHA-256 con el guardado en los metadatos. Si el tamaño y la fecha siguen
+// siendo los de entonces pero el hash no, el contenido se ha corrompido en
+// el disco sin que nadie lo tocara: queda marcado en /schedule hasta que un
+// administrador lo acepta. Los archivos sin hash (o modificados desde que se
+// calculó) solo se anotan, para comprobarlos en la siguiente pasada.
+// -scrub-mbps limita la lectura para no saturar el disco.
+
+type scrubMismatch struct {
+	Expected string    `json:"expected"`
+	Actual   string    `json:"actual"`
+	Size     int64     `json:"size"`
+	Found    time.Time `json:"found"`
+}
+
+// scrubReport es el resultado de la última pasada, lo que se guarda en disco
+type scrubReport struct {
+	LastRun    time.Time                 `json:"last_run,omitzero"`
+	Duration   time.Duration             `json:"duration_ns"`
+	Checked    int                       `json:"checked"`
+	Recorded   int                       `json:"recorded"`
+	Bytes      int64                     `json:"bytes"`
+	Mismatches map[string]*scrubMismatch `json:"mismatches"`
+}
+
+type ScrubState struct {
+	scrubReport
+	path string
+	mu   sync.Mutex
+}
+
+var scrub = ScrubState{scrubReport: scrubReport{Mismatches: make(map[string]*scrubMismatch)}}
+
+func (s *ScrubState) load(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &s.scrubReport); err != nil { log.Printf("Ignorando %s: %v", path, err) }
+	if s.Mismatches == nil { s.Mismatches = make(map[string]*scrubMismatch) }
+}
+
+func (s *ScrubState) save() error {
+	return writeJSONAtomic(s.path, s.scrubReport)
+}
+
+// Damaged es el número de archivos marcados como dañados
+func (s *ScrubState) Damaged() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.Mismatches)
+}
+
+// runScrub es la tarea "scrub"; falla si hay archivos dañados, para que se
+// vea en rojo en /schedule
+func runScrub(ctx context.Context) error {
+	start := time.Now()
+	var checked, recorded int
+	var bytes int64
+	found := make(map[string]*scrubMismatch)
+	seen := make(map[string]bool)
+	walkFiles(rootDir, func(rel string, info os.FileInfo) {
+		if ctx.Err() != nil { return }
+		seen[rel] = true
+		expected, known := knownSHA256(rel, info)
+		actual, err := fileSHA256(absPath(rel))
+		if err != nil { log.Printf("Verificación de %s: %v", rel, err); return }
+		bytes += info.Size()
+		// Con -scrub-mbps se espera lo que falte para no pasar de ese ritmo
+		if scrubMBps > 0 {
+			if wait := time.Duration(float64(bytes)/float64(scrubMBps<<20)*float64(time.Second)) - time.Since(start); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+			}
+		}
+		if !known {
+			meta.Fill(rel, func(m *FileMeta) { m.SHA256, m.HashSize, m.HashMTime = actual, info.Size(), info.ModTime().UnixNano() })
+			recorded++
+			return
+		}
+		checked++
+		if actual != expected {
+			found[rel] = &scrubMismatch{Expected: expected, Actual: actual, Size: info.Size(), Found: time.Now()}
+		}
+	})
+	meta.Flush()
+	if err := ctx.Err(); err != nil { return err }
+
+	scrub.mu.Lock()
+	defer scrub.mu.Unlock()
+	// Lo ya marcado sigue marcado (con su fecha) mientras exista y no haya
+	// cambiado; lo nuevo se avisa en el registro
+	for rel, m := range scrub.Mismatches {
+		if seen[rel] && found[rel] != nil { found[rel] = m }
+	}
+	for rel, m := range found {
+		if scrub.Mismatches[rel] == nil { log.Printf("ARCHIVO DAÑADO: %s (esperado %s, leído %s)", rel, m.Expected, m.Actual) }
+	}
+	scrub.Mismatches = found
+	scrub.LastRun, scrub.Duration, scrub.Checked, scrub.Recorded, scrub.Bytes = start, time.Since(start), checked, recorded, bytes
+	if err := scrub.save(); err != nil { log.Printf("Error guardando la verificación: %v", err) }
+	if len(found) > 0 { return fmt.Errorf("%d archivo(s) dañado(s)", len(found)) }
+	return nil
+}
+
+// Accept da por bueno el contenido actual de un archivo marcado: su hash
+// pasa a ser el de referencia
+func (s *ScrubState) Accept(rel string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := s.Mismatches[rel]
+	if m == nil { return false }
+	delete(s.Mismatches, rel)
+	if err := meta.Update(rel, func(fm *FileMeta) { fm.SHA256 = m.Actual }); err != nil { log.Printf("Error guardando metadatos: %v", err) }
+	if err := s.save(); err != nil { log.Printf("Error guardando la verificación: %v", err) }
+	return true
+}
+
+// Snapshot copia el estado para mostrarlo
+func (s *ScrubState) Snapshot() scrubReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.scrubReport
+	out.Mismatches = make(map[string]*scrubMismatch, len(s.Mismatches))
+	for rel, m := range s.Mismatches {
+		c := *m
+		out.Mismatches[rel] = &c
+	}
+	return out
+}
+
+// scrubHandler es GET /api/v1/scrub (el resultado de la última pasada) y
+// POST /scrub con path=... para aceptar un archivo marcado
+func scrubHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	if r.Method == "POST" {
+		rel := r.FormValue("path")
+		if !scrub.Accept(rel) { failWith(w, "not_found", "Ese archivo no está marcado como dañado", 404); return }
+		audit(r, "scrub_accept", map[string]string{"path": rel})
+		if wantsJSON(r) { w.WriteHeader(204); return }
+		http.Redirect(w, r, "/schedule", 303)
+		return
+	}
+	snap := scrub.Snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(&snap)
+}
+
+// --- IMPORTACIÓN DE ÁRBOLES EXISTENTES ---
+
+// Lo que llega a la carpeta por fuera de Cerbero (scp, Samba, un disco
+// copiado) no tiene metadatos hasta que alguien lo lista o lo descarga.
+// backfillMetadata recorre un árbol y calcula el SHA-256 y el tipo MIME de
+// lo que no los tenga, para que la búsqueda, la verificación de integridad o
+// If-Match funcionen desde el principio. Se lanza con "cerbero index" (con
+// el servidor parado) o desde /schedule como trabajo "backfill" de la cola.
+
+type backfillResult struct {
+	Files  int   `json:"files"`
+	Hashed int   `json:"hashed"`
+	Typed  int   `json:"typed"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// backfillMetadata rellena los metadatos bajo start; progress se llama cada
+// cierto número de archivos (puede ser nil)
+func backfillMetadata(ctx context.Context, start string, progress func(backfillResult)) (backfillResult, error) {
+	var res backfillResult
+	err := walkFiles(start, func(rel string, info os.FileInfo) {
+		if ctx.Err() != nil { return }
+		res.Files++
+		if _, ok := knownSHA256(rel, info); !ok {
+			if _, err := cachedSHA256(rel, info); err != nil { log.Printf("No se pudo leer %s: %v", rel, err); return }
+			res.Hashed++
+			res.Bytes += info.Size()
+		}
+		if fm, ok := meta.Get(rel); !ok || fm.MIME == "" {
+			fileMIME(rel)
+			res.Typed++
+		}
+		if opaqueIDs { fileID(rel) }
+		if isPhoto(rel) { photoTakenAt(rel, info) }
+		if fm, _ := meta.Get(rel); ffprobePath != "" && isVideo(rel) && fm.Duration == 0 { jobs.Enqueue("video", rel) }
+		if _, ok := hlsReady(rel, info); hlsEnabled() && isVideo(rel) && info.Size() >= hlsMinMB<<20 && !ok { jobs.Enqueue("hls", rel) }
+		// Se guarda de vez en cuando para no perderlo todo si se interrumpe
+		if res.Files%500 == 0 {
+			meta.Flush()
+			if progress != nil { progress(res) }
+		}
+	})
+	meta.Flush()
+	if err == nil { err = ctx.Err() }
+	return res, err
+}
+
+// backfillJob es el trabajo "backfill" de la cola; target es la carpeta
+func backfillJob(ctx context.Context, target string) error {
+	start, err := existingPath(target)
+	if err != nil { return err }
+	res, err := backfillMetadata(ctx, start, nil)
+	log.Printf("Importación de %s: %d archivos, %d con hash nuevo (%s), %d con tipo nuevo", relPath(start), res.Files, res.Hashed, humanSize(res.Bytes), res.Typed)
+	if res.Hashed > 0 || res.Typed > 0 { contentChanged() }
+	return err
+}
+
+// backfillHandler es POST /backfill[?dir=...]: encola la importación
+func backfillHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	dir, err := existingPath(r.FormValue("dir"))
+	if err != nil { pathError(w, err); return }
+	j := jobs.Enqueue("backfill", relPath(dir))
+	audit(r, "backfill", map[string]string{"dir": relPath(dir), "job": j.ID})
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(j)
+		return
+	}
+	http.Redirect(w, r, "/schedule", 303)
+}
+
+// runIndex es "cerbero index": la misma importación sin servidor
+func runIndex(args []string) error {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	root := fs.String("root", "./shared", "Carpeta raíz del servidor")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Uso: cerbero index [-root carpeta] [subcarpeta]")
+		fmt.Fprintln(fs.Output(), "Calcula el SHA-256 y el tipo de los archivos que no los tienen. Ejecútalo con el servidor")
+		fmt.Fprintln(fs.Output(), "parado; con él en marcha usa \"Importar archivos existentes\" en /schedule.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := useRoot(*root); err != nil { return err }
+	if err := os.MkdirAll(stateDir, 0700); err != nil { return err }
+	meta.load(filepath.Join(stateDir, "meta.json"))
+	start, err := existingPath(fs.Arg(0))
+	if err != nil { return fmt.Errorf("%s: %v", fs.Arg(0), err) }
+	began := time.Now()
+	res, err := backfillMetadata(context.Background(), start, func(p backfillResult) {
+		fmt.Fprintf(os.Stderr, "\r%d archivos, %s leídos", p.Files, humanSize(p.Bytes))
+	})
+	if err != nil { return err }
+	fmt.Fprintf(os.Stderr, "\r%d archivos en %s: %d con hash nuevo (%s), %d con tipo nuevo\n", res.Files, time.Since(began).Round(time.Second), res.Hashed, humanSize(res.Bytes), res.Typed)
+	return nil
+}
+
+// --- MIGRACIÓN (EXPORTAR E IMPORTAR EL ESTADO) ---
+
+// "cerbero export" guarda en un ZIP todo lo que hay en .cerbero salvo cachés,
+// papelera e instantáneas: metadatos, enlaces compartidos, solicitudes,
+// claves de API, permisos, cuotas, la clave de sesión y los argumentos con
+// los que arrancó el servidor. "cerbero import" lo deja en la raíz de la
+// máquina nueva; como las rutas se guardan relativas a -root, basta con
+// copiar también los archivos (rsync) para que los enlaces sigan funcionando.
+
+const exportManifestName = "cerbero-export.json"
+
+type exportFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type exportManifest struct {
+	Version  int          `json:"version"`
+	Created  time.Time    `json:"created"`
+	Hostname string       `json:"hostname,omitempty"`
+	Root     string       `json:"root"`
+	Args     []string     `json:"args,omitempty"`
+	Files    []exportFile `json:"files"`
+}
+
+// serverArgs guarda los argumentos con que arranca el servidor, para que la
+// exportación lleve también la configuración
+type serverArgs struct {
+	Args    []string  `json:"args"`
+	Started time.Time `json:"started"`
+}
+
+func recordServerArgs() {
+	writeJSONAtomic(filepath.Join(stateDir, "args.json"), serverArgs{Args: os.Args[1:], Started: time.Now()})
+}
+
+// exportable indica si un fichero de .cerbero forma parte del estado: las
+// carpetas (papelera, vistas previas, cuarentena, instantáneas) y los
+// temporales se quedan fuera
+func exportable(e os.DirEntry) bool {
+	name := e.Name()
+	return e.Type().IsRegular() && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".tmp")
+}
+
+// validExportName evita que una entrada del ZIP escriba fuera de .cerbero
+func validExportName(name string) bool {
+	return name != "" && name != exportManifestName && path.Base(name) == name && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, ".tmp") && !strings.ContainsAny(name, `/\`)
+}
+
+// useRoot prepara rootDir y stateDir para los subcomandos sin servidor
+func useRoot(root string) error {
+	abs, err := filepath.Abs(root)
+	if err != nil { return err }
+	rootDir = abs
+	if realRoot, err = filepath.EvalSymlinks(rootDir); err != nil { return fmt.Errorf("no se puede usar %s: %v", rootDir, err) }
+	stateDir = filepath.Join(rootDir, stateDirName)
+	return nil
+}
+
+// runExport es "cerbero export": funciona con el servidor en marcha porque
+// cada fichero se reemplaza de forma atómica al guardarse
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	root := fs.String("root", "./shared", "Carpeta raíz del servidor")
+	out := fs.String("o", "", "Archivo de salida (- = salida estándar; por defecto cerbero-export-FECHA.zip)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Uso: cerbero export [-root carpeta] [-o archivo.zip]")
+		fmt.Fprintln(fs.Output(), "Guarda la configuración, los metadatos y los enlaces compartidos para llevarlos a otra máquina.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := useRoot(*root); err != nil { return err }
+	entries, err := os.ReadDir(stateDir)
+	if err != nil { return fmt.Errorf("%s no tiene estado que exportar: %v", rootDir, err) }
+
+	m := exportManifest{Version: 1, Created: time.Now().UTC(), Root: rootDir}
+	m.Hostname, _ = os.Hostname()
+	if data, err := os.ReadFile(filepath.Join(stateDir, "args.json")); err == nil {
+		var a serverArgs
+		if json.Unmarshal(data, &a) == nil { m.Args = a.Args }
+	}
+	// Se lee todo antes de escribir para que el manifiesto vaya primero y
+	// cada fichero sea una copia coherente aunque el servidor lo reescriba
+	contents := make(map[string][]byte)
+	for _, e := range entries {
+		if !exportable(e) { continue }
+		data, err := os.ReadFile(filepath.Join(stateDir, e.Name()))
+		if err != nil { return err }
+		sum := sha256.Sum256(data)
+		contents[e.Name()] = data
+		m.Files = append(m.Files, exportFile{Name: e.Name(), Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+	}
+	if len(m.Files) == 0 { return fmt.Errorf("%s no tiene estado que exportar", stateDir) }
+
+	name := *out
+	if name == "" { name = "cerbero-export-" + time.Now().Format("20060102-150405") + ".zip" }
+	var dst io.Writer = os.Stdout
+	var f *os.File
+	if name != "-" {
+		if f, err = os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil { return err }
+		defer os.Remove(name + ".tmp")
+		defer f.Close()
+		dst = f
+	}
+	zw := zip.NewWriter(dst)
+	manifest, _ := json.MarshalIndent(m, "", "  ")
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: exportManifestName, Method: zip.Deflate, Modified: m.Created})
+	if err != nil { return err }
+	if _, err := w.Write(manifest); err != nil { return err }
+	for _, file := range m.Files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: file.Name, Method: zip.Deflate, Modified: m.Created})
+		if err != nil { return err }
+		if _, err := w.Write(contents[file.Name]); err != nil { return err }
+	}
+	if err := zw.Close(); err != nil { return err }
+	if f != nil {
+		if err := f.Close(); err != nil { return err }
+		if err := os.Rename(name+".tmp", name); err != nil { return err }
+		fmt.Fprintf(os.Stderr, "%d ficheros de estado exportados a %s\n", len(m.Files), name)
+	}
+	return nil
+}
+
+// runImport es "cerbero import": se ejecuta con el servidor parado
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	root := fs.String("root", "./shared", "Carpeta raíz del servidor nuevo")
+	force := fs.Bool("force", false, "Reemplazar el estado que ya exista (se aparta a .cerbero/pre-import-FECHA)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Uso: cerbero import [-root carpeta] [-force] archivo.zip")
+		fmt.Fprintln(fs.Output(), "Restaura lo guardado con \"cerbero export\". Ejecútalo con el servidor parado.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 { fs.Usage(); return errors.New("falta el archivo de exportación") }
+	zr, err := zip.OpenReader(fs.Arg(0))
+	if err != nil { return err }
+	defer zr.Close()
+
+	var m exportManifest
+	files := make(map[string]*zip.File)
+	for _, zf := range zr.File {
+		if zf.Name == exportManifestName {
+			rc, err := zf.Open()
+			if err != nil { return err }
+			err = json.NewDecoder(io.LimitReader(rc, 1<<20)).Decode(&m)
+			rc.Close()
+			if err != nil { return fmt.Errorf("manifiesto dañado: %v", err) }
+			continue
+		}
+		if !validExportName(zf.Name) { return fmt.Errorf("entrada no válida en la exportación: %q", zf.Name) }
+		files[zf.Name] = zf
+	}
+	if m.Version == 0 { return fmt.Errorf("%s no es una exportación de Cerbero", fs.Arg(0)) }
+	if m.Version > 1 { return fmt.Errorf("exportación de una versión más nueva (%d)", m.Version) }
+	// Todo se lee y se comprueba antes de tocar nada
+	contents := make(map[string][]byte)
+	for _, file := range m.Files {
+		zf := files[file.Name]
+		if zf == nil { return fmt.Errorf("falta %s en la exportación", file.Name) }
+		rc, err := zf.Open()
+		if err != nil { return err }
+		data, err := io.ReadAll(io.LimitReader(rc, file.Size+1))
+		rc.Close()
+		if err != nil { return fmt.Errorf("%s: %v", file.Name, err) }
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != file.Size || hex.EncodeToString(sum[:]) != file.SHA256 { return fmt.Errorf("%s no coincide con el manifiesto", file.Name) }
+		contents[file.Name] = data
+	}
+
+	if err := os.MkdirAll(*root, 0755); err != nil { return err }
+	if err := useRoot(*root); err != nil { return err }
+	if err := os.MkdirAll(stateDir, 0700); err != nil { return err }
+	var existing []string
+	entries, _ := os.ReadDir(stateDir)
+	for _, e := range entries {
+		if exportable(e) && e.Name() != "session.key" && e.Name() != "args.json" { existing = append(existing, e.Name()) }
+	}
+	if len(existing) > 0 && !*force { return fmt.Errorf("%s ya tiene estado (%s); usa -force para reemplazarlo", stateDir, strings.Join(existing, ", ")) }
+	if len(existing) > 0 {
+		aside := filepath.Join(stateDir, "pre-import-"+time.Now().Format("20060102-150405"))
+		if err := os.Mkdir(aside, 0700); err != nil { return err }
+		for _, e := range entries {
+			if !exportable(e) { continue }
+			if err := os.Rename(filepath.Join(stateDir, e.Name()), filepath.Join(aside, e.Name())); err != nil { return err }
+		}
+		fmt.Fprintf(os.Stderr, "Estado anterior apartado en %s\n", aside)
+	}
+	for _, file := range m.Files {
+		p := filepath.Join(stateDir, file.Name)
+		if err := os.WriteFile(p+".tmp", contents[file.Name], 0600); err != nil { return err }
+		if err := os.Rename(p+".tmp", p); err != nil { return err }
+	}
+	from := m.Root
+	if m.Hostname != "" { from = m.Hostname + ":" + m.Root }
+	fmt.Fprintf(os.Stderr, "%d ficheros de estado importados en %s (exportados de %s el %s)\n", len(m.Files), stateDir, from, m.Created.Local().Format("2006-01-02 15:04"))
+
+	// Los enlaces solo funcionan si los archivos están en la misma ruta
+	// relativa; se avisa de los que aún faltan
+	localShares.load(filepath.Join(stateDir, "shares.json"))
+	missing := 0
+	for _, sh := range localShares.shares {
+		if _, err := os.Stat(absPath(sh.Path)); err != nil { missing++ }
+	}
+	if missing > 0 {
+		fmt.Fprintf(os.Stderr, "%d de %d enlaces compartidos apuntan a archivos que aún no están en %s: copia los datos (rsync -a %s/ %s/) o arranca con los mismos -share\n", missing, len(localShares.shares), rootDir, m.Root, rootDir)
+	}
+	if len(m.Args) > 0 {
+		quoted := make([]string, len(m.Args))
+		for i, a := range m.Args {
+			quoted[i] = a
+			if a == "" || strings.ContainsAny(a, " \t\"'$;&|") { quoted[i] = strconv.Quote(a) }
+		}
+		fmt.Fprintf(os.Stderr, "El servidor original arrancaba con:\n  cerbero %s\nRevisa las rutas (-root, -share, certificados) antes de usarlo aquí.\n", strings.Join(quoted, " "))
+	}
+	return nil
+}
+
+// --- REDIS (VARIAS RÉPLICAS) ---
+
+// Con -redis varias réplicas detrás de un balanceador comparten lo que, con
+// una sola instancia, vive en memoria: las cubetas de los límites de
+// peticiones, los enlaces de descarga limitados (con sus contadores) y la
+// clave que firma las sesiones. Sin -redis todo sigue como siempre. El
+// cliente habla RESP directamente y solo usa lo imprescindible: scripts Lua
+// para que cada operación sea atómica entre réplicas.
+
+// redisConn es una conexión con su lector
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type redisClient struct {
+	addr     string
+	useTLS   bool
+	password string
+	db       string
+	pool     chan *redisConn
+}
+
+var errRedisDown = errors.New("Redis no responde")
+
+var redis *redisClient
+
+// newRedisClient interpreta redis://[:clave@]host[:puerto][/bd] (rediss:// con TLS)
+func newRedisClient(raw string) (*redisClient, error) {
+	u, err := url.Parse(raw)
+	if err != nil { return nil, err }
+	if u.Scheme != "redis" && u.Scheme != "rediss" { return nil, fmt.Errorf("se esperaba redis:// o rediss://, no %q", u.Scheme) }
+	c := &redisClient{addr: u.Host, useTLS: u.Scheme == "rediss", db: strings.Trim(u.Path, "/"), pool: make(chan *redisConn, 8)}
+	if u.Port() == "" { c.addr = net.JoinHostPort(u.Hostname(), "6379") }
+	if u.User != nil { c.password, _ = u.User.Password() }
+	if c.db != "" {
+		if _, err := strconv.Atoi(c.db); err != nil { return nil, fmt.Errorf("base de datos no válida: %q", c.db) }
+	}
+	return c, nil
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	d := &net.Dialer{Timeout: 3 * time.Second}
+	var conn net.Conn
+	var err error
+	if c.useTLS {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn, err = tls.DialWithDialer(d, "tcp", c.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = d.Dial("tcp", c.addr)
+	}
+	if err != nil { return nil, err }
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if c.password != "" {
+		if _, err := rc.do("AUTH", c.password); err != nil { conn.Close(); return nil, err }
+	}
+	if c.db != "" {
+		if _, err := rc.do("SELECT", c.db); err != nil { conn.Close(); return nil, err }
+	}
+	return rc, nil
+}
+
+// do envía una orden y lee la respuesta: string, int64, nil, []any o un
+// error si Redis contestó con uno
+func (rc *redisConn) do(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args { fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a) }
+	rc.conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := io.WriteString(rc.conn, b.String()); err != nil { return nil, err }
+	return rc.read()
+}
+
+// redisReplyError es un "-ERR ..." de Redis: la conexión sigue sirviendo
+type redisReplyError string
+
+func (e redisReplyError) Error() string { return string(e) }
+
+func (rc *redisConn) read() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil { return nil, err }
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") { return nil, errors.New("respuesta RESP mal formada") }
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisReplyError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 || n > 64<<20 { return nil, errors.New("longitud RESP no válida") }
+		if n == -1 { return nil, nil }
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil { return nil, err }
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < -1 || n > 1<<20 { return nil, errors.New("longitud RESP no válida") }
+		if n == -1 { return nil, nil }
+		list := make([]any, n)
+		for i := range list {
+			if list[i], err = rc.read(); err != nil {
+				if _, ok := err.(redisReplyError); !ok { return nil, err }
+				list[i] = err
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("tipo RESP desconocido %q", kind)
+}
+
+// Do ejecuta una orden con una conexión del pool. Un fallo de red descarta
+// la conexión y se devuelve envuelto en errRedisDown
+func (c *redisClient) Do(args ...string) (any, error) {
+	var rc *redisConn
+	select {
+	case rc = <-c.pool:
+	default:
+		var err error
+		if rc, err = c.dial(); err != nil { return nil, fmt.Errorf("%w: %v", errRedisDown, err) }
+	}
+	v, err := rc.do(args...)
+	if err != nil {
+		if _, ok := err.(redisReplyError); ok {
+			c.put(rc)
+			return nil, err
+		}
+		rc.conn.Close()
+		return nil, fmt.Errorf("%w: %v", errRedisDown, err)
+	}
+	c.put(rc)
+	return v, nil
+}
+
+func (c *redisClient) put(rc *redisConn) {
+	select {
+	case c.pool <- rc:
+	default:
+		rc.conn.Close()
+	}
+}
+
+// redisScript ejecuta un script Lua por su SHA1 y solo lo envía entero la
+// primera vez (o si Redis se reinició y lo olvidó)
+type redisScript struct {
+	src string
+	sha string
+}
+
+func newRedisScript(src string) *redisScript {
+	sum := sha1.Sum([]byte(src))
+	return &redisScript{src: src, sha: hex.EncodeToString(sum[:])}
+}
+
+func (s *redisScript) Run(c *redisClient, keys []string, args ...string) (any, error) {
+	call := append([]string{"EVALSHA", s.sha, strconv.Itoa(len(keys))}, keys...)
+	v, err := c.Do(append(call, args...)...)
+	if e, ok := err.(redisReplyError); ok && strings.HasPrefix(string(e), "NOSCRIPT") {
+		call[0], call[1] = "EVAL", s.src
+		v, err = c.Do(append(call, args...)...)
+	}
+	return v, err
+}
+
+// redisKey antepone -redis-prefix, para que varias instalaciones (o los
+// clientes de "cerbero tenants") puedan compartir un mismo Redis
+func redisKey(parts ...string) string { return redisPrefix + strings.Join(parts, ":") }
+
+// shareSessionKey hace que todas las réplicas firmen las sesiones con la
+// misma clave: la primera en arrancar deja la suya y las demás la adoptan
+func shareSessionKey() error {
+	key := redisKey("session-key")
+	if _, err := redis.Do("SET", key, hex.EncodeToString(sessionKey), "NX"); err != nil { return err }
+	v, err := redis.Do("GET", key)
+	if err != nil { return err }
+	s, _ := v.(string)
+	shared, err := hex.DecodeString(s)
+	if err != nil || len(shared) < 32 { return fmt.Errorf("clave de sesión no válida en %s", key) }
+	sessionKey = shared
+	return nil
+}
+
+// --- Límites de peticiones en Redis ---
+
+// redisBucketScript es la misma cubeta de fichas de RateLimiter.refill
+var redisBucketScript = newRedisScript(`
+local b = redis.call('HMGET', KEYS[1], 't', 'l')
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local t = tonumber(b[1]) or burst
+local l = tonumber(b[2]) or now
+t = math.min(burst, t + math.max(0, now - l) * rate)
+local ok = t >= 1
+if ok and ARGV[4] == '1' then t = t - 1 end
+redis.call('HSET', KEYS[1], 't', tostring(t), 'l', ARGV[3])
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+if ok then return 1 end
+return 0`)
+
+type redisBuckets struct{}
+
+func (redisBuckets) Take(key string, rule rateRule, spend bool) (bool, error) {
+	now := strconv.FormatFloat(float64(time.Now().UnixMicro())/1e6, 'f', 6, 64)
+	spendArg := "0"
+	if spend { spendArg = "1" }
+	v, err := redisBucketScript.Run(redis, []string{redisKey("rate", key)},
+		strconv.FormatFloat(rule.perSecond, 'g', -1, 64), strconv.FormatFloat(rule.burst, 'g', -1, 64), now, spendArg)
+	if err != nil { return false, err }
+	return v == int64(1), nil
+}
+
+// --- Enlaces de descarga en Redis ---
+
+// Cada enlace es un hash share:{token} con los datos en JSON, el máximo y las
+// descargas hechas; las descargas en curso van en un conjunto ordenado con
+// caducidad, para que una réplica que cae a mitad no deje el enlace
+// bloqueado. El conjunto "shares" permite recorrerlos al mover o borrar.
+type RedisShares struct {
+	mu      sync.Mutex
+	pending map[string][]string // reservas de esta réplica, por token
+}
+
+const redisShareHold = 6 * time.Hour
+
+var redisShareAcquire = newRedisScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then return false end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+local d = tonumber(redis.call('HGET', KEYS[1], 'downloads'))
+local data = redis.call('HGET', KEYS[1], 'data')
+if d + redis.call('ZCARD', KEYS[2]) >= tonumber(redis.call('HGET', KEYS[1], 'max')) then return {0, data, d} end
+if ARGV[3] ~= '' then
+  redis.call('ZADD', KEYS[2], ARGV[2], ARGV[3])
+  redis.call('PEXPIREAT', KEYS[2], ARGV[2])
+end
+return {1, data, d}`)
+
+var redisShareComplete = newRedisScript(`
+redis.call('ZREM', KEYS[2], ARGV[1])
+if ARGV[2] ~= '1' or redis.call('EXISTS', KEYS[1]) == 0 then return false end
+local d = redis.call('HINCRBY', KEYS[1], 'downloads', 1)
+if d < tonumber(redis.call('HGET', KEYS[1], 'max')) then return false end
+local data = redis.call('HGET', KEYS[1], 'data')
+redis.call('DEL', KEYS[1], KEYS[2])
+redis.call('SREM', KEYS[3], ARGV[3])
+return data`)
+
+func redisShareKeys(token string) []string {
+	return []string{redisKey("share", token), redisKey("share", token, "pending"), redisKey("shares")}
+}
+
+func (s *RedisShares) store(sh Share) error {
+	data, err := json.Marshal(sh)
+	if err != nil { return err }
+	keys := redisShareKeys(sh.Token)
+	if _, err := redis.Do("HSET", keys[0], "data", string(data), "max", strconv.Itoa(sh.MaxDownloads), "downloads", strconv.Itoa(sh.Downloads)); err != nil { return err }
+	_, err = redis.Do("SADD", keys[2], sh.Token)
+	return err
+}
+
+func (s *RedisShares) Create(sh Share) (Share, error) {
+	sh.Token = randomToken(18)
+	sh.Created = time.Now()
+	return sh, s.store(sh)
+}
+
+// reserve es Acquire (con member) o Peek (sin él)
+func (s *RedisShares) reserve(token, member string) (Share, error) {
+	now := time.Now()
+	v, err := redisShareAcquire.Run(redis, redisShareKeys(token)[:2], strconv.FormatInt(now.UnixMilli(), 10), strconv.FormatInt(now.Add(redisShareHold).UnixMilli(), 10), member)
+	if err != nil { return Share{}, err }
+	reply, ok := v.([]any)
+	if !ok || len(reply) != 3 { return Share{}, errNotFound }
+	var sh Share
+	data, _ := reply[1].(string)
+	if err := json.Unmarshal([]byte(data), &sh); err != nil { return Share{}, err }
+	downloads, _ := reply[2].(int64)
+	sh.Downloads = int(downloads)
+	if reply[0] != int64(1) { return sh, errShareGone }
+	return sh, nil
+}
+
+func (s *RedisShares) Acquire(token string) (Share, error) {
+	member := randomToken(12)
+	sh, err := s.reserve(token, member)
+	if err != nil { return sh, err }
+	s.mu.Lock()
+	s.pending[token] = append(s.pending[token], member)
+	s.mu.Unlock()
+	return sh, nil
+}
+
+func (s *RedisShares) Peek(token string) (Share, error) { return s.reserve(token, "") }
+
+func (s *RedisShares) Complete(token string, ok bool) {
+	s.mu.Lock()
+	members := s.pending[token]
+	if len(members) == 0 { s.mu.Unlock(); return }
+	member := members[0]
+	if s.pending[token] = members[1:]; len(s.pending[token]) == 0 { delete(s.pending, token) }
+	s.mu.Unlock()
+	okArg := "0"
+	if ok { okArg = "1" }
+	v, err := redisShareComplete.Run(redis, redisShareKeys(token), member, okArg, token)
+	if err != nil { log.Printf("Error guardando enlaces: %v", err); return }
+	// Solo la réplica que sirvió la última descarga recibe los datos
+	data, _ := v.(string)
+	var sh Share
+	if data == "" || json.Unmarshal([]byte(data), &sh) != nil || !sh.Burn { return }
+	abs, err := existingPath(sh.Path)
+	if err == nil {
+		if err := os.Remove(abs); err != nil { log.Printf("No se pudo borrar %s tras descargarlo: %v", sh.Path, err) }
+		pins.Forget(sh.Path)
+		meta.Delete(sh.Path)
+		postDeleteHook(sh.Path, "enlace")
+	}
+	s.Forget(sh.Path)
+	log.Printf("Archivo autodestruido tras su descarga: %s", sh.Path)
+}
+
+// each recorre los enlaces guardados; fn devuelve el enlace cambiado, o nil
+// para borrarlo, y ok=false para dejarlo como está
+func (s *RedisShares) each(fn func(sh Share) (*Share, bool)) {
+	v, err := redis.Do("SMEMBERS", redisKey("shares"))
+	if err != nil { log.Printf("Error leyendo enlaces: %v", err); return }
+	tokens, _ := v.([]any)
+	for _, t := range tokens {
+		token, _ := t.(string)
+		keys := redisShareKeys(token)
+		v, err := redis.Do("HGET", keys[0], "data")
+		if err != nil { log.Printf("Error leyendo enlaces: %v", err); return }
+		var sh Share
+		data, _ := v.(string)
+		if data == "" {
+			redis.Do("SREM", keys[2], token)
+			continue
+		}
+		if json.Unmarshal([]byte(data), &sh) != nil { continue }
+		changed, ok := fn(sh)
+		if !ok { continue }
+		if changed == nil {
+			redis.Do("DEL", keys[0], keys[1])
+			redis.Do("SREM", keys[2], token)
+			continue
+		}
+		if data, err := json.Marshal(changed); err == nil { redis.Do("HSET", keys[0], "data", string(data)) }
+	}
+}
+
+func (s *RedisShares) Rename(old, new string) {
+	s.each(func(sh Share) (*Share, bool) {
+		rest, ok := underPath(sh.Path, old)
+		if !ok { return nil, false }
+		sh.Path = new + rest
+		return &sh, true
+	})
+}
+
+func (s *RedisShares) Forget(name string) {
+	s.each(func(sh Share) (*Share, bool) { return nil, sh.Path == name })
+}
+
+// adopt sube a Redis los enlaces de shares.json la primera vez que se usa
+// -redis, para que el cambio no invalide los ya enviados. Solo una vez: desde
+// entonces shares.json no se actualiza y traería enlaces ya agotados
+func (s *RedisShares) adopt(local *ShareStore) error {
+	first, err := redis.Do("SET", redisKey("shares-adopted"), time.Now().UTC().Format(time.RFC3339), "NX")
+	if err != nil || first == nil { return err }
+	local.mu.Lock()
+	list := make([]Share, 0, len(local.shares))
+	for _, sh := range local.shares { list = append(list, *sh) }
+	local.mu.Unlock()
+	adopted := 0
+	for _, sh := range list {
+		v, err := redis.Do("EXISTS", redisShareKeys(sh.Token)[0])
+		if err != nil { return err }
+		if v == int64(1) { continue }
+		if err := s.store(sh); err != nil { return err }
+		adopted++
+	}
+	if adopted > 0 { log.Printf("%d enlaces de shares.json copiados a Redis", adopted) }
+	return nil
+}
+
+// setupRedis conecta con -redis y pasa a él los límites, los enlaces y la
+// clave de sesión
+func setupRedis() error {
+	var err error
+	if redis, err = newRedisClient(redisURL); err != nil { return err }
+	if _, err := redis.Do("PING"); err != nil { return err }
+	if err := shareSessionKey(); err != nil { return err }
+	remote := &RedisShares{pending: make(map[string][]string)}
+	if err := remote.adopt(&localShares); err != nil { return err }
+	shares = remote
+	limiter.shared = redisBuckets{}
+	log.Printf("Límites, enlaces y sesiones compartidos en Redis (%s)", redis.addr)
+	return nil
+}
+
+// --- LÍMITE DE PETICIONES ---
+
+// Cada clase de ruta tiene su cubeta de fichas por IP: se rellena a un ritmo
+// fijo hasta un máximo (ráfaga) y cada petición gasta una. "upload" cubre las
+// subidas, "auth" los intentos de login y de clave fallidos, y "download" las
+// descargas, con un margen mucho mayor.
+type rateRule struct {
+	perSecond float64
+	burst     float64
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type RateLimiter struct {
+	mu      sync.Mutex
+	rules   map[string]rateRule
+	buckets map[string]map[string]*rateBucket
+	allowed map[string]uint64
+	limited map[string]uint64
+	swept   uint64
+	shared  bucketStore // nil = las cubetas de buckets, en memoria
+	warned  time.Time
+}
+
+// bucketStore guarda las cubetas fuera del proceso para que varias réplicas
+// compartan los límites
+type bucketStore interface {
+	// Take rellena la cubeta de key según rule y, con spend, gasta una
+	// ficha; devuelve si quedaba alguna
+	Take(key string, rule rateRule, spend bool) (bool, error)
+}
+
+var limiter = RateLimiter{
+	rules:   make(map[string]rateRule),
+	buckets: make(map[string]map[string]*rateBucket),
+	allowed: make(map[string]uint64),
+	limited: make(map[string]uint64),
+}
+
+const defaultRateLimits = "upload=1/s,auth=10/m:5,download=20/s:40"
+
+// Configure lee -rate-limits: "clase=eventos/periodo[:ráfaga]" separados por
+// comas, con periodo s, m o h; "clase=0" quita el límite de esa clase
+func (l *RateLimiter) Configure(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item == "" { continue }
+		class, value, ok := strings.Cut(item, "=")
+		if !ok { return fmt.Errorf("falta '=' en %q", item) }
+		if class != "upload" && class != "auth" && class != "download" { return fmt.Errorf("clase desconocida %q (upload, auth, download)", class) }
+		if value == "0" { delete(l.rules, class); continue }
+		value, burstText, hasBurst := strings.Cut(value, ":")
+		countText, unit, _ := strings.Cut(value, "/")
+		count, err := strconv.ParseFloat(countText, 64)
+		if err != nil || count <= 0 { return fmt.Errorf("ritmo no válido en %q", item) }
+		period := map[string]float64{"s": 1, "": 1, "m": 60, "h": 3600}
+		secs, ok := period[unit]
+		if !ok { return fmt.Errorf("periodo no válido en %q (s, m, h)", item) }
+		rule := rateRule{perSecond: count / secs, burst: 1}
+		if hasBurst {
+			if rule.burst, err = strconv.ParseFloat(burstText, 64); err != nil || rule.burst < 1 { return fmt.Errorf("ráfaga no válida en %q", item) }
+		}
+		l.rules[class] = rule
+	}
+	return nil
+}
+
+// refill devuelve la cubeta de ip en class al día; se llama con l.mu tomado
+func (l *RateLimiter) refill(class, ip string, rule rateRule, now time.Time) *rateBucket {
+	if l.buckets[class] == nil { l.buckets[class] = make(map[string]*rateBucket) }
+	b := l.buckets[class][ip]
+	if b == nil {
+		b = &rateBucket{tokens: rule.burst, last: now}
+		l.buckets[class][ip] = b
+	}
+	b.tokens = min(rule.burst, b.tokens+now.Sub(b.last).Seconds()*rule.perSecond)
+	b.last = now
+	return b
+}
+
+// takeShared consulta las cubetas compartidas; done=false si no las hay o no
+// responden, y entonces se usan las de memoria
+func (l *RateLimiter) takeShared(class, ip string, spend bool) (ok, done bool) {
+	l.mu.Lock()
+	rule, limited := l.rules[class]
+	shared := l.shared
+	l.mu.Unlock()
+	if shared == nil || !limited { return false, false }
+	ok, err := shared.Take(class+":"+ip, rule, spend)
+	if err != nil {
+		l.mu.Lock()
+		if time.Since(l.warned) > time.Minute {
+			l.warned = time.Now()
+			log.Printf("Límites de peticiones en memoria mientras falle Redis: %v", err)
+		}
+		l.mu.Unlock()
+		return false, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !ok { l.limited[class]++ } else if spend { l.allowed[class]++ }
+	return ok, true
+}
+
+// Allow gasta una ficha de ip en class; false si no le quedan
+func (l *RateLimiter) Allow(class, ip string) bool {
+	if ok, done := l.takeShared(class, ip, true); done { return ok }
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rule, ok := l.rules[class]
+	if !ok { l.allowed[class]++; return true }
+	b := l.refill(class, ip, rule, time.Now())
+	if b.tokens < 1 { l.limited[class]++; return false }
+	b.tokens--
+	l.allowed[class]++
+	return true
+}
+
+// Exhausted dice si ip no tiene fichas en class, sin gastar ninguna
+func (l *RateLimiter) Exhausted(class, ip string) bool {
+	if ok, done := l.takeShared(class, ip, false); done { return !ok }
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rule, ok := l.rules[class]
+	if !ok { return false }
+	if l.refill(class, ip, rule, time.Now()).tokens >= 1 { return false }
+	l.limited[class]++
+	return true
+}
+
+// sweep borra las cubetas que ya se han rellenado del todo: son iguales que
+// una nueva, así que olvidarlas no cambia nada y el mapa no crece sin fin
+func (l *RateLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for class, ips := range l.buckets {
+		rule, ok := l.rules[class]
+		for ip, b := range ips {
+			if !ok || b.tokens+now.Sub(b.last).Seconds()*rule.perSecond >= rule.burst {
+				delete(ips, ip)
+				l.swept++
+			}
+		}
+	}
+}
+
+func rateLimitSweeper() {
+	for range time.Tick(time.Minute) { limiter.sweep() }
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil { return r.RemoteAddr }
+	// Detrás del supervisor de "cerbero tenants" todas las conexiones llegan
+	// de 127.0.0.1; la IP real la pone él en X-Forwarded-For
+	if tenantName != "" && net.ParseIP(host).IsLoopback() {
+		fwd := r.Header.Get("X-Forwarded-For")
+		if i := strings.LastIndex(fwd, ","); i >= 0 { fwd = fwd[i+1:] }
+		if ip := net.ParseIP(strings.TrimSpace(fwd)); ip != nil { return ip.String() }
+	}
+	return host
+}
+
+// rateLimited aplica la clase a la petición y, si se pasa, responde 429
+func rateLimited(w http.ResponseWriter, r *http.Request, class string) bool {
+	if limiter.Allow(class, clientIP(r)) { return false }
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Límite excedido", 429)
+	return true
+}
+
+// metricsHandler publica los contadores en formato de texto de Prometheus
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) { w.Header().Set("WWW-Authenticate", `Basic realm="cerbero"`); http.Error(w, "Clave errónea", 401); return }
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	classes := []string{"auth", "download", "upload"}
+	fmt.Fprintln(w, "# HELP cerbero_ratelimit_requests_total Peticiones que pasaron por el limitador, por clase y resultado.")
+	fmt.Fprintln(w, "# TYPE cerbero_ratelimit_requests_total counter")
+	for _, c := range classes {
+		fmt.Fprintf(w, "cerbero_ratelimit_requests_total{class=%q,result=\"allowed\"} %d\n", c, limiter.allowed[c])
+		fmt.Fprintf(w, "cerbero_ratelimit_requests_total{class=%q,result=\"limited\"} %d\n", c, limiter.limited[c])
+	}
+	fmt.Fprintln(w, "# HELP cerbero_ratelimit_clients IPs con cubeta activa, por clase.")
+	fmt.Fprintln(w, "# TYPE cerbero_ratelimit_clients gauge")
+	for _, c := range classes { fmt.Fprintf(w, "cerbero_ratelimit_clients{class=%q} %d\n", c, len(limiter.buckets[c])) }
+	fmt.Fprintln(w, "# HELP cerbero_ratelimit_rate Fichas por segundo de cada clase (0 = sin límite).")
+	fmt.Fprintln(w, "# TYPE cerbero_ratelimit_rate gauge")
+	for _, c := range classes { fmt.Fprintf(w, "cerbero_ratelimit_rate{class=%q} %g\n", c, limiter.rules[c].perSecond) }
+	fmt.Fprintln(w, "# HELP cerbero_ratelimit_burst Ráfaga máxima de cada clase.")
+	fmt.Fprintln(w, "# TYPE cerbero_ratelimit_burst gauge")
+	for _, c := range classes { fmt.Fprintf(w, "cerbero_ratelimit_burst{class=%q} %g\n", c, limiter.rules[c].burst) }
+	fmt.Fprintln(w, "# HELP cerbero_ratelimit_swept_total Cubetas inactivas recicladas por el barrido.")
+	fmt.Fprintln(w, "# TYPE cerbero_ratelimit_swept_total counter")
+	fmt.Fprintf(w, "cerbero_ratelimit_swept_total %d\n", limiter.swept)
+}
+
+// --- CUOTAS POR CLIENTE ---
+// Con -client-quota-mb cada usuario (o cada IP, si no hay sesión ni clave de
+// API) puede subir esa cantidad al día, aparte del espacio libre del disco. Lo
+// consumido se va olvidando poco a poco: cada hora se recupera 1/24 de la
+// cuota, sin esperar a medianoche. Los administradores identificados no
+// tienen cuota.
+
+const quotaPeriod = 24 * time.Hour
+
+var (
+	errQuotaExceeded = errors.New("cuota de subida agotada")
+	errQuotaTooLarge = errors.New("el archivo supera la cuota diaria")
+)
+
+type quotaUsage struct {
+	Used    float64   `json:"used"`
+	Updated time.Time `json:"updated"`
+}
+
+// QuotaStore guarda lo que ha subido cada cliente en .cerbero/quotas.json
+type QuotaStore struct {
+	path    string
+	clients map[string]*quotaUsage
+	pending bool
+	mu      sync.Mutex
+}
+
+var quotas = QuotaStore{clients: make(map[string]*quotaUsage)}
+
+func (q *QuotaStore) load(path string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &q.clients); err != nil {
+		log.Printf("Ignorando %s: %v", path, err)
+		q.clients = make(map[string]*quotaUsage)
+	}
+}
+
+// save guarda solo los clientes que aún deben algo; se llama con el mutex tomado
+func (q *QuotaStore) save() error {
+	now := time.Now()
+	for key := range q.clients {
+		if q.used(key, now) == 0 { delete(q.clients, key) }
+	}
+	return writeJSONAtomic(q.path, q.clients)
+}
+
+func quotaLimit() float64 { return float64(clientQuotaMB) * (1 << 20) }
+
+// quotaKey identifica al cliente; ok=false si la petición no tiene cuota
+func quotaKey(r *http.Request) (key string, ok bool) {
+	if clientQuotaMB <= 0 { return "", false }
+	user := currentUser(r)
+	if user == "" { return "ip:" + clientIP(r), true }
+	if authorized(r, roleAdmin) { return "", false }
+	return "user:" + user, true
+}
+
+// used devuelve lo consumido menos lo ya olvidado; se llama con el mutex tomado
+func (q *QuotaStore) used(key string, now time.Time) float64 {
+	u := q.clients[key]
+	if u == nil { return 0 }
+	return math.Max(0, u.Used-quotaLimit()*now.Sub(u.Updated).Seconds()/quotaPeriod.Seconds())
+}
+
+// Remaining devuelve los bytes que el cliente aún puede subir; -1 si no tiene cuota
+func (q *QuotaStore) Remaining(r *http.Request) int64 {
+	key, ok := quotaKey(r)
+	if !ok { return -1 }
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int64(quotaLimit() - q.used(key, time.Now()))
+}
+
+// Check comprueba que caben need bytes más (0 o -1 si no se conoce el tamaño).
+// Si no caben devuelve cuánto hay que esperar, o errQuotaTooLarge si no
+// cabrían nunca
+func (q *QuotaStore) Check(r *http.Request, need int64) (time.Duration, error) {
+	key, ok := quotaKey(r)
+	if !ok { return 0, nil }
+	if float64(need) > quotaLimit() { return 0, errQuotaTooLarge }
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	over := q.used(key, time.Now()) + float64(max(need, 1)) - quotaLimit()
+	if over <= 0 { return 0, nil }
+	return time.Duration(over / quotaLimit() * float64(quotaPeriod)), errQuotaExceeded
+}
+
+// Charge apunta n bytes subidos (también los de una subida que falló a medias)
+func (q *QuotaStore) Charge(r *http.Request, n int64) {
+	key, ok := quotaKey(r)
+	if !ok || n <= 0 { return }
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.clients[key] = &quotaUsage{Used: q.used(key, now) + float64(n), Updated: now}
+	if q.pending || q.path == "" { return }
+	q.pending = true
+	time.AfterFunc(5*time.Second, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.pending = false
+		if err := q.save(); err != nil { log.Printf("Error guardando las cuotas: %v", err) }
+	})
+}
+
+// Reader limita una subida de tamaño desconocido a lo que le queda al cliente
+func (q *QuotaStore) Reader(r *http.Request, src io.Reader) io.Reader {
+	left := q.Remaining(r)
+	if left < 0 { return src }
+	return &quotaReader{r: src, n: left}
+}
+
+type quotaReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *quotaReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 { return n, errQuotaExceeded }
+	return n, err
+}
+
+// quotaFail responde 413 si el archivo no cabe en la cuota o 429 con
+// Retry-After: lo que falta para que quepan need bytes
+func quotaFail(w http.ResponseWriter, r *http.Request, need int64, err error) {
+	if errors.Is(err, errQuotaTooLarge) {
+		failWith(w, "quota_too_large", fmt.Sprintf("El archivo supera la cuota diaria de %d MB", clientQuotaMB), 413)
+		return
+	}
+	retry, _ := quotas.Check(r, need)
+	retry = max(retry.Round(time.Second), time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.Seconds())))
+	failWith(w, "quota_exceeded", fmt.Sprintf("Cuota diaria de %d MB agotada; vuelve a intentarlo dentro de %s", clientQuotaMB, retry), 429)
+}
+
+// --- SALUD Y DISPONIBILIDAD ---
+
+// diskFree devuelve el espacio libre (para usuarios sin privilegios) y total
+func diskFree(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil { return 0, 0, err }
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
+
+var errDiskFull = errors.New("disco lleno")
+
+// checkFreeSpace comprueba que caben need bytes dejando libre la reserva -min-free-mb
+func checkFreeSpace(dir string, need int64) error {
+	free, _, err := diskFree(dir)
+	if err != nil { return nil }
+	if need < 0 { need = 0 }
+	if uint64(need)+uint64(minFreeMB)<<20 > free { return errDiskFull }
+	return nil
+}
+
+// diskGuardWriter vuelve a mirar el espacio libre cada 64 MB escritos, para
+// cortar una subida larga antes de agotar el disco, y traduce ENOSPC
+type diskGuardWriter struct {
+	w       io.Writer
+	dir     string
+	pending int64
+}
+
+func (g *diskGuardWriter) Write(p []byte) (int, error) {
+	g.pending += int64(len(p))
+	if g.pending >= 64<<20 {
+		g.pending = 0
+		if err := checkFreeSpace(g.dir, 0); err != nil { return 0, err }
+	}
+	n, err := g.w.Write(p)
+	if errors.Is(err, syscall.ENOSPC) { err = errDiskFull }
+	return n, err
+}
+
+// healthzHandler indica que el proceso responde (liveness) y el espacio libre
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	free, total, _ := diskFree(rootDir)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "disk_free": free, "disk_total": total})
+}
+
+// readyzHandler comprueba que se puede servir tráfico: carpeta escribible,
+// metadatos accesibles y espacio en disco por encima de -min-free-mb
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	ready := true
+	fail := func(name string, err error) {
+		checks[name] = err.Error()
+		ready = false
+	}
+
+	if f, err := os.CreateTemp(rootDir, ".cerbero-ready-*"); err != nil {
+		fail("root_writable", err)
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+		checks["root_writable"] = "ok"
+	}
+
+	meta.mu.Lock()
+	metaPath := meta.path
+	meta.mu.Unlock()
+	if _, err := os.Stat(metaPath); err != nil && !os.IsNotExist(err) {
+		fail("metadata", err)
+	} else if f, err := os.CreateTemp(stateDir, ".ready-*"); err != nil {
+		fail("metadata", err)
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+		checks["metadata"] = "ok"
+	}
+
+	free, total, err := diskFree(rootDir)
+	switch {
+	case err != nil:
+		fail("disk", err)
+	case free < uint64(minFreeMB)<<20:
+		fail("disk", fmt.Errorf("solo quedan %s libres", humanSize(int64(free))))
+	default:
+		checks["disk"] = "ok"
+	}
+
+	status, code := "ok", 200
+	if !ready { status, code = "unavailable", 503 }
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     status,
+		"checks":     checks,
+		"disk_free":  free,
+		"disk_total": total,
+	})
+}
+
+// --- TRAZAS (OpenTelemetry) ---
+
+// Trazador mínimo compatible con OTLP/HTTP en JSON: suficiente para ver en
+// Jaeger/Tempo cuánto tarda cada fase de una petición sin depender del SDK.
+// Sin -otlp-endpoint, startSpan devuelve nil y todas las operaciones son no-op.
+
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte
+	Name     string
+	Kind     int
+	Start    time.Time
+	Finish   time.Time
+	Attrs    map[string]interface{}
+	Err      string
+}
+
+type spanKey struct{}
+
+const (
+	spanInternal = 1
+	spanServer   = 2
+)
+
+var spanQueue chan *Span
+
+func tracingEnabled() bool { return otlpEndpoint != "" }
+
+// startSpan abre un span hijo del que haya en ctx (o la raíz de una traza nueva)
+func startSpan(ctx context.Context, name string) (context.Context, *Span) {
+	if !tracingEnabled() { return ctx, nil }
+	s := &Span{Name: name, Kind: spanInternal, Start: time.Now(), Attrs: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		rand.Read(s.TraceID[:])
+	}
+	rand.Read(s.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s != nil { s.Attrs[key] = value }
+}
+
+func (s *Span) SetError(err error) {
+	if s != nil && err != nil { s.Err = err.Error() }
+}
+
+// End cierra el span y lo encola para exportar; si la cola está llena se descarta
+func (s *Span) End() {
+	if s == nil { return }
+	s.Finish = time.Now()
+	select {
+	case spanQueue <- s:
+	default:
+	}
+}
+
+// parseTraceparent lee la cabecera W3C traceparent para continuar la traza del proxy
+func parseTraceparent(h string, s *Span) {
+	parts := strings.Split(h, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 { return }
+	tid, err1 := hex.DecodeString(parts[1])
+	pid, err2 := hex.DecodeString(parts[2])
+	if err1 != nil || err2 != nil { return }
+	copy(s.TraceID[:], tid)
+	copy(s.ParentID[:], pid)
+}
+
+// statusRecorder guarda el código de respuesta para el span de la petición
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter { return rec.ResponseWriter }
+
+// ReadFrom mantiene el camino de sendfile de net/http: sin él, envolver la
+// respuesta para las trazas obligaría a copiar cada descarga por espacio de usuario
+func (rec *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok { return rf.ReadFrom(src) }
+	return io.Copy(struct{ io.Writer }{rec.ResponseWriter}, src)
+}
+
+// tracing abre un span de servidor por petición
+func tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracingEnabled() { next.ServeHTTP(w, r); return }
+		ctx, span := startSpan(r.Context(), r.Method+" "+r.URL.Path)
+		span.Kind = spanServer
+		parseTraceparent(r.Header.Get("traceparent"), span)
+		span.SetAttr("http.method", r.Method)
+		span.SetAttr("http.target", r.URL.Path)
+		span.SetAttr("net.peer.ip", r.RemoteAddr)
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		span.SetAttr("http.status_code", rec.status)
+		if rec.status >= 500 { span.Err = http.StatusText(rec.status) }
+		span.End()
+	})
+}
+
+func otlpAttrs(attrs map[string]interface{}) []map[string]interface{} {
+	out := []map[string]interface{}{}
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch x := v.(type) {
+		case int:
+			value = map[string]interface{}{"intValue": fmt.Sprint(x)}
+		case int64:
+			value = map[string]interface{}{"intValue": fmt.Sprint(x)}
+		case bool:
+			value = map[string]interface{}{"boolValue": x}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+		}
+		out = append(out, map[string]interface{}{"key": k, "value": value})
+	}
+	return out
+}
+
+// exportSpans envía los spans en lotes cada 5 s (o al juntar 256)
+func exportSpans() {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(5 * time.Second)
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 { return }
+		var spans []map[string]interface{}
+		for _, s := range batch {
+			span := map[string]interface{}{
+				"traceId":           hex.EncodeToString(s.TraceID[:]),
+				"spanId":            hex.EncodeToString(s.SpanID[:]),
+				"name":              s.Name,
+				"kind":              s.Kind,
+				"startTimeUnixNano": fmt.Sprint(s.Start.UnixNano()),
+				"endTimeUnixNano":   fmt.Sprint(s.Finish.UnixNano()),
+				"attributes":        otlpAttrs(s.Attrs),
+			}
+			if s.ParentID != [8]byte{} { span["parentSpanId"] = hex.EncodeToString(s.ParentID[:]) }
+			if s.Err != "" { span["status"] = map[string]interface{}{"code": 2, "message": s.Err} }
+			spans = append(spans, span)
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"resourceSpans": []map[string]interface{}{{
+				"resource":   map[string]interface{}{"attributes": otlpAttrs(map[string]interface{}{"service.name": traceService})},
+				"scopeSpans": []map[string]interface{}{{"scope": map[string]string{"name": "cerbero-go"}, "spans": spans}},
+			}},
+		})
+		batch = batch[:0]
+		resp, err := client.Post(otlpEndpoint, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("OTLP: %v", err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 300 { log.Printf("OTLP: HTTP %d", resp.StatusCode) }
+	}
+	for {
+		select {
+		case s := <-spanQueue:
+			batch = append(batch, s)
+			if len(batch) >= 256 { flush() }
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// --- EDICIÓN DE TEXTO ---
+
+// Tamaño máximo de los archivos que se pueden editar en el navegador
+const maxEditBytes = 1 << 20
+
+// editMu serializa los guardados para que la comprobación de la fecha y el
+// reemplazo del archivo no se intercalen entre dos editores
+var editMu sync.Mutex
+
+// editable indica si un archivo se puede abrir en /edit
+func editable(mimeType string, size int64) bool {
+	if size > maxEditBytes { return false }
+	base, _, _ := strings.Cut(mimeType, ";")
+	switch base {
+	case "application/json", "application/yaml", "application/xml", "application/toml", "application/x-sh":
+		return true
+	}
+	return strings.HasPrefix(base, "text/")
+}
+
+var editTmpl *template.Template
+
+// editPage pinta el editor con el contenido indicado
+func editPage(w http.ResponseWriter, r *http.Request, abs, content string, mtime int64, status int, errMsg string) {
+	if status != 200 { w.WriteHeader(status) }
+	editTmpl.Execute(w, map[string]interface{}{
+		"Name":            relPath(abs),
+		"Content":         content,
+		"MTime":           mtime,
+		"Error":           errMsg,
+		"Saved":           r.URL.Query().Get("saved") != "",
+		"PasswordEnabled": password != "" && sessionFor(r) == nil,
+		"Back":            listingURL(filepath.Dir(abs)),
+	})
+}
+
+// editableFile resuelve la ruta y comprueba que se puede editar
+func editableFile(w http.ResponseWriter, r *http.Request) (string, os.FileInfo, bool) {
+	abs, err := existingPath(r.PathValue("path"))
+	if err != nil { pathError(w, err); return "", nil, false }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return "", nil, false }
+	if aclDenied(w, r, abs, aclRead) { return "", nil, false }
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() { http.Error(w, "No encontrado", 404); return "", nil, false }
+	if !editable(fileMIME(relPath(abs)), info.Size()) { http.Error(w, "Este archivo no se puede editar aquí", 415); return "", nil, false }
+	return abs, info, true
+}
+
+func editHandler(w http.ResponseWriter, r *http.Request) {
+	if opaqueDenied(w, r) { return }
+	abs, info, ok := editableFile(w, r)
+	if !ok { return }
+	data, err := os.ReadFile(abs)
+	if err != nil { http.Error(w, "Error leyendo archivo", 500); return }
+	if !utf8.Valid(data) { http.Error(w, "El archivo no es texto UTF-8", 415); return }
+	editPage(w, r, abs, string(data), info.ModTime().UnixNano(), 200, "")
+}
+
+// editSaveHandler guarda el texto si el archivo no cambió desde que se abrió
+// el editor (concurrencia optimista por fecha de modificación)
+func editSaveHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxEditBytes)
+	abs, _, ok := editableFile(w, r)
+	if !ok { return }
+	content := r.FormValue("content")
+	if len(content) > maxEditBytes { http.Error(w, "Texto demasiado grande", 413); return }
+	if err := checkMountWrite(abs, int64(len(content))); err != nil { mountWriteError(w, err); return }
+	if aclDenied(w, r, abs, aclWrite) { return }
+	sent, _ := strconv.ParseInt(r.FormValue("mtime"), 10, 64)
+
+	editMu.Lock()
+	defer editMu.Unlock()
+	info, err := os.Stat(abs)
+	if err != nil { http.Error(w, "No encontrado", 404); return }
+	unlock, err := pathLocks.TryLock(abs)
+	if err != nil {
+		editPage(w, r, abs, content, info.ModTime().UnixNano(), 409, "Se está subiendo otra versión de este archivo. Espera a que termine y vuelve a guardar.")
+		return
+	}
+	defer unlock()
+	if info.ModTime().UnixNano() != sent {
+		// Se devuelve lo escrito para no perderlo, con la fecha actual para poder forzar
+		editPage(w, r, abs, content, info.ModTime().UnixNano(), 409, "El archivo cambió mientras lo editabas. Revisa tu texto y vuelve a guardar para sobrescribirlo.")
+		return
+	}
+	// Los navegadores envían los textarea con CRLF; se respeta el estilo original
+	if old, err := os.ReadFile(abs); err == nil && !bytes.Contains(old, []byte("\r\n")) {
+		content = strings.ReplaceAll(content, "\r\n", "\n")
+	}
+	sum, err := receiveFile(hookContext(r), strings.NewReader(content), abs)
+	var rejected *hookRejected
+	if errors.As(err, &rejected) { editPage(w, r, abs, content, info.ModTime().UnixNano(), 403, rejected.Message); return }
+	if err != nil { http.Error(w, "Error guardando el archivo", 500); return }
+	if info, err = os.Stat(abs); err == nil {
+		err = meta.Update(relPath(abs), func(m *FileMeta) {
+			m.SHA256, m.HashSize, m.HashMTime = sum, info.Size(), info.ModTime().UnixNano()
+			m.CID = ""
+		})
+		if err != nil { log.Printf("Error guardando metadatos: %v", err) }
+		postUploadHook(r, abs, sum, info.Size())
+	}
+	if ipfsEnabled() { jobs.Enqueue("ipfs", relPath(abs)) }
+	contentChanged()
+	http.Redirect(w, r, "/edit/"+escapePath(relPath(abs))+"?saved=1", 303)
+}
+
+// noteRequest es una nota nueva, desde el formulario o desde POST /api/v1/notes
+type noteRequest struct {
+	Name    string `json:"name"`
+	Dir     string `json:"dir"`
+	Format  string `json:"format"` // md (por defecto) o txt
+	Content string `json:"content"`
+	Message string `json:"message"`
+}
+
+// createNote guarda el texto como un archivo nuevo; nunca sobrescribe. Devuelve
+// el código HTTP con el que responder si falla
+func createNote(r *http.Request, n noteRequest) (uploadResult, int, error) {
+	var result uploadResult
+	if strings.TrimSpace(n.Content) == "" { return result, 400, errors.New("La nota está vacía") }
+	if len(n.Content) > maxEditBytes { return result, 413, errors.New("Nota demasiado grande") }
+	format := strings.TrimPrefix(strings.ToLower(n.Format), ".")
+	if format == "" { format = "md" }
+	if format != "md" && format != "txt" { return result, 400, errors.New("Formato no válido (md o txt)") }
+	raw := strings.TrimSpace(n.Name)
+	if raw == "" { raw = "nota-" + time.Now().Format("2006-01-02-150405") }
+	if ext := strings.ToLower(path.Ext(raw)); ext != ".md" && ext != ".txt" { raw += "." + format }
+	name, err := sanitizeFilename(raw)
+	if err != nil { return result, 400, errors.New("Nombre no válido: " + err.Error()) }
+	result.Original, result.Renamed = raw, name != raw
+	if dir := strings.Trim(n.Dir, "/"); dir != "" {
+		if dir, err = sanitizeRelPath(dir); err != nil { return result, 400, errors.New("Carpeta no válida") }
+		name = dir + "/" + name
+	}
+	dst, err := securePath(name)
+	if err != nil { return result, 403, errors.New("Denegado") }
+	if m := lockedMount(r, dst); m != nil { return result, 401, errors.New("La carpeta " + m.name + " está protegida con clave") }
+	if !aclAllows(r, relPath(dst), aclWrite) { return result, 403, errors.New(aclMessage(aclWrite, path.Dir(relPath(dst)))) }
+	if err := checkMountWrite(dst, int64(len(n.Content))); errors.Is(err, errMountQuota) {
+		return result, 507, errors.New("La carpeta compartida ha llegado a su cuota")
+	} else if err != nil {
+		return result, 403, errors.New("Esta carpeta es de solo lectura")
+	}
+	unlock, err := pathLocks.TryLock(dst)
+	if err != nil { return result, 409, errors.New("Ya se está escribiendo " + name) }
+	defer unlock()
+	if _, err := os.Lstat(dst); err == nil { return result, 409, errors.New("Ya existe " + name) }
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil { return result, 409, errors.New("No se pudo crear la carpeta de " + name) }
+	if err := checkDirCapacity(dst); err != nil { return result, 507, err }
+	if err := checkFreeSpace(filepath.Dir(dst), int64(len(n.Content))); err != nil { return result, 507, err }
+	if result.SHA256, err = receiveFile(hookContext(r), strings.NewReader(n.Content), dst); err != nil {
+		var rejected *hookRejected
+		if errors.As(err, &rejected) { return result, 403, err }
+		return result, 500, errors.New("Error guardando la nota")
+	}
+	if err := finishUpload(r, dst, map[string]string{"message": n.Message}, &result); err != nil { return result, 500, err }
+	contentChanged()
+	return result, 201, nil
+}
+
+// notesHandler crea una nota desde el formulario del listado
+func notesHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxEditBytes)
+	n := noteRequest{Name: r.FormValue("name"), Dir: r.FormValue("dir"), Format: r.FormValue("format"), Content: r.FormValue("content")}
+	result, status, err := createNote(r, n)
+	if err != nil { http.Error(w, err.Error(), status); return }
+	abs, _ := securePath(result.Name)
+	http.Redirect(w, r, listingURL(filepath.Dir(abs)), 303)
+}
+
+// apiNotesHandler crea una nota desde scripts: {"name":..., "dir":..., "format":"md", "content":...}
+func apiNotesHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	var n noteRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4*maxEditBytes)).Decode(&n); err != nil { http.Error(w, "JSON no válido", 400); return }
+	result, status, err := createNote(r, n)
+	if err != nil { http.Error(w, err.Error(), status); return }
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(result)
+}
+
+// --- VISTA DE ARCHIVOS (/view) ---
+// /view/{ruta} enseña el contenido de algunos tipos de archivo en el
+// navegador sin descargarlos. Los CSV y TSV se ven como tabla: las primeras
+// -view-rows filas, con el separador adivinado y las columnas ordenables.
+// Los JSON se ven reformateados con sangría y los YAML tal cual, con número
+// de línea y bloques plegables según la sangría. Si no son válidos se dice
+// en qué línea está el error y se marca.
+// Los ZIP y los tar (también con gzip) enseñan la lista de lo que contienen,
+// y cada archivo de dentro se descarga con ?entry= sin descomprimir el resto
+// a disco: se lee del paquete y se envía según sale.
+
+var viewRows int
+
+// Como mucho se lee esto del archivo para la vista
+const maxViewBytes = 32 << 20
+
+// CSP de /view: la de por defecto, más su script
+const viewCSP = "default-src 'none'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+// viewKind dice cómo se ve un archivo en /view, o "" si no tiene vista
+func viewKind(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv", ".tsv":
+		return "table"
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".zip":
+		return "archive"
+	}
+	if tarball, _ := isTarball(name); tarball { return "archive" }
+	return ""
+}
+
+// sniffDelimiter elige, entre los separadores habituales, el que aparece en
+// más de las primeras líneas tantas veces como en la cabecera, sin contar lo
+// que va entre comillas. Ante la duda, la coma
+func sniffDelimiter(sample []byte) rune {
+	lines := strings.Split(strings.ReplaceAll(string(sample), "\r\n", "\n"), "\n")
+	// La última puede estar cortada
+	if len(lines) > 1 { lines = lines[:len(lines)-1] }
+	lines = lines[:min(len(lines), 20)]
+	best, bestLines := ',', 0
+	for _, d := range []rune{',', ';', '\t', '|'} {
+		want, consistent := -1, 0
+		for _, line := range lines {
+			if line == "" { continue }
+			n, quoted := 0, false
+			for _, c := range line {
+				if c == '"' { quoted = !quoted } else if c == d && !quoted { n++ }
+			}
+			if want == -1 { want = n }
+			if want == 0 { break }
+			if n == want { consistent++ }
+		}
+		if consistent > bestLines { best, bestLines = d, consistent }
+	}
+	return best
+}
+
+type viewTable struct {
+	Header    []string
+	Rows      [][]string
+	Delimiter string
+	Truncated bool
+	Error     string
+}
+
+// readTable lee la cabecera y hasta limit filas
+func readTable(abs string, limit int) (viewTable, error) {
+	var t viewTable
+	f, err := os.Open(abs)
+	if err != nil { return t, err }
+	defer f.Close()
+	br := bufio.NewReaderSize(io.LimitReader(f, maxViewBytes), 64<<10)
+	// Sin la marca BOM que deja Excel al principio
+	if bom, _ := br.Peek(3); bytes.Equal(bom, []byte("\xef\xbb\xbf")) { br.Discard(3) }
+	delim := '\t'
+	if strings.ToLower(filepath.Ext(abs)) != ".tsv" {
+		sample, _ := br.Peek(16 << 10)
+		delim = sniffDelimiter(sample)
+	}
+	t.Delimiter = map[rune]string{',': "coma", ';': "punto y coma", '\t': "tabulador", '|': "barra"}[delim]
+	cr := csv.NewReader(br)
+	cr.Comma, cr.LazyQuotes, cr.FieldsPerRecord, cr.ReuseRecord = delim, true, -1, false
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF { break }
+		if err != nil {
+			// Lo leído hasta el error se enseña igual
+			t.Error = err.Error()
+			break
+		}
+		for i := range rec { rec[i] = strings.ToValidUTF8(rec[i], "�") }
+		if t.Header == nil { t.Header = rec; continue }
+		if len(t.Rows) == limit { t.Truncated = true; break }
+		t.Rows = append(t.Rows, rec)
+	}
+	// Las filas más largas que la cabecera añaden columnas sin nombre
+	for _, row := range t.Rows {
+		for len(t.Header) < len(row) { t.Header = append(t.Header, "") }
+	}
+	return t, nil
+}
+
+// Tamaño máximo de un JSON o YAML en /view
+const maxViewTextBytes = 4 << 20
+
+// viewLine es una línea de la vista de código; las más sangradas que siguen
+// cuelgan de ella y se pliegan juntas
+type viewLine struct {
+	Num      int
+	Text     string
+	Error    bool
+	Children []viewLine
+}
+
+type viewCode struct {
+	Lines []viewLine
+	// Línea y mensaje del error de sintaxis; 0 si es válido
+	ErrorLine int
+	Error     string
+}
+
+// foldLines agrupa las líneas por sangría; las vacías no abren bloque
+func foldLines(lines []string, errLine int) []viewLine {
+	root := &viewLine{}
+	stack, indents := []*viewLine{root}, []int{-1}
+	for i, l := range lines {
+		l = strings.TrimRight(l, "\r")
+		ind := len(l) - len(strings.TrimLeft(l, " "))
+		blank := strings.TrimSpace(l) == ""
+		if blank { ind = indents[len(indents)-1] + 1 }
+		for ind <= indents[len(indents)-1] {
+			stack, indents = stack[:len(stack)-1], indents[:len(indents)-1]
+		}
+		parent := stack[len(stack)-1]
+		parent.Children = append(parent.Children, viewLine{Num: i + 1, Text: l, Error: i+1 == errLine})
+		if !blank {
+			stack, indents = append(stack, &parent.Children[len(parent.Children)-1]), append(indents, ind)
+		}
+	}
+	return root.Children
+}
+
+// lineAt da la línea (desde 1) del byte offset de data
+func lineAt(data []byte, offset int64) int {
+	offset = min(max(offset, 0), int64(len(data)))
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// jsonView reformatea un JSON válido o, si no lo es, lo deja como está y
+// señala la línea del error
+func jsonView(data []byte) viewCode {
+	var v viewCode
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	err := dec.Decode(&value)
+	if err == nil {
+		if _, extra := dec.Token(); extra != io.EOF { err = fmt.Errorf("hay más datos después del final del JSON") }
+	}
+	if err == nil {
+		var out bytes.Buffer
+		json.Indent(&out, data, "", "  ")
+		v.Lines = foldLines(strings.Split(out.String(), "\n"), 0)
+		return v
+	}
+	var syntax *json.SyntaxError
+	switch {
+	case errors.As(err, &syntax):
+		v.ErrorLine, v.Error = lineAt(data, syntax.Offset), syntax.Error()
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		v.ErrorLine, v.Error = lineAt(data, int64(len(bytes.TrimRight(data, " \t\r\n")))), "el JSON se acaba antes de cerrarse"
+	default:
+		v.ErrorLine, v.Error = lineAt(data, dec.InputOffset()), err.Error()
+	}
+	v.Lines = foldLines(strings.Split(string(data), "\n"), v.ErrorLine)
+	return v
+}
+
+func yamlView(data []byte) viewCode {
+	var v viewCode
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	v.ErrorLine, v.Error = checkYAML(text)
+	v.Lines = foldLines(strings.Split(text, "\n"), v.ErrorLine)
+	return v
+}
+
+// yamlLevel es un bloque abierto: una lista o un mapa con su sangría
+type yamlLevel struct {
+	indent int
+	seq    bool
+	keys   map[string]int
+}
+
+// checkYAML busca los errores habituales de un YAML escrito a mano: sangría
+// con tabuladores o que no cuadra, una clave donde ya había valor, claves
+// repetidas, listas y claves mezcladas en el mismo nivel, y comillas,
+// corchetes o llaves sin cerrar. No es un analizador completo: lo que no
+// entiende (anclas complejas, claves "? ") lo da por bueno. Devuelve la línea
+// del primer error y su descripción, o 0
+func checkYAML(text string) (int, string) {
+	var stack []*yamlLevel
+	open, openIndent := false, -1 // la línea anterior espera un bloque debajo
+	prevIndent := -1
+	blockScalar := -1 // sangría de la clave de un texto | o >
+	flowDepth, flowLine := 0, 0
+	quote, quoteLine := byte(0), 0
+
+	// place coloca una entrada (de lista o de mapa) con sangría ind
+	place := func(n, ind int, seq bool, key string) (int, string) {
+		for len(stack) > 0 && stack[len(stack)-1].indent > ind { stack = stack[:len(stack)-1] }
+		top := func() *yamlLevel {
+			if len(stack) == 0 { return nil }
+			return stack[len(stack)-1]
+		}
+		t := top()
+		switch {
+		case t != nil && t.indent == ind && t.seq != seq:
+			// "clave:" seguida de la lista a su misma altura es válido...
+			if seq && open && openIndent == ind {
+				stack = append(stack, &yamlLevel{indent: ind, seq: true})
+				return 0, ""
+			}
+			// ...y después de esa lista sigue el mapa
+			if !seq && len(stack) > 1 && stack[len(stack)-2].indent == ind && !stack[len(stack)-2].seq {
+				stack = stack[:len(stack)-1]
+				t = top()
+				break
+			}
+			return n, "se mezclan elementos de lista y claves en el mismo nivel"
+		case t != nil && t.indent < ind:
+			if !open || ind <= openIndent {
+				if ind < prevIndent { return n, "la sangría no coincide con la de ningún nivel anterior" }
+				return n, "aquí no se esperaba un bloque: la línea anterior ya tiene valor"
+			}
+			t = nil
+		}
+		if t == nil {
+			t = &yamlLevel{indent: ind, seq: seq}
+			stack = append(stack, t)
+		}
+		if !seq {
+			if t.keys == nil { t.keys = map[string]int{} }
+			if first, dup := t.keys[key]; dup { return n, fmt.Sprintf("la clave %q está repetida (ya estaba en la línea %d)", key, first) }
+			t.keys[key] = n
+		}
+		return 0, ""
+	}
+
+	for i, raw := range strings.Split(text, "\n") {
+		n := i + 1
+		line := strings.TrimRight(raw, "\r")
+		trimmed := strings.TrimLeft(line, " ")
+		ind := len(line) - len(trimmed)
+		if blockScalar >= 0 {
+			if strings.TrimSpace(line) == "" || ind > blockScalar { continue }
+			blockScalar = -1
+		}
+		if quote != 0 {
+			// Texto entre comillas de varias líneas: se busca el cierre
+			if yamlQuoteEnd(line, 0, quote) >= 0 { quote = 0 }
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") { return n, "hay un tabulador en la sangría (YAML solo admite espacios)" }
+		content, q := yamlStripComment(trimmed)
+		if q != 0 { quote, quoteLine = q, n }
+		if content == "" { continue }
+		if flowDepth > 0 {
+			if flowDepth += yamlFlowDepth(content); flowDepth < 0 { return n, "sobra un corchete o una llave de cierre" }
+			continue
+		}
+		if ind == 0 && (content == "---" || strings.HasPrefix(content, "--- ") || content == "..." || strings.HasPrefix(content, "%")) {
+			stack, open, openIndent, prevIndent = nil, false, -1, -1
+			continue
+		}
+		// Continuación de un texto sin comillas de varias líneas
+		if !open && prevIndent >= 0 && ind > prevIndent {
+			if _, _, ok := yamlKey(content); ok { return n, "aquí no se esperaba una clave: la línea anterior ya tiene valor" }
+			continue
+		}
+		col := ind
+		for {
+			// "- " abre un elemento de lista; lo que sigue va en otro nivel
+			if content == "-" || strings.HasPrefix(content, "- ") {
+				if ln, msg := place(n, col, true, ""); ln != 0 { return ln, msg }
+				rest := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+				open, openIndent = true, col
+				if rest == "" { break }
+				col += len(content) - len(rest)
+				content = rest
+				continue
+			}
+			key, rest, ok := yamlKey(content)
+			if !ok {
+				if t := len(stack) - 1; t >= 0 && !stack[t].seq && stack[t].indent == col { return n, "se esperaba «clave: valor»" }
+				open = false
+				if value := yamlStripProperties(content); value != "" && (value[0] == '|' || value[0] == '>') {
+					blockScalar = ind
+				} else if value != "" && (value[0] == '[' || value[0] == '{') {
+					if flowDepth = yamlFlowDepth(value); flowDepth < 0 { return n, "sobra un corchete o una llave de cierre" }
+					flowLine = n
+				}
+				break
+			}
+			if ln, msg := place(n, col, false, key); ln != 0 { return ln, msg }
+			open = false
+			switch value := yamlStripProperties(rest); {
+			case value == "":
+				open, openIndent = true, col
+			case value[0] == '|' || value[0] == '>':
+				blockScalar = col
+			case value[0] == '[' || value[0] == '{':
+				if flowDepth = yamlFlowDepth(value); flowDepth < 0 { return n, "sobra un corchete o una llave de cierre" }
+				flowLine = n
+			}
+			break
+		}
+		prevIndent = col
+	}
+	if quote != 0 { return quoteLine, "unas comillas no se cierran" }
+	if flowDepth > 0 { return flowLine, "un corchete o una llave no se cierra" }
+	return 0, ""
+}
+
+// yamlQuoteEnd devuelve la posición de la comilla que cierra el texto que
+// empieza en from, o -1. En '...' la comilla se escapa doblándola y en "..."
+// con barra invertida
+func yamlQuoteEnd(s string, from int, q byte) int {
+	for i := from; i < len(s); i++ {
+		switch {
+		case q == '"' && s[i] == '\\':
+			i++
+		case s[i] == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			i++
+		case s[i] == q:
+			return i
+		}
+	}
+	return -1
+}
+
+// yamlStripComment quita el comentario de una línea (un # tras un espacio,
+// fuera de comillas). Si unas comillas quedan abiertas devuelve cuáles
+func yamlStripComment(s string) (string, byte) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '#' && (i == 0 || s[i-1] == ' '):
+			return strings.TrimRight(s[:i], " "), 0
+		case (c == '"' || c == '\'') && yamlScalarStart(s, i):
+			end := yamlQuoteEnd(s, i+1, c)
+			if end < 0 { return s, c }
+			i = end
+		}
+	}
+	return strings.TrimRight(s, " "), 0
+}
+
+// yamlScalarStart indica si en i empieza un valor (y no es, por ejemplo, el
+// apóstrofo de un texto sin comillas)
+func yamlScalarStart(s string, i int) bool {
+	j := i - 1
+	for j >= 0 && s[j] == ' ' { j-- }
+	if j < 0 { return true }
+	switch s[j] {
+	case '[', '{', ',':
+		return true
+	case ':', '-', '?':
+		return j < i-1
+	}
+	return false
+}
+
+// yamlKey separa «clave: valor»; ok es falso si la línea no es una clave
+func yamlKey(s string) (key, rest string, ok bool) {
+	if s == "" || s[0] == '[' || s[0] == '{' { return "", "", false }
+	if s[0] == '"' || s[0] == '\'' {
+		end := yamlQuoteEnd(s, 1, s[0])
+		if end < 0 { return "", "", false }
+		after := strings.TrimLeft(s[end+1:], " ")
+		if after != ":" && !strings.HasPrefix(after, ": ") { return "", "", false }
+		return s[1:end], strings.TrimSpace(after[1:]), true
+	}
+	if strings.HasSuffix(s, ":") { return strings.TrimSpace(s[:len(s)-1]), "", true }
+	k, v, found := strings.Cut(s, ": ")
+	if !found { return "", "", false }
+	return strings.TrimSpace(k), strings.TrimSpace(v), true
+}
+
+// yamlStripProperties quita del valor las etiquetas (!tipo) y anclas (&a)
+func yamlStripProperties(v string) string {
+	for v != "" && (v[0] == '!' || v[0] == '&') {
+		_, after, _ := strings.Cut(v, " ")
+		v = strings.TrimLeft(after, " ")
+	}
+	return v
+}
+
+// yamlFlowDepth cuenta los corchetes y llaves que se abren menos los que se
+// cierran, fuera de comillas
+func yamlFlowDepth(v string) int {
+	depth := 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		case '"', '\'':
+			if end := yamlQuoteEnd(v, i+1, v[i]); end >= 0 { i = end }
+		}
+	}
+	return depth
+}
+
+// Como mucho se listan tantas entradas de un paquete
+const maxArchiveEntries = 10000
+
+type archiveEntry struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	HumanSize string    `json:"-"`
+	Modified  time.Time `json:"modified"`
+	IsDir     bool      `json:"dir,omitempty"`
+}
+
+type viewArchive struct {
+	Entries   []archiveEntry
+	Files     int
+	Total     string
+	Truncated bool
+	Error     string
+}
+
+func isTarball(name string) (tarball, gzipped bool) {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return true, true
+	case strings.HasSuffix(lower, ".tar"):
+		return true, false
+	}
+	return false, false
+}
+
+// openTar abre el tar, descomprimiéndolo al vuelo si hace falta
+func openTar(abs string) (*tar.Reader, io.Closer, error) {
+	f, err := os.Open(abs)
+	if err != nil { return nil, nil, err }
+	var r io.Reader = bufio.NewReader(f)
+	if _, gzipped := isTarball(abs); gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil { f.Close(); return nil, nil, err }
+		r = gz
+	}
+	return tar.NewReader(r), f, nil
+}
+
+// readArchive lista las entradas; un paquete dañado se enseña hasta donde
+// se pudo leer, con el error
+func readArchive(ctx context.Context, abs string) (viewArchive, error) {
+	var a viewArchive
+	var total int64
+	add := func(e archiveEntry) bool {
+		if len(a.Entries) == maxArchiveEntries { a.Truncated = true; return false }
+		e.HumanSize = "-"
+		if !e.IsDir { e.HumanSize, total = humanSize(e.Size), total+e.Size; a.Files++ }
+		a.Entries = append(a.Entries, e)
+		return true
+	}
+	if tarball, _ := isTarball(abs); tarball {
+		tr, closer, err := openTar(abs)
+		if err != nil { return a, err }
+		defer closer.Close()
+		for ctx.Err() == nil {
+			h, err := tr.Next()
+			if err == io.EOF { break }
+			if err != nil { a.Error = err.Error(); break }
+			if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeDir { continue }
+			if !add(archiveEntry{Name: h.Name, Size: h.Size, Modified: h.ModTime, IsDir: h.Typeflag == tar.TypeDir}) { break }
+		}
+	} else {
+		zr, err := zip.OpenReader(abs)
+		if err != nil { return a, err }
+		defer zr.Close()
+		for _, f := range zr.File {
+			if !add(archiveEntry{Name: f.Name, Size: int64(f.UncompressedSize64), Modified: f.Modified, IsDir: f.FileInfo().IsDir()}) { break }
+		}
+	}
+	a.Total = humanSize(total)
+	return a, nil
+}
+
+// serveArchiveEntry envía una entrada del paquete. Siempre como descarga: lo
+// que viene dentro de un paquete no se abre en el navegador en este origen
+func serveArchiveEntry(w http.ResponseWriter, r *http.Request, abs, name string) {
+	var src io.Reader
+	var size int64
+	if tarball, _ := isTarball(abs); tarball {
+		tr, closer, err := openTar(abs)
+		if err != nil { http.Error(w, "No se pudo abrir el paquete", 500); return }
+		defer closer.Close()
+		// En un tar hay que recorrerlo hasta llegar a la entrada
+		for r.Context().Err() == nil {
+			h, err := tr.Next()
+			if err != nil { break }
+			if h.Name == name && h.Typeflag == tar.TypeReg { src, size = tr, h.Size; break }
+		}
+	} else {
+		zr, err := zip.OpenReader(abs)
+		if err != nil { http.Error(w, "No se pudo abrir el paquete", 500); return }
+		defer zr.Close()
+		for _, f := range zr.File {
+			if f.Name != name || f.FileInfo().IsDir() { continue }
+			rc, err := f.Open()
+			if err != nil { http.Error(w, "Esta entrada no se puede extraer: "+err.Error(), 415); return }
+			defer rc.Close()
+			src, size = rc, int64(f.UncompressedSize64)
+			break
+		}
+	}
+	if src == nil { http.Error(w, "No está en el paquete", 404); return }
+	contentType := mimeByExtension(name)
+	if contentType == "" { contentType = "application/octet-stream" }
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if r.Method == "HEAD" { return }
+	if _, err := io.Copy(w, src); err != nil { log.Printf("Error enviando %s de %s: %v", name, relPath(abs), err) }
+}
+
+var viewTmpl *template.Template
+
+// viewHandler es /view/{ruta}
+func viewHandler(w http.ResponseWriter, r *http.Request) {
+	if opaqueDenied(w, r) { return }
+	abs, err := existingPath(r.PathValue("path"))
+	if err != nil { pathError(w, err); return }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+	if aclDenied(w, r, abs, aclRead) { return }
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() { http.Error(w, "No encontrado", 404); return }
+	// Las vistas muestran el contenido: pasan por el mismo gancho que una descarga
+	if downloadHookDenied(w, r, abs, info) { return }
+	data := map[string]interface{}{"Name": filepath.Base(abs), "RelPath": relPath(abs), "Back": listingURL(filepath.Dir(abs))}
+	if entry := r.URL.Query().Get("entry"); entry != "" && viewKind(abs) == "archive" {
+		if rateLimited(w, r, "download") { return }
+		serveArchiveEntry(w, r, abs, entry)
+		return
+	}
+	switch viewKind(abs) {
+	case "table":
+		t, err := readTable(abs, viewRows)
+		if err != nil { http.Error(w, "Error leyendo archivo", 500); return }
+		data["Table"] = t
+	case "archive":
+		a, err := readArchive(r.Context(), abs)
+		if err != nil { http.Error(w, "No se pudo leer el paquete: "+err.Error(), 415); return }
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"entries": a.Entries, "truncated": a.Truncated, "error": a.Error})
+			return
+		}
+		data["Archive"] = a
+	case "json", "yaml":
+		if info.Size() > maxViewTextBytes { http.Error(w, "Archivo demasiado grande para la vista", 413); return }
+		content, err := os.ReadFile(abs)
+		if err != nil { http.Error(w, "Error leyendo archivo", 500); return }
+		if !utf8.Valid(content) { http.Error(w, "El archivo no es texto UTF-8", 415); return }
+		if viewKind(abs) == "json" {
+			data["Kind"], data["Code"] = "JSON", jsonView(content)
+		} else {
+			data["Kind"], data["Code"] = "YAML", yamlView(content)
+		}
+	default:
+		http.Error(w, "Este archivo no tiene vista previa", 415)
+		return
+	}
+	if cspPolicy != "" { w.Header().Set("Content-Security-Policy", viewCSP) }
+	viewTmpl.Execute(w, data)
+}
+
+// --- OPERACIONES EN LOTE ---
+
+// /batch aplica varias operaciones (borrar, mover) como una transacción: se
+// valida todo antes de tocar nada y, si un paso falla, se deshacen los ya
+// hechos. Los borrados se hacen primero moviendo a una carpeta temporal dentro
+// de la de estado, de modo que también se pueden deshacer hasta el final.
+
+const maxBatchOps = 1000
+
+type batchOp struct {
+	Op   string `json:"op"` // delete o move
+	Path string `json:"path"`
+	// Destino de move; si es una carpeta existente o acaba en "/", se mueve dentro
+	To string `json:"to,omitempty"`
+	// Versión que vio el cliente: si el archivo cambió, el lote falla con 412
+	MTime   string `json:"mtime,omitempty"`
+	IfMatch string `json:"if_match,omitempty"`
+}
+
+type batchStep struct {
+	op       batchOp
+	src, dst string
+	staged   string
+}
+
+// underPath indica si name es prefix o está dentro de la carpeta prefix y
+// devuelve el resto de la ruta ("" o "/...")
+func underPath(name, prefix string) (string, bool) {
+	if name == prefix { return "", true }
+	if strings.HasPrefix(name, prefix+"/") { return name[len(prefix):], true }
+	return "", false
+}
+
+// planBatch valida las operaciones y resuelve sus rutas; devuelve el código
+// HTTP con el que responder si alguna no es posible
+func planBatch(r *http.Request, ops []batchOp) ([]batchStep, int, error) {
+	if len(ops) == 0 { return nil, 400, errors.New("No hay operaciones") }
+	if len(ops) > maxBatchOps { return nil, 400, fmt.Errorf("Máximo %d operaciones", maxBatchOps) }
+	var steps []batchStep
+	targets := make(map[string]bool)
+	for i, op := range ops {
+		fail := func(status int, msg string) ([]batchStep, int, error) {
+			return nil, status, fmt.Errorf("Operación %d (%s %s): %s", i+1, op.Op, op.Path, msg)
+		}
+		switch op.Op {
+		case "delete":
+			if !enableDelete { return fail(403, "borrado deshabilitado") }
+			if !authorizedDelete(r) { return fail(401, "clave errónea") }
+		case "move":
+			if !authorized(r, roleWrite) { return fail(401, "clave errónea") }
+		default:
+			return fail(400, "operación desconocida")
+		}
+		src, err := existingPath(op.Path)
+		if errors.Is(err, errNotFound) { return fail(404, "no encontrado") }
+		if err != nil || relPath(src) == "." || isMountDir(src) { return fail(403, "denegado") }
+		if m := lockedMount(r, src); m != nil { return fail(401, "la carpeta "+m.name+" está protegida") }
+		// Mover también quita el original: hace falta permiso de borrado
+		if !aclAllows(r, relPath(src), aclDelete) { return fail(403, "sin permiso de borrado") }
+		if err := checkMountWrite(src, -1); err != nil { return fail(403, err.Error()) }
+		info, err := os.Lstat(src)
+		if err != nil { return fail(404, "no encontrado") }
+		if !unchangedVersion(src, info, op.MTime, op.IfMatch) { return fail(412, "ha cambiado desde que se listó") }
+		step := batchStep{op: op, src: src}
+
+		if op.Op == "delete" {
+			if info.IsDir() {
+				entries, err := os.ReadDir(src)
+				if err != nil || len(entries) > 0 { return fail(409, "la carpeta no está vacía") }
+			}
+		} else {
+			to := strings.TrimSpace(op.To)
+			into := to == "" || strings.HasSuffix(to, "/")
+			if to = strings.Trim(to, "/"); to != "" {
+				if to, err = sanitizeRelPath(to); err != nil { return fail(400, "destino no válido") }
+			}
+			if !into {
+				if abs, err := securePath(to); err == nil {
+					if st, err := os.Stat(abs); err == nil && st.IsDir() { into = true }
+				}
+			}
+			if into { to = path.Join(to, filepath.Base(src)) }
+			if step.dst, err = securePath(to); err != nil { return fail(403, "destino denegado") }
+			if _, err := os.Lstat(step.dst); err == nil { return fail(409, "ya existe "+to) }
+			// rename no cruza de una carpeta montada a otra (pueden ser otros discos)
+			if mountOf(src) != mountOf(step.dst) { return fail(409, "no se puede mover entre carpetas compartidas") }
+			if m := lockedMount(r, step.dst); m != nil { return fail(401, "la carpeta "+m.name+" está protegida") }
+			if !aclAllows(r, relPath(step.dst), aclWrite) { return fail(403, "sin permiso de escritura en el destino") }
+			if within(src, step.dst) { return fail(409, "no se puede mover una carpeta dentro de sí misma") }
+			if targets[step.dst] { return fail(409, "destino repetido") }
+			targets[step.dst] = true
+		}
+		// Dos operaciones sobre la misma ruta (o una dentro de otra) no tienen un orden claro
+		for _, prev := range steps {
+			if within(prev.src, src) || within(src, prev.src) { return fail(409, "se solapa con otra operación") }
+		}
+		steps = append(steps, step)
+	}
+	return steps, 200, nil
+}
+
+// runBatch ejecuta las operaciones planificadas; si algo falla deshace lo hecho
+func runBatch(steps []batchStep) error {
+	staging, err := os.MkdirTemp(stateDir, "batch-")
+	if err != nil { return err }
+	defer os.RemoveAll(staging)
+	for i := range steps {
+		st := &steps[i]
+		st.staged = st.dst
+		if st.op.Op == "delete" {
+			st.staged = filepath.Join(staging, strconv.Itoa(i))
+			// Lo borrado en una carpeta montada se aparta dentro de ella
+			if m := mountOf(st.src); m != nil { st.staged = filepath.Join(m.dir, ".cerbero-"+filepath.Base(staging)+"-"+strconv.Itoa(i)) }
+		} else if err = os.MkdirAll(filepath.Dir(st.dst), 0755); err != nil {
+			rollbackBatch(steps[:i])
+			return err
+		}
+		if err = os.Rename(st.src, st.staged); err != nil {
+			rollbackBatch(steps[:i])
+			return fmt.Errorf("%s: %w", st.op.Path, err)
+		}
+	}
+	for _, st := range steps {
+		from := relPath(st.src)
+		if st.op.Op == "delete" {
+			if mountOf(st.src) != nil { os.RemoveAll(st.staged) }
+			pins.Forget(from)
+			meta.Delete(from)
+			shares.Forget(from)
+			acls.Forget(from)
+			folderLinks.Forget(from)
+			continue
+		}
+		to := relPath(st.dst)
+		meta.Rename(from, to)
+		pins.Rename(from, to)
+		shares.Rename(from, to)
+		acls.Rename(from, to)
+		folderLinks.Rename(from, to)
+	}
+	contentChanged()
+	return nil
+}
+
+func rollbackBatch(done []batchStep) {
+	for i := len(done) - 1; i >= 0; i-- {
+		if err := os.Rename(done[i].staged, done[i].src); err != nil {
+			log.Printf("No se pudo deshacer %s %s: %v", done[i].op.Op, done[i].op.Path, err)
+		}
+	}
+}
+
+// CSP del listado: como la de por defecto, pero con la hoja de estilos y el
+// script propios (/static/), sus consultas al servidor y el manifiesto
+const indexCSP = "default-src 'none'; script-src 'self'; connect-src 'self'; manifest-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+
+// batchHandler admite JSON ({"operations":[{"op":"move","path":"a","to":"b/"}]})
+// para scripts, o el formulario de la barra de selección del listado
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	var ops []batchOp
+	isJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if isJSON {
+		var req struct {
+			Operations []batchOp `json:"operations"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil { http.Error(w, "JSON no válido", 400); return }
+		ops = req.Operations
+	} else {
+		action := r.FormValue("action")
+		r.ParseForm()
+		for _, p := range r.PostForm["paths"] {
+			ops = append(ops, batchOp{Op: action, Path: p, To: r.FormValue("to") + "/"})
+		}
+	}
+	steps, status, err := planBatch(r, ops)
+	if err != nil { http.Error(w, err.Error(), status); return }
+	dir := "/"
+	if d := strings.Trim(r.FormValue("dir"), "/"); d != "" { dir = "/?dir=" + url.QueryEscape(d) }
+	if slices.ContainsFunc(steps, func(st batchStep) bool { return st.op.Op == "delete" }) { autoSnapshot("batch") }
+	// Lo borrado desde la barra de selección se puede deshacer como en /delete
+	if !isJSON && undoSeconds > 0 && !slices.ContainsFunc(steps, func(st batchStep) bool { return st.op.Op != "delete" }) {
+		srcs := make([]string, len(steps))
+		for i, st := range steps { srcs[i] = st.src }
+		token, err := deletions.Stage(r, srcs)
+		if err != nil { http.Error(w, "No se pudo completar el lote; no se ha cambiado nada: "+err.Error(), 500); return }
+		http.Redirect(w, r, withUndo(dir, token), 303)
+		return
+	}
+	if err := runBatch(steps); err != nil {
+		log.Printf("Lote deshecho: %v", err)
+		http.Error(w, "No se pudo completar el lote; no se ha cambiado nada: "+err.Error(), 500)
+		return
+	}
+	if isJSON {
+		done := make([]batchOp, len(steps))
+		for i, st := range steps {
+			done[i] = batchOp{Op: st.op.Op, Path: relPath(st.src)}
+			if st.dst != "" { done[i].To = relPath(st.dst) }
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"operations": done})
+		return
+	}
+	http.Redirect(w, r, dir, 303)
+}
+
+// --- COPIAS ---
+
+// POST /copy duplica archivos o carpetas sin volver a subirlos. Sin "to" la
+// copia queda junto al original ("informe (copia).pdf"); con "to" se copia a
+// esa ruta, o dentro si es una carpeta o acaba en "/". En Btrfs y XFS los
+// archivos se clonan (reflink): la copia es instantánea y no ocupa hasta que
+// se modifica; en el resto de sistemas se copian los bytes.
+
+type copyStep struct {
+	src, dst string
+	size     int64
+}
+
+// ioctl FICLONE de Linux: comparte los bloques de src con dst
+const ficlone = 0x40049409
+
+// cloneFile intenta el reflink; si el sistema de archivos no lo admite copia
+// con copy_file_range (ReadFrom), que el kernel también puede acelerar
+func cloneFile(dst, src *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno == 0 { return nil }
+	_, err := copyBuffered(&diskGuardWriter{w: dst, dir: filepath.Dir(dst.Name())}, src)
+	return err
+}
+
+// copyName busca un nombre libre para la copia junto al original
+func copyName(src string) string {
+	dir, base := filepath.Split(src)
+	ext := filepath.Ext(base)
+	if fi, err := os.Stat(src); err == nil && fi.IsDir() { ext = "" }
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		suffix := " (copia)"
+		if i > 1 { suffix = fmt.Sprintf(" (copia %d)", i) }
+		dst := filepath.Join(dir, stem+suffix+ext)
+		if _, err := os.Lstat(dst); err != nil { return dst }
+	}
+}
+
+// planCopy valida una copia y resuelve su destino; devuelve el código HTTP
+// con el que responder si no es posible
+func planCopy(r *http.Request, requested, to string, into bool) (copyStep, int, error) {
+	src, err := existingPath(requested)
+	if errors.Is(err, errNotFound) { return copyStep{}, 404, fmt.Errorf("%s: no encontrado", requested) }
+	if err != nil || relPath(src) == "." || isMountDir(src) { return copyStep{}, 403, fmt.Errorf("%s: denegado", requested) }
+	if m := lockedMount(r, src); m != nil { return copyStep{}, 401, fmt.Errorf("la carpeta %s está protegida", m.name) }
+	if !aclAllows(r, relPath(src), aclRead) { return copyStep{}, 403, fmt.Errorf("%s: sin permiso de lectura", requested) }
+	step := copyStep{src: src}
+	if to = strings.TrimSpace(to); to == "" {
+		step.dst = copyName(src)
+	} else {
+		into = into || strings.HasSuffix(to, "/")
+		if to = strings.Trim(to, "/"); to != "" {
+			if to, err = sanitizeRelPath(to); err != nil { return copyStep{}, 400, errors.New("destino no válido") }
+		}
+		if !into {
+			if abs, err := securePath(to); err == nil {
+				if st, err := os.Stat(abs); err == nil && st.IsDir() { into = true }
+			}
+		}
+		if into { to = path.Join(to, filepath.Base(src)) }
+		if step.dst, err = securePath(to); err != nil { return copyStep{}, 403, errors.New("destino denegado") }
+	}
+	if _, err := os.Lstat(step.dst); err == nil { return copyStep{}, 409, fmt.Errorf("ya existe %s", relPath(step.dst)) }
+	if within(src, step.dst) { return copyStep{}, 409, errors.New("no se puede copiar una carpeta dentro de sí misma") }
+	if m := lockedMount(r, step.dst); m != nil { return copyStep{}, 401, fmt.Errorf("la carpeta %s está protegida", m.name) }
+	if !aclAllows(r, relPath(step.dst), aclWrite) { return copyStep{}, 403, errors.New("sin permiso de escritura en el destino") }
+	if err := checkDirCapacity(step.dst); err != nil { return copyStep{}, 507, err }
+	filepath.WalkDir(src, func(p string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil { step.size += info.Size() }
+		}
+		return nil
+	})
+	if err := checkMountWrite(step.dst, step.size); err != nil {
+		if errors.Is(err, errMountQuota) { return copyStep{}, 507, errors.New("la carpeta compartida ha llegado a su cuota") }
+		return copyStep{}, 403, err
+	}
+	return step, 200, nil
+}
+
+// copyTree copia src en dst. Se escribe con un nombre temporal y se renombra
+// al final, así que una copia a medias nunca aparece en el listado. Los
+// enlaces simbólicos no se copian.
+func copyTree(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil { return err }
+	tmp := filepath.Join(filepath.Dir(dst), ".cerbero-copy-"+randomToken(8))
+	err := filepath.WalkDir(src, func(p string, d os.DirEntry, err error) error {
+		if err != nil { return err }
+		target := tmp + strings.TrimPrefix(p, src)
+		info, err := d.Info()
+		if err != nil { return err }
+		switch {
+		case d.IsDir():
+			return os.Mkdir(target, info.Mode().Perm()|0700)
+		case d.Type().IsRegular():
+			in, err := os.Open(p)
+			if err != nil { return err }
+			defer in.Close()
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+			if err != nil { return err }
+			if err := cloneFile(out, in); err != nil { out.Close(); return err }
+			if err := out.Close(); err != nil { return err }
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+	if err == nil { err = os.Rename(tmp, dst) }
+	if err != nil { os.RemoveAll(tmp) }
+	return err
+}
+
+// copyMeta da a la copia los metadatos del original salvo el hash y el ID
+func copyMeta(src, dst string) {
+	filepath.WalkDir(src, func(p string, d os.DirEntry, err error) error {
+		if err != nil { return nil }
+		fm, ok := meta.Get(relPath(p))
+		if !ok { return nil }
+		meta.Fill(relPath(dst+strings.TrimPrefix(p, src)), func(c *FileMeta) {
+			*c = fm
+			c.SHA256, c.HashSize, c.HashMTime, c.ID = "", 0, 0, ""
+		})
+		return nil
+	})
+	meta.Flush()
+}
+
+func copyHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	r.ParseForm()
+	paths := r.PostForm["paths"]
+	if p := r.FormValue("path"); p != "" { paths = append(paths, p) }
+	if len(paths) == 0 { http.Error(w, "No hay nada que copiar", 400); return }
+	if len(paths) > maxBatchOps { http.Error(w, fmt.Sprintf("Máximo %d elementos", maxBatchOps), 400); return }
+	var steps []copyStep
+	var total int64
+	targets := make(map[string]bool)
+	for _, p := range paths {
+		step, status, err := planCopy(r, p, r.FormValue("to"), len(paths) > 1 && r.FormValue("to") != "")
+		if err != nil { http.Error(w, "No se pudo copiar: "+err.Error(), status); return }
+		if targets[step.dst] { http.Error(w, "No se pudo copiar: destino repetido", 409); return }
+		targets[step.dst] = true
+		steps = append(steps, step)
+		total += step.size
+	}
+	if _, err := quotas.Check(r, total); err != nil { quotaFail(w, r, total, err); return }
+	if checkFreeSpace(filepath.Dir(steps[0].dst), total) != nil { failWith(w, "disk_full", "No hay espacio en disco para la copia", 507); return }
+	type copied struct {
+		Path string `json:"path"`
+		To   string `json:"to"`
+		Size int64  `json:"size"`
+	}
+	var done []copied
+	for _, st := range steps {
+		if err := copyTree(st.src, st.dst); err != nil {
+			log.Printf("Error copiando %s: %v", relPath(st.src), err)
+			if errors.Is(err, errDiskFull) { failWith(w, "disk_full", "No hay espacio en disco para la copia", 507); return }
+			http.Error(w, "No se pudo copiar "+relPath(st.src), 500)
+			return
+		}
+		copyMeta(st.src, st.dst)
+		quotas.Charge(r, st.size)
+		audit(r, "copy", map[string]string{"path": relPath(st.src), "to": relPath(st.dst)})
+		done = append(done, copied{Path: relPath(st.src), To: relPath(st.dst), Size: st.size})
+	}
+	contentChanged()
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"copies": done})
+		return
+	}
+	dir := "/"
+	if d := strings.Trim(r.FormValue("dir"), "/"); d != "" { dir = "/?dir=" + url.QueryEscape(d) }
+	http.Redirect(w, r, dir, 303)
+}
+
+// Formatos ya comprimidos: en el ZIP se guardan sin volver a comprimir
+var storedExtensions = map[string]bool{
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp4": true, ".mkv": true, ".webm": true, ".mov": true, ".mp3": true, ".ogg": true, ".opus": true, ".flac": true, ".m4a": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true, ".epub": true, ".apk": true, ".jar": true,
+}
+
+type zipEntry struct {
+	abs  string
+	name string // ruta dentro del ZIP
+	info os.FileInfo
+}
+
+// zipSelection resuelve las rutas elegidas (archivos o carpetas completas) en
+// la lista de archivos del ZIP, con rutas relativas a la carpeta de cada una
+func zipSelection(r *http.Request, paths []string) ([]zipEntry, error) {
+	var entries []zipEntry
+	for _, p := range paths {
+		a, err := existingPath(p)
+		// Una carpeta intermedia de un -share virtual incluye lo montado bajo ella
+		if errors.Is(err, errNotFound) && len(virtualChildren(strings.Trim(p, "/"))) > 0 { a, err = securePath(p) }
+		if err != nil { return nil, err }
+		if !aclAllows(r, relPath(a), aclRead) { return nil, errForbidden }
+		base := path.Dir(relPath(a))
+		walkFiles(a, func(rel string, info os.FileInfo) {
+			if !aclAllows(r, rel, aclRead) { return }
+			name := rel
+			if base != "." { name = strings.TrimPrefix(rel, base+"/") }
+			entries = append(entries, zipEntry{abs: absPath(rel), name: name, info: info})
+		})
+	}
+	return entries, nil
+}
+
+// lockedSelection devuelve la primera carpeta protegida que la petición no ha
+// desbloqueado entre las rutas elegidas
+func lockedSelection(r *http.Request, paths []string) *mount {
+	for _, p := range paths {
+		if a, err := existingPath(p); err == nil {
+			if m := lockedMount(r, a); m != nil { return m }
+		}
+	}
+	return nil
+}
+
+// zipEstimate calcula un máximo del tamaño del ZIP: el contenido sin
+// comprimir más las cabeceras (local, descriptor, directorio central y sus
+// extensiones zip64 si hacen falta)
+func zipEstimate(entries []zipEntry) (total int64, zip64 bool) {
+	for _, e := range entries { total += e.info.Size() }
+	zip64 = total >= math.MaxUint32 || len(entries) >= math.MaxUint16
+	for _, e := range entries {
+		// Deflate puede crecer 5 bytes por bloque de 16 KB con datos aleatorios
+		total += int64(30+46+2*len(e.name)) + 24 + 5*(e.info.Size()/16384+1)
+		if zip64 { total += 28 + 20 }
+	}
+	total += 22
+	if zip64 { total += 56 + 20 }
+	return total, zip64
+}
+
+func zipLimit() int64 { return int64(zipMaxMB) << 20 }
+
+// zipEstimateHandler informa de lo que ocuparía el ZIP de una selección antes
+// de pedirlo; el listado lo usa para avisar de descargas enormes
+func zipEstimateHandler(w http.ResponseWriter, r *http.Request) {
+	if opaqueDenied(w, r) { return }
+	r.ParseForm()
+	if len(r.Form["paths"]) == 0 { http.Error(w, "No hay nada seleccionado", 400); return }
+	if m := lockedSelection(r, r.Form["paths"]); m != nil { mountLocked(w, r, m); return }
+	entries, err := zipSelection(r, r.Form["paths"])
+	if err != nil { pathError(w, err); return }
+	size, zip64 := zipEstimate(entries)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"files":      len(entries),
+		"bytes":      size,
+		"human_size": humanSize(size),
+		"zip64":      zip64,
+		"limit":      zipLimit(),
+		"allowed":    zipLimit() == 0 || size <= zipLimit(),
+	})
+}
+
+// zipHandler descarga una selección (archivos y carpetas completas) como ZIP.
+// Las rutas van en paths, repetido. El archivo pasa a formato zip64 solo si
+// supera 4 GB o 65535 entradas, lo que archive/zip hace por sí mismo al cerrar
+func zipHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "download") { return }
+	if opaqueDenied(w, r) { return }
+	r.ParseForm()
+	selected := r.Form["paths"]
+	if len(selected) == 0 { http.Error(w, "No hay nada seleccionado", 400); return }
+	if m := lockedSelection(r, selected); m != nil { mountLocked(w, r, m); return }
+	entries, err := zipSelection(r, selected)
+	if err != nil { pathError(w, err); return }
+	size, _ := zipEstimate(entries)
+	if zipLimit() > 0 && size > zipLimit() {
+		http.Error(w, fmt.Sprintf("La selección ocupa %s y el máximo para ZIP es %s", humanSize(size), humanSize(zipLimit())), 413)
+		return
+	}
+	for _, e := range entries {
+		if e.info.Mode().IsRegular() && downloadHookDenied(w, r, e.abs, e.info) { return }
+	}
+	name := "cerbero-" + time.Now().Format("20060102-150405") + ".zip"
+	if len(selected) == 1 {
+		if a, _ := existingPath(selected[0]); relPath(a) != "." { name = filepath.Base(a) + ".zip" }
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("X-Cerbero-Zip-Files", strconv.Itoa(len(entries)))
+	w.Header().Set("X-Cerbero-Zip-Estimate", strconv.FormatInt(size, 10))
+
+	_, span := startSpan(r.Context(), "storage.zip")
+	defer span.End()
+	span.SetAttr("zip.files", len(entries))
+	cw, start := &countingWriter{ResponseWriter: w}, time.Now()
+	zw := zip.NewWriter(cw)
+	var failed error
+	for _, e := range entries {
+		if r.Context().Err() != nil { failed = r.Context().Err(); break }
+		hdr, err := zip.FileInfoHeader(e.info)
+		if err != nil { continue }
+		hdr.Name, hdr.Method = e.name, zip.Deflate
+		if storedExtensions[strings.ToLower(path.Ext(e.name))] { hdr.Method = zip.Store }
+		dst, err := zw.CreateHeader(hdr)
+		if err != nil { failed = err; break }
+		f, err := os.Open(e.abs)
+		if err != nil { continue }
+		_, failed = copyBuffered(dst, f)
+		f.Close()
+		if failed != nil { break }
+	}
+	if failed == nil { failed = zw.Close() }
+	span.SetError(failed)
+	if failed != nil { log.Printf("ZIP interrumpido: %v", failed) }
+	transfers.Record(r, "descarga", name, cw.n, time.Since(start), failed)
+}
+
+// --- GANCHOS (HOOKS) ---
+
+// Con -hook evento=destino cada evento del ciclo de vida de un archivo llama
+// a un comando externo o a una URL con el mismo JSON (hookEvent):
+//   - pre-upload: con el archivo ya recibido en un temporal y antes de
+//     publicarlo; puede rechazarlo.
+//   - pre-download: antes de servir /download, /id, /s/, ZIP y S3; puede
+//     negarlo.
+//   - post-upload y post-delete: después, en la cola de trabajos (con sus
+//     reintentos); sirven para transcodificar, marcar con agua, avisar...
+// Un comando recibe el JSON por la entrada estándar y {file} y {path} en sus
+// argumentos; una URL lo recibe por POST; un .wasm es un plugin que corre
+// dentro del proceso (ver PLUGINS WASM). Para los pre-*, salir con código
+// distinto de 0 (o responder 4xx, o {"allow": false}) rechaza; el mensaje es
+// la salida (o el cuerpo, o "message"). Un gancho que no responde a tiempo
+// también rechaza: una validación caída no debe dejar pasar nada.
+
+const (
+	hookPreUpload    = "pre-upload"
+	hookPostUpload   = "post-upload"
+	hookPreDownload  = "pre-download"
+	hookPostDelete   = "post-delete"
+	postHookTimeout  = 30 * time.Minute
+	maxHookReplySize = 64 << 10
+)
+
+var hookEvents = []string{hookPreUpload, hookPostUpload, hookPreDownload, hookPostDelete}
+
+type hookEvent struct {
+	Event  string    `json:"event"`
+	Path   string    `json:"path"`           // ruta relativa, como en las URLs
+	File   string    `json:"file,omitempty"` // ruta en disco (el temporal en pre-upload)
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256,omitempty"`
+	User   string    `json:"user,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+type hookVerdict struct {
+	Allow   *bool  `json:"allow"`
+	Message string `json:"message"`
+}
+
+// hookRejected es la negativa de un gancho pre-*; Message va tal cual al cliente
+type hookRejected struct{ Message string }
+
+func (e *hookRejected) Error() string { return e.Message }
+
+var (
+	hookSpecs   multiFlag
+	hookTimeout time.Duration
+	hooks       = make(map[string][]string)
+)
+
+// parseHooks lee los -hook evento=comando, evento=https://... o
+// evento=plugin.wasm
+func parseHooks() error {
+	for _, spec := range hookSpecs {
+		event, target, ok := strings.Cut(spec, "=")
+		event, target = strings.TrimSpace(event), strings.TrimSpace(target)
+		if !ok || target == "" { return fmt.Errorf("se esperaba evento=comando: %q", spec) }
+		if !slices.Contains(hookEvents, event) { return fmt.Errorf("evento desconocido %q (%s)", event, strings.Join(hookEvents, ", ")) }
+		if isWasmPlugin(target) {
+			if err := loadWasmPlugin(target); err != nil { return err }
+		}
+		hooks[event] = append(hooks[event], target)
+	}
+	return nil
+}
+
+func hooksFor(event string) bool { return len(hooks[event]) > 0 }
+
+// hookActorKey lleva en el contexto de una subida quién la hace, para los
+// ganchos y las reglas que se aplican desde receiveChecked
+type hookActorKey struct{}
+
+type hookActor struct{ User, Role, IP string }
+
+func hookContext(r *http.Request) context.Context {
+	if !hooksFor(hookPreUpload) && !rules.Active() { return r.Context() }
+	return context.WithValue(r.Context(), hookActorKey{}, hookActor{User: currentUser(r), Role: requestRole(r), IP: clientIP(r)})
+}
+
+// callHook ejecuta un gancho. Un *hookRejected es una negativa; cualquier
+// otro error, un fallo del propio gancho
+func callHook(ctx context.Context, target string, ev hookEvent) error {
+	isURL := strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+	// Al otro lado de una URL la ruta en disco no sirve de nada
+	if isURL { ev.File = "" }
+	body, err := json.Marshal(ev)
+	if err != nil { return err }
+	var verdict hookVerdict
+	if isURL {
+		req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(body))
+		if err != nil { return err }
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Cerbero-Event", ev.Event)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil { return err }
+		defer resp.Body.Close()
+		reply, _ := io.ReadAll(io.LimitReader(resp.Body, maxHookReplySize))
+		if json.Unmarshal(reply, &verdict) != nil { verdict.Message = strings.TrimSpace(string(reply)) }
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 { return &hookRejected{Message: hookMessage(verdict.Message, ev)} }
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 { return fmt.Errorf("%s respondió %s", target, resp.Status) }
+	} else if isWasmPlugin(target) {
+		stdout, stderr, code, err := runWasmPlugin(ctx, target, ev, body)
+		if err != nil { return err }
+		if json.Unmarshal(stdout, &verdict) != nil { verdict.Message = strings.TrimSpace(string(stdout)) }
+		if code != 0 {
+			if verdict.Message == "" { verdict.Message = strings.TrimSpace(string(stderr)) }
+			return &hookRejected{Message: hookMessage(verdict.Message, ev)}
+		}
+	} else {
+		var args []string
+		for _, a := range strings.Fields(target) {
+			a = strings.ReplaceAll(a, "{file}", ev.File)
+			args = append(args, strings.ReplaceAll(a, "{path}", ev.Path))
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(), "CERBERO_EVENT="+ev.Event, "CERBERO_PATH="+ev.Path, "CERBERO_FILE="+ev.File)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &limitedBuffer{&stdout, maxHookReplySize}, &limitedBuffer{&stderr, maxHookReplySize}
+		err := cmd.Run()
+		if json.Unmarshal(stdout.Bytes(), &verdict) != nil { verdict.Message = strings.TrimSpace(stdout.String()) }
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && ctx.Err() == nil {
+			if verdict.Message == "" { verdict.Message = strings.TrimSpace(stderr.String()) }
+			return &hookRejected{Message: hookMessage(verdict.Message, ev)}
+		}
+		if err != nil { return fmt.Errorf("%s: %v", args[0], err) }
+	}
+	if verdict.Allow != nil && !*verdict.Allow { return &hookRejected{Message: hookMessage(verdict.Message, ev)} }
+	return nil
+}
+
+// hookMessage limita lo que se enseña al cliente a una línea corta
+func hookMessage(msg string, ev hookEvent) string {
+	msg, _, _ = strings.Cut(strings.TrimSpace(msg), "\n")
+	if msg == "" { return fmt.Sprintf("Rechazado por la política del servidor (%s)", ev.Event) }
+	return truncateRunes(msg, 200)
+}
+
+// limitedBuffer guarda como mucho n bytes y descarta el resto sin fallar,
+// para que un gancho muy hablador no se bloquee escribiendo
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.n - b.buf.Len(); room > 0 { b.buf.Write(p[:min(len(p), room)]) }
+	return len(p), nil
+}
+
+// runPreHooks llama en orden a los ganchos de un evento pre-*; el primero
+// que rechaza decide
+func runPreHooks(ctx context.Context, ev hookEvent) error {
+	ev.Time = time.Now().UTC()
+	for _, target := range hooks[ev.Event] {
+		hctx, cancel := context.WithTimeout(ctx, hookTimeout)
+		err := callHook(hctx, target, ev)
+		cancel()
+		var rejected *hookRejected
+		if errors.As(err, &rejected) {
+			log.Printf("Gancho %s rechazó %s: %s", ev.Event, ev.Path, rejected.Message)
+			return err
+		}
+		if err != nil {
+			log.Printf("Gancho %s falló con %s: %v", ev.Event, ev.Path, err)
+			return &hookRejected{Message: "No se pudo comprobar la política del servidor; inténtalo más tarde"}
+		}
+	}
+	return nil
+}
+
+// preUploadHook comprueba un archivo recibido en tmp antes de publicarlo en
+// dstPath: primero las reglas de subida y luego los ganchos pre-upload
+func preUploadHook(ctx context.Context, tmp, dstPath string, size int64, sum string) error {
+	if err := checkUploadRules(ctx, tmp, dstPath, size); err != nil { return err }
+	if !hooksFor(hookPreUpload) { return nil }
+	actor, _ := ctx.Value(hookActorKey{}).(hookActor)
+	return runPreHooks(ctx, hookEvent{Event: hookPreUpload, Path: relPath(dstPath), File: tmp, Size: size, SHA256: sum, User: actor.User, IP: actor.IP})
+}
+
+// downloadHookDenied aplica pre-download; si niega, ya ha respondido con 403
+func downloadHookDenied(w http.ResponseWriter, r *http.Request, abs string, info os.FileInfo) bool {
+	if !hooksFor(hookPreDownload) { return false }
+	ev := hookEvent{Event: hookPreDownload, Path: relPath(abs), File: abs, Size: info.Size(), User: currentUser(r), IP: clientIP(r)}
+	ev.SHA256, _ = knownSHA256(ev.Path, info)
+	err := runPreHooks(r.Context(), ev)
+	if err == nil { return false }
+	failWith(w, "hook_denied", err.Error(), 403)
+	return true
+}
+
+// firePostHooks encola un trabajo por gancho; cada uno se reintenta por su cuenta
+func firePostHooks(ev hookEvent) {
+	if !hooksFor(ev.Event) { return }
+	ev.Time = time.Now().UTC()
+	for _, target := range hooks[ev.Event] {
+		job, err := json.Marshal(hookJob{Hook: target, Event: ev})
+		if err != nil { continue }
+		jobs.Enqueue("hook", string(job))
+	}
+}
+
+// postUploadHook avisa de un archivo ya publicado
+func postUploadHook(r *http.Request, dstPath, sum string, size int64) {
+	if !hooksFor(hookPostUpload) { return }
+	firePostHooks(hookEvent{Event: hookPostUpload, Path: relPath(dstPath), File: dstPath, Size: size, SHA256: sum, User: currentUser(r), IP: clientIP(r)})
+}
+
+// postDeleteHook avisa de un borrado definitivo; owner es el de undoOwner
+// ("user:..." o "ip:...") o quien borra sin petición (caducidad)
+func postDeleteHook(rel, owner string) {
+	if !hooksFor(hookPostDelete) { return }
+	ev := hookEvent{Event: hookPostDelete, Path: rel}
+	if user, ok := strings.CutPrefix(owner, "user:"); ok { ev.User = user } else if ip, ok := strings.CutPrefix(owner, "ip:"); ok { ev.IP = ip } else { ev.User = owner }
+	firePostHooks(ev)
+}
+
+// hookJob es el destino de un trabajo "hook" en la cola
+type hookJob struct {
+	Hook  string    `json:"hook"`
+	Event hookEvent `json:"event"`
+}
+
+func runHookJob(ctx context.Context, target string) error {
+	var j hookJob
+	if err := json.Unmarshal([]byte(target), &j); err != nil { return nil }
+	// Un gancho que ya no está configurado no se llama
+	if !slices.Contains(hooks[j.Event.Event], j.Hook) { return nil }
+	var before os.FileInfo
+	if j.Event.File != "" { before, _ = os.Stat(j.Event.File) }
+	ctx, cancel := context.WithTimeout(ctx, postHookTimeout)
+	defer cancel()
+	err := callHook(ctx, j.Hook, j.Event)
+	var rejected *hookRejected
+	if errors.As(err, &rejected) { return fmt.Errorf("el gancho falló: %s", rejected.Message) }
+	if err != nil { return err }
+	// Si el gancho cambió el archivo (marca de agua, recompresión), el hash
+	// guardado ya no vale: se recalcula al pedirlo
+	if before != nil {
+		if after, err := os.Stat(j.Event.File); err == nil && (after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime())) { contentChanged() }
+	}
+	return nil
+}
+
+// --- PLUGINS WASM ---
+
+// Un gancho cuyo destino termina en .wasm es un módulo WebAssembly (WASI) que
+// se ejecuta dentro del propio proceso con wazero, sin lanzar comandos: sirve
+// para validadores o procesados de terceros en los que no se quiere confiar.
+// Sigue el contrato de los comandos (el JSON por la entrada estándar, el
+// mensaje por la salida y el código de salida como veredicto), pero el módulo
+// no ve el sistema de archivos, la red ni el entorno del servidor; solo las
+// funciones del módulo "cerbero", que le dejan tocar el archivo de su evento
+// y nada más:
+//   - file_size() i64: tamaño del archivo (-1 si el evento no tiene archivo)
+//   - read_file(offset i64, ptr, len i32) i32: lee del archivo en su memoria;
+//     devuelve los bytes leídos, 0 al final o -1 si no puede
+//   - write_file(ptr, len i32) i32: sustituye el contenido del archivo, solo
+//     en post-upload (marcas de agua, recompresión); 0 o -1
+//   - log(ptr, len i32): escribe una línea en el registro del servidor
+// Cada ejecución tiene el tiempo de su gancho y -plugin-memory-mb de memoria.
+
+var (
+	pluginMemoryMB int
+	wasmRuntime    wazero.Runtime
+	wasmPlugins    = make(map[string]wazero.CompiledModule)
+)
+
+func isWasmPlugin(target string) bool { return strings.HasSuffix(target, ".wasm") }
+
+// loadWasmPlugin compila el módulo al arrancar, para que un plugin roto se
+// note antes de la primera subida
+func loadWasmPlugin(target string) error {
+	if wasmPlugins[target] != nil { return nil }
+	ctx := context.Background()
+	if wasmRuntime == nil {
+		if pluginMemoryMB < 1 || pluginMemoryMB > 4096 { return fmt.Errorf("-plugin-memory-mb debe estar entre 1 y 4096") }
+		cfg := wazero.NewRuntimeConfig().WithMemoryLimitPages(uint32(pluginMemoryMB) * 16).WithCloseOnContextDone(true)
+		rt := wazero.NewRuntimeWithConfig(ctx, cfg)
+		if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil { return err }
+		_, err := rt.NewHostModuleBuilder("cerbero").
+			NewFunctionBuilder().WithFunc(wasmFileSize).Export("file_size").
+			NewFunctionBuilder().WithFunc(wasmReadFile).Export("read_file").
+			NewFunctionBuilder().WithFunc(wasmWriteFile).Export("write_file").
+			NewFunctionBuilder().WithFunc(wasmLog).Export("log").
+			Instantiate(ctx)
+		if err != nil { return err }
+		wasmRuntime = rt
+	}
+	bin, err := os.ReadFile(target)
+	if err != nil { return err }
+	compiled, err := wasmRuntime.CompileModule(ctx, bin)
+	if err != nil { return fmt.Errorf("%s: %v", target, err) }
+	wasmPlugins[target] = compiled
+	return nil
+}
+
+// wasmCallKey lleva en el contexto la ejecución en curso a las funciones del
+// módulo "cerbero"
+type wasmCallKey struct{}
+
+// wasmCall es lo que puede tocar una ejecución: el archivo de su evento
+type wasmCall struct {
+	name string
+	ev   hookEvent
+	f    *os.File
+}
+
+func (c *wasmCall) file() *os.File {
+	if c.f == nil && c.ev.File != "" { c.f, _ = os.Open(c.ev.File) }
+	return c.f
+}
+
+func (c *wasmCall) close() {
+	if c.f != nil { c.f.Close(); c.f = nil }
+}
+
+// runWasmPlugin ejecuta el plugin con el JSON del evento. code es su código de
+// salida; err, que no ha podido terminar (tiempo, memoria, trampa)
+func runWasmPlugin(ctx context.Context, target string, ev hookEvent, input []byte) (stdout, stderr []byte, code uint32, err error) {
+	compiled := wasmPlugins[target]
+	if compiled == nil { return nil, nil, 0, fmt.Errorf("%s no está cargado", target) }
+	call := &wasmCall{name: filepath.Base(target), ev: ev}
+	defer call.close()
+	var out, errOut bytes.Buffer
+	cfg := wazero.NewModuleConfig().WithName("").WithArgs(call.name).
+		WithEnv("CERBERO_EVENT", ev.Event).WithEnv("CERBERO_PATH", ev.Path).
+		WithStdin(bytes.NewReader(input)).
+		WithStdout(&limitedBuffer{&out, maxHookReplySize}).WithStderr(&limitedBuffer{&errOut, maxHookReplySize}).
+		WithSysWalltime().WithSysNanotime()
+	mod, err := wasmRuntime.InstantiateModule(context.WithValue(ctx, wasmCallKey{}, call), compiled, cfg)
+	if mod != nil { mod.Close(context.Background()) }
+	var exit *sys.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return nil, nil, 0, fmt.Errorf("%s: %v", call.name, ctx.Err())
+	case errors.As(err, &exit):
+		return out.Bytes(), errOut.Bytes(), exit.ExitCode(), nil
+	case err != nil:
+		return nil, nil, 0, fmt.Errorf("%s: %v", call.name, err)
+	}
+	return out.Bytes(), errOut.Bytes(), 0, nil
+}
+
+func wasmFileSize(ctx context.Context, m api.Module) int64 {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	if call == nil || call.file() == nil { return -1 }
+	info, err := call.f.Stat()
+	if err != nil { return -1 }
+	return info.Size()
+}
+
+func wasmReadFile(ctx context.Context, m api.Module, offset uint64, ptr, n uint32) int32 {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	if call == nil || call.file() == nil || int64(offset) < 0 { return -1 }
+	buf, ok := m.Memory().Read(ptr, n)
+	if !ok { return -1 }
+	read, err := call.f.ReadAt(buf, int64(offset))
+	if err != nil && !errors.Is(err, io.EOF) { return -1 }
+	return int32(read)
+}
+
+// wasmWriteFile sustituye el archivo de un post-upload de una vez, como hace
+// cualquier subida: a un temporal en la misma carpeta y luego renombrado
+func wasmWriteFile(ctx context.Context, m api.Module, ptr, n uint32) int32 {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	if call == nil || call.ev.Event != hookPostUpload || call.ev.File == "" { return -1 }
+	data, ok := m.Memory().Read(ptr, n)
+	if !ok { return -1 }
+	info, err := os.Stat(call.ev.File)
+	if err != nil { return -1 }
+	tmp, err := os.CreateTemp(filepath.Dir(call.ev.File), ".cerbero-plugin-*")
+	if err != nil { return -1 }
+	_, err = tmp.Write(data)
+	if err == nil { err = tmp.Chmod(info.Mode().Perm()) }
+	if cerr := tmp.Close(); err == nil { err = cerr }
+	if err == nil { err = os.Rename(tmp.Name(), call.ev.File) }
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("Plugin %s no pudo escribir %s: %v", call.name, call.ev.Path, err)
+		return -1
+	}
+	// Las lecturas siguientes ven ya el contenido nuevo
+	call.close()
+	return 0
+}
+
+func wasmLog(ctx context.Context, m api.Module, ptr, n uint32) {
+	call, _ := ctx.Value(wasmCallKey{}).(*wasmCall)
+	msg, ok := m.Memory().Read(ptr, n)
+	if call == nil || !ok { return }
+	log.Printf("Plugin %s (%s %s): %s", call.name, call.ev.Event, call.ev.Path, truncateRunes(strings.TrimSpace(string(msg)), 500))
+}
+
+// --- REGLAS DE SUBIDA ---
+
+// Un archivo de reglas (-rules) decide qué subidas se aceptan y a qué carpeta
+// van. Una regla por línea; # empieza un comentario:
+//
+//	reject ext in [.exe, .bat] and role != admin : "Aquí no se suben ejecutables"
+//	reject size > 2GB
+//	route *.jpg or *.jpeg -> /fotos
+//	allow user == ana
+//
+// Las allow y reject se miran con el archivo ya recibido y la primera que se
+// cumple decide; si ninguna lo hace, la subida sigue. Las route se miran al
+// elegir el destino y gana la primera que se cumple. Los campos son name, ext
+// (en minúsculas, con el punto), dir, path, size, user, role, ip y mime; un
+// patrón suelto equivale a "name matches patrón" y matches no distingue
+// mayúsculas
+
+var (
+	rulesFile string
+	rules     = &ruleSet{}
+)
+
+// ruleFacts es lo que una regla sabe de una subida
+type ruleFacts struct {
+	Name string `json:"name"`
+	Dir  string `json:"dir"`
+	Size int64  `json:"size"`
+	User string `json:"user"`
+	Role string `json:"role"`
+	IP   string `json:"ip"`
+	MIME string `json:"mime"`
+}
+
+func factsFor(rel string) ruleFacts {
+	dir := path.Dir(rel)
+	if dir == "." { dir = "" }
+	return ruleFacts{Name: path.Base(rel), Dir: dir}
+}
+
+func (f ruleFacts) field(name string) string {
+	switch name {
+	case "name":
+		return f.Name
+	case "ext":
+		return strings.ToLower(path.Ext(f.Name))
+	case "dir":
+		return f.Dir
+	case "path":
+		return path.Join(f.Dir, f.Name)
+	case "user":
+		return f.User
+	case "role":
+		return f.Role
+	case "ip":
+		return f.IP
+	case "mime":
+		base, _, _ := strings.Cut(f.MIME, ";")
+		return strings.TrimSpace(base)
+	}
+	return ""
+}
+
+var ruleFields = []string{"name", "ext", "dir", "path", "size", "user", "role", "ip", "mime"}
+
+type ruleCond interface{ match(f ruleFacts) bool }
+
+type ruleAll []ruleCond
+
+func (c ruleAll) match(f ruleFacts) bool {
+	for _, sub := range c {
+		if !sub.match(f) { return false }
+	}
+	return true
+}
+
+type ruleAny []ruleCond
+
+func (c ruleAny) match(f ruleFacts) bool {
+	for _, sub := range c {
+		if sub.match(f) { return true }
+	}
+	return false
+}
+
+type ruleNot struct{ c ruleCond }
+
+func (c ruleNot) match(f ruleFacts) bool { return !c.c.match(f) }
+
+// ruleTest compara un campo con uno o varios valores; size es el único numérico
+type ruleTest struct {
+	field, op string
+	strs      []string
+	nums      []int64
+}
+
+func (t ruleTest) match(f ruleFacts) bool {
+	if t.field == "size" {
+		n := t.nums[0]
+		switch t.op {
+		case "==":
+			return f.Size == n
+		case "!=":
+			return f.Size != n
+		case "<":
+			return f.Size < n
+		case "<=":
+			return f.Size <= n
+		case ">":
+			return f.Size > n
+		case ">=":
+			return f.Size >= n
+		case "in":
+			return slices.Contains(t.nums, f.Size)
+		}
+		return false
+	}
+	v := f.field(t.field)
+	switch t.op {
+	case "==":
+		return v == t.strs[0]
+	case "!=":
+		return v != t.strs[0]
+	case "in":
+		return slices.Contains(t.strs, v)
+	case "matches":
+		v = strings.ToLower(v)
+		for _, glob := range t.strs {
+			if ok, _ := path.Match(glob, v); ok { return true }
+		}
+	}
+	return false
+}
+
+// uploadRule es una línea del archivo de reglas
+type uploadRule struct {
+	Line    int    `json:"line"`
+	Text    string `json:"text"`
+	Action  string `json:"action"`
+	Target  string `json:"target,omitempty"`
+	Message string `json:"message,omitempty"`
+	cond    ruleCond
+}
+
+type ruleToken struct {
+	text   string
+	quoted bool // cadena entre comillas: nunca es palabra clave
+}
+
+var ruleUnits = map[string]int64{"": 1, "b": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30, "tb": 1 << 40}
+
+// lexRule parte una línea en palabras, cadenas y operadores. Lo que no lleva
+// comillas llega hasta el siguiente espacio u operador, así que .exe o *.jpg
+// se pueden escribir tal cual
+func lexRule(line string) ([]ruleToken, error) {
+	var out []ruleToken
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '#':
+			return out, nil
+		case c == '"':
+			q, err := strconv.QuotedPrefix(line[i:])
+			if err != nil { return nil, errors.New("comillas sin cerrar") }
+			s, _ := strconv.Unquote(q)
+			out = append(out, ruleToken{text: s, quoted: true})
+			i += len(q)
+		case strings.HasPrefix(line[i:], "==") || strings.HasPrefix(line[i:], "!=") || strings.HasPrefix(line[i:], "<=") || strings.HasPrefix(line[i:], ">=") || strings.HasPrefix(line[i:], "->"):
+			out = append(out, ruleToken{text: line[i : i+2]})
+			i += 2
+		case strings.IndexByte("<>()[],:", c) >= 0:
+			out = append(out, ruleToken{text: line[i : i+1]})
+			i++
+		default:
+			j := i
+			for j < len(line) && strings.IndexByte(" \t#\"<>=!()[],:", line[j]) < 0 && !strings.HasPrefix(line[j:], "->") { j++ }
+			if j == i { return nil, fmt.Errorf("no se esperaba %q", c) }
+			out = append(out, ruleToken{text: line[i:j]})
+			i = j
+		}
+	}
+	return out, nil
+}
+
+type ruleParser struct {
+	toks []ruleToken
+	pos  int
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos >= len(p.toks) || p.toks[p.pos].quoted { return "" }
+	return p.toks[p.pos].text
+}
+
+func (p *ruleParser) next() (ruleToken, bool) {
+	if p.pos >= len(p.toks) { return ruleToken{}, false }
+	p.pos++
+	return p.toks[p.pos-1], true
+}
+
+func (p *ruleParser) expect(text string) error {
+	if p.peek() != text { return fmt.Errorf("se esperaba %q", text) }
+	p.pos++
+	return nil
+}
+
+func (p *ruleParser) or() (ruleCond, error) {
+	var alts ruleAny
+	for {
+		c, err := p.and()
+		if err != nil { return nil, err }
+		alts = append(alts, c)
+		if p.peek() != "or" { break }
+		p.pos++
+	}
+	if len(alts) == 1 { return alts[0], nil }
+	return alts, nil
+}
+
+func (p *ruleParser) and() (ruleCond, error) {
+	var all ruleAll
+	for {
+		c, err := p.unary()
+		if err != nil { return nil, err }
+		all = append(all, c)
+		if p.peek() != "and" { break }
+		p.pos++
+	}
+	if len(all) == 1 { return all[0], nil }
+	return all, nil
+}
+
+func (p *ruleParser) unary() (ruleCond, error) {
+	switch p.peek() {
+	case "not":
+		p.pos++
+		c, err := p.unary()
+		if err != nil { return nil, err }
+		return ruleNot{c}, nil
+	case "(":
+		p.pos++
+		c, err := p.or()
+		if err != nil { return nil, err }
+		return c, p.expect(")")
+	}
+	return p.test()
+}
+
+func (p *ruleParser) test() (ruleCond, error) {
+	tok, ok := p.next()
+	if !ok { return nil, errors.New("falta la condición") }
+	if tok.quoted || !slices.Contains(ruleFields, tok.text) {
+		// Un patrón suelto: *.jpg
+		if !tok.quoted && (tok.text == "" || strings.Contains("()[],:", tok.text) || slices.Contains([]string{"and", "or", "not", "->", "to"}, tok.text)) {
+			return nil, fmt.Errorf("se esperaba un campo (%s) o un patrón, no %q", strings.Join(ruleFields, ", "), tok.text)
+		}
+		if _, err := path.Match(tok.text, ""); err != nil { return nil, fmt.Errorf("patrón no válido: %q", tok.text) }
+		return ruleTest{field: "name", op: "matches", strs: []string{strings.ToLower(tok.text)}}, nil
+	}
+	t := ruleTest{field: tok.text}
+	op, _ := p.next()
+	t.op = op.text
+	numeric := t.field == "size"
+	switch {
+	case op.quoted:
+		return nil, fmt.Errorf("se esperaba un operador tras %s", t.field)
+	case t.op == "in", t.op == "matches" && !numeric:
+	case slices.Contains([]string{"==", "!="}, t.op):
+	case numeric && slices.Contains([]string{"<", "<=", ">", ">="}, t.op):
+	default:
+		return nil, fmt.Errorf("operador %q no válido para %s", t.op, t.field)
+	}
+	var values []string
+	if p.peek() == "[" {
+		if t.op != "in" && t.op != "matches" { return nil, fmt.Errorf("una lista solo vale con in o matches") }
+		p.pos++
+		for {
+			v, ok := p.next()
+			if !ok || (!v.quoted && strings.Contains("[](),:", v.text)) { return nil, errors.New("lista mal cerrada") }
+			values = append(values, v.text)
+			if p.peek() == "]" { p.pos++; break }
+			if err := p.expect(","); err != nil { return nil, err }
+		}
+	} else {
+		v, ok := p.next()
+		if !ok || (!v.quoted && v.text == "") { return nil, fmt.Errorf("falta el valor de %s", t.field) }
+		values = []string{v.text}
+	}
+	for _, v := range values {
+		switch t.field {
+		case "size":
+			n, err := parseRuleSize(v)
+			if err != nil { return nil, err }
+			t.nums = append(t.nums, n)
+			continue
+		case "ext":
+			// .EXE y exe valen lo mismo que .exe
+			if v = strings.ToLower(v); v != "" && !strings.HasPrefix(v, ".") && t.op != "matches" { v = "." + v }
+		}
+		if t.op == "matches" {
+			v = strings.ToLower(v)
+			if _, err := path.Match(v, ""); err != nil { return nil, fmt.Errorf("patrón no válido: %q", v) }
+		}
+		t.strs = append(t.strs, v)
+	}
+	return t, nil
+}
+
+// parseRuleSize entiende 500, 10KB, 1.5GB...
+func parseRuleSize(s string) (int64, error) {
+	i := len(s)
+	for i > 0 && (s[i-1] < '0' || s[i-1] > '9') { i-- }
+	unit, ok := ruleUnits[strings.ToLower(s[i:])]
+	n, err := strconv.ParseFloat(s[:i], 64)
+	if !ok || err != nil || n < 0 { return 0, fmt.Errorf("tamaño no válido: %q", s) }
+	return int64(n * float64(unit)), nil
+}
+
+// parseRule interpreta una línea: reject cond [: "mensaje"], allow cond o
+// route cond -> carpeta
+func parseRule(line string) (uploadRule, error) {
+	toks, err := lexRule(line)
+	if err != nil || len(toks) == 0 { return uploadRule{}, err }
+	rule := uploadRule{Text: strings.TrimSpace(line), Action: toks[0].text}
+	if toks[0].quoted || (rule.Action != "allow" && rule.Action != "reject" && rule.Action != "route") {
+		return rule, fmt.Errorf("acción desconocida %q (allow, reject o route)", toks[0].text)
+	}
+	p := &ruleParser{toks: toks, pos: 1}
+	if rule.cond, err = p.or(); err != nil { return rule, err }
+	switch rule.Action {
+	case "route":
+		if p.peek() != "->" && p.peek() != "to" { return rule, errors.New("route necesita -> carpeta") }
+		p.pos++
+		target, ok := p.next()
+		if !ok { return rule, errors.New("falta la carpeta de destino") }
+		if rule.Target = strings.Trim(target.text, "/"); strings.Contains("/"+rule.Target+"/", "/../") { return rule, errors.New("la carpeta no puede salir de la raíz") }
+	case "reject":
+		if p.peek() == ":" {
+			p.pos++
+			msg, ok := p.next()
+			if !ok { return rule, errors.New("falta el mensaje tras :") }
+			rule.Message = msg.text
+		}
+	}
+	if p.pos < len(toks) { return rule, fmt.Errorf("sobra %q", toks[p.pos].text) }
+	return rule, nil
+}
+
+func parseRules(text string) ([]uploadRule, error) {
+	var out []uploadRule
+	for i, line := range strings.Split(text, "\n") {
+		rule, err := parseRule(line)
+		if err != nil { return nil, fmt.Errorf("línea %d: %v", i+1, err) }
+		if rule.cond == nil { continue }
+		rule.Line = i + 1
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+// ruleSet guarda las reglas de -rules y las vuelve a leer si el archivo cambia;
+// si la versión nueva no se entiende, siguen valiendo las anteriores
+type ruleSet struct {
+	mu   sync.Mutex
+	mod  time.Time
+	size int64
+	list []uploadRule
+	err  error
+}
+
+func (s *ruleSet) Load() error {
+	if rulesFile == "" { return nil }
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reload()
+}
+
+// reload se llama con s.mu tomado
+func (s *ruleSet) reload() error {
+	info, err := os.Stat(rulesFile)
+	if err != nil { return err }
+	if info.ModTime().Equal(s.mod) && info.Size() == s.size { return s.err }
+	s.mod, s.size = info.ModTime(), info.Size()
+	data, err := os.ReadFile(rulesFile)
+	if err == nil {
+		var list []uploadRule
+		if list, err = parseRules(string(data)); err == nil { s.list = list }
+	}
+	if err != nil && s.list != nil { log.Printf("Reglas: %s no se ha recargado, siguen las anteriores: %v", rulesFile, err) }
+	s.err = err
+	return err
+}
+
+func (s *ruleSet) Rules() ([]uploadRule, error) {
+	if rulesFile == "" { return nil, nil }
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reload()
+	return s.list, s.err
+}
+
+func (s *ruleSet) Active() bool { return rulesFile != "" }
+
+// Check busca la primera allow o reject que se cumple; nil si ninguna
+func (s *ruleSet) Check(f ruleFacts) *uploadRule {
+	list, _ := s.Rules()
+	for i := range list {
+		if list[i].Action != "route" && list[i].cond.match(f) { return &list[i] }
+	}
+	return nil
+}
+
+// Route busca la primera route que se cumple; nil si ninguna
+func (s *ruleSet) Route(f ruleFacts) *uploadRule {
+	list, _ := s.Rules()
+	for i := range list {
+		if list[i].Action == "route" && list[i].cond.match(f) { return &list[i] }
+	}
+	return nil
+}
+
+// uploadRoleKey fija en el contexto el rol con el que se sube cuando no sale de
+// las cabeceras: la clave en el formulario o un enlace de subida
+type uploadRoleKey struct{}
+
+// requestRole es el rol con el que actúa la petición para las reglas: el de la
+// clave de API o la sesión; con la clave compartida (o sin clave) es admin
+func requestRole(r *http.Request) string {
+	if role, ok := r.Context().Value(uploadRoleKey{}).(string); ok { return role }
+	if bearerToken(r) != "" {
+		k := apiKeyFor(r)
+		for _, role := range []string{roleAdmin, roleWrite, roleRead} {
+			if k != nil && k.Allows(role) { return role }
+		}
+		return ""
+	}
+	if s := sessionFor(r); s != nil { return s.Role }
+	if password == "" && !loginEnabled() { return roleAdmin }
+	if sent, ok := headerPassword(r); ok && password != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(password)) == 1 { return roleAdmin }
+	return ""
+}
+
+// routeUpload aplica las route a una subida de name en dir y devuelve la
+// carpeta donde debe acabar. El tamaño es el anunciado (0 si no se sabe) y el
+// tipo, el de la extensión, porque aún no se ha leído nada
+func routeUpload(r *http.Request, dir, name string, size int64) string {
+	if !rules.Active() { return dir }
+	f := factsFor(path.Join(strings.Trim(dir, "/"), name))
+	f.Size, f.User, f.Role, f.IP, f.MIME = size, currentUser(r), requestRole(r), clientIP(r), mimeByExtension(name)
+	if rule := rules.Route(f); rule != nil { return rule.Target }
+	return dir
+}
+
+// checkUploadRules aplica allow y reject al temporal ya completo; una negativa
+// es un *hookRejected para que cada forma de subir responda como con un gancho
+func checkUploadRules(ctx context.Context, tmp, dstPath string, size int64) error {
+	if !rules.Active() { return nil }
+	actor, _ := ctx.Value(hookActorKey{}).(hookActor)
+	f := factsFor(relPath(dstPath))
+	f.Size, f.User, f.Role, f.IP, f.MIME = size, actor.User, actor.Role, actor.IP, sniffContentType(tmp, dstPath)
+	rule := rules.Check(f)
+	if rule == nil || rule.Action == "allow" { return nil }
+	msg := rule.Message
+	if msg == "" { msg = fmt.Sprintf("Una regla no permite esta subida (línea %d)", rule.Line) }
+	return &hookRejected{Message: msg}
+}
+
+// rulesHandler es GET /api/v1/rules (las reglas cargadas) y POST
+// /api/v1/rules/test, que dice qué pasaría con una subida sin hacerla
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	if !rules.Active() { failWith(w, "not_found", "No hay reglas de subida (-rules)", 404); return }
+	list, err := rules.Rules()
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "GET" {
+		out := map[string]interface{}{"file": rulesFile, "rules": list}
+		if err != nil { out["error"] = err.Error() }
+		json.NewEncoder(w).Encode(out)
+		return
+	}
+	var f ruleFacts
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&f); err != nil || f.Name == "" {
+		failWith(w, "bad_request", "Se esperaba un JSON con al menos name", 400)
+		return
+	}
+	// name puede traer la carpeta: "fotos/a.jpg"
+	full := factsFor(path.Join(strings.Trim(f.Dir, "/"), f.Name))
+	f.Name, f.Dir = full.Name, full.Dir
+	if f.MIME == "" { f.MIME = mimeByExtension(f.Name) }
+	out := struct {
+		Action string      `json:"action"`
+		Path   string      `json:"path"`
+		Rule   *uploadRule `json:"rule,omitempty"`
+		Route  *uploadRule `json:"route,omitempty"`
+	}{Action: "allow", Path: path.Join(f.Dir, f.Name)}
+	if out.Route = rules.Route(f); out.Route != nil {
+		f.Dir = out.Route.Target
+		out.Path = path.Join(f.Dir, f.Name)
+	}
+	if out.Rule = rules.Check(f); out.Rule != nil { out.Action = out.Rule.Action }
+	json.NewEncoder(w).Encode(out)
+}
+
+// --- BORRADO CON DESHACER ---
+
+// Lo que se borra desde el listado (botón X o barra de selección) no se
+// elimina enseguida: se aparta a la papelera (.cerbero/trash-*, o dentro de la
+// carpeta de -share para no cruzar de disco) y el listado ofrece "Deshacer"
+// durante -undo-seconds. Pasado ese tiempo, o en cuanto quien borró carga otra
+// página, se borra de verdad. Los borrados por la API, S3 o REST son
+// inmediatos, y lo que quede apartado al reiniciar se elimina al arrancar.
+
+type stagedDelete struct {
+	Src    string
+	Staged string
+}
+
+type pendingDelete struct {
+	Token    string
+	Owner    string
+	Items    []stagedDelete
+	Deadline time.Time
+	timer    *time.Timer
+}
+
+type DeletionQueue struct {
+	mu sync.Mutex
+	m  map[string]*pendingDelete
+}
+
+var deletions = DeletionQueue{m: make(map[string]*pendingDelete)}
+
+// undoOwner identifica a quien borró: el usuario o, sin sesión, su IP
+func undoOwner(r *http.Request) string {
+	if user := currentUser(r); user != "" { return "user:" + user }
+	return "ip:" + clientIP(r)
+}
+
+// withUndo añade a la URL del listado el token del borrado que se puede deshacer
+func withUndo(u, token string) string {
+	if token == "" { return u }
+	if strings.Contains(u, "?") { return u + "&undo=" + url.QueryEscape(token) }
+	return u + "?undo=" + url.QueryEscape(token)
+}
+
+// trashPath es donde se aparta el elemento i de un borrado pendiente
+func trashPath(src, token string, i int) string {
+	if m := mountOf(src); m != nil { return filepath.Join(m.dir, fmt.Sprintf(".cerbero-trash-%s-%d", token, i)) }
+	return filepath.Join(stateDir, fmt.Sprintf("trash-%s-%d", token, i))
+}
+
+// Stage aparta las rutas (ya validadas) y programa su borrado definitivo; si
+// alguna no se puede mover, devuelve las anteriores a su sitio
+func (q *DeletionQueue) Stage(r *http.Request, paths []string) (string, error) {
+	p := &pendingDelete{Token: randomToken(12), Owner: undoOwner(r), Deadline: time.Now().Add(time.Duration(undoSeconds) * time.Second)}
+	for i, src := range paths {
+		staged := trashPath(src, p.Token, i)
+		if err := os.Rename(src, staged); err != nil {
+			for j := len(p.Items) - 1; j >= 0; j-- { os.Rename(p.Items[j].Staged, p.Items[j].Src) }
+			return "", err
+		}
+		p.Items = append(p.Items, stagedDelete{Src: src, Staged: staged})
+	}
+	q.mu.Lock()
+	q.m[p.Token] = p
+	p.timer = time.AfterFunc(time.Until(p.Deadline), func() { q.Finalize(p.Token) })
+	q.mu.Unlock()
+	contentChanged()
+	return p.Token, nil
+}
+
+// take saca el borrado pendiente de la cola, o nil si ya no está
+func (q *DeletionQueue) take(token string) *pendingDelete {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p := q.m[token]
+	if p == nil { return nil }
+	delete(q.m, token)
+	p.timer.Stop()
+	return p
+}
+
+// Finalize borra definitivamente lo apartado con ese token
+func (q *DeletionQueue) Finalize(token string) {
+	p := q.take(token)
+	if p == nil { return }
+	for _, it := range p.Items {
+		// Si mientras tanto se subió otro con el mismo nombre, sus datos son suyos
+		filepath.WalkDir(it.Staged, func(staged string, d os.DirEntry, walkErr error) error {
+			src := it.Src + strings.TrimPrefix(staged, it.Staged)
+			if _, err := os.Lstat(src); err != nil {
+				forgetPath(relPath(src))
+				if walkErr == nil && d.Type().IsRegular() { postDeleteHook(relPath(src), p.Owner) }
+			}
+			return nil
+		})
+		if err := os.RemoveAll(it.Staged); err != nil { log.Printf("No se pudo vaciar %s de la papelera: %v", relPath(it.Src), err) }
+	}
+}
+
+// Settle confirma los borrados pendientes de quien carga una página, salvo
+// el que esa página ofrece deshacer
+func (q *DeletionQueue) Settle(r *http.Request, keep string) {
+	owner := undoOwner(r)
+	var tokens []string
+	q.mu.Lock()
+	for token, p := range q.m {
+		if p.Owner == owner && token != keep { tokens = append(tokens, token) }
+	}
+	q.mu.Unlock()
+	for _, token := range tokens { q.Finalize(token) }
+}
+
+// Get devuelve el borrado pendiente para mostrar su aviso
+func (q *DeletionQueue) Get(token string) (pendingDelete, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p := q.m[token]
+	if p == nil { return pendingDelete{}, false }
+	return *p, true
+}
+
+// Undo devuelve a su sitio lo apartado; lo que ya tiene otro archivo en su
+// ruta se borra definitivamente y se devuelve en conflicts
+func (q *DeletionQueue) Undo(token string) (restored, conflicts []string, ok bool) {
+	p := q.take(token)
+	if p == nil { return nil, nil, false }
+	for _, it := range p.Items {
+		rel := relPath(it.Src)
+		if _, err := os.Lstat(it.Src); err == nil {
+			os.RemoveAll(it.Staged)
+			conflicts = append(conflicts, rel)
+			continue
+		}
+		if err := os.Rename(it.Staged, it.Src); err != nil {
+			log.Printf("No se pudo deshacer el borrado de %s: %v", rel, err)
+			os.RemoveAll(it.Staged)
+			forgetPath(rel)
+			conflicts = append(conflicts, rel)
+			continue
+		}
+		restored = append(restored, rel)
+	}
+	contentChanged()
+	return restored, conflicts, true
+}
+
+// pending indica si el token sigue en plazo para deshacer
+func (q *DeletionQueue) pending(token string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.m[token] != nil
+}
+
+// holds indica si abs está apartado esperando a que se confirme su borrado
+func (q *DeletionQueue) holds(abs string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, p := range q.m {
+		for _, it := range p.Items {
+			if within(it.Src, abs) { return true }
+		}
+	}
+	return false
+}
+
+// sweepTrash elimina lo que quedó apartado si el servidor se paró durante
+// el plazo para deshacer, y lo que dejó un lote interrumpido hace más de una
+// hora. Se ejecuta al arrancar y como tarea "trash" de -schedule
+func sweepTrash(ctx context.Context) error {
+	dirs := []string{stateDir}
+	for _, m := range mounts { dirs = append(dirs, m.dir) }
+	for _, dir := range dirs {
+		entries, _ := os.ReadDir(dir)
+		for _, e := range entries {
+			name := e.Name()
+			if dir != stateDir {
+				var ok bool
+				if name, ok = strings.CutPrefix(name, stateDirName+"-"); !ok { continue }
+			}
+			stale := false
+			if rest, ok := strings.CutPrefix(name, "trash-"); ok {
+				if i := strings.LastIndex(rest, "-"); i > 0 { stale = !deletions.pending(rest[:i]) }
+			} else if strings.HasPrefix(name, "batch-") {
+				info, err := e.Info()
+				stale = err == nil && time.Since(info.ModTime()) > time.Hour
+			}
+			if stale {
+				if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil { log.Printf("No se pudo vaciar %s: %v", e.Name(), err) }
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// undoHandler es POST /undo con el token del aviso
+func undoHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := deletions.Get(r.FormValue("token"))
+	if !ok || p.Owner != undoOwner(r) { failWith(w, "gone", "Ya no se puede deshacer ese borrado", 410); return }
+	restored, conflicts, ok := deletions.Undo(p.Token)
+	if !ok { failWith(w, "gone", "Ya no se puede deshacer ese borrado", 410); return }
+	for _, rel := range restored { audit(r, "undelete", map[string]string{"path": rel}) }
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"restored": restored, "conflicts": conflicts})
+		return
+	}
+	if len(conflicts) > 0 { http.Error(w, "Ya existe otro archivo en: "+strings.Join(conflicts, ", "), 409); return }
+	http.Redirect(w, r, listingURL(filepath.Dir(p.Items[0].Src)), 303)
+}
+
+// --- INSTANTÁNEAS (btrfs/ZFS) ---
+
+// Con -snapshots btrfs (la raíz es un subvolumen) o -snapshots zfs (la raíz
+// está en un dataset) Cerbero crea instantáneas de solo lectura antes de lo
+// que borra en bloque: carpetas con contenido, borrados desde la barra de
+// selección y archivos caducados. Como mucho una automática cada
+// autoSnapshotGap, y se conservan las -snapshot-keep más recientes. En
+// /snapshots se listan, se crean con nombre y se restauran: el árbol de
+// archivos vuelve a como estaba, salvo .cerbero, y antes se hace otra
+// instantánea por si hay que deshacerlo. Las de btrfs se guardan en
+// .cerbero/snapshots; las de ZFS se leen de .zfs/snapshot.
+
+const autoSnapshotGap = 10 * time.Minute
+
+type snapshot struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Auto    bool      `json:"auto"`
+}
+
+var (
+	zfsDataset string // dataset de la raíz (con -snapshots zfs)
+	zfsSubdir  string // ruta de la raíz dentro del dataset
+	snapMu     sync.Mutex
+	lastAutoSnapshot time.Time
+)
+
+// validSnapshotName admite letras, números, ".", "_" y "-" (sin empezar por
+// ellos), que valen tal cual en btrfs y en ZFS
+func validSnapshotName(name string) bool {
+	if name == "" || len(name) > 64 || strings.ContainsAny(name[:1], "._-") { return false }
+	return !strings.ContainsFunc(name, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-')
+	})
+}
+
+func snapshotsEnabled() bool { return snapshotFS != "" }
+
+// snapshotCmd ejecuta btrfs o zfs y devuelve su salida
+func snapshotCmd(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if err != nil { return "", fmt.Errorf("%s: %v: %s", strings.Join(args[:min(3, len(args))], " "), err, strings.TrimSpace(string(out))) }
+	return string(out), nil
+}
+
+// initSnapshots comprueba al arrancar que la raíz admite instantáneas
+func initSnapshots() error {
+	switch snapshotFS {
+	case "":
+		return nil
+	case "btrfs":
+		if _, err := snapshotCmd("btrfs", "subvolume", "show", rootDir); err != nil { return fmt.Errorf("la raíz no es un subvolumen btrfs: %v", err) }
+		return os.MkdirAll(filepath.Join(stateDir, "snapshots"), 0700)
+	case "zfs":
+		out, err := snapshotCmd("zfs", "list", "-H", "-o", "name,mountpoint", rootDir)
+		if err != nil { return fmt.Errorf("la raíz no está en un dataset ZFS: %v", err) }
+		name, mountpoint, _ := strings.Cut(strings.TrimSpace(out), "\t")
+		rel, err := filepath.Rel(mountpoint, rootDir)
+		if err != nil || strings.HasPrefix(rel, "..") { return fmt.Errorf("la raíz no está bajo el punto de montaje %s", mountpoint) }
+		zfsDataset, zfsSubdir = name, rel
+		return nil
+	}
+	return fmt.Errorf("-snapshots admite btrfs o zfs, no %q", snapshotFS)
+}
+
+// snapshotRoot es la carpeta de solo lectura con la raíz tal como estaba
+func snapshotRoot(name string) string {
+	if snapshotFS == "zfs" {
+		out, _ := snapshotCmd("zfs", "get", "-H", "-o", "value", "mountpoint", zfsDataset)
+		return filepath.Join(strings.TrimSpace(out), ".zfs", "snapshot", name, zfsSubdir)
+	}
+	return filepath.Join(stateDir, "snapshots", name)
+}
+
+func createSnapshot(name string) error {
+	if !validSnapshotName(name) { return errors.New("nombre no válido (letras, números, . _ -)") }
+	if snapshotFS == "zfs" {
+		_, err := snapshotCmd("zfs", "snapshot", zfsDataset+"@"+name)
+		return err
+	}
+	dst := filepath.Join(stateDir, "snapshots", name)
+	if _, err := os.Lstat(dst); err == nil { return errors.New("ya existe una instantánea con ese nombre") }
+	_, err := snapshotCmd("btrfs", "subvolume", "snapshot", "-r", rootDir, dst)
+	return err
+}
+
+func deleteSnapshot(name string) error {
+	if !validSnapshotName(name) { return errors.New("nombre no válido") }
+	if snapshotFS == "zfs" {
+		_, err := snapshotCmd("zfs", "destroy", zfsDataset+"@"+name)
+		return err
+	}
+	_, err := snapshotCmd("btrfs", "subvolume", "delete", filepath.Join(stateDir, "snapshots", name))
+	return err
+}
+
+// listSnapshots devuelve las instantáneas de la más nueva a la más antigua
+func listSnapshots() ([]snapshot, error) {
+	var list []snapshot
+	if snapshotFS == "zfs" {
+		out, err := snapshotCmd("zfs", "list", "-H", "-p", "-t", "snapshot", "-d", "1", "-o", "name,creation", zfsDataset)
+		if err != nil { return nil, err }
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			full, created, ok := strings.Cut(line, "\t")
+			_, name, _ := strings.Cut(full, "@")
+			secs, err := strconv.ParseInt(strings.TrimSpace(created), 10, 64)
+			if !ok || err != nil || name == "" { continue }
+			list = append(list, snapshot{Name: name, Created: time.Unix(secs, 0)})
+		}
+	} else {
+		entries, err := os.ReadDir(filepath.Join(stateDir, "snapshots"))
+		if err != nil { return nil, err }
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || !e.IsDir() { continue }
+			list = append(list, snapshot{Name: e.Name(), Created: info.ModTime()})
+		}
+	}
+	for i := range list { list[i].Auto = strings.HasPrefix(list[i].Name, "auto-") }
+	slices.SortFunc(list, func(a, b snapshot) int { return b.Created.Compare(a.Created) })
+	return list, nil
+}
+
+// autoSnapshot se llama antes de un borrado en bloque; un fallo se registra
+// pero no impide el borrado
+func autoSnapshot(reason string) {
+	if !snapshotsEnabled() { return }
+	snapMu.Lock()
+	defer snapMu.Unlock()
+	if time.Since(lastAutoSnapshot) < autoSnapshotGap { return }
+	name := "auto-" + time.Now().Format("20060102-150405") + "-" + reason
+	if err := createSnapshot(name); err != nil { log.Printf("No se pudo crear la instantánea %s: %v", name, err); return }
+	lastAutoSnapshot = time.Now()
+	// Solo se podan las automáticas; las creadas a mano se borran a mano
+	list, err := listSnapshots()
+	if err != nil { return }
+	kept := 0
+	for _, s := range list {
+		if !s.Auto { continue }
+		if kept++; kept > snapshotKeep {
+			if err := deleteSnapshot(s.Name); err != nil { log.Printf("No se pudo borrar la instantánea %s: %v", s.Name, err) }
+		}
+	}
+}
+
+// restoreSnapshot devuelve el árbol de archivos (salvo .cerbero) a como
+// estaba en la instantánea. Lo actual se aparta primero y, si la copia
+// falla, vuelve a su sitio
+func restoreSnapshot(name string) error {
+	if !validSnapshotName(name) { return errors.New("nombre no válido") }
+	src := snapshotRoot(name)
+	entries, err := os.ReadDir(src)
+	if err != nil { return fmt.Errorf("no se puede leer la instantánea: %v", err) }
+	snapMu.Lock()
+	defer snapMu.Unlock()
+	if err := createSnapshot("pre-restore-" + time.Now().Format("20060102-150405")); err != nil { return fmt.Errorf("no se pudo guardar el estado actual: %v", err) }
+	aside, err := os.MkdirTemp(stateDir, "restore-")
+	if err != nil { return err }
+	var moved []string
+	undo := func() {
+		restored, _ := os.ReadDir(rootDir)
+		for _, e := range restored {
+			if e.Name() != stateDirName { os.RemoveAll(filepath.Join(rootDir, e.Name())) }
+		}
+		for _, n := range moved { os.Rename(filepath.Join(aside, n), filepath.Join(rootDir, n)) }
+		os.RemoveAll(aside)
+	}
+	current, _ := os.ReadDir(rootDir)
+	for _, e := range current {
+		if e.Name() == stateDirName { continue }
+		if err := os.Rename(filepath.Join(rootDir, e.Name()), filepath.Join(aside, e.Name())); err != nil { undo(); return err }
+		moved = append(moved, e.Name())
+	}
+	for _, e := range entries {
+		if e.Name() == stateDirName { continue }
+		if err := copyTree(filepath.Join(src, e.Name()), filepath.Join(rootDir, e.Name())); err != nil { undo(); return err }
+	}
+	go os.RemoveAll(aside)
+	contentChanged()
+	return nil
+}
+var snapshotsTmpl *template.Template
+
+// snapshotsHandler lista las instantáneas (en JSON con Accept:
+// application/json o en /api/v1/snapshots); POST con action=create, restore
+// o delete y name=... las gestiona
+func snapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	if !snapshotsEnabled() { failWith(w, "unavailable", "Las instantáneas están desactivadas (-snapshots)", 503); return }
+	if r.Method == "POST" {
+		name, action := strings.TrimSpace(r.FormValue("name")), r.FormValue("action")
+		var err error
+		switch action {
+		case "create":
+			err = createSnapshot(name)
+		case "delete":
+			err = deleteSnapshot(name)
+		case "restore":
+			err = restoreSnapshot(name)
+		default:
+			http.Error(w, "Acción desconocida", 400)
+			return
+		}
+		if err != nil {
+			log.Printf("Instantánea %s (%s): %v", name, action, err)
+			failWith(w, "snapshot_failed", "No se pudo: "+err.Error(), 500)
+			return
+		}
+		audit(r, "snapshot_"+action, map[string]string{"name": name})
+		if wantsJSON(r) { w.WriteHeader(204); return }
+		http.Redirect(w, r, "/snapshots", 303)
+		return
+	}
+	list, err := listSnapshots()
+	if wantsJSON(r) || strings.HasPrefix(r.URL.Path, "/api/") {
+		if err != nil { failWith(w, "snapshot_failed", err.Error(), 500); return }
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{"fs": snapshotFS, "snapshots": list})
+		return
+	}
+	data := map[string]interface{}{"FS": snapshotFS, "Snapshots": list, "Error": ""}
+	if err != nil { data["Error"] = err.Error() }
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	snapshotsTmpl.Execute(w, data)
+}
+
+// --- CADUCIDAD DE ARCHIVOS ---
+
+// Duraciones que se pueden elegir al subir un archivo
+var expiryChoices = map[string]time.Duration{
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+	"1w": 7 * 24 * time.Hour,
+}
+
+// uploadExpiry traduce el campo expires del formulario (vacío o never = no caduca)
+func uploadExpiry(v string) (time.Duration, bool) {
+	if v == "" || v == "never" { return 0, true }
+	d, ok := expiryChoices[v]
+	return d, ok
+}
+
+// remainingLifetime da el tiempo que le queda a un archivo para el listado
+func remainingLifetime(expires int64) string {
+	if expires == 0 { return "" }
+	left := time.Until(time.Unix(expires, 0))
+	switch {
+	case left < time.Minute:
+		return "< 1 min"
+	case left < time.Hour:
+		return fmt.Sprintf("%d min", int(left.Minutes()))
+	case left < 48*time.Hour:
+		return fmt.Sprintf("%d h", int(left.Hours()))
+	}
+	return fmt.Sprintf("%d días", int(left.Hours()/24))
+}
+
+func removeExpired() {
+	expired := meta.Expired(time.Now())
+	if len(expired) > 0 { autoSnapshot("expire") }
+	for _, name := range expired {
+		abs, err := existingPath(name)
+		if err == nil {
+			if err := os.Remove(abs); err != nil {
+				log.Printf("No se pudo borrar %s caducado: %v", name, err)
+				continue
+			}
+			log.Printf("Archivo caducado borrado: %s", name)
+			postDeleteHook(name, "caducidad")
+		}
+		pins.Forget(name)
+		meta.Delete(name)
+		shares.Forget(name)
+	}
+}
+
+// --- ENLACES DE DESCARGA ---
+
+// Un enlace /s/{token} permite un número limitado de descargas de un archivo.
+// Con Burn, el archivo se borra tras la última descarga completa. Las
+// descargas en curso se reservan bajo el mutex, así que dos peticiones
+// simultáneas no pueden superar el límite.
+
+type Share struct {
+	Token        string    `json:"token"`
+	Path         string    `json:"path"`
+	MaxDownloads int       `json:"max_downloads"`
+	Downloads    int       `json:"downloads"`
+	Burn         bool      `json:"burn,omitempty"`
+	CreatedBy    string    `json:"created_by,omitempty"`
+	Created      time.Time `json:"created"`
+	pending      int
+}
+
+type ShareStore struct {
+	path   string
+	shares map[string]*Share
+	mu     sync.Mutex
+}
+
+// shareBackend guarda los enlaces: ShareStore en memoria con copia en
+// shares.json o, con -redis, RedisShares compartido entre réplicas
+type shareBackend interface {
+	Create(sh Share) (Share, error)
+	Acquire(token string) (Share, error)
+	Peek(token string) (Share, error)
+	Complete(token string, ok bool)
+	Rename(old, new string)
+	Forget(name string)
+}
+
+var localShares = ShareStore{shares: make(map[string]*Share)}
+
+var shares shareBackend = &localShares
+
+var errShareGone = errors.New("enlace agotado")
+
+func (s *ShareStore) load(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	var list []*Share
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Printf("Ignorando %s: %v", path, err)
+		return
+	}
+	for _, sh := range list { s.shares[sh.Token] = sh }
+}
+
+func (s *ShareStore) save() error {
+	list := make([]*Share, 0, len(s.shares))
+	for _, sh := range s.shares { list = append(list, sh) }
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return writeJSONAtomic(s.path, list)
+}
+
+func (s *ShareStore) Create(sh Share) (Share, error) {
+	sh.Token = randomToken(18)
+	sh.Created = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shares[sh.Token] = &sh
+	return sh, s.save()
+}
+
+// Acquire reserva una descarga; devuelve errNotFound si el enlace no existe y
+// errShareGone si ya se agotó o las descargas en curso lo agotarían
+func (s *ShareStore) Acquire(token string) (Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh := s.shares[token]
+	if sh == nil { return Share{}, errNotFound }
+	if sh.Downloads+sh.pending >= sh.MaxDownloads { return *sh, errShareGone }
+	sh.pending++
+	return *sh, nil
+}
+
+// Peek devuelve el enlace si todavía le quedan descargas, sin reservar ninguna
+func (s *ShareStore) Peek(token string) (Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh := s.shares[token]
+	if sh == nil { return Share{}, errNotFound }
+	if sh.Downloads+sh.pending >= sh.MaxDownloads { return *sh, errShareGone }
+	return *sh, nil
+}
+
+// Complete cierra una descarga reservada. Si terminó bien y era la última, el
+// enlace desaparece y, con Burn, también el archivo
+func (s *ShareStore) Complete(token string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sh := s.shares[token]
+	if sh == nil { return }
+	sh.pending--
+	if !ok { return }
+	sh.Downloads++
+	if sh.Downloads >= sh.MaxDownloads {
+		delete(s.shares, token)
+		if sh.Burn { s.burn(sh.Path) }
+	}
+	if err := s.save(); err != nil { log.Printf("Error guardando enlaces: %v", err) }
+}
+
+// burn borra el archivo y los demás enlaces que apuntan a él; se llama con el
+// mutex tomado
+func (s *ShareStore) burn(name string) {
+	abs, err := existingPath(name)
+	if err == nil {
+		if err := os.Remove(abs); err != nil { log.Printf("No se pudo borrar %s tras descargarlo: %v", name, err) }
+		pins.Forget(name)
+		meta.Delete(name)
+		postDeleteHook(name, "enlace")
+	}
+	for token, sh := range s.shares {
+		if sh.Path == name { delete(s.shares, token) }
+	}
+	log.Printf("Archivo autodestruido tras su descarga: %s", name)
+}
+
+// Rename mantiene los enlaces de los archivos movidos
+func (s *ShareStore) Rename(old, new string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, sh := range s.shares {
+		if rest, ok := underPath(sh.Path, old); ok {
+			sh.Path = new + rest
+			changed = true
+		}
+	}
+	if changed {
+		if err := s.save(); err != nil { log.Printf("Error guardando enlaces: %v", err) }
+	}
+}
+
+// Forget invalida los enlaces de un archivo (al borrarlo)
+func (s *ShareStore) Forget(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for token, sh := range s.shares {
+		if sh.Path == name {
+			delete(s.shares, token)
+			changed = true
+		}
+	}
+	if changed {
+		if err := s.save(); err != nil { log.Printf("Error guardando enlaces: %v", err) }
+	}
+}
+
+var shareTmpl *template.Template
+
+// shareHandler crea un enlace de descarga limitado para un archivo
+func shareHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	abs, err := existingPath(r.FormValue("path"))
+	if err != nil { pathError(w, err); return }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+	if aclDenied(w, r, abs, aclRead) { return }
+	if info, err := os.Stat(abs); err != nil || info.IsDir() { http.Error(w, "Solo se pueden compartir archivos", 400); return }
+	sh := Share{Path: relPath(abs), MaxDownloads: 1, Burn: r.FormValue("burn") != "", CreatedBy: currentUser(r)}
+	if v := r.FormValue("downloads"); v != "" {
+		if sh.MaxDownloads, err = strconv.Atoi(v); err != nil || sh.MaxDownloads < 1 { http.Error(w, "Número de descargas no válido", 400); return }
+	}
+	// Un burn con destrucción del archivo solo lo puede pedir quien puede borrar
+	if sh.Burn && (!enableDelete || !authorizedDelete(r)) { http.Error(w, "Borrado no permitido", 403); return }
+	if sh.Burn {
+		if err := checkMountWrite(abs, -1); err != nil { mountWriteError(w, err); return }
+		if aclDenied(w, r, abs, aclDelete) { return }
+	}
+	sh, err = shares.Create(sh)
+	if err != nil { http.Error(w, "Error guardando", 500); return }
+	url := baseURL(r) + "/s/" + sh.Token
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(map[string]interface{}{"url": url, "path": sh.Path, "max_downloads": sh.MaxDownloads, "burn": sh.Burn})
+		return
+	}
+	shareTmpl.Execute(w, map[string]interface{}{"Share": sh, "URL": url})
+}
+
+// Los navegadores y los rastreadores que generan la tarjeta de un enlace
+// pegado en un chat reciben primero una página con el nombre, el tamaño y una
+// miniatura (Open Graph / Twitter); la descarga está en /s/{token}?dl=1. Ver la
+// página no gasta descargas. Los clientes que no piden HTML (curl, wget)
+// siguen recibiendo el archivo directamente.
+
+// Fragmentos del User-Agent de los rastreadores de vistas previas de enlaces
+var linkPreviewBots = []string{
+	"facebookexternalhit", "facebot", "twitterbot", "slackbot", "slack-imgproxy", "discordbot",
+	"telegrambot", "whatsapp", "linkedinbot", "skypeuripreview", "mattermost", "redditbot",
+	"applebot", "iframely", "embedly", "signal",
+}
+
+// wantsSharePage indica si /s/{token} debe responder con la página del enlace
+func wantsSharePage(r *http.Request) bool {
+	if r.URL.Query().Has("dl") { return false }
+	if strings.Contains(r.Header.Get("Accept"), "text/html") { return true }
+	ua := strings.ToLower(r.UserAgent())
+	for _, bot := range linkPreviewBots {
+		if strings.Contains(ua, bot) { return true }
+	}
+	return false
+}
+
+// shareThumbnail genera (o reutiliza) la miniatura de un archivo compartido:
+// las imágenes se reducen aquí y los PDF y documentos usan el conversor de
+// las vistas previas si está configurado
+func shareThumbnail(abs string, info os.FileInfo) (string, error) {
+	switch strings.ToLower(filepath.Ext(abs)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		if lowMem { return "", errNotFound }
+		return cachedPreview(abs, info, func(out string) error { return imageThumbnail(abs, out) })
+	}
+	generate := previewGenerator(abs)
+	if generate == nil { return "", errNotFound }
+	return cachedPreview(abs, info, generate)
+}
+
+// hasShareThumbnail indica si el archivo puede tener miniatura, sin generarla
+func hasShareThumbnail(abs string) bool {
+	switch strings.ToLower(filepath.Ext(abs)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return !lowMem
+	}
+	return previewCommand(abs) != "" || hasVideoPoster(abs)
+}
+
+var sharePageTmpl *template.Template
+
+// sharePage muestra la página de un enlace sin gastar ninguna descarga
+func sharePage(w http.ResponseWriter, r *http.Request, sh Share) {
+	abs, err := existingPath(sh.Path)
+	if err != nil { pathError(w, err); return }
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() { http.Error(w, "No encontrado", 404); return }
+	left := sh.MaxDownloads - sh.Downloads
+	desc := humanSize(info.Size()) + " · 1 descarga disponible"
+	if left != 1 { desc = fmt.Sprintf("%s · %d descargas disponibles", humanSize(info.Size()), left) }
+	url := baseURL(r) + "/s/" + sh.Token
+	data := map[string]interface{}{
+		"Share": sh, "Name": filepath.Base(abs), "Description": desc, "URL": url,
+		"Icon": baseURL(r) + "/icon-512.png",
+	}
+	if hasShareThumbnail(abs) { data["Image"] = url + "/preview" }
+	w.Header().Set("Cache-Control", "no-store")
+	sharePageTmpl.Execute(w, data)
+}
+
+// sharePreviewHandler sirve la miniatura de un enlace mientras siga vigente
+func sharePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	sh, err := shares.Peek(r.PathValue("token"))
+	if errors.Is(err, errNotFound) { http.Error(w, "Enlace desconocido", 404); return }
+	if errors.Is(err, errShareGone) { http.Error(w, "Este enlace ya no está disponible", 410); return }
+	if err != nil { http.Error(w, "Enlaces no disponibles ahora mismo", 503); return }
+	if reports.Quarantined(sh.Path) { quarantineError(w); return }
+	abs, err := existingPath(sh.Path)
+	if err != nil { pathError(w, err); return }
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() { http.NotFound(w, r); return }
+	thumbnail := shareThumbnail
+	if watermarkFor(r, abs) { thumbnail = watermarkedThumbnail }
+	out, err := thumbnail(abs, info)
+	if errors.Is(err, errNotFound) { http.NotFound(w, r); return }
+	if err != nil { http.Error(w, "Vista previa no disponible", 500); return }
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	http.ServeFile(w, r, out)
+}
+
+// shareDownloadHandler sirve el archivo de un enlace. Solo cuenta una descarga
+// si se envió completa; por eso no admite rangos
+func shareDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "download") { return }
+	token := r.PathValue("token")
+	if wantsSharePage(r) {
+		sh, err := shares.Peek(token)
+		if errors.Is(err, errNotFound) { http.Error(w, "Enlace desconocido", 404); return }
+		if errors.Is(err, errShareGone) { http.Error(w, "Este enlace ya no está disponible", 410); return }
+		if err != nil { http.Error(w, "Enlaces no disponibles ahora mismo", 503); return }
+		if reports.Quarantined(sh.Path) { quarantineError(w); return }
+		sharePage(w, r, sh)
+		return
+	}
+	sh, err := shares.Acquire(token)
+	if errors.Is(err, errNotFound) { http.Error(w, "Enlace desconocido", 404); return }
+	if errors.Is(err, errShareGone) { http.Error(w, "Este enlace ya no está disponible", 410); return }
+	if err != nil { http.Error(w, "Enlaces no disponibles ahora mismo", 503); return }
+	ok := false
+	defer func() { shares.Complete(token, ok) }()
+	if reports.Quarantined(sh.Path) { quarantineError(w); return }
+
+	abs, err := existingPath(sh.Path)
+	if err != nil { pathError(w, err); return }
+	f, err := os.Open(abs)
+	if err != nil { http.Error(w, "Error leyendo archivo", 500); return }
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() { http.Error(w, "No encontrado", 404); return }
+	if downloadHookDenied(w, r, abs, info) { return }
+	marked := watermarkFor(r, abs)
+	if marked {
+		copyPath, err := watermarkedCopy(abs, info)
+		if err == nil { f, err = os.Open(copyPath) }
+		if err == nil { defer f.Close(); info, err = f.Stat() }
+		if err != nil { http.Error(w, "No se pudo preparar la imagen", 500); return }
+	}
+
+	if cspPolicy != "" { w.Header().Set("Content-Security-Policy", downloadCSP) }
+	w.Header().Set("Content-Type", withCharset(fileMIME(sh.Path)))
+	if forceDownload && isRiskyContent(abs) { w.Header().Set("Content-Type", "application/octet-stream") }
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(abs)}))
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if sum, ok := knownSHA256(sh.Path, info); ok && !marked { setDigestHeaders(w.Header(), sum) }
+	if r.Method == "HEAD" { return }
+
+	_, span := startSpan(r.Context(), "storage.read")
+	span.SetAttr("file.name", filepath.Base(abs))
+	start := time.Now()
+	n, err := io.Copy(w, f)
+	span.End()
+	ok = err == nil && n == info.Size()
+	if err == nil && !ok { err = io.ErrUnexpectedEOF }
+	transfers.Record(r, "descarga", sh.Path+" (enlace)", n, time.Since(start), err)
+}
+
+// --- REGISTRO DE AUDITORÍA ---
+// .cerbero/audit.log guarda una línea JSON por acción que puede hacer falta
+// demostrar después (aceptación de las condiciones, cuarentenas). Solo se
+// añade: no se rota ni se reescribe.
+
+var (
+	auditPath string
+	auditMu   sync.Mutex
+)
+
+type auditEntry struct {
+	Time   time.Time         `json:"time"`
+	Event  string            `json:"event"`
+	IP     string            `json:"ip"`
+	User   string            `json:"user,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// audit anota un evento con la IP y el usuario de la petición
+func audit(r *http.Request, event string, fields map[string]string) {
+	line, _ := json.Marshal(auditEntry{Time: time.Now(), Event: event, IP: clientIP(r), User: currentUser(r), Fields: fields})
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	f, err := os.OpenFile(auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if cerr := f.Close(); err == nil { err = cerr }
+	}
+	if err != nil { log.Printf("Registro de auditoría: %v", err) }
+}
+
+// hiddenToggleHandler muestra u oculta los archivos ocultos para todos hasta
+// el próximo reinicio (que vuelve a lo que diga -show-hidden)
+func hiddenToggleHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) { http.Error(w, "Clave errónea", 401); return }
+	show := r.FormValue("show") == "1"
+	hiddenRevealed.Store(show)
+	audit(r, "hidden_files", map[string]string{"show": strconv.FormatBool(show)})
+	back := "/"
+	if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host { back = localPath(ref.RequestURI()) }
+	http.Redirect(w, r, back, 303)
+}
+
+// --- CARPETAS COMPARTIDAS ---
+// Cada -share nombre=/ruta monta otra carpeta como si fuera una carpeta del
+// listado (/?dir=nombre, o /shares/nombre). El nombre puede ser una ruta
+// virtual (descargas/peliculas): las carpetas intermedias que no existen en
+// rootDir se muestran igualmente. Las rutas bajo ella se resuelven y se
+// encierran en esa carpeta (securePath) y pueden tener permisos propios: ro
+// (solo lectura), password= (hay que desbloquearla con esa clave para verla;
+// los administradores identificados no la necesitan), quota-mb= (tamaño
+// máximo de lo que contiene) y symlinks= (qué enlaces se siguen dentro).
+// Con -share-allow, las carpetas montadas tienen que estar en esa lista.
+
+// multiFlag acumula los valores de un flag que se puede repetir
+type multiFlag []string
+
+func (m *multiFlag) String() string     { return strings.Join(*m, " ") }
+func (m *multiFlag) Set(v string) error { *m = append(*m, v); return nil }
+
+var (
+	shareSpecs multiFlag
+	shareAllow string
+	// shareAllowed son las carpetas de -share-allow con los enlaces resueltos
+	shareAllowed []string
+)
+
+// Qué enlaces simbólicos se siguen dentro de una carpeta montada
+const (
+	linksNone      = "none"      // ninguno
+	linksInside    = "inside"    // los que apuntan dentro de la propia carpeta
+	linksAllowlist = "allowlist" // además, los que apuntan a carpetas de -share-allow
+)
+
+type mount struct {
+	name     string // ruta virtual, sin "/" al principio ni al final
+	dir      string // ruta absoluta tal como se configuró
+	real     string // con los enlaces resueltos
+	readOnly bool
+	password string
+	quota    int64 // bytes; 0 = sin límite
+	symlinks string
+
+	mu     sync.Mutex
+	used   int64
+	usedAt time.Time
+}
+
+var mounts []*mount
+
+// rootQuota aplica -quota-mb a la carpeta principal como si fuera una
+// carpeta montada más; nil = sin límite
+var rootQuota *mount
+
+var (
+	errReadOnlyMount = errors.New("carpeta de solo lectura")
+	errMountQuota    = errors.New("cuota de la carpeta agotada")
+	errMountLocked   = errors.New("carpeta protegida")
+)
+
+// parseMount interpreta nombre=/ruta[,ro][,password=clave][,quota-mb=N][,symlinks=none|inside|allowlist]
+func parseMount(spec string) (*mount, error) {
+	name, rest, ok := strings.Cut(spec, "=")
+	if !ok { return nil, errors.New("se esperaba nombre=/ruta") }
+	name = strings.Trim(name, "/")
+	if name == "" || strings.Contains(name, "\\") { return nil, fmt.Errorf("nombre no válido: %q", name) }
+	for _, seg := range strings.Split(name, "/") {
+		if seg == "" || seg == ".." || strings.HasPrefix(seg, ".") { return nil, fmt.Errorf("nombre no válido: %q", name) }
+	}
+	opts := strings.Split(rest, ",")
+	m := &mount{name: name, symlinks: linksInside}
+	if noSymlinks { m.symlinks = linksNone }
+	abs, err := filepath.Abs(opts[0])
+	if err != nil { return nil, err }
+	m.dir = abs
+	for _, opt := range opts[1:] {
+		key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "ro":
+			m.readOnly = true
+		case "password":
+			m.password = value
+		case "quota-mb":
+			mb, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || mb < 1 { return nil, fmt.Errorf("quota-mb no válido: %q", value) }
+			m.quota = mb << 20
+		case "symlinks":
+			if value != linksNone && value != linksInside && value != linksAllowlist { return nil, fmt.Errorf("symlinks no válido: %q", value) }
+			m.symlinks = value
+		default:
+			return nil, fmt.Errorf("opción desconocida: %q", opt)
+		}
+	}
+	return m, nil
+}
+
+// setupMounts valida los -share al arrancar; una carpeta no puede estar
+// dentro de otra ni de rootDir, porque la misma ruta tendría dos nombres
+func setupMounts() {
+	for _, dir := range strings.Split(shareAllow, ",") {
+		if dir = strings.TrimSpace(dir); dir == "" { continue }
+		real, err := filepath.EvalSymlinks(dir)
+		if err != nil { log.Fatalf("-share-allow %s: %v", dir, err) }
+		if real, err = filepath.Abs(real); err != nil { log.Fatalf("-share-allow %s: %v", dir, err) }
+		shareAllowed = append(shareAllowed, real)
+	}
+	for _, spec := range shareSpecs {
+		m, err := parseMount(spec)
+		if err != nil { log.Fatalf("-share %s: %v", spec, err) }
+		if mountByName(m.name) != nil { log.Fatalf("-share: %s está repetido", m.name) }
+		info, err := os.Stat(m.dir)
+		if err != nil || !info.IsDir() { log.Fatalf("-share %s: %s no es una carpeta", m.name, m.dir) }
+		if m.real, err = filepath.EvalSymlinks(m.dir); err != nil { log.Fatalf("-share %s: %v", m.name, err) }
+		if within(realRoot, m.real) || within(m.real, realRoot) { log.Fatalf("-share %s no puede contener ni estar dentro de -root", m.name) }
+		if len(shareAllowed) > 0 && !allowedTarget(m.real) { log.Fatalf("-share %s: %s no está en -share-allow", m.name, m.dir) }
+		if m.symlinks == linksAllowlist && len(shareAllowed) == 0 { log.Fatalf("-share %s: symlinks=allowlist necesita -share-allow", m.name) }
+		for _, other := range mounts {
+			if within(other.real, m.real) || within(m.real, other.real) { log.Fatalf("-share %s y %s se solapan", m.name, other.name) }
+			if virtualWithin(other.name, m.name) || virtualWithin(m.name, other.name) { log.Fatalf("-share %s y %s se solapan", m.name, other.name) }
+		}
+		mounts = append(mounts, m)
+		mode := "lectura y escritura"
+		if m.readOnly { mode = "solo lectura" }
+		log.Printf("Carpeta compartida %s: %s (%s)", m.name, m.dir, mode)
+	}
+}
+
+// allowedTarget indica si una ruta real está dentro de alguna carpeta de
+// -share-allow. No vale la de otra carpeta montada, que tiene sus permisos
+func allowedTarget(real string) bool {
+	for _, m := range mounts {
+		if within(m.real, real) { return false }
+	}
+	for _, dir := range shareAllowed {
+		if within(dir, real) { return true }
+	}
+	return false
+}
+
+// virtualWithin indica si la ruta virtual name es dir o está dentro de ella
+func virtualWithin(dir, name string) bool {
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// virtualChildren devuelve lo que las carpetas montadas añaden al listado de
+// dir: su nombre si cuelgan directamente de ella, o la carpeta intermedia
+func virtualChildren(dir string) (children []string) {
+	seen := map[string]bool{}
+	for _, m := range mounts {
+		rest := m.name
+		if dir != "" {
+			if !strings.HasPrefix(m.name, dir+"/") { continue }
+			rest = strings.TrimPrefix(m.name, dir+"/")
+		}
+		first, _, _ := strings.Cut(rest, "/")
+		if !seen[first] { seen[first], children = true, append(children, first) }
+	}
+	return children
+}
+
+func mountByName(name string) *mount {
+	for _, m := range mounts {
+		if m.name == name { return m }
+	}
+	return nil
+}
+
+// mountFor busca la carpeta montada de una ruta limpia ("/media/x"); rest
+// es lo que queda dentro de ella ("/x")
+func mountFor(clean string) (m *mount, rest string) {
+	rel := strings.TrimPrefix(clean, "/")
+	for _, candidate := range mounts {
+		if virtualWithin(candidate.name, rel) { return candidate, "/" + strings.TrimPrefix(rel[len(candidate.name):], "/") }
+	}
+	return nil, clean
+}
+
+// isMountDir indica si abs es la raíz de una carpeta montada, que no se
+// puede borrar ni mover
+func isMountDir(abs string) bool {
+	m := mountOf(abs)
+	return m != nil && m.dir == abs
+}
+
+// mountOf devuelve la carpeta montada que contiene una ruta absoluta, o nil
+func mountOf(abs string) *mount {
+	for _, m := range mounts {
+		if within(m.dir, abs) { return m }
+	}
+	return nil
+}
+
+// absPath traduce una ruta relativa ya validada (de los metadatos o de un
+// recorrido) a su ruta en disco
+func absPath(rel string) string {
+	if m, rest := mountFor(path.Clean("/" + rel)); m != nil { return filepath.Join(m.dir, filepath.FromSlash(rest)) }
+	return filepath.Join(rootDir, filepath.FromSlash(rel))
+}
+
+// usage devuelve lo que ocupa la carpeta; se recalcula como mucho cada minuto
+func (m *mount) usage() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.usedAt) < time.Minute { return m.used }
+	var total int64
+	filepath.WalkDir(m.dir, func(p string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() && p == stateDir { return filepath.SkipDir }
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil { total += info.Size() }
+		}
+		return nil
+	})
+	m.used, m.usedAt = total, time.Now()
+	return total
+}
+
+// checkMountWrite comprueba que se puede escribir need bytes en abs: la
+// carpeta no es de solo lectura y cabe en su cuota. need < 0 es para lo que
+// no ocupa más (borrar, mover), que se permite aunque la cuota esté superada
+func checkMountWrite(abs string, need int64) error {
+	if h := homeQuota(abs); h != nil && need >= 0 && !h.fits(need) { return errHomeQuota }
+	m := mountOf(abs)
+	if m == nil { m = rootQuota }
+	if m == nil { return nil }
+	if m.readOnly { return errReadOnlyMount }
+	if m.quota > 0 && need >= 0 && !m.fits(need) { return errMountQuota }
+	return nil
+}
+
+// fits indica si caben need bytes más en la cuota de la carpeta
+func (m *mount) fits(need int64) bool {
+	if m.usage()+need > m.quota { return false }
+	// La siguiente comprobación vuelve a medir con lo recién escrito
+	m.mu.Lock()
+	m.usedAt = time.Time{}
+	m.mu.Unlock()
+	return true
+}
+
+// mountWriteError responde al fallo de checkMountWrite
+func mountWriteError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errHomeQuota) { failWith(w, "home_quota", "Tu carpeta personal ha llegado a su cuota", 507); return }
+	if errors.Is(err, errMountQuota) { failWith(w, "share_quota", "La carpeta compartida ha llegado a su cuota", 507); return }
+	failWith(w, "read_only", "Esta carpeta es de solo lectura", 403)
+}
+
+const mountCookie = "cerbero_shares"
+
+// mountKey identifica la clave vigente de una carpeta en la cookie sin
+// guardarla: si la clave cambia, hay que volver a desbloquearla
+func (m *mount) key() string {
+	sum := sha256.Sum256([]byte(m.name + "\x00" + m.password))
+	return hex.EncodeToString(sum[:8])
+}
+
+// lockedMount devuelve la carpeta protegida que contiene abs si la petición
+// no la ha desbloqueado (cookie o cabecera X-Cerbero-Share-Password)
+func lockedMount(r *http.Request, abs string) *mount {
+	m := mountOf(abs)
+	if m == nil || m.password == "" { return nil }
+	if identifiedAdmin(r) { return nil }
+	if sent := r.Header.Get("X-Cerbero-Share-Password"); sent != "" && subtle.ConstantTimeCompare([]byte(sent), []byte(m.password)) == 1 { return nil }
+	var unlocked map[string]string
+	if readSignedCookie(r, mountCookie, &unlocked) && unlocked[m.name] == m.key() { return nil }
+	return m
+}
+
+// lockedDir devuelve la carpeta protegida que se pide listar con ?dir= si la
+// petición no la ha desbloqueado
+func lockedDir(r *http.Request) *mount {
+	m, _ := mountFor(path.Clean("/" + r.URL.Query().Get("dir")))
+	if m == nil { return nil }
+	return lockedMount(r, m.dir)
+}
+
+// mountLocked manda al navegador a desbloquear la carpeta; a los demás, 401
+func mountLocked(w http.ResponseWriter, r *http.Request, m *mount) {
+	if r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, "/shares/"+escapePath(m.name), 303)
+		return
+	}
+	failWith(w, "share_locked", "La carpeta "+m.name+" está protegida con clave (X-Cerbero-Share-Password)", 401)
+}
+
+var mountTmpl *template.Template
+
+// mountHandler abre /shares/{name}: lleva al listado de la carpeta o, si está
+// protegida, pide su clave y la recuerda en una cookie firmada
+func mountHandler(w http.ResponseWriter, r *http.Request) {
+	m := mountByName(strings.Trim(r.PathValue("name"), "/"))
+	if m == nil { http.NotFound(w, r); return }
+	listing := "/?dir=" + url.QueryEscape(m.name)
+	if lockedMount(r, m.dir) == nil { http.Redirect(w, r, listing, 303); return }
+	data := map[string]interface{}{"Name": m.name, "Error": ""}
+	if r.Method == "POST" {
+		ip := clientIP(r)
+		sent := r.FormValue("password")
+		if !limiter.Exhausted("auth", ip) && subtle.ConstantTimeCompare([]byte(sent), []byte(m.password)) == 1 {
+			unlocked := map[string]string{}
+			readSignedCookie(r, mountCookie, &unlocked)
+			unlocked[m.name] = m.key()
+			setSignedCookie(w, r, mountCookie, unlocked, sessionTTL)
+			http.Redirect(w, r, listing, 303)
+			return
+		}
+		limiter.Allow("auth", ip)
+		data["Error"] = "Clave errónea"
+		w.WriteHeader(401)
+	}
+	mountTmpl.Execute(w, data)
+}
+
+// --- LISTAS DE CONTROL DE ACCESO ---
+// Un administrador puede asignar a una carpeta quién puede leer (r),
+// escribir (w) y borrar (d) en ella: un usuario ("user:ana"), un grupo de
+// LDAP u OIDC ("group:diseño") o cualquiera ("*"). La lista vale para toda la
+// carpeta y lo que cuelga de ella hasta que una subcarpeta tenga la suya, que
+// la sustituye. Donde no hay ninguna manda solo el rol. Los administradores
+// identificados no están sujetos a las listas. Se editan en /acl.
+
+const (
+	aclRead   = "r"
+	aclWrite  = "w"
+	aclDelete = "d"
+)
+
+var aclPermNames = map[string]string{aclRead: "lectura", aclWrite: "escritura", aclDelete: "borrado"}
+
+// ACLEntry da permisos (combinación de r, w y d) a un usuario, grupo o a todos
+type ACLEntry struct {
+	Who   string `json:"who"`
+	Perms string `json:"perms"`
+}
+
+type ACLStore struct {
+	path    string
+	Folders map[string][]ACLEntry `json:"folders"` // ruta relativa; "" es la raíz
+	mu      sync.Mutex
+}
+
+var acls = ACLStore{Folders: make(map[string][]ACLEntry)}
+
+// aclUserKey marca en el contexto la identidad de las peticiones que no
+// llevan sesión (la API S3 cuenta como el usuario "s3")
+type aclUserKey struct{}
+
+func (s *ACLStore) load(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, s); err != nil { log.Printf("Ignorando %s: %v", path, err) }
+	if s.Folders == nil { s.Folders = make(map[string][]ACLEntry) }
+}
+
+func (s *ACLStore) save() error {
+	return writeJSONAtomic(s.path, s)
+}
+
+// parseACL interpreta una entrada por línea, "quién=permisos"
+func parseACL(text string) ([]ACLEntry, error) {
+	var entries []ACLEntry
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") { continue }
+		who, perms, ok := strings.Cut(line, "=")
+		who, perms = strings.TrimSpace(who), strings.TrimSpace(perms)
+		if !ok || (who != "*" && !strings.HasPrefix(who, "user:") && !strings.HasPrefix(who, "group:")) {
+			return nil, fmt.Errorf("línea no válida: %q (se espera user:nombre=rw, group:nombre=r o *=r)", line)
+		}
+		if strings.Trim(perms, "rwd") != "" { return nil, fmt.Errorf("permisos no válidos en %q: solo r, w y d", line) }
+		entries = append(entries, ACLEntry{Who: who, Perms: perms})
+	}
+	return entries, nil
+}
+
+// Set sustituye la lista de una carpeta; una lista vacía la quita y la
+// carpeta vuelve a heredar la de arriba
+func (s *ACLStore) Set(dir string, entries []ACLEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(entries) == 0 {
+		delete(s.Folders, dir)
+	} else {
+		s.Folders[dir] = entries
+	}
+	return s.save()
+}
+
+// List devuelve una copia de todas las listas
+func (s *ACLStore) List() map[string][]ACLEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]ACLEntry, len(s.Folders))
+	for dir, entries := range s.Folders { out[dir] = slices.Clone(entries) }
+	return out
+}
+
+// rulesFor devuelve la lista que se aplica a rel: la de la carpeta más
+// cercana que tenga una, subiendo hasta la raíz
+func (s *ACLStore) rulesFor(rel string) ([]ACLEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Folders) == 0 { return nil, false }
+	for rel = strings.Trim(rel, "/"); ; rel = path.Dir(rel) {
+		if rel == "." { rel = "" }
+		if entries, ok := s.Folders[rel]; ok { return entries, true }
+		if rel == "" { return nil, false }
+	}
+}
+
+// Rename mantiene las listas de las carpetas movidas y de lo que hay dentro
+func (s *ACLStore) Rename(old, new string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for dir, entries := range s.Folders {
+		if dir != old && !strings.HasPrefix(dir, old+"/") { continue }
+		delete(s.Folders, dir)
+		s.Folders[new+strings.TrimPrefix(dir, old)] = entries
+		changed = true
+	}
+	if changed {
+		if err := s.save(); err != nil { log.Printf("Error guardando permisos: %v", err) }
+	}
+}
+
+// Forget borra las listas de una carpeta eliminada
+func (s *ACLStore) Forget(rel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for dir := range s.Folders {
+		if dir == rel || strings.HasPrefix(dir, rel+"/") { delete(s.Folders, dir); changed = true }
+	}
+	if changed {
+		if err := s.save(); err != nil { log.Printf("Error guardando permisos: %v", err) }
+	}
+}
+
+// aclPrincipal es el usuario y los grupos con los que se evalúan las listas
+func aclPrincipal(r *http.Request) (string, []string) {
+	if user, ok := r.Context().Value(aclUserKey{}).(string); ok { return user, nil }
+	if k := apiKeyFor(r); k != nil { return k.User, nil }
+	if s := sessionFor(r); s != nil { return s.User, s.Groups }
+	return "", nil
+}
+
+// aclAllows indica si la petición tiene el permiso perm sobre rel
+func aclAllows(r *http.Request, rel, perm string) bool {
+	if perm == aclRead && !visibilityAllows(r, rel) { return false }
+	if ok, decided := homeAllows(r, rel, perm); decided { return ok }
+	entries, ok := acls.rulesFor(rel)
+	if !ok { return true }
+	if identifiedAdmin(r) { return true }
+	user, groups := aclPrincipal(r)
+	for _, e := range entries {
+		if !strings.Contains(e.Perms, perm) { continue }
+		who, name, _ := strings.Cut(e.Who, ":")
+		switch {
+		case e.Who == "*":
+			return true
+		case who == "user" && user != "" && strings.EqualFold(name, user):
+			return true
+		case who == "group" && slices.ContainsFunc(groups, func(g string) bool { return strings.EqualFold(g, name) }):
+			return true
+		}
+	}
+	return false
+}
+
+// aclMessage explica qué permiso falta y dónde
+func aclMessage(perm, rel string) string {
+	return "No tienes permiso de " + aclPermNames[perm] + " en /" + strings.TrimPrefix(rel, ".")
+}
+
+// aclDenied responde 403 si la petición no tiene el permiso perm sobre abs
+func aclDenied(w http.ResponseWriter, r *http.Request, abs, perm string) bool {
+	if aclAllows(r, relPath(abs), perm) { return false }
+	if perm == aclRead && !visibilityAllows(r, relPath(abs)) { visibilityDenied(w, relPath(abs)); return true }
+	failWith(w, "acl_denied", aclMessage(perm, relPath(abs)), 403)
+	return true
+}
+
+// listingDenied responde 403 si la petición no puede leer la carpeta ?dir=
+func listingDenied(w http.ResponseWriter, r *http.Request) bool {
+	dir := strings.Trim(path.Clean("/"+r.URL.Query().Get("dir")), "/")
+	if aclAllows(r, dir, aclRead) { return false }
+	failWith(w, "acl_denied", aclMessage(aclRead, dir), 403)
+	return true
+}
+
+var aclTmpl *template.Template
+
+// aclHandler es el editor de listas para los administradores; con Accept:
+// application/json (o en /api/v1/acl) devuelve todas en JSON
+func aclHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if r.Method == "GET" && !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	data := map[string]interface{}{
+		"Error":           "",
+		"Dir":             strings.Trim(r.FormValue("dir"), "/"),
+		"PasswordEnabled": password != "" && sessionFor(r) == nil && r.Header.Get("Authorization") == "",
+	}
+	if r.Method == "POST" {
+		dir := strings.Trim(r.FormValue("dir"), "/")
+		var err error
+		if dir != "" {
+			if dir, err = sanitizeRelPath(dir); err != nil {
+				err = errors.New("Carpeta no válida")
+			} else if _, err = existingPath(dir); err != nil && len(virtualChildren(dir)) == 0 {
+				err = errors.New("No existe la carpeta /" + dir)
+			} else {
+				err = nil
+			}
+		}
+		var entries []ACLEntry
+		if err == nil { entries, err = parseACL(r.FormValue("entries")) }
+		if err == nil { err = acls.Set(dir, entries) }
+		if err == nil {
+			audit(r, "acl_set", map[string]string{"dir": dir, "entries": strings.TrimSpace(r.FormValue("entries"))})
+			http.Redirect(w, r, "/acl", 303)
+			return
+		}
+		data["Error"] = err.Error()
+	}
+	folders := acls.List()
+	if wantsJSON(r) || strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"folders": folders})
+		return
+	}
+	data["Folders"] = folders
+	aclTmpl.Execute(w, data)
+}
+
+// --- CARPETAS PERSONALES ---
+
+// Con -user-homes cada usuario identificado (sesión o clave de API) tiene su
+// carpeta homes/<usuario>, que se crea al entrar por primera vez. Quien no es
+// administrador queda encerrado en ella: el listado empieza ahí y cualquier
+// otra ruta se trata como si una lista de control de acceso se la negara, así
+// que vale igual para descargas, subidas, ZIP, búsquedas y la API. Los
+// anónimos no ven homes/ y los administradores lo ven todo. Con
+// -home-quota-mb cada carpeta tiene además su cuota de espacio.
+
+const homesDirName = "homes"
+
+var (
+	homeMounts   = map[string]*mount{}
+	homeMountsMu sync.Mutex
+)
+
+var errHomeQuota = fmt.Errorf("carpeta personal: %w", errMountQuota)
+
+// homeName es el nombre de la carpeta personal de user; "" si el nombre no
+// sirve como carpeta (oculto o reservado)
+func homeName(user string) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || unicode.IsControl(r) { return '_' }
+		return r
+	}, user)
+	if name == "" || strings.HasPrefix(name, ".") || isInternalName(name) { return "" }
+	return name
+}
+
+// homeOwner devuelve la carpeta personal que contiene rel ("" para la propia
+// homes/) e inHomes indica si rel está bajo homes/
+func homeOwner(rel string) (owner string, inHomes bool) {
+	rel = strings.Trim(rel, "/")
+	if rel != homesDirName && !strings.HasPrefix(rel, homesDirName+"/") { return "", false }
+	owner, _, _ = strings.Cut(strings.TrimPrefix(rel[len(homesDirName):], "/"), "/")
+	return owner, true
+}
+
+// confinedHome devuelve la carpeta personal ("homes/<usuario>") de un usuario
+// identificado que no es administrador, creándola si aún no existe; "" si la
+// petición no está encerrada en ninguna
+func confinedHome(r *http.Request) string {
+	if !userHomes { return "" }
+	user := currentUser(r)
+	if user == "" || identifiedAdmin(r) { return "" }
+	name := homeName(user)
+	if name == "" { return "" }
+	if err := os.MkdirAll(filepath.Join(rootDir, homesDirName, name), 0755); err != nil {
+		log.Printf("No se pudo crear la carpeta personal de %s: %v", user, err)
+	}
+	return homesDirName + "/" + name
+}
+
+// homeAllows aplica -user-homes antes que las listas de control de acceso;
+// decided=false deja la decisión a las listas
+func homeAllows(r *http.Request, rel, perm string) (ok, decided bool) {
+	if !userHomes { return false, false }
+	owner, inHomes := homeOwner(rel)
+	user := currentUser(r)
+	if user == "" { return false, inHomes }
+	if identifiedAdmin(r) { return false, false }
+	if name := homeName(user); inHomes && name != "" && owner == name { return true, true }
+	// Para llegar a la suya puede leer la raíz y homes/, donde no verá nada más
+	rel = strings.Trim(rel, "/")
+	if perm == aclRead && (rel == "" || rel == "." || rel == homesDirName) { return true, true }
+	return false, true
+}
+
+// homeQuota devuelve la cuota de la carpeta personal que contiene abs, o nil
+func homeQuota(abs string) *mount {
+	if !userHomes || homeQuotaMB <= 0 || mountOf(abs) != nil { return nil }
+	owner, _ := homeOwner(relPath(abs))
+	if owner == "" { return nil }
+	return homeMount(owner)
+}
+
+// homeMount trata la carpeta personal como una carpeta montada más para
+// medir lo que ocupa (con la misma caché de un minuto) y aplicar su cuota
+func homeMount(name string) *mount {
+	homeMountsMu.Lock()
+	defer homeMountsMu.Unlock()
+	m := homeMounts[name]
+	if m == nil {
+		dir := filepath.Join(rootDir, homesDirName, name)
+		m = &mount{name: homesDirName + "/" + name, dir: dir, real: dir, quota: int64(homeQuotaMB) << 20}
+		homeMounts[name] = m
+	}
+	return m
+}
+
+var homesTmpl *template.Template
+
+// homesHandler es la vista de administración de /homes (JSON en
+// /api/v1/homes): cada carpeta personal con lo que ocupa y su cuota
+func homesHandler(w http.ResponseWriter, r *http.Request) {
+	if !userHomes { http.NotFound(w, r); return }
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	type home struct {
+		User     string    `json:"user"`
+		Path     string    `json:"path"`
+		Size     int64     `json:"size"`
+		Quota    int64     `json:"quota,omitempty"`
+		Over     bool      `json:"over_quota,omitempty"`
+		Modified time.Time `json:"modified"`
+	}
+	homes := []home{}
+	entries, err := os.ReadDir(filepath.Join(rootDir, homesDirName))
+	if err != nil && !os.IsNotExist(err) { http.Error(w, "Error leyendo carpeta", 500); return }
+	for _, e := range entries {
+		if !e.IsDir() || homeName(e.Name()) != e.Name() { continue }
+		info, err := e.Info()
+		if err != nil { continue }
+		m := homeMount(e.Name())
+		h := home{User: e.Name(), Path: m.name, Size: m.usage(), Modified: info.ModTime()}
+		if homeQuotaMB > 0 { h.Quota, h.Over = m.quota, h.Size > m.quota }
+		homes = append(homes, h)
+	}
+	sort.Slice(homes, func(i, j int) bool { return homes[i].Size > homes[j].Size })
+	if wantsJSON(r) || strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"homes": homes})
+		return
+	}
+	homesTmpl.Execute(w, map[string]interface{}{"Homes": homes})
+}
+
+
+// --- VISIBILIDAD DE ARCHIVOS ---
+
+// Cada archivo puede ser público (por defecto: cualquiera con el enlace),
+// "con clave" (hace falta la clave del servidor, una sesión o una clave de
+// API) o privado (solo usuarios identificados: sesión o clave de API). Se
+// guarda en los metadatos, así que sigue al archivo al moverlo y sobrevive a
+// que se reemplace su contenido. Los que no se pueden ver no aparecen en
+// listados, búsquedas ni ZIP; los enlaces /s/ y de carpeta los sirven igual,
+// porque los crea alguien que sí tiene acceso.
+
+const (
+	visPublic   = "public"
+	visPassword = "password"
+	visPrivate  = "private"
+)
+
+var visibilityNames = map[string]string{visPublic: "pública", visPassword: "con clave", visPrivate: "privada"}
+
+// fileVisibility devuelve la visibilidad de rel; sin metadatos es pública
+func fileVisibility(rel string) string {
+	fm, ok := meta.Get(rel)
+	if !ok || fm.Visibility == "" { return visPublic }
+	return fm.Visibility
+}
+
+// visibilityAllows indica si la petición puede ver el archivo rel
+func visibilityAllows(r *http.Request, rel string) bool {
+	vis := fileVisibility(rel)
+	if vis == visPublic { return true }
+	if user, _ := aclPrincipal(r); user != "" { return true }
+	if vis == visPrivate { return false }
+	ok, _ := authorizedByIdentity(r, roleRead)
+	return ok
+}
+
+// visibilityDenied responde 401: con la clave del servidor el navegador la
+// pide por HTTP Basic; un archivo privado necesita iniciar sesión
+func visibilityDenied(w http.ResponseWriter, rel string) {
+	if fileVisibility(rel) == visPrivate {
+		failWith(w, "login_required", "Archivo privado: inicia sesión para verlo", 401)
+		return
+	}
+	if password != "" { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+	failWith(w, "password_required", "Este archivo requiere la clave", 401)
+}
+
+// visibilityHandler cambia la visibilidad de un archivo (POST /visibility
+// con path y visibility)
+func visibilityHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	abs, err := existingPath(r.FormValue("path"))
+	if err != nil { pathError(w, err); return }
+	if info, err := os.Stat(abs); err != nil || info.IsDir() { http.Error(w, "Solo se puede cambiar la visibilidad de archivos", 400); return }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+	if aclDenied(w, r, abs, aclWrite) { return }
+	vis := r.FormValue("visibility")
+	if _, ok := visibilityNames[vis]; !ok { http.Error(w, "Visibilidad no válida (public, password o private)", 400); return }
+	rel := relPath(abs)
+	if err := meta.Update(rel, func(m *FileMeta) { m.Visibility = strings.TrimPrefix(vis, visPublic) }); err != nil {
+		http.Error(w, "Error guardando", 500)
+		return
+	}
+	audit(r, "visibility", map[string]string{"path": rel, "visibility": vis})
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"path": rel, "visibility": vis})
+		return
+	}
+	http.Redirect(w, r, listingURL(filepath.Dir(abs)), 303)
+}
+
+// --- IDENTIFICADORES OPACOS ---
+
+// Con -opaque-ids cada archivo recibe un identificador aleatorio guardado en
+// sus metadatos y los enlaces del listado, de las subidas y de la API pasan a
+// ser /id/{id}: no dejan ver la ruta ni permiten adivinar otros archivos, y
+// como el identificador viaja con los metadatos sigue valiendo si el archivo
+// se mueve o se renombra. /download/{ruta} queda solo para quien se
+// identifica (clave, sesión o clave de API).
+
+// fileID devuelve el identificador de rel, creándolo si aún no tiene; el
+// nuevo queda pendiente de meta.Flush
+func fileID(rel string) string {
+	if fm, ok := meta.Get(rel); ok && fm.ID != "" { return fm.ID }
+	var id string
+	meta.Fill(rel, func(m *FileMeta) {
+		if m.ID == "" { m.ID = randomToken(12) }
+		id = m.ID
+	})
+	return id
+}
+
+// ByID busca la ruta del archivo con ese identificador
+func (m *MetaStore) ByID(id string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, fm := range m.files {
+		if fm.ID == id { return name, true }
+	}
+	return "", false
+}
+
+// idHandler sirve GET /id/{id} con las mismas comprobaciones que /download/
+func idHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "download") { return }
+	id := r.PathValue("id")
+	rel, ok := meta.ByID(id)
+	if !ok || id == "" { http.Error(w, "No encontrado", 404); return }
+	abs, err := existingPath(rel)
+	if err != nil { pathError(w, err); return }
+	if info, err := os.Stat(abs); err != nil || info.IsDir() { http.Error(w, "No encontrado", 404); return }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+	if aclDenied(w, r, abs, aclRead) { return }
+	serveDownload(w, r, abs)
+}
+
+// --- PATRONES IGNORADOS ---
+// Lo que coincide con -exclude o con el archivo .cerberoignore de la raíz
+// (misma sintaxis que .gitignore: comodines, **, / final para carpetas, /
+// inicial o intermedia para anclar a la raíz y ! para volver a incluir) no
+// aparece en el listado, la búsqueda, los ZIP, el manifiesto ni S3. Sigue
+// siendo accesible por su ruta. .cerberoignore se relee cuando cambia.
+
+const ignoreFileName = ".cerberoignore"
+
+type ignoreRule struct {
+	segs     []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+type ignoreList []ignoreRule
+
+// parseIgnore interpreta un patrón por línea; devuelve nil para vacías y comentarios
+func parseIgnore(lines []string) ignoreList {
+	var list ignoreList
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") { continue }
+		var rule ignoreRule
+		if strings.HasPrefix(line, "!") { rule.negate, line = true, line[1:] }
+		line = strings.TrimPrefix(line, "\\")
+		if strings.HasSuffix(line, "/") { rule.dirOnly, line = true, strings.TrimRight(line, "/") }
+		if strings.Contains(line, "/") { rule.anchored, line = true, strings.TrimPrefix(line, "/") }
+		if line == "" { continue }
+		rule.segs = strings.Split(line, "/")
+		list = append(list, rule)
+	}
+	return list
+}
+
+// matchSegments compara tramo a tramo; ** equivale a cero o más tramos
+func matchSegments(pat, segs []string) bool {
+	if len(pat) == 0 { return len(segs) == 0 }
+	if pat[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if matchSegments(pat[1:], segs[i:]) { return true }
+		}
+		return false
+	}
+	if len(segs) == 0 { return false }
+	ok, _ := path.Match(pat[0], segs[0])
+	return ok && matchSegments(pat[1:], segs[1:])
+}
+
+// matches aplica las reglas a una sola ruta; gana la última que coincide
+func (l ignoreList) matches(segs []string, isDir bool) bool {
+	ignored := false
+	for _, rule := range l {
+		if rule.dirOnly && !isDir { continue }
+		var ok bool
+		if rule.anchored {
+			ok = matchSegments(rule.segs, segs)
+		} else {
+			ok, _ = path.Match(rule.segs[0], segs[len(segs)-1])
+		}
+		if ok { ignored = !rule.negate }
+	}
+	return ignored
+}
+
+// Match indica si rel (relativa a la raíz, con /) está ignorada, ella o
+// alguna de sus carpetas: como en git, lo que hay dentro de una carpeta
+// ignorada no se puede volver a incluir
+func (l ignoreList) Match(rel string, isDir bool) bool {
+	if len(l) == 0 || rel == "" || rel == "." { return false }
+	segs := strings.Split(rel, "/")
+	for i := 1; i <= len(segs); i++ {
+		if l.matches(segs[:i], i < len(segs) || isDir) { return true }
+	}
+	return false
+}
+
+type IgnoreStore struct {
+	flagRules ignoreList
+	fileRules ignoreList
+	fileMod   time.Time
+	mu        sync.Mutex
+}
+
+var ignores IgnoreStore
+
+// Current devuelve las reglas vigentes, releyendo .cerberoignore si cambió;
+// se llama una vez por listado o recorrido
+func (s *IgnoreStore) Current() ignoreList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file := filepath.Join(rootDir, ignoreFileName)
+	info, err := os.Stat(file)
+	switch {
+	case err != nil:
+		s.fileRules, s.fileMod = nil, time.Time{}
+	case !info.ModTime().Equal(s.fileMod):
+		data, err := os.ReadFile(file)
+		if err != nil { log.Printf("%s: %v", ignoreFileName, err); break }
+		s.fileRules, s.fileMod = parseIgnore(strings.Split(string(data), "\n")), info.ModTime()
+	}
+	if len(s.fileRules) == 0 { return s.flagRules }
+	return append(slices.Clip(s.flagRules), s.fileRules...)
+}
+
+// --- CONDICIONES DE USO ---
+// Con -terms-file, quien no tenga clave de API tiene que aceptar las
+// condiciones en /terms antes de subir nada. La aceptación queda en una
+// cookie firmada con la versión del texto (su SHA-256): si el archivo cambia,
+// hay que volver a aceptarlas. Cada aceptación se anota en el registro de
+// auditoría con la IP y la hora.
+
+const termsCookie = "cerbero_terms"
+
+var (
+	termsParagraphs []string
+	termsVersion    string
+)
+
+// loadTerms lee el texto; las líneas en blanco separan párrafos
+func loadTerms(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil { log.Fatalf("-terms-file: %v", err) }
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	for _, p := range strings.Split(text, "\n\n") {
+		if p = strings.TrimSpace(p); p != "" { termsParagraphs = append(termsParagraphs, p) }
+	}
+	if len(termsParagraphs) == 0 { log.Fatalf("-terms-file: %s está vacío", path) }
+	sum := sha256.Sum256(data)
+	termsVersion = hex.EncodeToString(sum[:6])
+}
+
+type termsConsent struct {
+	Version  string    `json:"v"`
+	Accepted time.Time `json:"t"`
+}
+
+// termsAccepted indica si la petición puede subir sin pasar por /terms
+func termsAccepted(r *http.Request) bool {
+	if termsVersion == "" || bearerToken(r) != "" { return true }
+	var c termsConsent
+	return readSignedCookie(r, termsCookie, &c) && c.Version == termsVersion
+}
+
+// localPath admite solo rutas del propio sitio como destino de una redirección
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") { return "/" }
+	return next
+}
+
+// needsTerms envuelve las rutas de subida. Los navegadores van a /terms y
+// vuelven a la página de la que venían; los demás clientes reciben 403
+func needsTerms(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if termsAccepted(r) { next(w, r); return }
+		if r.Method == "GET" || strings.Contains(r.Header.Get("Accept"), "text/html") {
+			back := r.URL.RequestURI()
+			if r.Method != "GET" {
+				back = "/"
+				if ref, err := url.Parse(r.Referer()); err == nil && ref.Host == r.Host { back = ref.RequestURI() }
+			}
+			http.Redirect(w, r, "/terms?next="+url.QueryEscape(localPath(back)), 303)
+			return
+		}
+		failWith(w, "terms_required", "Hay que aceptar las condiciones de uso en /terms antes de subir", 403)
+	}
+}
+
+var termsTmpl *template.Template
+
+// termsHandler muestra las condiciones y registra su aceptación
+func termsHandler(w http.ResponseWriter, r *http.Request) {
+	if termsVersion == "" { http.NotFound(w, r); return }
+	next := localPath(r.FormValue("next"))
+	if r.Method == "POST" {
+		setSignedCookie(w, r, termsCookie, termsConsent{Version: termsVersion, Accepted: time.Now()}, 365*24*time.Hour)
+		audit(r, "terms_accepted", map[string]string{"version": termsVersion, "user_agent": truncateRunes(r.UserAgent(), 300)})
+		http.Redirect(w, r, next, 303)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	termsTmpl.Execute(w, map[string]interface{}{"Paragraphs": termsParagraphs, "Next": next, "Accepted": termsAccepted(r)})
+}
+
+// --- DENUNCIAS Y CUARENTENA ---
+// La página de un enlace /s/{token} tiene un enlace "Denunciar" para avisar
+// de contenido ilegal o peligroso sin necesidad de cuenta. Los administradores
+// ven las denuncias en /reports y pueden poner el archivo en cuarentena: se
+// mueve a .cerbero/quarantine/reports, desaparece del listado y sus enlaces
+// responden 451, pero se conserva hasta que se restaura o se borra.
+
+// Motivos que se ofrecen en el formulario
+var reportReasons = []string{"Contenido ilegal", "Derechos de autor", "Malware o phishing", "Datos personales", "Otro"}
+
+// Denuncias pendientes como máximo; más allá se rechazan para que no sirvan
+// para llenar el disco
+const maxPendingReports = 1000
+
+type AbuseReport struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Path     string    `json:"path"`
+	Token    string    `json:"token,omitempty"`
+	Reason   string    `json:"reason"`
+	Details  string    `json:"details,omitempty"`
+	Reporter string    `json:"reporter"`
+	// pendiente, cuarentena, descartada, restaurada o borrada
+	Status string `json:"status"`
+}
+
+// quarantinedFile es un archivo retirado: Stored es su ruta dentro de .cerbero
+type quarantinedFile struct {
+	Stored string    `json:"stored"`
+	Since  time.Time `json:"since"`
+	By     string    `json:"by,omitempty"`
+}
+
+type ReportStore struct {
+	path       string
+	Reports    []*AbuseReport              `json:"reports"`
+	Quarantine map[string]*quarantinedFile `json:"quarantine"`
+	mu         sync.Mutex
+}
+
+var reports = ReportStore{Quarantine: make(map[string]*quarantinedFile)}
+
+func (s *ReportStore) load(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, s); err != nil { log.Printf("Ignorando %s: %v", path, err) }
+	if s.Quarantine == nil { s.Quarantine = make(map[string]*quarantinedFile) }
+}
+
+func (s *ReportStore) save() error {
+	return writeJSONAtomic(s.path, s)
+}
+
+// Add registra una denuncia; una IP que ya denunció el mismo archivo y sigue
+// pendiente no crea otra
+func (s *ReportStore) Add(rep AbuseReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := 0
+	for _, old := range s.Reports {
+		if old.Status != "pendiente" { continue }
+		if old.Path == rep.Path && old.Reporter == rep.Reporter { return nil }
+		pending++
+	}
+	if pending >= maxPendingReports { return errors.New("Demasiadas denuncias pendientes; inténtalo más tarde") }
+	rep.ID, rep.Time, rep.Status = randomToken(8), time.Now(), "pendiente"
+	s.Reports = append(s.Reports, &rep)
+	return s.save()
+}
+
+// List devuelve las denuncias de la más nueva a la más antigua
+func (s *ReportStore) List() []AbuseReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]AbuseReport, 0, len(s.Reports))
+	for i := len(s.Reports) - 1; i >= 0; i-- { out = append(out, *s.Reports[i]) }
+	return out
+}
+
+// Pending cuenta las denuncias sin revisar (para el aviso del listado)
+func (s *ReportStore) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, rep := range s.Reports {
+		if rep.Status == "pendiente" { n++ }
+	}
+	return n
+}
+
+// Quarantined indica si un archivo está retirado
+func (s *ReportStore) Quarantined(rel string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Quarantine[rel] != nil
+}
+
+// setStatus cambia el estado de las denuncias abiertas de un archivo; se
+// llama con el mutex tomado
+func (s *ReportStore) setStatus(rel, status string) {
+	for _, rep := range s.Reports {
+		if rep.Path == rel && (rep.Status == "pendiente" || rep.Status == "cuarentena") { rep.Status = status }
+	}
+}
+
+// Dismiss descarta una denuncia sin tocar el archivo
+func (s *ReportStore) Dismiss(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rep := range s.Reports {
+		if rep.ID == id && rep.Status == "pendiente" {
+			rep.Status = "descartada"
+			return s.save()
+		}
+	}
+	return errNotFound
+}
+
+// Isolate mueve el archivo a la cuarentena
+func (s *ReportStore) Isolate(rel, by string) error {
+	abs, err := existingPath(rel)
+	if err != nil { return err }
+	if info, err := os.Stat(abs); err != nil || info.IsDir() { return errors.New("Solo se pueden retirar archivos") }
+	unlock, err := pathLocks.TryLock(abs)
+	if err != nil { return err }
+	defer unlock()
+	if err := checkMountWrite(abs, -1); err != nil { return err }
+	dir := filepath.Join(stateDir, "quarantine", "reports", randomToken(8))
+	// En una carpeta montada se aparta dentro de ella: rename no cruza discos
+	if m := mountOf(abs); m != nil { dir = filepath.Join(m.dir, stateDirName+"-quarantine", randomToken(8)) }
+	if err := os.MkdirAll(dir, 0700); err != nil { return err }
+	stored := filepath.Join(dir, filepath.Base(abs))
+	if err := os.Rename(abs, stored); err != nil { return err }
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Quarantine[rel] = &quarantinedFile{Stored: stored, Since: time.Now(), By: by}
+	s.setStatus(rel, "cuarentena")
+	log.Printf("Archivo en cuarentena por denuncia: %s", rel)
+	return s.save()
+}
+
+// quarantineError responde a quien pide un archivo retirado
+func quarantineError(w http.ResponseWriter) {
+	http.Error(w, "Este archivo está retirado mientras se revisa una denuncia", 451)
+}
+
+// Release devuelve un archivo a su sitio (restore) o lo borra para siempre
+func (s *ReportStore) Release(rel string, restore bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.Quarantine[rel]
+	if q == nil { return errNotFound }
+	if restore {
+		abs, err := securePath(rel)
+		if err != nil { return err }
+		if _, err := os.Lstat(abs); err == nil { return errors.New("Ya existe otro archivo en " + rel) }
+		if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil { return err }
+		if err := os.Rename(q.Stored, abs); err != nil { return err }
+		s.setStatus(rel, "restaurada")
+	} else {
+		if err := os.Remove(q.Stored); err != nil && !os.IsNotExist(err) { return err }
+		shares.Forget(rel)
+		meta.Delete(rel)
+		s.setStatus(rel, "borrada")
+	}
+	os.Remove(filepath.Dir(q.Stored))
+	delete(s.Quarantine, rel)
+	return s.save()
+}
+
+var reportTmpl *template.Template
+
+// reportHandler muestra y recibe el formulario de denuncia de un enlace
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && rateLimited(w, r, "upload") { return }
+	sh, err := shares.Peek(r.PathValue("token"))
+	if errors.Is(err, errNotFound) { http.Error(w, "Enlace desconocido", 404); return }
+	if errors.Is(err, errShareGone) { http.Error(w, "Este enlace ya no está disponible", 410); return }
+	if err != nil { http.Error(w, "Enlaces no disponibles ahora mismo", 503); return }
+	data := map[string]interface{}{"Name": path.Base(sh.Path), "Reasons": reportReasons, "Done": false, "Error": ""}
+	if reports.Quarantined(sh.Path) { data["Done"] = true }
+	if r.Method == "POST" && !reports.Quarantined(sh.Path) {
+		reason := r.FormValue("reason")
+		if !slices.Contains(reportReasons, reason) { http.Error(w, "Motivo no válido", 400); return }
+		rep := AbuseReport{
+			Path: sh.Path, Token: sh.Token, Reason: reason, Reporter: clientIP(r),
+			Details: truncateRunes(strings.TrimSpace(r.FormValue("details")), 2000),
+		}
+		if err := reports.Add(rep); err != nil {
+			data["Error"] = err.Error()
+		} else {
+			log.Printf("Denuncia de %s desde %s: %s", sh.Path, rep.Reporter, reason)
+			data["Done"] = true
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	reportTmpl.Execute(w, data)
+}
+
+var reportsAdminTmpl *template.Template
+
+// reportsHandler es la revisión de denuncias para los administradores; con
+// Accept: application/json (o en /api/v1/reports) devuelve la lista en JSON
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if r.Method == "GET" && !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	data := map[string]interface{}{
+		"Error":           "",
+		"EnableDelete":    enableDelete,
+		"PasswordEnabled": password != "" && sessionFor(r) == nil && r.Header.Get("Authorization") == "",
+	}
+	if r.Method == "POST" {
+		rel := r.FormValue("path")
+		var err error
+		switch r.FormValue("action") {
+		case "quarantine":
+			err = reports.Isolate(rel, currentUser(r))
+		case "dismiss":
+			err = reports.Dismiss(r.FormValue("id"))
+		case "restore":
+			err = reports.Release(rel, true)
+		case "delete":
+			if !enableDelete { http.Error(w, "Borrado deshabilitado", 403); return }
+			err = reports.Release(rel, false)
+		default:
+			http.Error(w, "Acción desconocida", 400)
+			return
+		}
+		if err == nil {
+			audit(r, "report_"+r.FormValue("action"), map[string]string{"path": rel, "id": r.FormValue("id")})
+			http.Redirect(w, r, "/reports", 303)
+			return
+		}
+		if errors.Is(err, errPathBusy) { err = errors.New("El archivo se está escribiendo; vuelve a intentarlo") }
+		if errors.Is(err, errNotFound) { err = errors.New("No encontrado: " + rel) }
+		data["Error"] = err.Error()
+	}
+	list := reports.List()
+	reports.mu.Lock()
+	quarantine := make(map[string]quarantinedFile, len(reports.Quarantine))
+	for rel, q := range reports.Quarantine { quarantine[rel] = *q }
+	reports.mu.Unlock()
+	if wantsJSON(r) || strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"reports": list, "quarantine": quarantine})
+		return
+	}
+	data["Reports"], data["Quarantine"] = list, quarantine
+	reportsAdminTmpl.Execute(w, data)
+}
+
+// --- SOLICITUDES DE ARCHIVOS ---
+
+// Una solicitud de archivos es un enlace /r/{token} que un admin crea para
+// recibir archivos en una subcarpeta sin dar la clave: caduca, puede limitar
+// el número de envíos, el tamaño por archivo y las extensiones.
+
+type FileRequest struct {
+	Token      string    `json:"token"`
+	Title      string    `json:"title"`
+	Dir        string    `json:"dir"`
+	Expires    time.Time `json:"expires"`
+	MaxBytes   int64     `json:"max_bytes,omitempty"`
+	Extensions []string  `json:"extensions,omitempty"`
+	MaxUses    int       `json:"max_uses,omitempty"`
+	Uses       int       `json:"uses"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Created    time.Time `json:"created"`
+}
+
+// Open indica si todavía acepta envíos
+func (fr *FileRequest) Open() bool {
+	return time.Now().Before(fr.Expires) && (fr.MaxUses == 0 || fr.Uses < fr.MaxUses)
+}
+
+type FileRequestStore struct {
+	path     string
+	requests []*FileRequest
+	mu       sync.Mutex
+}
+
+var fileRequests FileRequestStore
+
+func (s *FileRequestStore) load(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &s.requests); err != nil { log.Printf("Ignorando %s: %v", path, err) }
+}
+
+func (s *FileRequestStore) save() error {
+	return writeJSONAtomic(s.path, s.requests)
+}
+
+func (s *FileRequestStore) Create(fr FileRequest) (*FileRequest, error) {
+	fr.Token = randomToken(18)
+	fr.Created = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, &fr)
+	return &fr, s.save()
+}
+
+// Get devuelve una copia de la solicitud
+func (s *FileRequestStore) Get(token string) (FileRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fr := range s.requests {
+		if subtle.ConstantTimeCompare([]byte(fr.Token), []byte(token)) == 1 { return *fr, true }
+	}
+	return FileRequest{}, false
+}
+
+// Reserve cuenta un envío antes de recibirlo, para que dos envíos simultáneos
+// no superen MaxUses; si el envío falla se devuelve con Release
+func (s *FileRequestStore) Reserve(token string) (FileRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fr := range s.requests {
+		if subtle.ConstantTimeCompare([]byte(fr.Token), []byte(token)) != 1 { continue }
+		if !fr.Open() { return *fr, false }
+		fr.Uses++
+		return *fr, true
+	}
+	return FileRequest{}, false
+}
+
+func (s *FileRequestStore) Release(token string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fr := range s.requests {
+		if fr.Token != token { continue }
+		if !ok { fr.Uses-- }
+		if err := s.save(); err != nil { log.Printf("Error guardando solicitudes: %v", err) }
+		return
+	}
+}
+
+func (s *FileRequestStore) Revoke(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, fr := range s.requests {
+		if fr.Token == token {
+			s.requests = append(s.requests[:i], s.requests[i+1:]...)
+			return s.save()
+		}
+	}
+	return errNotFound
+}
+
+func (s *FileRequestStore) List() []FileRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]FileRequest, 0, len(s.requests))
+	for _, fr := range s.requests { out = append(out, *fr) }
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+var fileRequestTmpl *template.Template
+
+var fileRequestsAdminTmpl *template.Template
+
+// fileRequestsHandler es la página de administración de solicitudes. En modo
+// contraseña el navegador la pide con HTTP Basic (cualquier usuario, la clave)
+func fileRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if r.Method == "GET" && !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	data := map[string]interface{}{
+		"Error":           "",
+		"Base":            baseURL(r),
+		"PasswordEnabled": password != "" && sessionFor(r) == nil && r.Header.Get("Authorization") == "",
+	}
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			fr, err := parseFileRequest(r)
+			if err != nil {
+				data["Error"] = err.Error()
+				break
+			}
+			fr.CreatedBy = currentUser(r)
+			if _, err := fileRequests.Create(fr); err != nil { http.Error(w, "Error guardando", 500); return }
+			http.Redirect(w, r, "/requests", 303)
+			return
+		case "revoke":
+			if err := fileRequests.Revoke(r.FormValue("token")); err != nil { http.Error(w, "No encontrado", 404); return }
+			http.Redirect(w, r, "/requests", 303)
+			return
+		}
+	}
+	data["Requests"] = fileRequests.List()
+	fileRequestsAdminTmpl.Execute(w, data)
+}
+
+// parseFileRequest valida el formulario de creación
+func parseFileRequest(r *http.Request) (FileRequest, error) {
+	fr := FileRequest{Title: truncateRunes(strings.TrimSpace(r.FormValue("title")), 200)}
+	if fr.Title == "" { return fr, errors.New("Falta el título") }
+	dir, err := sanitizeRelPath(r.FormValue("dir"))
+	if err != nil { return fr, errors.New("Carpeta no válida") }
+	if _, err := securePath(dir); err != nil { return fr, errors.New("Carpeta no permitida") }
+	fr.Dir = dir
+	ttl := 7 * 24 * time.Hour
+	if v := strings.TrimSpace(r.FormValue("ttl")); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 { return fr, errors.New("Duración no válida") }
+	}
+	fr.Expires = time.Now().Add(ttl)
+	if v := strings.TrimSpace(r.FormValue("maxmb")); v != "" {
+		mb, err := strconv.Atoi(v)
+		if err != nil || mb < 0 { return fr, errors.New("Tamaño máximo no válido") }
+		fr.MaxBytes = int64(mb) << 20
+	}
+	if v := strings.TrimSpace(r.FormValue("uses")); v != "" {
+		if fr.MaxUses, err = strconv.Atoi(v); err != nil || fr.MaxUses < 0 { return fr, errors.New("Número de envíos no válido") }
+	}
+	for _, ext := range strings.FieldsFunc(strings.ToLower(r.FormValue("extensions")), func(c rune) bool { return c == ',' || c == ' ' }) {
+		fr.Extensions = append(fr.Extensions, "."+strings.TrimPrefix(ext, "."))
+	}
+	return fr, nil
+}
+
+// fileRequestPageHandler muestra el formulario público de la solicitud
+func fileRequestPageHandler(w http.ResponseWriter, r *http.Request) {
+	fr, ok := fileRequests.Get(r.PathValue("token"))
+	if !ok { http.Error(w, "Enlace desconocido", 404); return }
+	fileRequestTmpl.Execute(w, map[string]interface{}{
+		"Request": &fr,
+		"MaxSize": humanSize(fr.MaxBytes),
+		"Accept":  strings.Join(fr.Extensions, ","),
+	})
+}
+
+// fileRequestUploadHandler recibe un envío: no pide clave, solo el enlace
+func fileRequestUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "upload") { return }
+	token := r.PathValue("token")
+	fr, ok := fileRequests.Reserve(token)
+	if !ok {
+		if fr.Token == "" { http.Error(w, "Enlace desconocido", 404); return }
+		http.Error(w, "Esta solicitud ya no acepta archivos", 410)
+		return
+	}
+	stored := receiveUploads(w, r, true, uploadPolicy{
+		Fixed: true, Dir: fr.Dir, MaxBytes: fr.MaxBytes, Extensions: fr.Extensions, Message: fr.Title,
+	})
+	fileRequests.Release(token, stored != nil)
+	if stored == nil { return }
+	respondUploads(w, r, stored)
+}
+
+// --- ENLACES DE CARPETA ---
+// Un enlace /f/{token} da acceso de invitado a una carpeta entera: su listado
+// (con las subcarpetas) y la descarga de lo que contiene, incluido lo que se
+// añada después. Con Upload, el invitado también puede subir archivos. La
+// página se actualiza sola cuando cambia el contenido. Los crea un admin en
+// /folder-links y pueden caducar.
+
+type FolderLink struct {
+	Token     string    `json:"token"`
+	Title     string    `json:"title,omitempty"`
+	Dir       string    `json:"dir"`
+	Upload    bool      `json:"upload,omitempty"`
+	Expires   time.Time `json:"expires"` // cero = no caduca
+	CreatedBy string    `json:"created_by,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// Active indica si el enlace no ha caducado
+func (fl *FolderLink) Active() bool {
+	return fl.Expires.IsZero() || time.Now().Before(fl.Expires)
+}
+
+type FolderLinkStore struct {
+	path  string
+	links []*FolderLink
+	mu    sync.Mutex
+}
+
+var folderLinks FolderLinkStore
+
+func (s *FolderLinkStore) load(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &s.links); err != nil { log.Printf("Ignorando %s: %v", path, err) }
+}
+
+func (s *FolderLinkStore) save() error {
+	return writeJSONAtomic(s.path, s.links)
+}
+
+func (s *FolderLinkStore) Create(fl FolderLink) (*FolderLink, error) {
+	fl.Token = randomToken(18)
+	fl.Created = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links = append(s.links, &fl)
+	return &fl, s.save()
+}
+
+// Get devuelve una copia del enlace
+func (s *FolderLinkStore) Get(token string) (FolderLink, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fl := range s.links {
+		if subtle.ConstantTimeCompare([]byte(fl.Token), []byte(token)) == 1 { return *fl, true }
+	}
+	return FolderLink{}, false
+}
+
+func (s *FolderLinkStore) Revoke(token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, fl := range s.links {
+		if fl.Token == token {
+			s.links = append(s.links[:i], s.links[i+1:]...)
+			return s.save()
+		}
+	}
+	return errNotFound
+}
+
+func (s *FolderLinkStore) List() []FolderLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]FolderLink, 0, len(s.links))
+	for _, fl := range s.links { out = append(out, *fl) }
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.After(out[j].Created) })
+	return out
+}
+
+// Rename mantiene los enlaces de las carpetas movidas
+func (s *FolderLinkStore) Rename(old, new string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, fl := range s.links {
+		if rest, ok := underPath(fl.Dir, old); ok {
+			fl.Dir = new + rest
+			changed = true
+		}
+	}
+	if changed {
+		if err := s.save(); err != nil { log.Printf("Error guardando enlaces de carpeta: %v", err) }
+	}
+}
+
+// Forget quita los enlaces de una carpeta borrada
+func (s *FolderLinkStore) Forget(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.links[:0]
+	for _, fl := range s.links {
+		if _, ok := underPath(fl.Dir, dir); !ok { kept = append(kept, fl) }
+	}
+	if len(kept) == len(s.links) { return }
+	s.links = kept
+	if err := s.save(); err != nil { log.Printf("Error guardando enlaces de carpeta: %v", err) }
+}
+
+// CSP de la página del enlace: como la de por defecto, más su script, que
+// consulta el listado para actualizarlo
+const folderLinkCSP = "default-src 'none'; script-src 'self'; connect-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+// folderLinkFor busca un enlace vigente y responde 404 o 410 si no lo hay
+func folderLinkFor(w http.ResponseWriter, r *http.Request) (FolderLink, bool) {
+	fl, ok := folderLinks.Get(r.PathValue("token"))
+	if !ok { http.Error(w, "Enlace desconocido", 404); return fl, false }
+	if !fl.Active() { http.Error(w, "Este enlace ha caducado", 410); return fl, false }
+	return fl, true
+}
+
+// folderLinkPath resuelve sub dentro de la carpeta del enlace; ".." no puede
+// salir de ella porque se limpia antes de unirla
+func folderLinkPath(fl FolderLink, sub string) (rel, abs string, err error) {
+	rel = strings.Trim(path.Join(fl.Dir, path.Clean("/"+sub)), "/")
+	abs, err = existingPath(rel)
+	return rel, abs, err
+}
+
+type folderLinkEntry struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"` // relativa a la carpeta del enlace
+	IsDir     bool      `json:"dir,omitempty"`
+	Size      int64     `json:"size"`
+	HumanSize string    `json:"-"`
+	Modified  time.Time `json:"modified"`
+}
+
+// folderLinkListing lista una carpeta del enlace; version cambia cuando se
+// añade, quita o modifica algo, y la página la consulta para recargarse
+func folderLinkListing(fl FolderLink, sub, abs string) (entries []folderLinkEntry, version string, err error) {
+	infos, err := listCache.ReadDir(abs)
+	if err != nil { return nil, "", err }
+	ignored := ignores.Current()
+	h := sha256.New()
+	for _, info := range infos {
+		if isHiddenName(info.Name()) { continue }
+		rel := path.Join(sub, info.Name())
+		if ignored.Match(strings.Trim(path.Join(fl.Dir, rel), "/"), info.IsDir()) { continue }
+		e := folderLinkEntry{Name: info.Name(), Path: rel, IsDir: info.IsDir(), Modified: info.ModTime(), HumanSize: "-"}
+		if !e.IsDir { e.Size, e.HumanSize = info.Size(), humanSize(info.Size()) }
+		entries = append(entries, e)
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", e.Name, e.Size, e.Modified.UnixNano())
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir { return entries[i].IsDir }
+		return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name)
+	})
+	return entries, hex.EncodeToString(h.Sum(nil)[:8]), nil
+}
+
+var folderLinkTmpl *template.Template
+
+// folderLinkHandler muestra la carpeta del enlace (?dir= para subcarpetas);
+// con Accept: application/json devuelve el listado y su versión
+func folderLinkHandler(w http.ResponseWriter, r *http.Request) {
+	fl, ok := folderLinkFor(w, r)
+	if !ok { return }
+	sub := strings.Trim(path.Clean("/"+r.URL.Query().Get("dir")), "/")
+	_, abs, err := folderLinkPath(fl, sub)
+	if err != nil { pathError(w, err); return }
+	if info, err := os.Stat(abs); err != nil || !info.IsDir() { http.Error(w, "No encontrado", 404); return }
+	entries, version, err := folderLinkListing(fl, sub, abs)
+	if err != nil { http.Error(w, "Error leyendo carpeta", 500); return }
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"dir": sub, "version": version, "upload": fl.Upload, "files": entries})
+		return
+	}
+	title := fl.Title
+	if title == "" { title = path.Base("/" + fl.Dir) }
+	if title == "/" { title = "Carpeta compartida" }
+	parent := path.Dir(sub)
+	if parent == "." { parent = "" }
+	if cspPolicy != "" { w.Header().Set("Content-Security-Policy", folderLinkCSP) }
+	folderLinkTmpl.Execute(w, map[string]interface{}{
+		"Token": fl.Token, "Title": title, "Sub": sub, "Parent": parent, "Upload": fl.Upload,
+		"Expires": fl.Expires, "Entries": entries, "Version": version,
+		"HasAudio": slices.ContainsFunc(entries, func(e folderLinkEntry) bool { return !e.IsDir && isAudio(e.Name) }),
+	})
+}
+
+// folderLinkDownloadHandler descarga un archivo de la carpeta del enlace
+func folderLinkDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "download") { return }
+	fl, ok := folderLinkFor(w, r)
+	if !ok { return }
+	rel, abs, err := folderLinkPath(fl, r.PathValue("path"))
+	if errors.Is(err, errNotFound) && reports.Quarantined(rel) { quarantineError(w); return }
+	if err != nil { pathError(w, err); return }
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() { http.Error(w, "No encontrado", 404); return }
+	if watermarkFor(r, abs) {
+		if !downloadHookDenied(w, r, abs, info) { serveWatermarked(w, r, abs, info) }
+		return
+	}
+	serveDownload(w, r, abs)
+}
+
+// folderLinkUploadHandler recibe archivos en la carpeta (o subcarpeta) del
+// enlace, si lo permite; no pide clave
+func folderLinkUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "upload") { return }
+	fl, ok := folderLinkFor(w, r)
+	if !ok { return }
+	if !fl.Upload { http.Error(w, "Este enlace es de solo lectura", 403); return }
+	rel, abs, err := folderLinkPath(fl, r.URL.Query().Get("dir"))
+	if err != nil { pathError(w, err); return }
+	if info, err := os.Stat(abs); err != nil || !info.IsDir() { http.Error(w, "No encontrado", 404); return }
+	stored := receiveUploads(w, r, true, uploadPolicy{Fixed: true, Dir: rel, Message: "Enlace de carpeta"})
+	if stored == nil { return }
+	if !wantsJSON(r) {
+		contentChanged()
+		back := "/f/" + fl.Token
+		if sub := strings.Trim(r.URL.Query().Get("dir"), "/"); sub != "" { back += "?dir=" + url.QueryEscape(sub) }
+		http.Redirect(w, r, back, 303)
+		return
+	}
+	respondUploads(w, r, stored)
+}
+
+var folderLinksAdminTmpl *template.Template
+
+// folderLinksHandler crea, lista y revoca enlaces de carpeta (admin); con
+// Accept: application/json la creación devuelve el enlace y el GET la lista
+func folderLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if r.Method == "GET" && !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	data := map[string]interface{}{
+		"Error":           "",
+		"Base":            baseURL(r),
+		"Dir":             strings.Trim(r.FormValue("dir"), "/"),
+		"PasswordEnabled": password != "" && sessionFor(r) == nil && r.Header.Get("Authorization") == "",
+	}
+	if r.Method == "POST" {
+		switch r.FormValue("action") {
+		case "create":
+			fl, err := parseFolderLink(r)
+			if err != nil {
+				if wantsJSON(r) { http.Error(w, err.Error(), 400); return }
+				data["Error"] = err.Error()
+				break
+			}
+			fl.CreatedBy = currentUser(r)
+			created, err := folderLinks.Create(fl)
+			if err != nil { http.Error(w, "Error guardando", 500); return }
+			audit(r, "folder_link_create", map[string]string{"dir": created.Dir, "upload": strconv.FormatBool(created.Upload)})
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(201)
+				json.NewEncoder(w).Encode(map[string]interface{}{"url": baseURL(r) + "/f/" + created.Token, "link": created})
+				return
+			}
+			http.Redirect(w, r, "/folder-links", 303)
+			return
+		case "revoke":
+			if err := folderLinks.Revoke(r.FormValue("token")); err != nil { http.Error(w, "No encontrado", 404); return }
+			audit(r, "folder_link_revoke", map[string]string{"token": r.FormValue("token")})
+			http.Redirect(w, r, "/folder-links", 303)
+			return
+		default:
+			http.Error(w, "Acción desconocida", 400)
+			return
+		}
+	}
+	links := folderLinks.List()
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"links": links})
+		return
+	}
+	data["Links"] = links
+	folderLinksAdminTmpl.Execute(w, data)
+}
+
+// parseFolderLink valida el formulario de creación
+func parseFolderLink(r *http.Request) (FolderLink, error) {
+	fl := FolderLink{Title: truncateRunes(strings.TrimSpace(r.FormValue("title")), 200), Upload: r.FormValue("upload") != ""}
+	if dir := strings.Trim(r.FormValue("dir"), "/"); dir != "" {
+		var err error
+		if fl.Dir, err = sanitizeRelPath(dir); err != nil { return fl, errors.New("Carpeta no válida") }
+	}
+	abs, err := existingPath(fl.Dir)
+	if err != nil { return fl, errors.New("No existe la carpeta /" + fl.Dir) }
+	if info, err := os.Stat(abs); err != nil || !info.IsDir() { return fl, errors.New("/" + fl.Dir + " no es una carpeta") }
+	if v := strings.TrimSpace(r.FormValue("ttl")); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 { return fl, errors.New("Duración no válida") }
+		fl.Expires = time.Now().Add(ttl)
+	}
+	return fl, nil
+}
+
+// --- HISTORIAL DE TRANSFERENCIAS ---
+
+// Transfer es una subida o descarga terminada (bien o mal), para ver en
+// /transfers quién movió qué y a qué velocidad
+type Transfer struct {
+	Time     time.Time     `json:"time"`
+	Kind     string        `json:"kind"` // subida o descarga
+	Path     string        `json:"path"`
+	Peer     string        `json:"peer"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+	Result   string        `json:"result"`
+}
+
+func (t Transfer) HumanSize() string { return humanSize(t.Bytes) }
+
+// Speed es la velocidad media; por debajo de 1 ms no tiene sentido medirla
+func (t Transfer) Speed() string {
+	if t.Duration < time.Millisecond { return "-" }
+	return humanSize(int64(float64(t.Bytes)/t.Duration.Seconds())) + "/s"
+}
+
+// TransferLog guarda las últimas -transfer-history transferencias en
+// .cerbero/transfers.json. Las descargas son frecuentes, así que se escribe
+// como mucho una vez cada pocos segundos
+type TransferLog struct {
+	path    string
+	items   []Transfer
+	pending bool
+	mu      sync.Mutex
+}
+
+var transfers TransferLog
+
+func (t *TransferLog) load(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &t.items); err != nil { log.Printf("Ignorando %s: %v", path, err) }
+}
+
+func (t *TransferLog) save() error {
+	return writeJSONAtomic(t.path, t.items)
+}
+
+// Record añade la transferencia; err != nil (o una conexión cortada) la
+// marca como fallida con el motivo
+func (t *TransferLog) Record(r *http.Request, kind, rel string, n int64, took time.Duration, err error) {
+	if transferHistory <= 0 { return }
+	peer := clientIP(r)
+	if user := currentUser(r); user != "" { peer = user + " (" + peer + ")" }
+	result := "ok"
+	if err == nil && r.Context().Err() != nil { err = r.Context().Err() }
+	if err != nil { result = err.Error() }
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.items = append(t.items, Transfer{Time: time.Now(), Kind: kind, Path: rel, Peer: peer, Bytes: n, Duration: took, Result: result})
+	if extra := len(t.items) - transferHistory; extra > 0 { t.items = slices.Delete(t.items, 0, extra) }
+	if t.pending || t.path == "" { return }
+	t.pending = true
+	time.AfterFunc(5*time.Second, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.pending = false
+		if err := t.save(); err != nil { log.Printf("Error guardando el historial: %v", err) }
+	})
+}
+
+// Recent devuelve las transferencias de la más nueva a la más antigua
+func (t *TransferLog) Recent() []Transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := slices.Clone(t.items)
+	slices.Reverse(out)
+	return out
+}
+
+// countingReader cuenta lo recibido, también en subidas que fallan a medias
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter cuenta lo enviado al cliente; ReadFrom mantiene sendfile
+type countingWriter struct {
+	http.ResponseWriter
+	n      int64
+	status int
+}
+
+func (cw *countingWriter) WriteHeader(code int) {
+	if cw.status == 0 { cw.status = code }
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 { cw.status = 200 }
+	n, err := cw.ResponseWriter.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) ReadFrom(src io.Reader) (int64, error) {
+	if cw.status == 0 { cw.status = 200 }
+	var n int64
+	var err error
+	if rf, ok := cw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{cw.ResponseWriter}, src)
+	}
+	cw.n += n
+	return n, err
+}
+
+func (cw *countingWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+var transfersTmpl *template.Template
+
+// transfersHandler muestra el historial a los administradores; con
+// Accept: application/json (o en /api/v1/transfers) lo devuelve en JSON
+func transfersHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	list := transfers.Recent()
+	if wantsJSON(r) || strings.HasPrefix(r.URL.Path, "/api/") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+	transfersTmpl.Execute(w, map[string]interface{}{"Transfers": list, "Enabled": transferHistory > 0})
+}
+
+// --- INTEGRIDAD DE DESCARGAS ---
+
+// Las descargas llevan el SHA-256 del archivo completo: en Repr-Digest
+// (RFC 9530), en Digest (RFC 3230, para clientes antiguos) y en
+// X-Cerbero-SHA256. Si aún no está calculado, se calcula mientras se envía y
+// va en un trailer. /api/v1/checksums da además el SHA-256 de cada tramo, con
+// el que cerbero get verifica y repite solo los tramos dañados.
+
+const (
+	defaultChecksumChunk = 8 << 20
+	minChecksumChunk     = 1 << 20
+	maxChecksumChunk     = 64 << 20
+)
+
+func setDigestHeaders(h http.Header, sum string) {
+	raw, err := hex.DecodeString(sum)
+	if err != nil { return }
+	b64 := base64.StdEncoding.EncodeToString(raw)
+	h.Set("Repr-Digest", "sha-256=:"+b64+":")
+	h.Set("Digest", "SHA-256="+b64)
+	h.Set("X-Cerbero-SHA256", sum)
+}
+
+// hashingWriter calcula el SHA-256 de lo que se envía al cliente
+type hashingWriter struct {
+	http.ResponseWriter
+	h hash.Hash
+	n int64
+}
+
+func (hw *hashingWriter) WriteHeader(code int) {
+	hw.Header().Del("Content-Length")
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.ResponseWriter.Write(p)
+	hw.h.Write(p[:n])
+	hw.n += int64(n)
+	return n, err
+}
+
+// checksumsHandler devuelve el SHA-256 del archivo y el de cada tramo de
+// ?chunk= bytes (8 MB por defecto)
+func checksumsHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "download") { return }
+	if opaqueDenied(w, r) { return }
+	abs, err := existingPath(r.PathValue("path"))
+	if errors.Is(err, errNotFound) && reports.Quarantined(r.PathValue("path")) { quarantineError(w); return }
+	if err != nil { pathError(w, err); return }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+	if aclDenied(w, r, abs, aclRead) { return }
+	chunk := int64(defaultChecksumChunk)
+	if v := r.URL.Query().Get("chunk"); v != "" {
+		if chunk, err = strconv.ParseInt(v, 10, 64); err != nil || chunk < minChecksumChunk || chunk > maxChecksumChunk {
+			http.Error(w, fmt.Sprintf("chunk debe estar entre %d y %d", minChecksumChunk, maxChecksumChunk), 400)
+			return
+		}
+	}
+	f, err := os.Open(abs)
+	if err != nil { http.Error(w, "Error leyendo archivo", 500); return }
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() { http.Error(w, "No encontrado", 404); return }
+	if downloadHookDenied(w, r, abs, info) { return }
+
+	_, span := startSpan(r.Context(), "storage.checksums")
+	whole := sha256.New()
+	chunks := []string{}
+	for {
+		part := sha256.New()
+		n, err := copyBuffered(io.MultiWriter(whole, part), io.LimitReader(f, chunk))
+		if err != nil { span.SetError(err); span.End(); http.Error(w, "Error leyendo archivo", 500); return }
+		if n == 0 && len(chunks) > 0 { break }
+		chunks = append(chunks, hex.EncodeToString(part.Sum(nil)))
+		if n < chunk { break }
+	}
+	span.End()
+	sum := hex.EncodeToString(whole.Sum(nil))
+	rel := relPath(abs)
+	meta.Fill(rel, func(m *FileMeta) { m.SHA256, m.HashSize, m.HashMTime = sum, info.Size(), info.ModTime().UnixNano() })
+	meta.Flush()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":       rel,
+		"size":       info.Size(),
+		"sha256":     sum,
+		"chunk_size": chunk,
+		"chunks":     chunks,
+	})
+}
+
+// runGet es el cliente de descarga: baja el archivo por tramos con Range,
+// comprueba cada uno con /api/v1/checksums, repite los que llegan dañados y
+// reanuda un .part anterior conservando los tramos correctos
+func runGet(args []string) error {
+	fs := flag.NewFlagSet("get", flag.ExitOnError)
+	out := fs.String("o", "", "Archivo de salida (por defecto, el nombre del remoto)")
+	pass := fs.String("password", os.Getenv("CERBERO_PASSWORD"), "Clave del servidor (o CERBERO_PASSWORD)")
+	chunkMB := fs.Int("chunk-mb", defaultChecksumChunk>>20, "Tamaño de los tramos verificados en MB")
+	retries := fs.Int("retries", 3, "Reintentos por tramo dañado o cortado")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Uso: cerbero get [opciones] http://host:8080/download/ruta")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	src := fs.Arg(0)
+	u, err := url.Parse(src)
+	if err != nil || !strings.HasPrefix(u.Path, "/download/") { return fmt.Errorf("%s no es una URL /download/ de Cerbero", src) }
+	name := path.Base(u.Path)
+	if *out == "" { *out = name }
+	do := func(req *http.Request) (*http.Response, error) {
+		if *pass != "" { req.Header.Set("X-Cerbero-Password", *pass) }
+		return http.DefaultClient.Do(req)
+	}
+
+	sumURL := *u
+	sumURL.Path = "/api/v1/checksums/" + strings.TrimPrefix(u.Path, "/download/")
+	sumURL.RawPath = ""
+	sumURL.RawQuery = "chunk=" + strconv.Itoa(*chunkMB<<20)
+	req, _ := http.NewRequest("GET", sumURL.String(), nil)
+	resp, err := do(req)
+	if err != nil { return err }
+	var sums struct {
+		Size      int64    `json:"size"`
+		SHA256    string   `json:"sha256"`
+		ChunkSize int64    `json:"chunk_size"`
+		Chunks    []string `json:"chunks"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&sums)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || err != nil { return fmt.Errorf("no se pudieron obtener las sumas de %s: %s", name, resp.Status) }
+
+	part := *out + ".part"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil { return err }
+	defer f.Close()
+	if err := f.Truncate(sums.Size); err != nil { return err }
+
+	buf := make([]byte, sums.ChunkSize)
+	reused, repaired := 0, 0
+	for i, want := range sums.Chunks {
+		start := int64(i) * sums.ChunkSize
+		length := min(sums.ChunkSize, sums.Size-start)
+		// Un tramo ya descargado (de un intento anterior) se conserva si es correcto
+		if n, err := f.ReadAt(buf[:length], start); int64(n) == length && (err == nil || err == io.EOF) && sha256Hex(buf[:length]) == want {
+			reused++
+			continue
+		}
+		var lastErr error
+		for attempt := 0; attempt <= *retries; attempt++ {
+			if attempt > 0 {
+				repaired++
+				log.Printf("Tramo %d/%d: %v; reintentando", i+1, len(sums.Chunks), lastErr)
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			lastErr = fetchRange(do, src, buf[:length], start, want)
+			if lastErr == nil { break }
+		}
+		if lastErr != nil { return fmt.Errorf("tramo %d: %w", i+1, lastErr) }
+		if _, err := f.WriteAt(buf[:length], start); err != nil { return err }
+	}
+
+	if err := f.Sync(); err != nil { return err }
+	if _, err := f.Seek(0, io.SeekStart); err != nil { return err }
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil { return err }
+	if got := hex.EncodeToString(h.Sum(nil)); got != sums.SHA256 { return fmt.Errorf("el SHA-256 final no coincide (%s, se esperaba %s); se conserva %s para reintentar", got, sums.SHA256, part) }
+	f.Close()
+	if err := os.Rename(part, *out); err != nil { return err }
+	fmt.Printf("Descargado %s (%s), SHA-256 verificado %s", *out, humanSize(sums.Size), sums.SHA256)
+	if reused > 0 { fmt.Printf(", %d tramos reutilizados", reused) }
+	if repaired > 0 { fmt.Printf(", %d reintentos", repaired) }
+	fmt.Println()
+	return nil
+}
+
+// fetchRange descarga un tramo en buf y comprueba su SHA-256
+func fetchRange(do func(*http.Request) (*http.Response, error), src string, buf []byte, start int64, want string) error {
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil { return err }
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+int64(len(buf))-1))
+	resp, err := do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 206 && !(resp.StatusCode == 200 && start == 0 && resp.ContentLength == int64(len(buf))) {
+		return fmt.Errorf("respuesta %s", resp.Status)
+	}
+	if _, err := io.ReadFull(resp.Body, buf); err != nil { return err }
+	if sha256Hex(buf) != want { return errors.New("SHA-256 del tramo incorrecto") }
+	return nil
+}
+
+// --- ENVÍOS ENTRE INSTANCIAS ---
+
+// Un token de envío permite una única subida a /send/{token} sin clave ni
+// sesión. Quien recibe lo crea con POST /api/v1/send-tokens y pasa la URL a
+// quien envía, que usa "cerbero send <archivo> <url>" o cualquier cliente HTTP.
+
+const maxSendTokenTTL = 7 * 24 * time.Hour
+
+type SendToken struct {
+	Hash      string    `json:"hash"`
+	Dir       string    `json:"dir,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	inUse     bool
+}
+
+type SendTokenStore struct {
+	path   string
+	tokens []*SendToken
+	mu     sync.Mutex
+}
+
+var sendTokens SendTokenStore
+
+func (s *SendTokenStore) load(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	data, err := os.ReadFile(path)
+	if err != nil { return }
+	if err := json.Unmarshal(data, &s.tokens); err != nil { log.Printf("Ignorando %s: %v", path, err) }
+}
+
+func (s *SendTokenStore) save() error {
+	now := time.Now()
+	live := s.tokens[:0]
+	for _, t := range s.tokens {
+		if now.Before(t.Expires) { live = append(live, t) }
+	}
+	s.tokens = live
+	return writeJSONAtomic(s.path, s.tokens)
+}
+
+// Create genera un token y devuelve el valor en claro (solo se guarda el hash)
+func (s *SendTokenStore) Create(t SendToken) (string, error) {
+	token := "cbs_" + randomToken(24)
+	t.Hash = hashToken(token)
+	t.Created = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = append(s.tokens, &t)
+	return token, s.save()
+}
+
+// Claim reserva el token para una subida; mientras dura nadie más puede usarlo.
+// Si la subida falla se libera con Release y sirve para reintentar.
+func (s *SendTokenStore) Claim(token string) (*SendToken, error) {
+	h := hashToken(token)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(h)) != 1 { continue }
+		if time.Now().After(t.Expires) { return nil, errNotFound }
+		if t.inUse { return nil, errors.New("el token ya se está usando") }
+		t.inUse = true
+		return t, nil
+	}
+	return nil, errNotFound
+}
+
+func (s *SendTokenStore) Release(t *SendToken) {
+	s.mu.Lock()
+	t.inUse = false
+	s.mu.Unlock()
+}
+
+// Consume borra el token tras una subida correcta
+func (s *SendTokenStore) Consume(t *SendToken) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, other := range s.tokens {
+		if other == t {
+			s.tokens = append(s.tokens[:i], s.tokens[i+1:]...)
+			break
+		}
+	}
+	if err := s.save(); err != nil { log.Printf("Error guardando tokens de envío: %v", err) }
+}
+
+// sendTokenCreateHandler crea un token de envío: {"dir": "...", "ttl": "24h", "note": "..."}
+func sendTokenCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	var req struct {
+		Dir  string `json:"dir"`
+		TTL  string `json:"ttl"`
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 16<<10)).Decode(&req); err != nil { http.Error(w, "JSON no válido", 400); return }
+	}
+	ttl := 24 * time.Hour
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > maxSendTokenTTL { http.Error(w, "ttl no válido (máximo 168h)", 400); return }
+		ttl = d
+	}
+	dir := ""
+	if req.Dir = strings.Trim(req.Dir, "/"); req.Dir != "" {
+		var err error
+		if dir, err = sanitizeRelPath(req.Dir); err != nil { http.Error(w, "Carpeta no válida", 400); return }
+		abs, err := securePath(dir)
+		if err != nil { http.Error(w, "Denegado", 403); return }
+		if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+		if err := checkMountWrite(abs, 0); err != nil { mountWriteError(w, err); return }
+		if aclDenied(w, r, abs, aclWrite) { return }
+	}
+	t := SendToken{Dir: dir, Note: truncateRunes(strings.TrimSpace(req.Note), 500), CreatedBy: currentUser(r), Expires: time.Now().Add(ttl)}
+	token, err := sendTokens.Create(t)
+	if err != nil { http.Error(w, "Error guardando", 500); return }
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":   token,
+		"url":     baseURL(r) + "/send/" + token,
+		"expires": t.Expires.UTC(),
+	})
+}
+
+// sendReceiveHandler recibe el cuerpo en bruto de PUT /send/{token}; el nombre
+// va en Content-Disposition (filename) o en ?name=
+func sendReceiveHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "upload") { return }
+	t, err := sendTokens.Claim(r.PathValue("token"))
+	if errors.Is(err, errNotFound) { http.Error(w, "Token desconocido, caducado o ya usado", 404); return }
+	if err != nil { http.Error(w, err.Error(), 409); return }
+	consumed := false
+	defer func() {
+		if !consumed { sendTokens.Release(t) }
+	}()
+
+	original := r.URL.Query().Get("name")
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		original = params["filename"]
+	}
+	name, err := sanitizeFilename(original)
+	if err != nil { http.Error(w, "Nombre de archivo no válido: "+err.Error(), 400); return }
+	result := uploadResult{Original: original, Renamed: name != original}
+	if t.Dir != "" { name = t.Dir + "/" + name }
+	if r.ContentLength > int64(maxUploadMB)<<20 { http.Error(w, "Archivo demasiado grande", 413); return }
+	if r.ContentLength > 0 && checkFreeSpace(rootDir, r.ContentLength) != nil {
+		http.Error(w, "No hay espacio en disco para este archivo", 507)
+		return
+	}
+	if _, err := quotas.Check(r, r.ContentLength); err != nil { quotaFail(w, r, r.ContentLength, err); return }
+	dstPath, err := securePath(name)
+	if err != nil { http.Error(w, "Denegado", 403); return }
+	if err := checkMountWrite(dstPath, max(r.ContentLength, 0)); err != nil { mountWriteError(w, err); return }
+	unlock, err := pathLocks.TryLock(dstPath)
+	if err != nil { failWith(w, "path_busy", "Otra subida está escribiendo "+name+"; vuelve a intentarlo", 409); return }
+	defer unlock()
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil { http.Error(w, "No se pudo crear la carpeta", 409); return }
+	if err := checkDirCapacity(dstPath); err != nil { http.Error(w, err.Error(), 507); return }
+	if info, err := os.Lstat(dstPath); err == nil {
+		if info.IsDir() { http.Error(w, "Ya existe una carpeta llamada "+name, 409); return }
+		result.Replaced = true
+	}
+
+	want, err := contentSHA256(r.Header.Get("X-Content-SHA256"))
+	if err != nil { http.Error(w, err.Error(), 400); return }
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadMB)<<20)
+	start, counted := time.Now(), &countingReader{r: quotas.Reader(r, r.Body)}
+	result.SHA256, err = receiveChecked(hookContext(r), counted, dstPath, want)
+	transfers.Record(r, "subida", name, counted.n, time.Since(start), err)
+	quotas.Charge(r, counted.n)
+	if err != nil {
+		log.Printf("Envío de %s interrumpido: %v", name, err)
+		var tooBig *http.MaxBytesError
+		var rejected *hookRejected
+		switch {
+		case errors.As(err, &rejected):
+			failWith(w, "hook_rejected", rejected.Message, 403)
+		case errors.Is(err, errChecksumMismatch):
+			failWith(w, "checksum_mismatch", err.Error(), 422)
+		case errors.Is(err, errQuotaExceeded):
+			quotaFail(w, r, 1, err)
+		case errors.As(err, &tooBig):
+			http.Error(w, "Archivo demasiado grande", 413)
+		case errors.Is(err, errDiskFull):
+			http.Error(w, "No hay espacio en disco para este archivo", 507)
+		default:
+			http.Error(w, "Error guardando el archivo", 400)
+		}
+		return
+	}
+	sender := truncateRunes(strings.TrimSpace(r.Header.Get("X-Cerbero-Sender")), 100)
+	if sender == "" { sender = "envío" }
+	if err := finishUpload(r, dstPath, map[string]string{"uploader": sender, "message": t.Note}, &result); err != nil {
+		http.Error(w, "Imagen no válida", 422)
+		return
+	}
+	consumed = true
+	sendTokens.Consume(t)
+	contentChanged()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(map[string]interface{}{"files": []uploadResult{result}})
+}
+
+// --- VARIOS CLIENTES EN UN PUERTO ---
+
+// "cerbero tenants" sirve varias instancias aisladas desde un solo puerto:
+// cada cliente es un proceso propio de este mismo binario, con su -root, sus
+// usuarios, su cuota (-quota-mb) y su aspecto (-assets-dir), escuchando en un
+// puerto local. El supervisor elige el proceso por el nombre de host de la
+// petición y reenvía la petición tal cual. Al ser procesos distintos no
+// comparten memoria, metadatos ni sesiones.
+
+// tenantEnv marca a los procesos de cliente: solo ellos se fían de
+// X-Forwarded-For, y solo si la conexión viene de la propia máquina
+const tenantEnv = "CERBERO_TENANT"
+
+type tenant struct {
+	Name  string   `json:"name"`
+	Hosts []string `json:"hosts"`
+	Args  []string `json:"args"`
+	addr  string
+}
+
+// loadTenants lee y valida el fichero de -config
+func loadTenants(file string) ([]*tenant, error) {
+	data, err := os.ReadFile(file)
+	if err != nil { return nil, err }
+	var list []*tenant
+	if err := json.Unmarshal(data, &list); err != nil { return nil, fmt.Errorf("%s: %v", file, err) }
+	if len(list) == 0 { return nil, fmt.Errorf("%s no define ningún cliente", file) }
+	names, hosts, roots := make(map[string]bool), make(map[string]string), make(map[string]string)
+	for _, t := range list {
+		if t.Name == "" || strings.ContainsAny(t.Name, " /\\") { return nil, fmt.Errorf("nombre de cliente no válido: %q", t.Name) }
+		if names[t.Name] { return nil, fmt.Errorf("el cliente %s está repetido", t.Name) }
+		names[t.Name] = true
+		if len(t.Hosts) == 0 { return nil, fmt.Errorf("%s: falta hosts", t.Name) }
+		for i, h := range t.Hosts {
+			h = strings.ToLower(strings.TrimSpace(h))
+			if other, ok := hosts[h]; ok { return nil, fmt.Errorf("el host %s está en %s y en %s", h, other, t.Name) }
+			hosts[h], t.Hosts[i] = t.Name, h
+		}
+		root := ""
+		for i, a := range t.Args {
+			name, value, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+			if !strings.HasPrefix(a, "-") { continue }
+			if name == "listen" { return nil, fmt.Errorf("%s: -listen lo asigna el supervisor", t.Name) }
+			if name != "root" { continue }
+			if !hasValue && i+1 < len(t.Args) { value = t.Args[i+1] }
+			root = value
+		}
+		if root == "" { return nil, fmt.Errorf("%s: cada cliente necesita su propio -root", t.Name) }
+		abs, err := filepath.Abs(root)
+		if err != nil { return nil, err }
+		for other, name := range roots {
+			if within(other, abs) || within(abs, other) { return nil, fmt.Errorf("las carpetas de %s y %s se solapan", name, t.Name) }
+		}
+		roots[abs] = t.Name
+	}
+	return list, nil
+}
+
+// freeLocalAddr reserva un puerto libre en 127.0.0.1 para un cliente
+func freeLocalAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil { return "", err }
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// superviseTenant mantiene vivo el proceso del cliente y antepone su nombre
+// a cada línea de su registro
+func superviseTenant(ctx context.Context, exe string, t *tenant) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		cmd := exec.CommandContext(ctx, exe, append(slices.Clone(t.Args), "-listen", t.addr)...)
+		cmd.Env = append(os.Environ(), tenantEnv+"="+t.Name)
+		cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+		cmd.WaitDelay = 10 * time.Second
+		out, _ := cmd.StderrPipe()
+		cmd.Stdout = os.Stdout
+		started := time.Now()
+		if err := cmd.Start(); err != nil {
+			log.Printf("[%s] No se puede arrancar: %v", t.Name, err)
+		} else {
+			sc := bufio.NewScanner(out)
+			for sc.Scan() { fmt.Fprintf(os.Stderr, "[%s] %s\n", t.Name, sc.Text()) }
+			err := cmd.Wait()
+			if ctx.Err() != nil { return }
+			log.Printf("[%s] El proceso terminó (%v)", t.Name, err)
+		}
+		// Un cliente que arranca y cae enseguida no debe acaparar la máquina
+		if time.Since(started) > time.Minute { backoff = time.Second }
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// runTenants es "cerbero tenants"
+func runTenants(args []string) error {
+	fs := flag.NewFlagSet("tenants", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "Puerto común a todos los clientes")
+	config := fs.String("config", "tenants.json", "Fichero JSON con los clientes")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Uso: cerbero tenants [-listen :8080] [-config tenants.json]")
+		fmt.Fprintln(fs.Output(), "Sirve varios clientes aislados, elegidos por el nombre de host, desde un solo puerto.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	list, err := loadTenants(*config)
+	if err != nil { return err }
+	exe, err := os.Executable()
+	if err != nil { return err }
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	byHost := make(map[string]*httputil.ReverseProxy)
+	var wg sync.WaitGroup
+	for _, t := range list {
+		if t.addr, err = freeLocalAddr(); err != nil { return err }
+		target := &url.URL{Scheme: "http", Host: t.addr}
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(target)
+				pr.SetXForwarded()
+				pr.Out.Host = pr.In.Host
+				// Si delante hay otro proxy con TLS, se respeta lo que dice
+				if pr.In.Header.Get("X-Forwarded-Proto") == "https" { pr.Out.Header.Set("X-Forwarded-Proto", "https") }
+			},
+			// Las subidas y descargas van en streaming, y /events es SSE
+			FlushInterval: -1,
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				log.Printf("[%s] %s %s: %v", t.Name, r.Method, r.URL.Path, err)
+				http.Error(w, "El sitio no está disponible ahora mismo", 502)
+			},
+		}
+		for _, h := range t.Hosts { byHost[h] = proxy }
+		log.Printf("Cliente %s: %s en %s", t.Name, strings.Join(t.Hosts, ", "), t.addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			superviseTenant(ctx, exe, t)
+		}()
+	}
+
+	server := &http.Server{
+		Addr:              *listen,
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil { host = h }
+			proxy := byHost[strings.ToLower(host)]
+			if proxy == nil { http.Error(w, "Sitio desconocido", 404); return }
+			proxy.ServeHTTP(w, r)
+		}),
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+	log.Printf("Supervisor de %d clientes en %s", len(list), *listen)
+	err = server.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) { stop() } else { err = nil }
+	wg.Wait()
+	return err
+}
+
+// runSend implementa "cerbero send <archivo> <url>": sube el archivo en
+// streaming a la URL /send/{token} de otra instancia
+func runSend(args []string) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	sender := fs.String("from", "", "Nombre de quien envía")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Uso: cerbero send [-from nombre] <archivo> <url>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil { return err }
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil { return err }
+	if info.IsDir() { return fmt.Errorf("%s es una carpeta", fs.Arg(0)) }
+	// Con el SHA-256 por delante el receptor descarta el archivo si llega dañado
+	local, err := fileSHA256(fs.Arg(0))
+	if err != nil { return err }
+
+	req, err := http.NewRequest("PUT", fs.Arg(1), f)
+	if err != nil { return err }
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(fs.Arg(0))}))
+	req.Header.Set("Accept", "application/json")
+	if *sender != "" { req.Header.Set("X-Cerbero-Sender", *sender) }
+	req.Header.Set("X-Content-SHA256", local)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != 201 { return fmt.Errorf("%s: %s", resp.Status, errorMessage(body)) }
+	var out struct {
+		Files []uploadResult `json:"files"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil || len(out.Files) == 0 { return fmt.Errorf("respuesta inesperada: %s", body) }
+	// El SHA-256 final solo difiere si el receptor limpia los metadatos de las
+	// imágenes (-strip-exif)
+	if !strings.EqualFold(local, out.Files[0].SHA256) {
+		fmt.Fprintf(os.Stderr, "Aviso: el SHA-256 recibido (%s) no coincide con el local (%s)\n", out.Files[0].SHA256, local)
+	}
+	fmt.Printf("Enviado %s (%s) como %s\nSHA-256 %s\n", fs.Arg(0), humanSize(info.Size()), out.Files[0].Name, out.Files[0].SHA256)
+	return nil
+}
+
+// runPut implementa "cerbero put": sube un archivo o, sin él (o con "-"), la
+// entrada estándar tal como llega, para volcar la salida de un comando:
+//
+//	make 2>&1 | cerbero put -to http://host:8080 -name build.log
+//
+// La entrada se manda por trozos sin longitud a /api/v1/stream, así que no
+// hace falta guardarla antes en local
+func runPut(args []string) error {
+	fs := flag.NewFlagSet("put", flag.ExitOnError)
+	to := fs.String("to", os.Getenv("CERBERO_SERVER"), "URL del servidor, ej. http://host:8080 (o CERBERO_SERVER)")
+	name := fs.String("name", "", "Nombre en el servidor (obligatorio con la entrada estándar)")
+	dir := fs.String("dir", "", "Carpeta destino en el servidor")
+	pass := fs.String("password", os.Getenv("CERBERO_PASSWORD"), "Clave del servidor (o CERBERO_PASSWORD)")
+	apiKey := fs.String("api-key", os.Getenv("CERBERO_API_KEY"), "Clave de API con alcance write (o CERBERO_API_KEY)")
+	from := fs.String("from", "", "Nombre de quien sube")
+	message := fs.String("m", "", "Mensaje para el listado")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Uso: cerbero put [opciones] [archivo | -]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *to == "" || fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var src io.Reader = os.Stdin
+	size, want := int64(-1), ""
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil { return err }
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil { return err }
+		if info.IsDir() { return fmt.Errorf("%s es una carpeta", fs.Arg(0)) }
+		if *name == "" { *name = filepath.Base(fs.Arg(0)) }
+		// De un archivo se conoce el SHA-256 por delante y el servidor lo verifica
+		if want, err = fileSHA256(fs.Arg(0)); err != nil { return err }
+		src, size = f, info.Size()
+	}
+	if *name == "" { return errors.New("falta -name para subir la entrada estándar") }
+
+	// El SHA-256 se calcula mientras se envía y se compara con el del servidor
+	h := sha256.New()
+	q := url.Values{"name": {*name}}
+	if *dir != "" { q.Set("dir", *dir) }
+	req, err := http.NewRequest("POST", strings.TrimRight(*to, "/")+"/api/v1/stream?"+q.Encode(), io.TeeReader(src, h))
+	if err != nil { return err }
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Accept", "application/json")
+	if *from != "" { req.Header.Set("X-Cerbero-Sender", *from) }
+	if *message != "" { req.Header.Set("X-Cerbero-Message", *message) }
+	if want != "" { req.Header.Set("X-Content-SHA256", want) }
+	if *apiKey != "" { req.Header.Set("Authorization", "Bearer "+*apiKey) }
+	if *pass != "" { req.Header.Set("X-Cerbero-Password", *pass) }
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != 200 && resp.StatusCode != 201 { return fmt.Errorf("%s: %s", resp.Status, errorMessage(body)) }
+	var out struct {
+		Files []uploadResult `json:"files"`
+	}
+	if err := json.Unmarshal(body, &out); err != nil || len(out.Files) == 0 { return fmt.Errorf("respuesta inesperada: %s", body) }
+	if local := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(local, out.Files[0].SHA256) {
+		fmt.Fprintf(os.Stderr, "Aviso: el SHA-256 recibido (%s) no coincide con el enviado (%s)\n", out.Files[0].SHA256, local)
+	}
+	fmt.Printf("Subido %s (%s)\n%s\n", out.Files[0].Name, humanSize(out.Files[0].Size), out.Files[0].URL)
+	return nil
+}
+
+// --- CARPETAS VIGILADAS (cerbero watch) ---
+
+// cerbero watch es el modo compañero de escritorio: vigila carpetas locales
+// (capturas de pantalla, descargas de la cámara) y sube lo nuevo a un
+// servidor con la API normal. Se vigila por sondeo, sin dependencias, y un
+// archivo se sube cuando su tamaño y fecha no cambian entre dos pasadas. Antes
+// de subir se compara su SHA-256 con el manifiesto remoto para no duplicar.
+
+type watchEntry struct {
+	size  int64
+	mtime time.Time
+	done  bool
+}
+
+type watchClient struct {
+	server   string
+	dir      string
+	password string
+	apiKey   string
+	uploader string
+	remote   map[string]bool // SHA-256 que ya tiene el servidor
+	seen     map[string]*watchEntry
+}
+
+func runWatch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	to := fs.String("to", "", "URL del servidor, ej. http://host:8080")
+	dir := fs.String("dir", "", "Carpeta destino en el servidor")
+	pass := fs.String("password", os.Getenv("CERBERO_PASSWORD"), "Clave del servidor (o CERBERO_PASSWORD)")
+	apiKey := fs.String("api-key", os.Getenv("CERBERO_API_KEY"), "Clave de API con alcance write (o CERBERO_API_KEY)")
+	from := fs.String("from", "", "Nombre de quien sube (por defecto, el del equipo)")
+	interval := fs.Duration("interval", 5*time.Second, "Cada cuánto se revisan las carpetas")
+	skipExisting := fs.Bool("skip-existing", false, "No subir lo que ya había al arrancar")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Uso: cerbero watch [opciones] <carpeta>... -to http://host:8080")
+		fs.PrintDefaults()
+	}
+	// Las opciones pueden ir antes o después de las carpetas
+	var folders []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 { break }
+		folders = append(folders, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if *to == "" || len(folders) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *from == "" { *from, _ = os.Hostname() }
+	c := &watchClient{
+		server: strings.TrimRight(*to, "/"), dir: *dir, password: *pass, apiKey: *apiKey, uploader: *from,
+		seen: make(map[string]*watchEntry),
+	}
+	for i, folder := range folders {
+		abs, err := filepath.Abs(folder)
+		if err != nil { return err }
+		if info, err := os.Stat(abs); err != nil || !info.IsDir() { return fmt.Errorf("%s no es una carpeta", folder) }
+		folders[i] = abs
+	}
+	if err := c.refreshManifest(); err != nil { return fmt.Errorf("no se pudo leer el manifiesto de %s: %w", c.server, err) }
+	if *skipExisting {
+		for _, folder := range folders { c.scan(folder, true) }
+	}
+	log.Printf("Vigilando %s; se sube a %s/%s", strings.Join(folders, ", "), c.server, c.dir)
+	lastManifest := time.Now()
+	for {
+		time.Sleep(*interval)
+		// El manifiesto se refresca de vez en cuando por si otros suben lo mismo
+		if time.Since(lastManifest) > 10*time.Minute {
+			if err := c.refreshManifest(); err != nil { log.Printf("Manifiesto: %v", err) }
+			lastManifest = time.Now()
+		}
+		for _, folder := range folders {
+			if err := c.scan(folder, false); err != nil { return err }
+		}
+	}
+}
+
+func (c *watchClient) authorize(req *http.Request) {
+	if c.apiKey != "" { req.Header.Set("Authorization", "Bearer "+c.apiKey) }
+	if c.password != "" { req.Header.Set("X-Cerbero-Password", c.password) }
+}
+
+func (c *watchClient) refreshManifest() error {
+	req, err := http.NewRequest("GET", c.server+"/api/v1/manifest", nil)
+	if err != nil { return err }
+	c.authorize(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 { return fmt.Errorf("%s", resp.Status) }
+	var entries []struct {
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil { return err }
+	c.remote = make(map[string]bool, len(entries))
+	for _, e := range entries { c.remote[strings.ToLower(e.SHA256)] = true }
+	return nil
+}
+
+// watchIgnored descarta ocultos y temporales de navegadores y editores
+func watchIgnored(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") { return true }
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".part", ".crdownload", ".tmp", ".download", ".partial", ".swp":
+		return true
+	}
+	return false
+}
+
+// scan recorre una carpeta y sube los archivos que ya no cambian. Con
+// baseline solo se anotan como subidos. Devuelve error solo si el servidor
+// rechaza las credenciales, porque no tiene sentido seguir
+func (c *watchClient) scan(folder string, baseline bool) error {
+	var fatal error
+	filepath.WalkDir(folder, func(p string, d os.DirEntry, err error) error {
+		if err != nil || fatal != nil { return nil }
+		if p != folder && watchIgnored(d.Name()) {
+			if d.IsDir() { return filepath.SkipDir }
+			return nil
+		}
+		if !d.Type().IsRegular() { return nil }
+		info, err := d.Info()
+		if err != nil { return nil }
+		prev := c.seen[p]
+		if prev == nil || prev.size != info.Size() || !prev.mtime.Equal(info.ModTime()) {
+			// Nuevo o todavía cambiando: se espera a la siguiente pasada
+			c.seen[p] = &watchEntry{size: info.Size(), mtime: info.ModTime(), done: baseline}
+			return nil
+		}
+		if prev.done { return nil }
+		rel, _ := filepath.Rel(folder, p)
+		done, err := c.upload(p, filepath.ToSlash(rel))
+		if err != nil { fatal = err }
+		prev.done = done
+		return nil
+	})
+	return fatal
+}
+
+// upload sube un archivo; devuelve true si ya no hay que volver a intentarlo
+func (c *watchClient) upload(abs, rel string) (bool, error) {
+	sum, err := fileSHA256(abs)
+	if err != nil { return false, nil }
+	if c.remote[sum] {
+		log.Printf("%s ya está en el servidor", rel)
+		return true, nil
+	}
+	f, err := os.Open(abs)
+	if err != nil { return false, nil }
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil { return false, nil }
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		// Los campos van antes que el archivo: el servidor los lee en streaming
+		if c.password != "" { mw.WriteField("password", c.password) }
+		if c.dir != "" { mw.WriteField("dir", c.dir) }
+		mw.WriteField("uploader", c.uploader)
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": "folder", "filename": rel}))
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("X-Content-SHA256", sum)
+		part, err := mw.CreatePart(h)
+		if err == nil { _, err = io.Copy(part, f) }
+		if err == nil { err = mw.Close() }
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequest("POST", c.server+"/upload", pr)
+	if err != nil { return false, err }
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("If-None-Match", `"`+sum+`"`)
+	c.authorize(req)
+	resp, err := http.DefaultClient.Do(req)
+	// El servidor admite una subida por segundo y por IP
+	defer time.Sleep(1100 * time.Millisecond)
+	if err != nil {
+		log.Printf("%s: %v (se reintentará)", rel, err)
+		return false, nil
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	switch resp.StatusCode {
+	case 201:
+		c.remote[sum] = true
+		log.Printf("Subido %s (%s)", rel, humanSize(info.Size()))
+		return true, nil
+	case 412:
+		log.Printf("%s ya está en el servidor", rel)
+		return true, nil
+	case 401, 403:
+		return false, fmt.Errorf("el servidor rechaza las credenciales: %s", errorMessage(body))
+	case 422, 429, 500, 502, 503, 504, 507:
+		log.Printf("%s: %s (se reintentará)", rel, resp.Status)
+		return false, nil
+	}
+	log.Printf("%s rechazado: %s %s", rel, resp.Status, errorMessage(body))
+	return true, nil
+}
+
+// --- TRANSFERENCIAS P2P (WebRTC) ---
+
+// El servidor solo hace de señalización: quien envía crea una sala y comparte
+// el enlace; los dos navegadores intercambian oferta, respuesta y candidatos
+// ICE por /p2p/{sala}/{rol}/signal (POST) y /p2p/{sala}/{rol}/events (SSE), y
+// el archivo viaja por un canal de datos directo. Si la conexión directa no
+// se establece, el emisor lo envía por /p2p/{sala}/relay, que lo pasa al
+// receptor sin guardarlo en disco.
+
+// CSP de la página P2P: solo ejecuta su propio script (/static/p2p.js)
+const p2pCSP = "default-src 'none'; script-src 'self'; connect-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+const p2pRoomTTL = time.Hour
+
+type p2pRelay struct {
+	body io.Reader
+	name string
+	size int64
+	done chan error
+}
+
+type p2pRoom struct {
+	key     string
+	queues  map[string]chan []byte
+	relay   chan *p2pRelay
+	updated time.Time
+}
+
+var p2pRooms = struct {
+	m  map[string]*p2pRoom
+	mu sync.Mutex
+}{m: make(map[string]*p2pRoom)}
+
+var p2pTmpl *template.Template
+
+
+// p2pRoomFor devuelve la sala si el rol es válido; el emisor además debe
+// presentar la clave que recibió al crearla
+func p2pRoomFor(r *http.Request) (*p2pRoom, string) {
+	role := r.PathValue("role")
+	p2pRooms.mu.Lock()
+	defer p2pRooms.mu.Unlock()
+	room := p2pRooms.m[r.PathValue("room")]
+	if room == nil { return nil, "" }
+	if role == "sender" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("key")), []byte(room.key)) != 1 { return nil, "" }
+	if role != "sender" && role != "receiver" { return nil, "" }
+	room.updated = time.Now()
+	return room, role
+}
+
+func p2pPageHandler(w http.ResponseWriter, r *http.Request) {
+	room := r.PathValue("room")
+	if room != "" {
+		p2pRooms.mu.Lock()
+		_, ok := p2pRooms.m[room]
+		p2pRooms.mu.Unlock()
+		if !ok { http.Error(w, "La sala no existe o caducó", 404); return }
+	}
+	if cspPolicy != "" { w.Header().Set("Content-Security-Policy", p2pCSP) }
+	p2pTmpl.Execute(w, map[string]interface{}{
+		"Room":            room,
+		"ICE":             p2pICE,
+		"PasswordEnabled": password != "" && sessionFor(r) == nil,
+	})
+}
+
+// p2pCreateHandler abre una sala; crearla requiere poder subir archivos
+func p2pCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	room := &p2pRoom{
+		key:     randomToken(16),
+		queues:  map[string]chan []byte{"sender": make(chan []byte, 256), "receiver": make(chan []byte, 256)},
+		relay:   make(chan *p2pRelay),
+		updated: time.Now(),
+	}
+	id := randomToken(16)
+	p2pRooms.mu.Lock()
+	p2pRooms.m[id] = room
+	p2pRooms.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "key": room.key, "url": baseURL(r) + "/p2p/" + id})
+}
+
+// p2pSignalHandler deja un mensaje en la cola del otro rol
+func p2pSignalHandler(w http.ResponseWriter, r *http.Request) {
+	room, role := p2pRoomFor(r)
+	if room == nil { http.Error(w, "Sala desconocida", 404); return }
+	msg, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil || !json.Valid(msg) { http.Error(w, "Mensaje no válido", 400); return }
+	other := "receiver"
+	if role == "receiver" { other = "sender" }
+	select {
+	case room.queues[other] <- msg:
+		w.WriteHeader(204)
+	default:
+		http.Error(w, "Demasiados mensajes pendientes", 429)
+	}
+}
+
+// p2pEventsHandler entrega los mensajes del rol como Server-Sent Events
+func p2pEventsHandler(w http.ResponseWriter, r *http.Request) {
+	room, role := p2pRoomFor(r)
+	if room == nil { http.Error(w, "Sala desconocida", 404); return }
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	rc.Flush()
+	ping := time.NewTicker(25 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case msg := <-room.queues[role]:
+			fmt.Fprintf(w, "data: %s\n\n", msg)
+		case <-ping.C:
+			io.WriteString(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil { return }
+	}
+}
+
+// p2pRelayPutHandler entrega el cuerpo al receptor que espera en el GET y
+// no termina hasta que este lo ha leído entero
+func p2pRelayPutHandler(w http.ResponseWriter, r *http.Request) {
+	r.SetPathValue("role", "sender")
+	room, _ := p2pRoomFor(r)
+	if room == nil { http.Error(w, "Sala desconocida", 404); return }
+	if r.ContentLength > int64(maxUploadMB)<<20 { http.Error(w, "Archivo demasiado grande", 413); return }
+	name := "archivo"
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		if clean, err := sanitizeFilename(params["filename"]); err == nil { name = clean }
+	}
+	relay := &p2pRelay{body: http.MaxBytesReader(w, r.Body, int64(maxUploadMB)<<20), name: name, size: r.ContentLength, done: make(chan error, 1)}
+	select {
+	case room.relay <- relay:
+	case <-time.After(2 * time.Minute):
+		http.Error(w, "Quien recibe no se conectó", 504)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	if err := <-relay.done; err != nil { http.Error(w, "El receptor se desconectó", 502); return }
+	w.WriteHeader(204)
+}
+
+func p2pRelayGetHandler(w http.ResponseWriter, r *http.Request) {
+	r.SetPathValue("role", "receiver")
+	room, _ := p2pRoomFor(r)
+	if room == nil { http.Error(w, "Sala desconocida", 404); return }
+	var relay *p2pRelay
+	select {
+	case relay = <-room.relay:
+	case <-time.After(2 * time.Minute):
+		http.Error(w, "Quien envía no se conectó", 504)
+		return
+	case <-r.Context().Done():
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": relay.name}))
+	if relay.size > 0 { w.Header().Set("Content-Length", strconv.FormatInt(relay.size, 10)) }
+	_, span := startSpan(r.Context(), "p2p.relay")
+	_, err := io.Copy(w, relay.body)
+	span.SetError(err)
+	span.End()
+	relay.done <- err
+}
+
+// sweepP2PRooms cierra las salas sin actividad
+func sweepP2PRooms() {
+	for range time.Tick(5 * time.Minute) {
+		p2pRooms.mu.Lock()
+		for id, room := range p2pRooms.m {
+			if time.Since(room.updated) > p2pRoomTTL { delete(p2pRooms.m, id) }
+		}
+		p2pRooms.mu.Unlock()
+	}
+}
+
+// --- APLICACIÓN WEB (PWA) ---
+
+// Cerbero se puede instalar como aplicación y aparecer en el menú "Compartir"
+// del móvil (Web Share Target). Lo compartido lo recibe el service worker, que
+// lo guarda en IndexedDB y redirige a /share-target: esa página lo sube (o lo
+// deja en cola si no hay conexión o falta la clave). Sin service worker, el
+// POST llega al servidor y se trata como una subida normal.
+
+// CSP de la página de compartir: script propio y fetch al mismo origen
+const pwaCSP = "default-src 'none'; script-src 'self'; connect-src 'self'; manifest-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+const pwaManifest = `{
+  "name": "Cerbero-Go",
+  "short_name": "Cerbero",
+  "start_url": "/",
+  "scope": "/",
+  "display": "standalone",
+  "background_color": "#f0f2f5",
+  "theme_color": "#1a73e8",
+  "icons": [
+    {"src": "/icon-192.png", "sizes": "192x192", "type": "image/png"},
+    {"src": "/icon-512.png", "sizes": "512x512", "type": "image/png", "purpose": "any maskable"}
+  ],
+  "share_target": {
+    "action": "/share-target",
+    "method": "POST",
+    "enctype": "multipart/form-data",
+    "params": {
+      "title": "title",
+      "text": "text",
+      "url": "url",
+      "files": [{"name": "file", "accept": ["*/*"]}]
+    }
+  }
+}`
+
+
+
+
+var shareTargetTmpl *template.Template
+
+func shareTargetPageHandler(w http.ResponseWriter, r *http.Request) {
+	if cspPolicy != "" { w.Header().Set("Content-Security-Policy", pwaCSP) }
+	shareTargetTmpl.Execute(w, map[string]interface{}{"PasswordEnabled": password != "" && sessionFor(r) == nil})
+}
+
+// staticHandler sirve un recurso embebido con su tipo
+func staticHandler(contentType, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		io.WriteString(w, body)
+	}
+}
+
+// pwaIcon dibuja el icono de la aplicación: un círculo blanco sobre el azul de
+// la interfaz, con margen suficiente para los iconos recortados ("maskable")
+func pwaIcon(size int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	blue, white := color.RGBA{0x1a, 0x73, 0xe8, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}
+	c, outer, inner := float64(size)/2, float64(size)*0.3, float64(size)*0.2
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			d := math.Hypot(float64(x)+0.5-c, float64(y)+0.5-c)
+			if d <= outer && d >= inner {
+				img.Set(x, y, white)
+			} else {
+				img.Set(x, y, blue)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func iconHandler(size int) http.HandlerFunc {
+	icon := pwaIcon(size)
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Write(icon)
+	}
+}
+
+// --- SUBIDAS POR PARTES ---
+
+// Una subida por partes se inicia con POST /chunk (nombre, tamaño y tamaño de
+// parte), recibe las partes en paralelo con PUT /chunk/{id}/{n} escribiéndolas
+// en su posición de un temporal junto al destino, y se cierra con POST
+// /chunk/{id} indicando el SHA-256 total, que se comprueba antes de renombrar.
+
+const (
+	maxChunkSize     = 256 << 20
+	chunkUploadTTL   = 24 * time.Hour
+	defaultChunkSize = 16 << 20
+)
+
+type chunkedUpload struct {
+	ID        string
+	Dst       string
+	Tmp       string
+	Original  string
+	Size      int64
+	ChunkSize int64
+	Received  []bool
+	Fields    map[string]string
+	User      string
+	Updated   time.Time
+	finishing bool
+	writes    sync.WaitGroup // partes escribiéndose; el cierre espera a que acaben
+}
+
+func (u *chunkedUpload) chunks() int { return int((u.Size + u.ChunkSize - 1) / u.ChunkSize) }
+
+func (u *chunkedUpload) missing() []int {
+	out := []int{}
+	for n, ok := range u.Received {
+		if !ok { out = append(out, n) }
+	}
+	return out
+}
+
+var chunkUploads = struct {
+	m  map[string]*chunkedUpload
+	mu sync.Mutex
+}{m: make(map[string]*chunkedUpload)}
+
+// chunkUploadFor busca la subida y comprueba que sea del mismo usuario
+func chunkUploadFor(r *http.Request) *chunkedUpload {
+	chunkUploads.mu.Lock()
+	defer chunkUploads.mu.Unlock()
+	u := chunkUploads.m[r.PathValue("id")]
+	if u == nil || u.User != currentUser(r) { return nil }
+	return u
+}
+
+// chunkInitHandler reserva la subida: valida nombre, tamaño y espacio libre
+// y crea el temporal con el tamaño final
+func chunkInitHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "upload") { return }
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	var req struct {
+		Name      string `json:"name"`
+		Dir       string `json:"dir"`
+		Size      int64  `json:"size"`
+		ChunkSize int64  `json:"chunk_size"`
+		Uploader  string `json:"uploader"`
+		Message   string `json:"message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil {
+		http.Error(w, "JSON no válido", 400)
+		return
+	}
+	if req.Size <= 0 { http.Error(w, "Falta el tamaño", 400); return }
+	if req.Size > int64(maxUploadMB)<<20 { http.Error(w, "Archivo demasiado grande", 413); return }
+	if _, err := quotas.Check(r, req.Size); err != nil { quotaFail(w, r, req.Size, err); return }
+	if req.ChunkSize == 0 { req.ChunkSize = defaultChunkSize }
+	if req.ChunkSize < 1<<20 || req.ChunkSize > maxChunkSize {
+		http.Error(w, fmt.Sprintf("chunk_size debe estar entre 1 MB y %d MB", maxChunkSize>>20), 400)
+		return
+	}
+	name, err := sanitizeRelPath(req.Name)
+	if err != nil { http.Error(w, "Nombre de archivo no válido: "+err.Error(), 400); return }
+	if dir := strings.Trim(routeUpload(r, req.Dir, name, req.Size), "/"); dir != "" { name = dir + "/" + name }
+	dstPath, err := securePath(name)
+	if err != nil { http.Error(w, "Denegado", 403); return }
+	if m := lockedMount(r, dstPath); m != nil { mountLocked(w, r, m); return }
+	if err := checkMountWrite(dstPath, req.Size); err != nil { mountWriteError(w, err); return }
+	if aclDenied(w, r, dstPath, aclWrite) { return }
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		http.Error(w, "No se pudo crear la carpeta de "+name, 409)
+		return
+	}
+	if err := checkDirCapacity(dstPath); err != nil { http.Error(w, err.Error(), 507); return }
+	if unchangedUpload(r, dstPath) { http.Error(w, "Sin cambios: "+name, 412); return }
+	if checkFreeSpace(filepath.Dir(dstPath), req.Size) != nil {
+		http.Error(w, "No hay espacio en disco para este archivo", 507)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), ".cerbero-upload-*")
+	if err != nil { http.Error(w, "Error creando el temporal", 500); return }
+	err = tmp.Truncate(req.Size)
+	if cerr := tmp.Close(); err == nil { err = cerr }
+	if err != nil {
+		os.Remove(tmp.Name())
+		http.Error(w, "Error creando el temporal", 500)
+		return
+	}
+	u := &chunkedUpload{
+		ID: randomToken(16), Dst: dstPath, Tmp: tmp.Name(), Original: req.Name,
+		Size: req.Size, ChunkSize: req.ChunkSize, User: currentUser(r), Updated: time.Now(),
+		Fields: map[string]string{"uploader": req.Uploader, "message": req.Message},
+	}
+	u.Received = make([]bool, u.chunks())
+	chunkUploads.mu.Lock()
+	chunkUploads.m[u.ID] = u
+	chunkUploads.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/chunk/"+u.ID)
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": u.ID, "chunks": u.chunks(), "chunk_size": u.ChunkSize})
+}
+
+// chunkPutHandler escribe la parte n en su posición; reenviar una parte es
+// seguro (se sobrescribe), así que el cliente puede reintentar sin más
+func chunkPutHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	u := chunkUploadFor(r)
+	if u == nil { http.Error(w, "Subida desconocida", 404); return }
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 0 || n >= len(u.Received) { http.Error(w, "Número de parte fuera de rango", 400); return }
+	offset := int64(n) * u.ChunkSize
+	length := u.ChunkSize
+	if offset+length > u.Size { length = u.Size - offset }
+	if r.ContentLength >= 0 && r.ContentLength != length {
+		http.Error(w, fmt.Sprintf("La parte %d debe tener %d bytes", n, length), 400)
+		return
+	}
+	chunkUploads.mu.Lock()
+	finishing := u.finishing
+	if !finishing { u.writes.Add(1) }
+	chunkUploads.mu.Unlock()
+	if finishing { http.Error(w, "La subida ya se está cerrando", 409); return }
+	defer u.writes.Done()
+
+	_, span := startSpan(r.Context(), "storage.write_chunk")
+	defer span.End()
+	span.SetAttr("chunk.index", n)
+	f, err := os.OpenFile(u.Tmp, os.O_WRONLY, 0)
+	if err != nil {
+		span.SetError(err)
+		http.Error(w, "Subida desconocida", 404)
+		return
+	}
+	written, err := copyBuffered(io.NewOffsetWriter(f, offset), io.LimitReader(r.Body, length))
+	if cerr := f.Close(); err == nil { err = cerr }
+	if err == nil && written != length { err = io.ErrUnexpectedEOF }
+	if err != nil {
+		span.SetError(err)
+		log.Printf("Parte %d de %s: %v", n, u.ID, err)
+		http.Error(w, "Error guardando la parte", 400)
+		return
+	}
+	chunkUploads.mu.Lock()
+	u.Received[n] = true
+	u.Updated = time.Now()
+	chunkUploads.mu.Unlock()
+	w.WriteHeader(204)
+}
+
+// chunkStatusHandler devuelve las partes que faltan, para reanudar
+func chunkStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	u := chunkUploadFor(r)
+	if u == nil { http.Error(w, "Subida desconocida", 404); return }
+	chunkUploads.mu.Lock()
+	missing := u.missing()
+	chunkUploads.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": u.ID, "chunks": u.chunks(), "chunk_size": u.ChunkSize, "missing": missing})
+}
+
+// chunkCompleteHandler verifica que estén todas las partes y el SHA-256
+// total, y solo entonces mueve el temporal a su destino
+func chunkCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	u := chunkUploadFor(r)
+	if u == nil { http.Error(w, "Subida desconocida", 404); return }
+	var req struct {
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&req); err != nil || req.SHA256 == "" {
+		http.Error(w, "Falta sha256", 400)
+		return
+	}
+	// Con finishing ya no empieza ninguna parte; las que estaban escribiéndose
+	// terminan antes de calcular la suma y mover el temporal
+	chunkUploads.mu.Lock()
+	busy := u.finishing
+	u.finishing = true
+	chunkUploads.mu.Unlock()
+	if busy { http.Error(w, "La subida ya se está cerrando", 409); return }
+	u.writes.Wait()
+	chunkUploads.mu.Lock()
+	missing := u.missing()
+	if len(missing) > 0 { u.finishing = false }
+	chunkUploads.mu.Unlock()
+	if len(missing) > 0 { http.Error(w, fmt.Sprintf("Faltan %d partes", len(missing)), 409); return }
+
+	_, span := startSpan(r.Context(), "storage.verify")
+	sum, err := fileSHA256(u.Tmp)
+	span.SetError(err)
+	span.End()
+	if err == nil && !strings.EqualFold(sum, req.SHA256) { err = fmt.Errorf("SHA-256 no coincide: recibido %s", sum) }
+	if err == nil { err = preUploadHook(hookContext(r), u.Tmp, u.Dst, u.Size, sum) }
+	if err != nil {
+		chunkUploads.mu.Lock()
+		u.finishing = false
+		chunkUploads.mu.Unlock()
+		var rejected *hookRejected
+		if errors.As(err, &rejected) { failWith(w, "hook_rejected", rejected.Message, 403); return }
+		http.Error(w, err.Error(), 422)
+		return
+	}
+
+	result := uploadResult{Original: u.Original, Renamed: relPath(u.Dst) != strings.Trim(u.Original, "/"), SHA256: sum}
+	unlock, err := pathLocks.TryLock(u.Dst)
+	if err != nil {
+		// La subida por partes sigue intacta: se puede volver a cerrar después
+		chunkUploads.mu.Lock()
+		u.finishing = false
+		chunkUploads.mu.Unlock()
+		failWith(w, "path_busy", "Otra subida está escribiendo ese archivo; vuelve a intentarlo", 409)
+		return
+	}
+	defer unlock()
+	if info, err := os.Lstat(u.Dst); err == nil {
+		if info.IsDir() {
+			chunkUploads.mu.Lock()
+			u.finishing = false
+			chunkUploads.mu.Unlock()
+			http.Error(w, "Ya existe una carpeta con ese nombre", 409)
+			return
+		}
+		result.Replaced = true
+	}
+	err = os.Chmod(u.Tmp, 0644)
+	if err == nil { err = os.Rename(u.Tmp, u.Dst) }
+	if err != nil {
+		// Sin finishing el barrido puede volver a caducarla y borrar el temporal
+		chunkUploads.mu.Lock()
+		u.finishing = false
+		chunkUploads.mu.Unlock()
+		log.Printf("Cerrando la subida %s: %v", u.ID, err)
+		http.Error(w, "Error guardando el archivo", 500)
+		return
+	}
+	chunkUploads.mu.Lock()
+	delete(chunkUploads.m, u.ID)
+	chunkUploads.mu.Unlock()
+	quotas.Charge(r, u.Size)
+
+	if err := finishUpload(r, u.Dst, u.Fields, &result); err != nil {
+		http.Error(w, "Imagen no válida", 422)
+		return
+	}
+	contentChanged()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(map[string]interface{}{"files": []uploadResult{result}})
+}
+
+// chunkAbortHandler cancela la subida y borra el temporal
+func chunkAbortHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	u := chunkUploadFor(r)
+	if u == nil { http.Error(w, "Subida desconocida", 404); return }
+	chunkUploads.mu.Lock()
+	delete(chunkUploads.m, u.ID)
+	chunkUploads.mu.Unlock()
+	os.Remove(u.Tmp)
+	w.WriteHeader(204)
+}
+
+// sweepChunkUploads borra las subidas (también los PUT por trozos) sin
+// actividad en chunkUploadTTL
+func sweepChunkUploads() {
+	for range time.Tick(time.Hour) {
+		chunkUploads.mu.Lock()
+		for id, u := range chunkUploads.m {
+			if time.Since(u.Updated) > chunkUploadTTL && !u.finishing {
+				os.Remove(u.Tmp)
+				delete(chunkUploads.m, id)
+			}
+		}
+		chunkUploads.mu.Unlock()
+		rangePuts.mu.Lock()
+		for tmp, updated := range rangePuts.m {
+			if time.Since(updated) > chunkUploadTTL { os.Remove(tmp); delete(rangePuts.m, tmp) }
+		}
+		rangePuts.mu.Unlock()
+	}
+}
+
+// --- REGISTROS POR ANEXADO ---
+
+// POST /append/{ruta} añade el cuerpo al final de un archivo, para que
+// sensores y dispositivos vayan volcando su registro sin parar. Se escribe
+// por líneas completas: cada lote de líneas entra de una vez, así que varios
+// dispositivos pueden escribir en el mismo archivo sin mezclar líneas, y una
+// línea final sin salto se cierra con uno. Cuando el archivo superaría
+// -append-max-mb se rota (registro.log → registro.log.1 → .2...) conservando
+// -append-keep. La conexión puede quedarse abierta: lo recibido se va
+// escribiendo según llega.
+
+const (
+	maxAppendLine  = 64 << 10
+	appendBatchMax = 256 << 10
+)
+
+var errLineTooLong = errors.New("Línea demasiado larga (máx. 64 KB)")
+
+// appendResult resume lo escrito por una petición a /append
+type appendResult struct {
+	Path    string `json:"path"`
+	Lines   int    `json:"lines"`
+	Bytes   int64  `json:"bytes"`
+	Rotated int    `json:"rotated"`
+}
+
+// lockAppend espera a que la ruta quede libre (otro dispositivo puede estar
+// escribiendo su lote) en lugar de fallar enseguida como las subidas
+func lockAppend(ctx context.Context, abs string) (func(), error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		unlock, err := pathLocks.TryLock(abs)
+		if err == nil || time.Now().After(deadline) { return unlock, err }
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// rotateAppend desplaza abs a abs.1 (y abs.1 a abs.2...) quedándose con
+// appendKeep copias; sin copias, el archivo simplemente se vacía
+func rotateAppend(abs string) error {
+	if appendKeep <= 0 { return os.Truncate(abs, 0) }
+	os.Remove(fmt.Sprintf("%s.%d", abs, appendKeep))
+	for n := appendKeep - 1; n >= 1; n-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", abs, n), fmt.Sprintf("%s.%d", abs, n+1)); err != nil && !os.IsNotExist(err) { return err }
+	}
+	return os.Rename(abs, abs+".1")
+}
+
+// writeAppend añade un lote de líneas completas a abs, rotándolo antes si no
+// cabe; devuelve si rotó
+func writeAppend(ctx context.Context, abs string, batch []byte) (bool, error) {
+	unlock, err := lockAppend(ctx, abs)
+	if err != nil { return false, err }
+	defer unlock()
+	rotated := false
+	if info, err := os.Stat(abs); err == nil && appendMaxMB > 0 && info.Size() > 0 && info.Size()+int64(len(batch)) > int64(appendMaxMB)<<20 {
+		if err := rotateAppend(abs); err != nil { return false, err }
+		rotated = true
+	}
+	f, err := os.OpenFile(abs, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil { return rotated, err }
+	_, err = (&diskGuardWriter{w: f, dir: filepath.Dir(abs)}).Write(batch)
+	if cerr := f.Close(); err == nil { err = cerr }
+	return rotated, err
+}
+
+// appendLines lee src por líneas y las escribe por lotes: un lote se cierra
+// cuando no queda nada más recibido o alcanza appendBatchMax
+func appendLines(ctx context.Context, src io.Reader, abs string, res *appendResult) error {
+	br := bufio.NewReaderSize(src, maxAppendLine)
+	var batch []byte
+	flush := func() error {
+		if len(batch) == 0 { return nil }
+		rotated, err := writeAppend(ctx, abs, batch)
+		if rotated { res.Rotated++ }
+		if err == nil { res.Bytes += int64(len(batch)) }
+		batch = batch[:0]
+		return err
+	}
+	for {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) { flush(); return errLineTooLong }
+		if len(line) > 0 {
+			batch = append(batch, line...)
+			if line[len(line)-1] != '\n' { batch = append(batch, '\n') }
+			res.Lines++
+		}
+		if err == io.EOF { return flush() }
+		if err != nil { flush(); return err }
+		if br.Buffered() == 0 || len(batch) >= appendBatchMax {
+			if err := flush(); err != nil { return err }
+		}
+	}
+}
+
+func appendHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "upload") { return }
+	if ok, _ := authorizedByIdentity(r, roleWrite); !ok {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	original := r.PathValue("path")
+	if original == "" || strings.HasSuffix(original, "/") { http.Error(w, "Falta el nombre del archivo", 400); return }
+	name, err := sanitizeRelPath(original)
+	if err != nil { http.Error(w, "Nombre de archivo no válido: "+err.Error(), 400); return }
+	if _, err := quotas.Check(r, r.ContentLength); err != nil { quotaFail(w, r, r.ContentLength, err); return }
+	abs, err := securePath(name)
+	if err != nil { http.Error(w, "Denegado", 403); return }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+	if err := checkMountWrite(abs, max(r.ContentLength, 0)); err != nil { mountWriteError(w, err); return }
+	if aclDenied(w, r, abs, aclWrite) { return }
+	if info, err := os.Lstat(abs); err == nil && !info.Mode().IsRegular() { http.Error(w, "Ya existe una carpeta llamada "+name, 409); return }
+	if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil { http.Error(w, "No se pudo crear la carpeta", 409); return }
+	if err := checkDirCapacity(abs); err != nil { http.Error(w, err.Error(), 507); return }
+
+	res := appendResult{Path: name}
+	start, counted := time.Now(), &countingReader{r: quotas.Reader(r, r.Body)}
+	err = appendLines(r.Context(), counted, abs, &res)
+	transfers.Record(r, "subida", name+" (añadido)", counted.n, time.Since(start), err)
+	quotas.Charge(r, counted.n)
+	if res.Bytes > 0 { contentChanged() }
+	if err != nil {
+		log.Printf("Anexado a %s interrumpido: %v", name, err)
+		switch {
+		case errors.Is(err, errLineTooLong):
+			http.Error(w, err.Error(), 413)
+		case errors.Is(err, errQuotaExceeded):
+			quotaFail(w, r, 1, err)
+		case errors.Is(err, errDiskFull):
+			http.Error(w, "No hay espacio en disco para este archivo", 507)
+		case errors.Is(err, errPathBusy):
+			failWith(w, "path_busy", "Otra escritura ocupa "+name+"; vuelve a intentarlo", 409)
+		default:
+			http.Error(w, "Error escribiendo el registro", 400)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// --- API COMPATIBLE CON S3 ---
+
+// Subconjunto de S3 (ListBuckets, ListObjects v1/v2, Head/Get/Put/DeleteObject)
+// en un puerto aparte, con firma AWS Signature V4 y direccionamiento por ruta
+// (http://host:puerto/bucket/clave). Un único bucket representa rootDir.
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+var errBadDigest = errors.New("el contenido no coincide con x-amz-content-sha256")
+
+func s3Enabled() bool { return s3Listen != "" }
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string `xml:",omitempty"`
+}
+
+func s3Fail(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == "HEAD" { return }
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(s3Error{Code: code, Message: msg, Resource: r.URL.Path})
+}
+
+func s3XML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+// s3Encode aplica la codificación URI de SigV4: todo salvo A-Z a-z 0-9 - _ . ~
+// (y "/" en rutas) se escribe como %XX en mayúsculas
+func s3Encode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Auth es el resultado de verificar la firma; las partes de una subida
+// aws-chunked se firman encadenadas a partir de Signature
+type s3Auth struct {
+	Key       []byte
+	Date      string
+	Scope     string
+	Signature string
+	Payload   string
+}
+
+// s3Verify comprueba la firma SigV4 de la cabecera Authorization o de una URL
+// prefirmada (X-Amz-Signature en la query)
+func s3Verify(r *http.Request) (*s3Auth, error) {
+	query := r.URL.Query()
+	var credential, signedHeaders, signature, amzDate, payload string
+	presigned := false
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		for _, kv := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			switch k {
+			case "Credential": credential = v
+			case "SignedHeaders": signedHeaders = v
+			case "Signature": signature = v
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payload = r.Header.Get("X-Amz-Content-Sha256")
+		if payload == "" { return nil, errors.New("falta x-amz-content-sha256") }
+	} else if query.Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256" {
+		presigned = true
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payload = "UNSIGNED-PAYLOAD"
+	} else {
+		return nil, errors.New("se requiere firma AWS4-HMAC-SHA256")
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" { return nil, errors.New("credencial mal formada") }
+	if subtle.ConstantTimeCompare([]byte(parts[0]), []byte(s3AccessKey)) != 1 { return nil, errors.New("clave de acceso desconocida") }
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || parts[1] != amzDate[:8] { return nil, errors.New("fecha de firma no válida") }
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || expires > 7*24*3600 { return nil, errors.New("X-Amz-Expires no válido") }
+		if time.Now().After(signedAt.Add(time.Duration(expires) * time.Second)) { return nil, errors.New("la URL prefirmada caducó") }
+	} else if d := time.Since(signedAt); d > 15*time.Minute || d < -15*time.Minute {
+		return nil, errors.New("la hora de la firma difiere más de 15 minutos")
+	}
+
+	// Petición canónica
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if !(presigned && k == "X-Amz-Signature") { keys = append(keys, k) }
+	}
+	sort.Strings(keys)
+	var canonicalQuery []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values { canonicalQuery = append(canonicalQuery, s3Encode(k, true)+"="+s3Encode(v, true)) }
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range strings.Split(signedHeaders, ";") {
+		value := strings.Join(r.Header.Values(h), ",")
+		switch {
+		case h == "host": value = r.Host
+		case h == "content-length" && value == "": value = strconv.FormatInt(r.ContentLength, 10)
+		}
+		canonicalHeaders.WriteString(h + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+	canonical := strings.Join([]string{
+		r.Method, s3Encode(r.URL.Path, false), strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(), signedHeaders, payload,
+	}, "\n")
+
+	a := &s3Auth{Date: amzDate, Scope: strings.Join(parts[1:], "/"), Signature: signature, Payload: payload}
+	a.Key = hmacSHA256([]byte("AWS4"+s3SecretKey), parts[1])
+	for _, p := range parts[2:] { a.Key = hmacSHA256(a.Key, p) }
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + a.Scope + "\n" + sha256Hex([]byte(canonical))
+	expected := hex.EncodeToString(hmacSHA256(a.Key, stringToSign))
+	if !hmac.Equal([]byte(expected), []byte(signature)) { return nil, errors.New("la firma no coincide") }
+	return a, nil
+}
+
+// sha256CheckReader falla al llegar al final si el contenido no tiene el
+// SHA-256 anunciado; receiveFile descarta entonces el temporal
+type sha256CheckReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+}
+
+func (c *sha256CheckReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	if err == io.EOF && !strings.EqualFold(hex.EncodeToString(c.h.Sum(nil)), c.want) { return n, errBadDigest }
+	return n, err
+}
+
+// awsChunkedReader decodifica el cuerpo aws-chunked de los SDK
+// ("tamaño;chunk-signature=firma\r\ndatos\r\n"), comprobando la firma
+// encadenada de cada parte si auth no es nil
+type awsChunkedReader struct {
+	br   *bufio.Reader
+	auth *s3Auth
+	buf  []byte
+	pos  int
+	done bool
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for c.pos >= len(c.buf) {
+		if c.done { return 0, io.EOF }
+		if err := c.next(); err != nil { return 0, err }
+	}
+	n := copy(p, c.buf[c.pos:])
+	c.pos += n
+	return n, nil
+}
+
+func (c *awsChunkedReader) next() error {
+	line, err := c.br.ReadSlice('\n')
+	if err != nil { return fmt.Errorf("aws-chunked: %w", err) }
+	sizeHex, ext, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > 16<<20 { return errors.New("aws-chunked: tamaño de parte no válido") }
+	if int64(cap(c.buf)) < size { c.buf = make([]byte, size) }
+	c.buf, c.pos = c.buf[:size], 0
+	if _, err := io.ReadFull(c.br, c.buf); err != nil { return fmt.Errorf("aws-chunked: %w", err) }
+	if c.auth != nil {
+		sig := strings.TrimPrefix(ext, "chunk-signature=")
+		stringToSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.auth.Date + "\n" + c.auth.Scope + "\n" + c.auth.Signature + "\n" + sha256Hex(nil) + "\n" + sha256Hex(c.buf)
+		if !hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(c.auth.Key, stringToSign))), []byte(sig)) { return errBadDigest }
+		c.auth.Signature = sig
+	}
+	// La última parte (vacía) puede ir seguida de cabeceras finales, que se ignoran
+	if size == 0 {
+		c.done = true
+		return nil
+	}
+	_, err = c.br.Discard(2)
+	return err
+}
+
+// s3Handler enruta las peticiones del puerto S3
+func s3Handler(w http.ResponseWriter, r *http.Request) {
+	auth, err := s3Verify(r)
+	if err != nil {
+		s3Fail(w, r, 403, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+	// Las listas de control de acceso ven las peticiones S3 como el usuario "s3"
+	r = r.WithContext(context.WithValue(r.Context(), aclUserKey{}, "s3"))
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	switch {
+	case bucket == "" && r.Method == "GET":
+		s3ListBuckets(w)
+	case bucket == "":
+		s3Fail(w, r, 405, "MethodNotAllowed", "Operación no soportada")
+	case bucket != s3Bucket:
+		s3Fail(w, r, 404, "NoSuchBucket", "El único bucket es "+s3Bucket)
+	case key == "" && r.Method == "GET" && r.URL.Query().Has("location"):
+		s3XML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			NS      string   `xml:"xmlns,attr"`
+			Region  string   `xml:",chardata"`
+		}{NS: s3Namespace, Region: s3Region})
+	case key == "" && r.Method == "GET":
+		s3ListObjects(w, r)
+	case key == "" && (r.Method == "HEAD" || r.Method == "PUT"):
+		// PUT del bucket (CreateBucket): ya existe y es nuestro
+		w.WriteHeader(200)
+	case key == "":
+		s3Fail(w, r, 501, "NotImplemented", "Operación no soportada")
+	case r.Method == "GET" || r.Method == "HEAD":
+		s3GetObject(w, r, key)
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") == "":
+		s3PutObject(w, r, key, auth)
+	case r.Method == "DELETE":
+		s3DeleteObject(w, r, key)
+	default:
+		s3Fail(w, r, 501, "NotImplemented", "Operación no soportada (sin subidas multiparte ni copias)")
+	}
+}
+
+func s3ListBuckets(w http.ResponseWriter) {
+	type bucketXML struct {
+		Name         string
+		CreationDate string
+	}
+	created := time.Now()
+	if info, err := os.Stat(rootDir); err == nil { created = info.ModTime() }
+	s3XML(w, struct {
+		XMLName xml.Name    `xml:"ListAllMyBucketsResult"`
+		NS      string      `xml:"xmlns,attr"`
+		Owner   struct{ ID, DisplayName string }
+		Buckets []bucketXML `xml:"Buckets>Bucket"`
+	}{
+		NS:      s3Namespace,
+		Owner:   struct{ ID, DisplayName string }{"cerbero", "cerbero"},
+		Buckets: []bucketXML{{Name: s3Bucket, CreationDate: created.UTC().Format("2006-01-02T15:04:05.000Z")}},
+	})
+}
+
+// s3ETag identifica la versión de un archivo sin leerlo; al llevar un "-"
+// los clientes no lo confunden con un MD5
+func s3ETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+// s3ListObjects implementa ListObjects (v1 con marker y v2 con list-type=2)
+func s3ListObjects(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := 1000
+	if n, err := strconv.Atoi(q.Get("max-keys")); err == nil && n >= 0 && n < maxKeys { maxKeys = n }
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			raw, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil { s3Fail(w, r, 400, "InvalidArgument", "continuation-token no válido"); return }
+			after = string(raw)
+		}
+	}
+
+	// Se recorre solo la carpeta más profunda que contiene el prefijo
+	start := rootDir
+	if i := strings.LastIndex(prefix, "/"); i > 0 {
+		if p, err := existingPath(prefix[:i]); err == nil { start = p } else { start = "" }
+	}
+	var objects []s3Object
+	prefixes := map[string]bool{}
+	if start != "" {
+		walkFiles(start, func(key string, info os.FileInfo) {
+			if !strings.HasPrefix(key, prefix) || key <= after || !aclAllows(r, key, aclRead) { return }
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					prefixes[key[:len(prefix)+i+len(delimiter)]] = true
+					return
+				}
+			}
+			objects = append(objects, s3Object{
+				Key: key, LastModified: info.ModTime().UTC().Format("2006-01-02T15:04:05.000Z"),
+				ETag: s3ETag(info), Size: info.Size(), StorageClass: "STANDARD",
+			})
+		})
+	}
+
+	// Objetos y prefijos comunes se paginan juntos, en orden de clave
+	type entry struct {
+		key    string
+		object *s3Object
+	}
+	var all []entry
+	for i := range objects { all = append(all, entry{objects[i].Key, &objects[i]}) }
+	for p := range prefixes {
+		if p > after { all = append(all, entry{p, nil}) }
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].key < all[j].key })
+	truncated := len(all) > maxKeys
+	if truncated { all = all[:maxKeys] }
+
+	encode := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" { encode = func(s string) string { return s3Encode(s, false) } }
+	type commonPrefix struct{ Prefix string }
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		NS                    string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		Marker                string `xml:",omitempty"`
+		NextMarker            string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		KeyCount              *int   `xml:",omitempty"`
+		MaxKeys               int
+		EncodingType          string `xml:",omitempty"`
+		IsTruncated           bool
+		Contents              []s3Object
+		CommonPrefixes        []commonPrefix
+	}{
+		NS: s3Namespace, Name: s3Bucket, Prefix: encode(prefix), Delimiter: encode(delimiter),
+		MaxKeys: maxKeys, EncodingType: q.Get("encoding-type"), IsTruncated: truncated,
+	}
+	for _, e := range all {
+		if e.object != nil {
+			o := *e.object
+			o.Key = encode(o.Key)
+			result.Contents = append(result.Contents, o)
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{encode(e.key)})
+		}
+	}
+	last := ""
+	if len(all) > 0 { last = all[len(all)-1].key }
+	if v2 {
+		count := len(all)
+		result.KeyCount = &count
+		result.StartAfter = encode(q.Get("start-after"))
+		result.ContinuationToken = q.Get("continuation-token")
+		if truncated { result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last)) }
+	} else {
+		result.Marker = encode(q.Get("marker"))
+		if truncated { result.NextMarker = encode(last) }
+	}
+	s3XML(w, result)
+}
+
+func s3GetObject(w http.ResponseWriter, r *http.Request, key string) {
+	abs, err := existingPath(key)
+	if errors.Is(err, errForbidden) { s3Fail(w, r, 403, "AccessDenied", "Acceso denegado"); return }
+	if err != nil { s3Fail(w, r, 404, "NoSuchKey", "No existe la clave"); return }
+	if lockedMount(r, abs) != nil { s3Fail(w, r, 403, "AccessDenied", "Carpeta protegida con clave"); return }
+	if !aclAllows(r, key, aclRead) { s3Fail(w, r, 403, "AccessDenied", "Sin permiso de lectura"); return }
+	f, err := os.Open(abs)
+	if err != nil { s3Fail(w, r, 404, "NoSuchKey", "No existe la clave"); return }
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() { s3Fail(w, r, 404, "NoSuchKey", "No existe la clave"); return }
+	if hooksFor(hookPreDownload) {
+		ev := hookEvent{Event: hookPreDownload, Path: relPath(abs), File: abs, Size: info.Size(), User: currentUser(r), IP: clientIP(r)}
+		if err := runPreHooks(r.Context(), ev); err != nil { s3Fail(w, r, 403, "AccessDenied", err.Error()); return }
+	}
+	w.Header().Set("ETag", s3ETag(info))
+	w.Header().Set("Content-Type", fileMIME(relPath(abs)))
+	_, span := startSpan(r.Context(), "storage.read")
+	span.SetAttr("file.name", key)
+	http.ServeContent(w, r, "", info.ModTime(), f)
+	span.End()
+}
+
+func s3PutObject(w http.ResponseWriter, r *http.Request, key string, auth *s3Auth) {
+	name, err := sanitizeRelPath(key)
+	if err != nil || name != strings.TrimSuffix(key, "/") {
+		s3Fail(w, r, 400, "InvalidArgument", "Nombre de clave no admitido por el servidor")
+		return
+	}
+	dstPath, err := securePath(name)
+	if err != nil { s3Fail(w, r, 403, "AccessDenied", "Acceso denegado"); return }
+	if lockedMount(r, dstPath) != nil { s3Fail(w, r, 403, "AccessDenied", "Carpeta protegida con clave"); return }
+	if err := checkMountWrite(dstPath, max(r.ContentLength, 0)); err != nil { s3Fail(w, r, 403, "AccessDenied", err.Error()); return }
+	if !aclAllows(r, relPath(dstPath), aclWrite) { s3Fail(w, r, 403, "AccessDenied", "Sin permiso de escritura"); return }
+	// Las claves acabadas en "/" son los marcadores de carpeta de las consolas S3
+	if strings.HasSuffix(key, "/") {
+		if err := os.MkdirAll(dstPath, 0755); err != nil { s3Fail(w, r, 409, "InvalidArgument", "No se pudo crear la carpeta"); return }
+		w.WriteHeader(200)
+		return
+	}
+
+	// Todos los lectores van sobre el cuerpo limitado: con aws-chunked o sin
+	// tamaño, -maxmb solo se puede comprobar al leer. El cuerpo en bruto lleva
+	// además las cabeceras y firmas de cada trozo
+	limit := int64(maxUploadMB) << 20
+	r.Body = http.MaxBytesReader(w, r.Body, limit+limit/64+1<<20)
+	size := r.ContentLength
+	body := io.Reader(r.Body)
+	switch {
+	case strings.HasPrefix(auth.Payload, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"):
+		s3Fail(w, r, 501, "NotImplemented", "Firma por partes con trailer no soportada")
+		return
+	case auth.Payload == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD":
+		body = &awsChunkedReader{br: bufio.NewReader(r.Body), auth: auth}
+	case auth.Payload == "STREAMING-UNSIGNED-PAYLOAD-TRAILER":
+		body = &awsChunkedReader{br: bufio.NewReader(r.Body)}
+	case auth.Payload != "UNSIGNED-PAYLOAD":
+		body = &sha256CheckReader{r: r.Body, h: sha256.New(), want: auth.Payload}
+	}
+	// Y lo decodificado no puede pasar de -maxmb
+	body = http.MaxBytesReader(w, io.NopCloser(body), limit)
+	if decoded := r.Header.Get("X-Amz-Decoded-Content-Length"); decoded != "" { size, _ = strconv.ParseInt(decoded, 10, 64) }
+	if size > limit { s3Fail(w, r, 400, "EntityTooLarge", "Supera -maxmb"); return }
+	if size > 0 && checkFreeSpace(rootDir, size) != nil { s3Fail(w, r, 507, "InsufficientStorage", "No hay espacio en disco"); return }
+	if retry, err := quotas.Check(r, size); errors.Is(err, errQuotaTooLarge) {
+		s3Fail(w, r, 400, "EntityTooLarge", "Supera la cuota diaria")
+		return
+	} else if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		s3Fail(w, r, 503, "SlowDown", "Cuota diaria agotada")
+		return
+	}
+
+	unlock, err := pathLocks.TryLock(dstPath)
+	if err != nil { s3Fail(w, r, 409, "OperationAborted", "Hay otra subida en curso para esta clave"); return }
+	defer unlock()
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil { s3Fail(w, r, 409, "InvalidArgument", "No se pudo crear la carpeta"); return }
+	if err := checkDirCapacity(dstPath); err != nil { s3Fail(w, r, 507, "InsufficientStorage", err.Error()); return }
+	if info, err := os.Lstat(dstPath); err == nil && info.IsDir() { s3Fail(w, r, 409, "InvalidArgument", "Ya existe una carpeta con ese nombre"); return }
+	md5sum := md5.New()
+	var result uploadResult
+	// Sin tamaño conocido, la cuota se comprueba según se lee
+	counted := &countingReader{r: quotas.Reader(r, body)}
+	result.SHA256, err = receiveFile(hookContext(r), io.TeeReader(counted, md5sum), dstPath)
+	quotas.Charge(r, counted.n)
+	if err != nil {
+		log.Printf("S3: subida de %s interrumpida: %v", key, err)
+		var tooBig *http.MaxBytesError
+		var rejected *hookRejected
+		switch {
+		case errors.As(err, &rejected):
+			s3Fail(w, r, 403, "AccessDenied", rejected.Message)
+		case errors.Is(err, errBadDigest):
+			s3Fail(w, r, 400, "XAmzContentSHA256Mismatch", err.Error())
+		case errors.As(err, &tooBig):
+			s3Fail(w, r, 400, "EntityTooLarge", "Supera -maxmb")
+		case errors.Is(err, errQuotaExceeded):
+			retry, _ := quotas.Check(r, 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+			s3Fail(w, r, 503, "SlowDown", "Cuota diaria agotada")
+		case errors.Is(err, errDiskFull):
+			s3Fail(w, r, 507, "InsufficientStorage", "No hay espacio en disco")
+		default:
+			s3Fail(w, r, 500, "InternalError", "Error guardando el archivo")
+		}
+		return
+	}
+	if err := finishUpload(r, dstPath, map[string]string{"uploader": "S3"}, &result); err != nil {
+		s3Fail(w, r, 400, "InvalidArgument", "Imagen no válida")
+		return
+	}
+	contentChanged()
+	w.Header().Set("ETag", "\""+hex.EncodeToString(md5sum.Sum(nil))+"\"")
+	w.WriteHeader(200)
+}
+
+func s3DeleteObject(w http.ResponseWriter, r *http.Request, key string) {
+	if !enableDelete { s3Fail(w, r, 403, "AccessDenied", "Borrado deshabilitado"); return }
+	abs, err := existingPath(strings.TrimSuffix(key, "/"))
+	if errors.Is(err, errForbidden) || err == nil && isMountDir(abs) { s3Fail(w, r, 403, "AccessDenied", "Acceso denegado"); return }
+	// Borrar algo que no existe es un éxito en S3
+	if err == nil {
+		if lockedMount(r, abs) != nil { s3Fail(w, r, 403, "AccessDenied", "Carpeta protegida con clave"); return }
+		if err := checkMountWrite(abs, -1); err != nil { s3Fail(w, r, 403, "AccessDenied", err.Error()); return }
+		if !aclAllows(r, relPath(abs), aclDelete) { s3Fail(w, r, 403, "AccessDenied", "Sin permiso de borrado"); return }
+		if err := os.Remove(abs); err != nil && !os.IsNotExist(err) {
+			s3Fail(w, r, 409, "InvalidArgument", "No se pudo borrar")
+			return
+		}
+		pins.Forget(relPath(abs))
+		meta.Delete(relPath(abs))
+		postDeleteHook(relPath(abs), undoOwner(r))
+		contentChanged()
+	}
+	w.WriteHeader(204)
+}
+
+// --- BLOQUEO DE RUTAS ---
+
+// Cada escritura va a un temporal propio (O_EXCL) que se renombra al final,
+// así que dos subidas nunca mezclan bytes; pero sin bloqueo ganaría la
+// última en terminar, con metadatos de la otra. pathLocks marca las rutas con
+// una escritura en curso y la segunda recibe 409 en vez de esperar: una
+// subida puede durar minutos. Solo protege dentro del proceso.
+type pathLockTable struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+var pathLocks = pathLockTable{held: make(map[string]bool)}
+
+var errPathBusy = errors.New("hay otra escritura en curso en esa ruta")
+
+// TryLock reserva abs o devuelve errPathBusy; la función devuelta la libera
+func (t *pathLockTable) TryLock(abs string) (func(), error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.held[abs] { return nil, errPathBusy }
+	t.held[abs] = true
+	return func() {
+		t.mu.Lock()
+		delete(t.held, abs)
+		t.mu.Unlock()
+	}, nil
+}
+
+// --- MEMORIA DE FORMULARIOS ---
+
+// Las subidas (/upload, /share-target, /r/...) leen el multipart en streaming
+// y no guardan nada en memoria. El resto de formularios POST pasan por form():
+// si llegan como multipart/form-data, net/http guardaría en memoria hasta
+// 32 MB de archivos por petición; aquí cada una toma como mucho
+// -upload-buffer-mb de un cupo común de -upload-buffer-total-mb y lo que no
+// cabe va a archivos temporales en -tmp-dir.
+type formMemoryPool struct {
+	mu   sync.Mutex
+	used int64
+}
+
+var formMemory formMemoryPool
+
+// take reserva hasta want bytes sin esperar; con el cupo agotado devuelve 0
+// y el formulario se guarda entero en disco
+func (p *formMemoryPool) take(want int64) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	got := max(0, min(want, int64(uploadBufferTotalMB)<<20-p.used))
+	p.used += got
+	return got
+}
+
+func (p *formMemoryPool) release(n int64) {
+	p.mu.Lock()
+	p.used -= n
+	p.mu.Unlock()
+}
+
+// form analiza antes del handler los formularios multipart con memoria acotada
+func form(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if ct != "multipart/form-data" { next(w, r); return }
+		budget := formMemory.take(int64(uploadBufferMB) << 20)
+		defer formMemory.release(budget)
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadMB)<<20)
+		// Los campos de texto no cuentan: Go les reserva aparte hasta 10 MB
+		if err := r.ParseMultipartForm(budget); err != nil { http.Error(w, "Formulario no válido", 400); return }
+		next(w, r)
+	}
+}
+
+// --- MODO DE POCA MEMORIA ---
+
+// applyLowMem ajusta -low-mem para una Raspberry Pi o un router: búferes
+// pequeños, formularios siempre a disco, sin vistas previas (lanzan
+// conversores pesados) y un GC más frecuente. Los parámetros puestos a mano
+// en la línea de órdenes se respetan.
+func applyLowMem() {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["upload-buffer-mb"] { uploadBufferMB = 0 }
+	if !set["upload-buffer-total-mb"] { uploadBufferTotalMB = 4 }
+	if !set["page-size"] { listPageSize = 100 }
+	if !set["stat-workers"] { statWorkers = 2 }
+	copyBufSize = 64 << 10
+	if pdfPreviewCmd != "" || officePreviewCmd != "" { log.Print("-low-mem: vistas previas desactivadas") }
+	pdfPreviewCmd, officePreviewCmd = "", ""
+	// GOGC en el entorno manda; si no, se recolecta al crecer un 25 % en vez de un 100 %
+	if os.Getenv("GOGC") == "" { debug.SetGCPercent(25) }
+}
+
+// warnTempSpace avisa si una subida de -maxmb no cabría en la carpeta de
+// temporales (formularios) o si el destino no tiene ese espacio libre
+func warnTempSpace() {
+	need := uint64(maxUploadMB) << 20
+	for _, dir := range []string{os.TempDir(), rootDir} {
+		if free, _, err := diskFree(dir); err == nil && need > free {
+			log.Printf("Aviso: -maxmb %d supera el espacio libre de %s (%s)", maxUploadMB, dir, humanSize(int64(free)))
+		}
+	}
+}
+
+// --- TIEMPOS DE ESPERA ---
+
+// streaming sustituye los plazos globales de lectura/escritura por
+// -stream-timeout (0 = sin límite) en las rutas que transfieren archivos:
+// una descarga de varios GB no puede cortarse a los 60 s como una página
+func streaming(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		if streamTimeout > 0 { deadline = time.Now().Add(streamTimeout) }
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(deadline); err != nil { log.Printf("Plazo de lectura: %v", err) }
+		if err := rc.SetWriteDeadline(deadline); err != nil { log.Printf("Plazo de escritura: %v", err) }
+		next(w, r)
+	}
+}
+
+// --- CACHÉ DE LISTADOS ---
+
+// listCache guarda el ReadDir+stat de cada carpeta listada. Una entrada vale
+// mientras no pase -list-cache y la fecha de modificación de la carpeta siga
+// igual: crear, borrar o renombrar (también cada subida, que termina en un
+// rename) la cambia, así que la caché no sirve listados viejos aunque el TTL
+// sea largo. Editar un archivo en el sitio no toca la carpeta; eso lo cubre el TTL.
+type listCacheEntry struct {
+	dirMod time.Time
+	loaded time.Time
+	infos  []os.FileInfo
+}
+
+type ListCache struct {
+	mu      sync.Mutex
+	entries map[string]listCacheEntry
+}
+
+const listCacheMaxDirs = 256
+
+var listCache = ListCache{entries: make(map[string]listCacheEntry)}
+
+// inParallel ejecuta fn(0..n-1) con como mucho -stat-workers a la vez: en NFS
+// o SMB cada stat es un viaje de red y hacerlos en serie domina el listado
+func inParallel(n int, fn func(i int)) {
+	workers := min(statWorkers, n)
+	if workers <= 1 {
+		for i := 0; i < n; i++ { fn(i) }
+		return
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next { fn(i) }
+		}()
+	}
+	for i := 0; i < n; i++ { next <- i }
+	close(next)
+	wg.Wait()
+}
+
+// lazyInfo es la entrada de ReadDir sin stat (-lazy-stat): se sabe si es
+// carpeta, pero el tamaño queda en -1 y la fecha a cero hasta pedirlos
+type lazyInfo struct{ os.DirEntry }
+
+func (l lazyInfo) Size() int64        { return -1 }
+func (l lazyInfo) Mode() os.FileMode  { return l.Type() }
+func (l lazyInfo) ModTime() time.Time { return time.Time{} }
+func (l lazyInfo) Sys() any           { return nil }
+
+// ReadDir devuelve la información de las entradas de abs, de la caché si sigue vigente
+func (c *ListCache) ReadDir(abs string) ([]os.FileInfo, error) {
+	dirInfo, err := os.Stat(abs)
+	if err != nil { return nil, err }
+	if listCacheTTL > 0 {
+		c.mu.Lock()
+		e, ok := c.entries[abs]
+		c.mu.Unlock()
+		if ok && e.dirMod.Equal(dirInfo.ModTime()) && time.Since(e.loaded) < listCacheTTL { return e.infos, nil }
+	}
+
+	entries, err := os.ReadDir(abs)
+	if err != nil { return nil, err }
+	infos := make([]os.FileInfo, len(entries))
+	if lazyStat {
+		for i, entry := range entries { infos[i] = lazyInfo{entry} }
+	} else {
+		inParallel(len(entries), func(i int) {
+			if info, err := entries[i].Info(); err == nil { infos[i] = info }
+		})
+		// Un archivo borrado entre ReadDir e Info simplemente no aparece
+		infos = slices.DeleteFunc(infos, func(info os.FileInfo) bool { return info == nil })
+	}
+	if listCacheTTL > 0 {
+		c.mu.Lock()
+		if len(c.entries) >= listCacheMaxDirs { clear(c.entries) }
+		c.entries[abs] = listCacheEntry{dirMod: dirInfo.ModTime(), loaded: time.Now(), infos: infos}
+		c.mu.Unlock()
+	}
+	return infos, nil
+}
+
+// --- TAMAÑO DE CARPETAS ---
+
+// Un recorrido en segundo plano suma lo que ocupa cada carpeta (lo mismo que
+// se ve en el listado: sin ocultos, ignorados ni carpetas de -share con clave)
+// cada -du-interval y unos segundos después de cada cambio hecho desde
+// Cerbero. El listado muestra esas sumas en la columna de tamaño y
+// /api/v1/du devuelve el desglose en árbol para el panel de administración.
+
+type dirUsage struct {
+	Size  int64 `json:"size"`
+	Files int   `json:"files"`
+}
+
+type DirSizes struct {
+	mu      sync.Mutex
+	dirs    map[string]dirUsage
+	scanned time.Time
+	took    time.Duration
+	trigger chan struct{}
+}
+
+var dirSizes = DirSizes{trigger: make(chan struct{}, 1)}
+
+// contentChanged avisa a los procesos en segundo plano (índice de texto,
+// tamaño de carpetas) de que algo cambió en disco
+func contentChanged() {
+	textIndex.Trigger()
+	dirSizes.Trigger()
+}
+
+// Get devuelve lo que ocupa la carpeta rel según el último recorrido
+func (d *DirSizes) Get(rel string) (dirUsage, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	u, ok := d.dirs[rel]
+	return u, ok
+}
+
+// Trigger pide un recorrido sin esperar a que termine
+func (d *DirSizes) Trigger() {
+	if duInterval <= 0 { return }
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run recorre al arrancar, cada duInterval y tras los cambios; espera unos
+// segundos tras un aviso para juntar los de una subida de muchos archivos
+func (d *DirSizes) run() {
+	ticker := time.NewTicker(duInterval)
+	defer ticker.Stop()
+	for {
+		d.scan()
+		select {
+		case <-ticker.C:
+		case <-d.trigger:
+			time.Sleep(2 * time.Second)
+		}
+	}
+}
+
+func (d *DirSizes) scan() {
+	start := time.Now()
+	dirs := map[string]dirUsage{".": {}}
+	walkFiles(rootDir, func(rel string, info os.FileInfo) {
+		for dir := path.Dir(rel); ; dir = path.Dir(dir) {
+			u := dirs[dir]
+			u.Size += info.Size()
+			u.Files++
+			dirs[dir] = u
+			if dir == "." { break }
+		}
+	})
+	d.mu.Lock()
+	d.dirs, d.scanned, d.took = dirs, time.Now(), time.Since(start)
+	d.mu.Unlock()
+}
+
+// duNode es una carpeta del desglose de /api/v1/du; Own es lo que ocupan sus
+// archivos sin contar las subcarpetas
+type duNode struct {
+	Name     string   `json:"name"`
+	Path     string   `json:"path"`
+	Size     int64    `json:"size"`
+	Files    int      `json:"files"`
+	Own      int64    `json:"own"`
+	Children []duNode `json:"children,omitempty"`
+}
+
+// Tree arma el desglose de rel con depth niveles de subcarpetas, de mayor a menor
+func (d *DirSizes) Tree(rel string, depth int) (duNode, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	children := map[string][]string{}
+	for dir := range d.dirs {
+		if dir != "." { children[path.Dir(dir)] = append(children[path.Dir(dir)], dir) }
+	}
+	var build func(dir string, depth int) duNode
+	build = func(dir string, depth int) duNode {
+		u := d.dirs[dir]
+		n := duNode{Name: path.Base(dir), Path: dir, Size: u.Size, Files: u.Files, Own: u.Size}
+		for _, sub := range children[dir] {
+			n.Own -= d.dirs[sub].Size
+			if depth > 0 { n.Children = append(n.Children, build(sub, depth-1)) }
+		}
+		sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Size > n.Children[j].Size })
+		return n
+	}
+	if _, ok := d.dirs[rel]; !ok { return duNode{}, false }
+	return build(rel, depth), true
+}
+
+// treemapRect es un rectángulo del mapa de /usage, en porcentajes del área
+type treemapRect struct {
+	Node       duNode
+	X, Y, W, H float64
+	Color      template.CSS
+	Link       bool
+}
+
+// Área virtual del mapa: más ancha que alta, como el recuadro de la página,
+// para que los rectángulos salgan cuadrados en pantalla
+const treemapW, treemapH = 160.0, 100.0
+
+// squarify reparte nodos (de mayor a menor) en el rectángulo x,y,w,h con el
+// algoritmo "squarified": va llenando filas a lo largo del lado corto mientras
+// la peor proporción de la fila mejore
+func squarify(nodes []duNode, x, y, w, h float64) []treemapRect {
+	var total int64
+	for _, n := range nodes { total += n.Size }
+	if total <= 0 { return nil }
+	scale := w * h / float64(total)
+	worst := func(row []duNode, short float64) float64 {
+		var sum float64
+		for _, n := range row { sum += float64(n.Size) * scale }
+		ratio := 0.0
+		for _, n := range row {
+			a := float64(n.Size) * scale
+			ratio = max(ratio, short*short*a/(sum*sum), sum*sum/(short*short*a))
+		}
+		return ratio
+	}
+	var out []treemapRect
+	for rest := nodes; len(rest) > 0; {
+		short := min(w, h)
+		n := 1
+		for n < len(rest) && worst(rest[:n+1], short) <= worst(rest[:n], short) { n++ }
+		var area float64
+		for _, node := range rest[:n] { area += float64(node.Size) * scale }
+		if w >= h {
+			cw, cy := area/h, y
+			for _, node := range rest[:n] {
+				ih := float64(node.Size) * scale / cw
+				out = append(out, treemapRect{Node: node, X: x, Y: cy, W: cw, H: ih})
+				cy += ih
+			}
+			x, w = x+cw, w-cw
+		} else {
+			rh, cx := area/w, x
+			for _, node := range rest[:n] {
+				iw := float64(node.Size) * scale / rh
+				out = append(out, treemapRect{Node: node, X: cx, Y: y, W: iw, H: rh})
+				cx += iw
+			}
+			y, h = y+rh, h-rh
+		}
+		rest = rest[n:]
+	}
+	return out
+}
+
+var usageTmpl *template.Template
+
+// usageHandler muestra en /usage?dir= un mapa de rectángulos (treemap) con lo
+// que ocupa cada subcarpeta, a partir de los tamaños ya calculados
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	if duInterval <= 0 { failWith(w, "unavailable", "El cálculo de tamaños está desactivado (-du-interval 0)", 503); return }
+	dir := strings.Trim(path.Clean("/"+r.URL.Query().Get("dir")), "/")
+	if dir == "" { dir = "." }
+	tree, ok := dirSizes.Tree(dir, 1)
+	if !ok { http.Error(w, "No encontrado (o aún sin calcular)", 404); return }
+	if dir == "." { tree.Name = "Raíz" }
+	nodes := slices.Clone(tree.Children)
+	if tree.Own > 0 { nodes = append(nodes, duNode{Name: "Archivos sueltos", Path: dir, Size: tree.Own}) }
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].Size > nodes[j].Size })
+	rects := squarify(slices.DeleteFunc(nodes, func(n duNode) bool { return n.Size <= 0 }), 0, 0, treemapW, treemapH)
+	for i := range rects {
+		rc := &rects[i]
+		rc.X, rc.W = rc.X/treemapW*100, rc.W/treemapW*100
+		rc.Color = template.CSS(fmt.Sprintf("hsl(%d, 55%%, 72%%)", i*47%360))
+		rc.Link = rc.Node.Path != dir
+	}
+	var crumbs []duNode
+	if dir != "." {
+		crumbs = append(crumbs, duNode{Name: "Raíz", Path: "."})
+		parts := strings.Split(dir, "/")
+		for i := range parts[:len(parts)-1] { crumbs = append(crumbs, duNode{Name: parts[i], Path: strings.Join(parts[:i+1], "/")}) }
+	}
+	dirSizes.mu.Lock()
+	scanned := dirSizes.scanned
+	dirSizes.mu.Unlock()
+	percent := func(n int64) float64 {
+		if tree.Size == 0 { return 0 }
+		return float64(n) * 100 / float64(tree.Size)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	usageTmpl.Execute(w, map[string]interface{}{"Tree": tree, "Rects": rects, "Crumbs": crumbs, "Scanned": scanned, "Percent": percent})
+}
+
+// duHandler es GET /api/v1/du?dir=...&depth=N (2 por defecto, hasta 6)
+func duHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleAdmin) {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	if duInterval <= 0 { failWith(w, "unavailable", "El cálculo de tamaños está desactivado (-du-interval 0)", 503); return }
+	dir := strings.Trim(path.Clean("/"+r.URL.Query().Get("dir")), "/")
+	if dir == "" { dir = "." }
+	depth, err := strconv.Atoi(r.URL.Query().Get("depth"))
+	if err != nil { depth = 2 }
+	tree, ok := dirSizes.Tree(dir, min(max(depth, 0), 6))
+	if !ok { http.Error(w, "No encontrado (o aún sin calcular)", 404); return }
+	dirSizes.mu.Lock()
+	scanned, took := dirSizes.scanned, dirSizes.took
+	dirSizes.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"scanned": scanned, "took_ms": took.Milliseconds(), "tree": tree})
+}
+
+// --- RECONCILIACIÓN CON EL DISCO ---
+
+// Lo que se crea, borra o mueve desde la consola o por Samba no pasa por
+// Cerbero, así que sus metadatos, fijados, enlaces de descarga y permisos se
+// quedarían apuntando a rutas viejas. Cada -reconcile-interval se mira la
+// fecha de modificación de cada carpeta conocida (cambia al crear, borrar o
+// renombrar algo dentro, igual que en la caché de listados) y solo las que
+// cambiaron se vuelven a leer:
+//   - lo que desaparece se olvida (también sus enlaces /s/);
+//   - lo que aparece con el tamaño y la fecha de algo que desapareció en la
+//     misma pasada se toma por un mv y sus datos lo siguen; si era una
+//     carpeta entera, también sus permisos y enlaces de carpeta;
+//   - lo nuevo sin hash se encola como trabajo "backfill".
+// Sin dependencias ni inotify: funciona igual en Linux, macOS y discos de red.
+
+type reconciledFile struct {
+	size  int64
+	mtime time.Time
+}
+
+type reconciledDir struct {
+	mtime time.Time
+	files map[string]reconciledFile
+	dirs  map[string]bool
+}
+
+type Reconciler struct {
+	dirs map[string]*reconciledDir // por ruta relativa de la carpeta
+}
+
+var reconciler = Reconciler{dirs: make(map[string]*reconciledDir)}
+
+// readReconciledDir lee una carpeta tal como está ahora, sin lo interno de Cerbero
+func readReconciledDir(rel string) (*reconciledDir, error) {
+	abs := absPath(rel)
+	info, err := os.Stat(abs)
+	if err != nil { return nil, err }
+	entries, err := os.ReadDir(abs)
+	if err != nil { return nil, err }
+	d := &reconciledDir{mtime: info.ModTime(), files: make(map[string]reconciledFile), dirs: make(map[string]bool)}
+	for _, e := range entries {
+		if isInternalName(e.Name()) { continue }
+		switch {
+		case e.IsDir():
+			d.dirs[e.Name()] = true
+		case e.Type().IsRegular():
+			if fi, err := e.Info(); err == nil { d.files[e.Name()] = reconciledFile{fi.Size(), fi.ModTime()} }
+		}
+	}
+	return d, nil
+}
+
+// load recorre una carpeta y sus subcarpetas y devuelve sus archivos
+func (rc *Reconciler) load(rel string, files map[string]reconciledFile) {
+	d, err := readReconciledDir(rel)
+	if err != nil { return }
+	rc.dirs[rel] = d
+	for name, f := range d.files {
+		if files != nil { files[path.Join(rel, name)] = f }
+	}
+	for name := range d.dirs { rc.load(path.Join(rel, name), files) }
+}
+
+// forget quita una carpeta desaparecida y devuelve sus archivos
+func (rc *Reconciler) forget(rel string, files map[string]reconciledFile) {
+	d := rc.dirs[rel]
+	if d == nil { return }
+	delete(rc.dirs, rel)
+	for name, f := range d.files { files[path.Join(rel, name)] = f }
+	for name := range d.dirs { rc.forget(path.Join(rel, name), files) }
+}
+
+// roots son la raíz y las carpetas de -share
+func reconcileRoots() []string {
+	roots := []string{"."}
+	for _, m := range mounts { roots = append(roots, m.name) }
+	return roots
+}
+
+// pass compara las carpetas que cambiaron y devuelve lo que desapareció y
+// lo que apareció (archivos y carpetas)
+func (rc *Reconciler) pass() (gone, added map[string]reconciledFile, goneDirs, addedDirs []string) {
+	gone, added = make(map[string]reconciledFile), make(map[string]reconciledFile)
+	for _, root := range reconcileRoots() {
+		if rc.dirs[root] == nil { rc.load(root, nil) }
+	}
+	for _, rel := range slices.Sorted(maps.Keys(rc.dirs)) {
+		old := rc.dirs[rel]
+		if old == nil { continue } // ya olvidada con su padre
+		cur, err := readReconciledDir(rel)
+		if err != nil || cur.mtime.Equal(old.mtime) { continue }
+		rc.dirs[rel] = cur
+		for name, f := range old.files {
+			if _, ok := cur.files[name]; !ok { gone[path.Join(rel, name)] = f }
+		}
+		for name, f := range cur.files {
+			if _, ok := old.files[name]; !ok { added[path.Join(rel, name)] = f }
+		}
+		for name := range old.dirs {
+			if !cur.dirs[name] { goneDirs = append(goneDirs, path.Join(rel, name)); rc.forget(path.Join(rel, name), gone) }
+		}
+		for name := range cur.dirs {
+			if !old.dirs[name] { addedDirs = append(addedDirs, path.Join(rel, name)); rc.load(path.Join(rel, name), added) }
+		}
+	}
+	return gone, added, goneDirs, addedDirs
+}
+
+// renameStores lleva todo lo guardado de una ruta a otra
+func renameStores(from, to string) {
+	meta.Rename(from, to)
+	pins.Rename(from, to)
+	shares.Rename(from, to)
+	acls.Rename(from, to)
+	folderLinks.Rename(from, to)
+}
+
+// reconcile aplica una pasada; devuelve si hubo cambios
+func (rc *Reconciler) reconcile() bool {
+	gone, added, goneDirs, addedDirs := rc.pass()
+	if len(gone) == 0 && len(added) == 0 && len(goneDirs) == 0 && len(addedDirs) == 0 { return false }
+	// Lo apartado para deshacer un borrado no se da por perdido
+	for rel := range gone {
+		if deletions.holds(absPath(rel)) { delete(gone, rel) }
+	}
+	goneDirs = slices.DeleteFunc(goneDirs, func(rel string) bool { return deletions.holds(absPath(rel)) })
+
+	// Un mv conserva tamaño y fecha: se empareja lo desaparecido con lo
+	// aparecido cuando no hay dudas sobre cuál es cuál
+	type sig struct {
+		size  int64
+		mtime int64
+	}
+	bySig := make(map[sig][]string)
+	for rel, f := range added { bySig[sig{f.size, f.mtime.UnixNano()}] = append(bySig[sig{f.size, f.mtime.UnixNano()}], rel) }
+	moved := make(map[string]string)
+	counts := make(map[sig]int)
+	for _, f := range gone { counts[sig{f.size, f.mtime.UnixNano()}]++ }
+	for rel, f := range gone {
+		s := sig{f.size, f.mtime.UnixNano()}
+		if cands := bySig[s]; len(cands) == 1 && counts[s] == 1 { moved[rel] = cands[0] }
+	}
+	// Una carpeta se ha movido si todo lo que tenía aparece en otra con la
+	// misma estructura
+	var movedDirs []string
+	for _, from := range goneDirs {
+		for _, to := range addedDirs {
+			n, all := 0, true
+			for rel := range gone {
+				rest, ok := underPath(rel, from)
+				if !ok { continue }
+				n++
+				if moved[rel] != to+rest { all = false; break }
+			}
+			if !all || n == 0 && path.Base(from) != path.Base(to) { continue }
+			log.Printf("Movido fuera de Cerbero: %s -> %s", from, to)
+			renameStores(from, to)
+			movedDirs = append(movedDirs, from)
+			for rel := range gone {
+				if _, ok := underPath(rel, from); ok { delete(gone, rel); delete(added, moved[rel]); delete(moved, rel) }
+			}
+			break
+		}
+	}
+	goneDirs = slices.DeleteFunc(goneDirs, func(rel string) bool { return slices.Contains(movedDirs, rel) })
+	for from, to := range moved {
+		renameStores(from, to)
+		delete(gone, from)
+		delete(added, to)
+	}
+	for rel := range gone { forgetPath(rel) }
+	for _, rel := range goneDirs { forgetPath(rel) }
+	if len(gone) > 0 || len(goneDirs) > 0 { log.Printf("Reconciliación: %d archivo(s) y %d carpeta(s) desaparecidos fuera de Cerbero", len(gone), len(goneDirs)) }
+	for rel, f := range added {
+		if fm, ok := meta.Get(rel); !ok || fm.SHA256 == "" || fm.HashSize != f.size || fm.HashMTime != f.mtime.UnixNano() { jobs.Enqueue("backfill", rel) }
+	}
+	return true
+}
+
+// run revisa el disco cada -reconcile-interval
+func (rc *Reconciler) run() {
+	rc.reconcile()
+	for range time.Tick(reconcileInterval) {
+		if rc.reconcile() { contentChanged() }
+	}
+}
+
+// --- RECURSOS INTEGRADOS ---
+// Las plantillas de las páginas, la hoja de estilos y los scripts viajan
+// dentro del binario (carpeta assets/). Se sirven en /static/ con una huella del
+// contenido en el nombre, así el navegador los guarda sin caducidad y cada
+// versión nueva cambia la URL. Con -assets-dir cualquiera de ellos se puede
+// sustituir por un archivo con la misma ruta relativa, ej.
+// static/cerbero.css o templates/index.html.
+
+//go:embed assets
+var embeddedAssets embed.FS
+
+type staticAsset struct {
+	body []byte
+	hash string
+}
+
+// Recursos de assets/static por nombre; se rellena en loadAssets
+var staticAssets = map[string]*staticAsset{}
+
+// Plantillas de assets/templates y la variable de cada una; todas enlazan
+// static/cerbero.css y solo llevan en línea sus propios estilos
+var pageTemplates = map[string]**template.Template{
+	"index.html": &pageTmpl,
+	"login.html": &loginTmpl,
+	"settings.html": &settingsTmpl,
+	"index-status.html": &indexStatusTmpl,
+	"upload-result.html": &uploadResultTmpl,
+	"error.html": &errorTmpl,
+	"play.html": &playPageTmpl,
+	"playlist.html": &playlistTmpl,
+	"photos.html": &photosTmpl,
+	"schedule.html": &scheduleTmpl,
+	"edit.html": &editTmpl,
+	"view.html": &viewTmpl,
+	"snapshots.html": &snapshotsTmpl,
+	"share.html": &shareTmpl,
+	"share-page.html": &sharePageTmpl,
+	"mount.html": &mountTmpl,
+	"acl.html": &aclTmpl,
+	"homes.html": &homesTmpl,
+	"terms.html": &termsTmpl,
+	"report.html": &reportTmpl,
+	"reports.html": &reportsAdminTmpl,
+	"file-request.html": &fileRequestTmpl,
+	"file-requests.html": &fileRequestsAdminTmpl,
+	"folder-link.html": &folderLinkTmpl,
+	"folder-links.html": &folderLinksAdminTmpl,
+	"transfers.html": &transfersTmpl,
+	"p2p.html": &p2pTmpl,
+	"share-target.html": &shareTargetTmpl,
+	"usage.html": &usageTmpl,
+	"delete-tree.html": &deleteTreeTmpl,
+}
+
+// readAsset lee un recurso de -assets-dir si existe allí y si no del binario
+func readAsset(name string) ([]byte, error) {
+	if assetsDir != "" {
+		data, err := os.ReadFile(filepath.Join(assetsDir, filepath.FromSlash(name)))
+		if err == nil || !errors.Is(err, fs.ErrNotExist) { return data, err }
+	}
+	return embeddedAssets.ReadFile("assets/" + name)
+}
+
+// loadAssets carga los recursos estáticos, calcula sus huellas y prepara las
+// plantillas; un recurso sustituido que no se puede leer o una plantilla con
+// errores detienen el arranque
+func loadAssets() {
+	entries, err := embeddedAssets.ReadDir("assets/static")
+	if err != nil { log.Fatal(err) }
+	for _, e := range entries {
+		body, err := readAsset("static/" + e.Name())
+		if err != nil { log.Fatalf("Recurso %s: %v", e.Name(), err) }
+		sum := sha256.Sum256(body)
+		staticAssets[e.Name()] = &staticAsset{body: body, hash: hex.EncodeToString(sum[:5])}
+	}
+	for name, tmpl := range pageTemplates {
+		text, err := readAsset("templates/" + name)
+		if err != nil { log.Fatalf("Plantilla %s: %v", name, err) }
+		if *tmpl, err = template.New(strings.TrimSuffix(name, ".html")).Funcs(templateFuncs).Parse(string(text)); err != nil {
+			log.Fatalf("Plantilla %s: %v", name, err)
+		}
+	}
+}
+
+// assetURL devuelve la URL versionada de un recurso, ej. /static/cerbero.3f2a9c01d4.css
+func assetURL(name string) string {
+	a := staticAssets[name]
+	if a == nil { return "/static/" + name }
+	ext := path.Ext(name)
+	return "/static/" + strings.TrimSuffix(name, ext) + "." + a.hash + ext
+}
+
+// staticAssetHandler sirve /static/{file}. Con la huella vigente la respuesta no
+// caduca; sin huella, o con la de una versión anterior, se sirve el contenido
+// actual pero el navegador tiene que revalidarlo
+func staticAssetHandler(w http.ResponseWriter, r *http.Request) {
+	name, hash := r.PathValue("file"), ""
+	if staticAssets[name] == nil {
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		if i := strings.LastIndexByte(base, '.'); i >= 0 { name, hash = base[:i]+ext, base[i+1:] }
+	}
+	a := staticAssets[name]
+	if a == nil { http.NotFound(w, r); return }
+	w.Header().Set("ETag", `"`+a.hash+`"`)
+	if hash == a.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(a.body))
+}
+
+// serviceWorkerHandler sirve el service worker en la raíz (su alcance depende
+// de la URL) junto con la cola que comparte con la página
+func serviceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(staticAssets["pwa-queue.js"].body)
+	w.Write(staticAssets["sw.js"].body)
+}
+
+// --- HANDLERS ---
+
+// listFiles lee la carpeta ?dir= (la raíz si falta) y devuelve su contenido
+// filtrado por ?q=: primero los fijados, luego las subcarpetas y después los
+// archivos más recientes
+func listFiles(r *http.Request) ([]FileInfo, error) {
+	dir := strings.Trim(r.URL.Query().Get("dir"), "/")
+	abs := rootDir
+	virtual := virtualChildren(dir)
+	if dir != "" {
+		var err error
+		// Las carpetas intermedias de un -share virtual pueden no existir en rootDir
+		if abs, err = existingPath(dir); errors.Is(err, errNotFound) && len(virtual) > 0 {
+			abs = ""
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	var entries []os.FileInfo
+	if abs != "" {
+		var err error
+		if entries, err = listCache.ReadDir(abs); err != nil { return nil, err }
+	}
+
+	user := currentUser(r)
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	var contentHits map[string]bool
+	if query != "" && enableIndex { contentHits = textIndex.Search(query) }
+	ignored := ignores.Current()
+	files := []FileInfo{}
+	listed := map[string]bool{}
+	for _, info := range entries {
+		if isHiddenName(info.Name()) { continue }
+		rel := path.Join(dir, info.Name())
+		// Una carpeta de -share tapa a la del mismo nombre
+		if mountByName(rel) != nil { continue }
+		if !aclAllows(r, rel, aclRead) { continue }
+		listed[info.Name()] = true
+		if ignored.Match(rel, info.IsDir()) { continue }
+		if query != "" && !strings.Contains(strings.ToLower(info.Name()), strings.ToLower(query)) && !contentHits[rel] {
+			continue
+		}
+		if info.IsDir() {
+			files = append(files, FileInfo{
+				Name: info.Name(), RelPath: rel, ModTime: info.ModTime(), IsDir: true,
+				Pinned: pins.IsPinned(user, rel), Icon: "📁", HumanSize: "-",
+			})
+			continue
+		}
+		f := FileInfo{
+			Name:      info.Name(),
+			Size:      info.Size(),
+			RelPath:   rel,
+			HumanSize: humanSize(info.Size()),
+			ModTime:   info.ModTime(),
+			Pinned:    pins.IsPinned(user, rel),
+		}
+		if f.Size < 0 { f.SizePending, f.HumanSize = true, "…" }
+		files = append(files, f)
+	}
+	for _, name := range virtual {
+		if listed[name] { continue }
+		if query != "" && !strings.Contains(strings.ToLower(name), strings.ToLower(query)) { continue }
+		rel := path.Join(dir, name)
+		if !aclAllows(r, rel, aclRead) { continue }
+		f := FileInfo{Name: name, RelPath: rel, IsDir: true, Pinned: pins.IsPinned(user, rel), Icon: "📁", HumanSize: "-"}
+		if m := mountByName(rel); m != nil {
+			f.Icon = "🗄️"
+			if m.password != "" { f.Icon = "🔒" }
+			if info, err := os.Stat(m.dir); err == nil { f.ModTime = info.ModTime() }
+		}
+		files = append(files, f)
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Pinned != files[j].Pinned { return files[i].Pinned }
+		if files[i].IsDir != files[j].IsDir { return files[i].IsDir }
+		return files[i].ModTime.After(files[j].ModTime)
+	})
+	return files, nil
+}
+
+// describeFiles completa tipo, icono y metadatos de los archivos que se van
+// a mostrar; se hace después de paginar porque detectar el tipo puede leer
+// el archivo y en carpetas enormes solo se enseña una parte
+func describeFiles(files []FileInfo) {
+	for i := range files {
+		f := &files[i]
+		if f.IsDir {
+			if u, ok := dirSizes.Get(f.RelPath); ok { f.Size, f.HumanSize = u.Size, humanSize(u.Size) }
+			continue
+		}
+		f.MIME = fileMIME(f.RelPath)
+		fm, _ := meta.Get(f.RelPath)
+		f.Preview = previewCommand(f.Name) != "" || hasVideoPoster(f.Name)
+		f.Playable, f.Video = isVideo(f.Name), videoSummary(fm)
+		f.Image = isPhoto(f.Name) && !lowMem
+		f.Icon = mimeIcon(f.MIME)
+		f.Uploader, f.Message, f.CID = fm.Uploader, fm.Message, fm.CID
+		f.ExpiresIn = remainingLifetime(fm.Expires)
+		f.Editable = editable(f.MIME, f.Size)
+		f.Viewable = viewKind(f.Name) != ""
+		f.Visibility = fileVisibility(f.RelPath)
+		if opaqueIDs { f.ID = fileID(f.RelPath) }
+	}
+	meta.Flush()
+}
+
+// fillStats hace en paralelo el stat que -lazy-stat dejó pendiente
+func fillStats(files []FileInfo) {
+	inParallel(len(files), func(i int) {
+		f := &files[i]
+		if !f.SizePending { return }
+		abs, err := securePath(f.RelPath)
+		if err != nil { return }
+		if info, err := os.Stat(abs); err == nil {
+			f.Size, f.ModTime, f.HumanSize, f.SizePending = info.Size(), info.ModTime(), humanSize(info.Size()), false
+		}
+	})
+}
+
+// pageOf recorta el listado a [offset, offset+limit)
+func pageOf(files []FileInfo, offset, limit int) []FileInfo {
+	if offset > len(files) { offset = len(files) }
+	if limit <= 0 || offset+limit > len(files) { limit = len(files) - offset }
+	return files[offset : offset+limit]
+}
+
+func renderIndex(w http.ResponseWriter, r *http.Request) {
+	// Con -user-homes la raíz de cada usuario es su carpeta personal
+	if home := confinedHome(r); home != "" && r.URL.Query().Get("dir") == "" {
+		http.Redirect(w, r, "/?dir="+url.QueryEscape(home), 302)
+		return
+	}
+	if m := lockedDir(r); m != nil { mountLocked(w, r, m); return }
+	if listingDenied(w, r) { return }
+	all, err := listFiles(r)
+	if errors.Is(err, errForbidden) || errors.Is(err, errNotFound) { pathError(w, err); return }
+	if err != nil {
+		http.Error(w, "Error leyendo carpeta", 500)
+		return
+	}
+	// En carpetas enormes se pagina; con JavaScript hay además una vista continua
+	pages := (len(all) + listPageSize - 1) / listPageSize
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	page = max(1, min(page, pages))
+	files := pageOf(all, (page-1)*listPageSize, listPageSize)
+	describeFiles(files)
+	pinnedCount := 0
+	for _, f := range files {
+		if f.Pinned { pinnedCount++ }
+	}
+
+	user := currentUser(r)
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	session := sessionFor(r)
+	data := map[string]interface{}{
+		"Files":           files,
+		"PinnedCount":     pinnedCount,
+		"EnableDelete":    enableDelete,
+		"PasswordEnabled": password != "" && session == nil,
+		"LoginEnabled":    loginEnabled(),
+		"User":            user,
+		"Role":            "",
+		"Query":           query,
+		"IndexEnabled":    enableIndex,
+		"DiskFree":        "",
+		"Dir":             strings.Trim(r.URL.Query().Get("dir"), "/"),
+		"Parent":          "",
+		"P2PEnabled":      enableP2P,
+		"IPFSGateway":     strings.TrimRight(ipfsGateway, "/"),
+		"Total":           len(all),
+		"Page":            page,
+		"Pages":           pages,
+		"PrevURL":         "",
+		"NextURL":         "",
+	}
+	if pages > 1 {
+		q := r.URL.Query()
+		if page > 1 {
+			q.Set("page", strconv.Itoa(page-1))
+			data["PrevURL"] = "/?" + q.Encode()
+		}
+		if page < pages {
+			q.Set("page", strconv.Itoa(page+1))
+			data["NextURL"] = "/?" + q.Encode()
+		}
+	}
+	if dir := data["Dir"].(string); strings.Contains(dir, "/") { data["Parent"] = path.Dir(dir) }
+	freeDir := rootDir
+	m, _ := mountFor(path.Clean("/" + data["Dir"].(string)))
+	if m != nil { freeDir, data["ReadOnly"] = m.dir, m.readOnly }
+	if free, total, err := diskFree(freeDir); err == nil {
+		data["DiskFree"] = humanSize(int64(free)) + " libres de " + humanSize(int64(total))
+	}
+	if h := homeQuota(absPath(data["Dir"].(string))); h != nil { m = h }
+	if m != nil && m.quota > 0 {
+		data["DiskFree"] = humanSize(max(m.quota-m.usage(), 0)) + " libres de la cuota de " + humanSize(m.quota)
+	}
+	if session != nil { data["Role"] = session.Role }
+	if session != nil && session.Role == roleAdmin { data["Reports"] = reports.Pending() }
+	data["UserHomes"] = userHomes
+	if session != nil && session.Role == roleAdmin { data["Reports"], data["Damaged"] = reports.Pending(), scrub.Damaged() }
+	data["Snapshots"] = snapshotsEnabled()
+	data["TermsRequired"] = !termsAccepted(r)
+	data["HiddenShown"] = hiddenRevealed.Load()
+	data["HasAudio"], data["HasPhotos"] = hasAudio(all), hasPhotos(all)
+	// Cargar otra página confirma los borrados anteriores; el recién hecho
+	// se ofrece para deshacer
+	undo := r.URL.Query().Get("undo")
+	deletions.Settle(r, undo)
+	if p, ok := deletions.Get(undo); ok && p.Owner == undoOwner(r) {
+		label := fmt.Sprintf("%d elementos", len(p.Items))
+		if len(p.Items) == 1 { label = filepath.Base(p.Items[0].Src) }
+		data["Undo"] = map[string]interface{}{"Token": p.Token, "Label": label, "Seconds": int(time.Until(p.Deadline).Seconds())}
+	}
+	if cspPolicy != "" { w.Header().Set("Content-Security-Policy", indexCSP) }
+	pageTmpl.Execute(w, data)
+}
+
+// apiFilesHandler devuelve el listado en JSON, con el mismo filtro ?q= que la web.
+func apiFilesHandler(w http.ResponseWriter, r *http.Request) {
+	if m := lockedDir(r); m != nil { mountLocked(w, r, m); return }
+	if listingDenied(w, r) { return }
+	files, err := listFiles(r)
+	if errors.Is(err, errForbidden) || errors.Is(err, errNotFound) { pathError(w, err); return }
+	if err != nil { http.Error(w, "Error leyendo carpeta", 500); return }
+	// ?offset= y ?limit= piden un tramo; el total va en X-Total-Count
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(files)))
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	files = pageOf(files, max(offset, 0), limit)
+	fillStats(files)
+	describeFiles(files)
+	type apiFile struct {
+		Name     string    `json:"name"`
+		Path     string    `json:"path"`
+		Dir      bool      `json:"dir,omitempty"`
+		Size     int64     `json:"size"`
+		Modified time.Time `json:"modified"`
+		MIME     string    `json:"mime"`
+		Pinned   bool      `json:"pinned"`
+		Uploader string    `json:"uploader,omitempty"`
+		Message  string    `json:"message,omitempty"`
+		CID      string    `json:"cid,omitempty"`
+		Visibility string  `json:"visibility,omitempty"`
+		ID       string    `json:"id,omitempty"`
+	}
+	out := []apiFile{}
+	for _, f := range files {
+		out = append(out, apiFile{Name: f.Name, Path: f.RelPath, Dir: f.IsDir, Size: f.Size, Modified: f.ModTime, MIME: f.MIME, Pinned: f.Pinned, Uploader: f.Uploader, Message: f.Message, CID: f.CID, Visibility: f.Visibility, ID: f.ID})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// apiStatHandler devuelve tamaño y fecha de ?paths=a&paths=b (hasta 1000);
+// el listado con -lazy-stat lo usa para rellenar las columnas pendientes
+func apiStatHandler(w http.ResponseWriter, r *http.Request) {
+	paths := r.URL.Query()["paths"]
+	if len(paths) > 1000 { http.Error(w, "Demasiadas rutas (máximo 1000)", 400); return }
+	type apiStat struct {
+		Size      int64     `json:"size"`
+		HumanSize string    `json:"human_size"`
+		Modified  time.Time `json:"modified"`
+	}
+	stats := make([]*apiStat, len(paths))
+	inParallel(len(paths), func(i int) {
+		abs, err := securePath(strings.Trim(paths[i], "/"))
+		if err != nil || lockedMount(r, abs) != nil || !aclAllows(r, relPath(abs), aclRead) { return }
+		if info, err := os.Stat(abs); err == nil && !info.IsDir() {
+			stats[i] = &apiStat{Size: info.Size(), HumanSize: humanSize(info.Size()), Modified: info.ModTime()}
+		}
+	})
+	out := make(map[string]*apiStat)
+	for i, p := range paths {
+		if stats[i] != nil { out[p] = stats[i] }
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// manifestHandler devuelve ruta, tamaño, fecha y SHA-256 de todos los
+// archivos para que los clientes de sincronización calculen diferencias.
+// Los hashes se guardan en los metadatos y solo se recalculan si el archivo cambió.
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	type manifestEntry struct {
+		Path     string    `json:"path"`
+		Size     int64     `json:"size"`
+		Modified time.Time `json:"mtime"`
+		SHA256   string    `json:"sha256"`
+	}
+	out := []manifestEntry{}
+	_, span := startSpan(r.Context(), "storage.manifest")
+	walkFiles(rootDir, func(rel string, info os.FileInfo) {
+		if !aclAllows(r, rel, aclRead) { return }
+		sum, err := cachedSHA256(rel, info)
+		if err != nil {
+			log.Printf("Manifiesto: %s: %v", rel, err)
+			return
+		}
+		out = append(out, manifestEntry{Path: rel, Size: info.Size(), Modified: info.ModTime().UTC(), SHA256: sum})
+	})
+	meta.Flush()
+	span.SetAttr("files.count", len(out))
+	span.End()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// etagMatches evalúa If-None-Match ("*" o lista de hashes entre comillas)
+// contra el SHA-256 del archivo existente
+func etagMatches(header, sum string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+		if tag == "*" || sum != "" && strings.EqualFold(tag, sum) { return true }
+	}
+	return false
+}
+
+// unchangedVersion comprueba que abs sigue siendo la versión que vio el
+// cliente: mtime en nanosegundos Unix (el listado) o RFC 3339 (el campo
+// "modified" de /api/v1/files), e ifMatch con el SHA-256 como en If-Match.
+// Vacíos no imponen condición.
+func unchangedVersion(abs string, info os.FileInfo, mtime, ifMatch string) bool {
+	if mtime = strings.TrimSpace(mtime); mtime != "" {
+		want, err := strconv.ParseInt(mtime, 10, 64)
+		if err != nil {
+			t, perr := time.Parse(time.RFC3339Nano, mtime)
+			if perr != nil { return false }
+			want = t.UnixNano()
+		}
+		if info.ModTime().UnixNano() != want { return false }
+	}
+	if ifMatch = strings.TrimSpace(ifMatch); ifMatch != "" && ifMatch != "*" {
+		if info.IsDir() { return false }
+		sum, err := cachedSHA256(relPath(abs), info)
+		meta.Flush()
+		if err != nil || !etagMatches(ifMatch, sum) { return false }
+	}
+	return true
+}
+
+// unchangedUpload aplica If-None-Match a una subida: es true si el destino
+// ya existe con ese contenido y no hace falta volver a guardarlo
+func unchangedUpload(r *http.Request, dstPath string) bool {
+	cond := r.Header.Get("If-None-Match")
+	if cond == "" { return false }
+	info, err := os.Stat(dstPath)
+	if err != nil || info.IsDir() { return false }
+	if strings.TrimSpace(cond) == "*" { return true }
+	sum, err := cachedSHA256(relPath(dstPath), info)
+	meta.Flush()
+	return err == nil && etagMatches(cond, sum)
+}
+
+// uploadHandler recibe el multipart en streaming: los campos de texto se leen
+// en orden y cada parte de archivo se escribe directamente en un temporal de
+// la carpeta destino, que se renombra al final. Así no hay copia intermedia en
+// /tmp ni doble escritura, y la clave se valida antes de aceptar el archivo.
+// Las partes "file" se guardan por su nombre; las "folder" (selector de
+// carpetas del navegador) conservan su ruta relativa, creando subcarpetas.
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "upload") { return }
+	authed, decided := authorizedByIdentity(r, roleWrite)
+	if decided && !authed { http.Error(w, "Clave errónea", 401); return }
+	stored := receiveUploads(w, r, authed, uploadPolicy{})
+	if stored == nil { return }
+	respondUploads(w, r, stored)
+}
+
+// uploadPolicy restringe lo que acepta receiveUploads. La subida normal no
+// tiene restricciones; las solicitudes de archivos fijan carpeta, tamaño y tipos.
+type uploadPolicy struct {
+	Fixed      bool     // carpeta fija en Dir: se ignoran el campo dir y las partes folder
+	Dir        string
+	MaxBytes   int64    // por archivo (0 = solo -maxmb para toda la petición)
+	Extensions []string // en minúsculas y con punto (vacío = cualquiera)
+	Message    string   // mensaje si el formulario no trae uno
+}
+
+var errFileTooLarge = errors.New("archivo demasiado grande")
+
+// sizeLimitReader corta con errFileTooLarge en cuanto se pasa del límite,
+// sin esperar a recibir el archivo entero
+type sizeLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 { return n, errFileTooLarge }
+	return n, err
+}
+
+// receiveUploads lee el multipart y guarda cada archivo. Si algo falla
+// responde el error y devuelve nil; los archivos ya guardados se conservan.
+func receiveUploads(w http.ResponseWriter, r *http.Request, authed bool, policy uploadPolicy) []uploadResult {
+	if r.ContentLength > 0 && checkFreeSpace(rootDir, r.ContentLength) != nil {
+		http.Error(w, "No hay espacio en disco para este archivo", 507)
+		return nil
+	}
+	if _, err := quotas.Check(r, r.ContentLength); err != nil { quotaFail(w, r, r.ContentLength, err); return nil }
+	// Quien sube por un enlace no tiene rol propio para las reglas
+	if policy.Fixed { r = r.WithContext(context.WithValue(r.Context(), uploadRoleKey{}, "")) }
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadMB)<<20)
+	mr, err := r.MultipartReader()
+	if err != nil { http.Error(w, "Error", 400); return nil }
+
+	fields := make(map[string]string)
+	preAuthBytes := 0
+	var stored []uploadResult
+	for {
+		_, parseSpan := startSpan(r.Context(), "upload.parse")
+		part, err := mr.NextPart()
+		parseSpan.End()
+		if err == io.EOF { break }
+		if err != nil {
+			if len(stored) > 0 { break }
+			http.Error(w, "Error", 400)
+			return nil
+		}
+
+		if part.FileName() == "" {
+			value, _ := io.ReadAll(io.LimitReader(part, 64<<10))
+			// Sin autenticar solo se aceptan unos pocos KB de campos antes de cortar
+			if !authed {
+				preAuthBytes += len(value) + 512
+				if preAuthBytes > maxPreAuthBytes { http.Error(w, "Clave errónea", 401); return nil }
+			}
+			fields[part.FormName()] = string(value)
+			if part.FormName() == "password" && !authed {
+				if !passwordMatches(r, string(value)) { http.Error(w, "Clave errónea", 401); return nil }
+				authed = true
+				r = r.WithContext(context.WithValue(r.Context(), uploadRoleKey{}, roleAdmin))
+			}
+			continue
+		}
+		if part.FormName() != "file" && (part.FormName() != "folder" || policy.Fixed) { continue }
+		if !authed { http.Error(w, "Clave errónea (debe enviarse antes que el archivo)", 401); return nil }
+		// En las solicitudes de archivos la caducidad no la decide quien envía
+		if policy.Fixed { delete(fields, "expires") }
+		if _, ok := uploadExpiry(fields["expires"]); !ok { http.Error(w, "Caducidad no válida (1h, 1d, 1w o never)", 400); return nil }
+
+		// FileName() se queda solo con la base; la ruta relativa está en la cabecera
+		original := part.FileName()
+		var name string
+		if part.FormName() == "folder" {
+			original = rawFileName(part)
+			name, err = sanitizeRelPath(original)
+		} else {
+			name, err = sanitizeFilename(original)
+		}
+		if err != nil { http.Error(w, "Nombre de archivo no válido: "+err.Error(), 400); return nil }
+		if len(policy.Extensions) > 0 && !slices.Contains(policy.Extensions, strings.ToLower(path.Ext(name))) {
+			http.Error(w, "Tipo de archivo no permitido: "+name, 415)
+			return nil
+		}
+		// El SHA-256 esperado va en la cabecera de la parte, en un campo
+		// "sha256" justo antes del archivo o, para una sola subida, en la petición
+		want := part.Header.Get("X-Content-SHA256")
+		if want == "" { want = fields["sha256"] }
+		if want == "" { want = r.Header.Get("X-Content-SHA256") }
+		delete(fields, "sha256")
+		if want, err = contentSHA256(want); err != nil { http.Error(w, err.Error(), 400); return nil }
+		result := uploadResult{Original: original, Renamed: name != original}
+		dir := policy.Dir
+		if !policy.Fixed { dir = routeUpload(r, fields["dir"], name, 0) }
+		if dir = strings.Trim(dir, "/"); dir != "" { name = dir + "/" + name }
+		dstPath, err := securePath(name)
+		if err != nil { http.Error(w, "Denegado", 403); return nil }
+		// Los enlaces (solicitudes, carpetas) ya son el permiso de quien los creó
+		if !policy.Fixed {
+			if m := lockedMount(r, dstPath); m != nil { mountLocked(w, r, m); return nil }
+			if aclDenied(w, r, filepath.Dir(dstPath), aclWrite) { return nil }
+		}
+		src := quotas.Reader(r, part)
+		if policy.MaxBytes > 0 { src = &sizeLimitReader{r: src, n: policy.MaxBytes} }
+		if fields["message"] == "" { fields["message"] = policy.Message }
+		unlock, err := pathLocks.TryLock(dstPath)
+		if err != nil { failWith(w, "path_busy", "Otra subida está escribiendo "+name+"; vuelve a intentarlo", 409); return nil }
+		start, counted := time.Now(), &countingReader{r: src}
+		status, err := storePart(r, counted, dstPath, name, want, fields, &result)
+		unlock()
+		took := time.Since(start)
+		transfers.Record(r, "subida", name, counted.n, took, err)
+		quotas.Charge(r, counted.n)
+		result.Speed = Transfer{Bytes: counted.n, Duration: took}.Speed()
+		if errors.Is(err, errQuotaExceeded) { quotaFail(w, r, 1, err); return nil }
+		if errors.Is(err, errChecksumMismatch) { failWith(w, "checksum_mismatch", err.Error()+": "+name, 422); return nil }
+		if err != nil { http.Error(w, err.Error(), status); return nil }
+		stored = append(stored, result)
+	}
+	if len(stored) == 0 { http.Error(w, "Falta el archivo", 400); return nil }
+	return stored
+}
+
+// storePart guarda una parte de la subida en dstPath (comprobando su SHA-256
+// si el cliente lo dio en want); se llama con la ruta bloqueada y devuelve el
+// código HTTP del fallo
+func storePart(r *http.Request, src io.Reader, dstPath, name, want string, fields map[string]string, result *uploadResult) (int, error) {
+	if err := checkMountWrite(dstPath, 0); errors.Is(err, errMountQuota) {
+		return 507, errors.New("La carpeta compartida ha llegado a su cuota")
+	} else if err != nil {
+		return 403, errors.New("Esta carpeta es de solo lectura")
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil { return 409, errors.New("No se pudo crear la carpeta de " + name) }
+	if err := checkDirCapacity(dstPath); err != nil { return 507, err }
+	if unchangedUpload(r, dstPath) { return 412, errors.New("Sin cambios: " + name) }
+	if info, err := os.Lstat(dstPath); err == nil {
+		if info.IsDir() { return 409, errors.New("Ya existe una carpeta llamada " + name) }
+		result.Replaced = true
+	}
+	var err error
+	if result.SHA256, err = receiveChecked(hookContext(r), src, dstPath, want); err != nil {
+		log.Printf("Subida de %s interrumpida: %v", name, err)
+		if errors.Is(err, errChecksumMismatch) { return 422, err }
+		var rejected *hookRejected
+		if errors.As(err, &rejected) { return 403, err }
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) || errors.Is(err, errFileTooLarge) { return 413, errors.New("Archivo demasiado grande") }
+		if errors.Is(err, errDiskFull) { return 507, errors.New("No hay espacio en disco para este archivo") }
+		if errors.Is(err, errQuotaExceeded) { return 429, err }
+		return 400, errors.New("Error guardando el archivo")
+	}
+	if err := finishUpload(r, dstPath, fields, result); err != nil { return 422, errors.New("Imagen no válida: " + name) }
+	return 0, nil
+}
+
+// respondUploads contesta con la página de resultado o, para clientes de API, con JSON
+func respondUploads(w http.ResponseWriter, r *http.Request, stored []uploadResult) {
+	contentChanged()
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(map[string]interface{}{"files": stored})
+		return
+	}
+	uploadResultTmpl.Execute(w, map[string]interface{}{"Files": stored})
+}
+
+// uploadResult describe un archivo recibido, para la página de resultado y la API
+type uploadResult struct {
+	Name      string `json:"name"`
+	Original  string `json:"original"`
+	Renamed   bool   `json:"renamed"`
+	Replaced  bool   `json:"replaced"`
+	Size      int64  `json:"size"`
+	HumanSize string `json:"-"`
+	SHA256    string `json:"sha256"`
+	URL       string `json:"url"`
+	Speed     string `json:"-"`
+}
+
+// finishUpload limpia los metadatos de imagen si se pidió, guarda los metadatos
+// del archivo y completa el resultado. Si la imagen no es válida la borra.
+func finishUpload(r *http.Request, dstPath string, fields map[string]string, result *uploadResult) error {
+	uploader := truncateRunes(strings.TrimSpace(fields["uploader"]), 100)
+	if uploader == "" { uploader = currentUser(r) }
+	message := truncateRunes(strings.TrimSpace(fields["message"]), 500)
+	info, sum, err := recordUpload(r.Context(), dstPath, uploader, message, result.SHA256)
+	if err != nil { return err }
+	if ttl, _ := uploadExpiry(fields["expires"]); ttl > 0 {
+		expires := time.Now().Add(ttl).Unix()
+		if err := meta.Update(relPath(dstPath), func(m *FileMeta) { m.Expires = expires }); err != nil { log.Printf("Error guardando metadatos: %v", err) }
+	}
+
+	postUploadHook(r, dstPath, sum, info.Size())
+	rel := relPath(dstPath)
+	result.SHA256 = sum
+	result.Name = rel
+	result.Size = info.Size()
+	result.HumanSize = humanSize(result.Size)
+	result.URL = baseURL(r) + "/download/" + escapePath(rel)
+	if opaqueIDs {
+		result.URL = baseURL(r) + "/id/" + fileID(rel)
+		meta.Flush()
+	}
+	return nil
+}
+
+// recordUpload es la parte de finishUpload que no depende de la petición
+// (también la usan las carpetas de entrada): quita los metadatos de imagen si
+// se pidió y guarda tipo, autor, mensaje y SHA-256. Devuelve el SHA-256 final.
+func recordUpload(ctx context.Context, dstPath, uploader, message, sum string) (os.FileInfo, string, error) {
+	// La fecha de captura se lee antes de que -strip-exif la quite
+	var taken int64
+	if isPhoto(dstPath) { taken = exifTakenUnix(dstPath) }
+	if stripExif {
+		_, stripSpan := startSpan(ctx, "upload.strip_metadata")
+		err := stripImageMetadata(dstPath)
+		stripSpan.SetError(err)
+		stripSpan.End()
+		if err != nil {
+			log.Printf("No se pudieron quitar los metadatos de %s: %v", dstPath, err)
+			os.Remove(dstPath)
+			return nil, "", err
+		}
+		// El archivo cambió: la suma tiene que ser la de lo que se sirve
+		var sumErr error
+		if sum, sumErr = fileSHA256(dstPath); sumErr != nil { log.Printf("Error calculando SHA-256: %v", sumErr) }
+	}
+	info, err := os.Stat(dstPath)
+	if err != nil { return nil, "", err }
+	_, metaSpan := startSpan(ctx, "storage.metadata")
+	err = meta.Update(relPath(dstPath), func(m *FileMeta) {
+		m.MIME = detectContentType(dstPath)
+		m.Uploader = uploader
+		m.Message = message
+		m.SHA256, m.HashSize, m.HashMTime = sum, info.Size(), info.ModTime().UnixNano()
+		m.CID = ""
+		m.Expires = 0
+		m.Duration, m.Width, m.Height = 0, 0, 0
+		m.Taken = taken
+	})
+	metaSpan.SetError(err)
+	metaSpan.End()
+	if err != nil { log.Printf("Error guardando metadatos: %v", err) }
+	if ipfsEnabled() { jobs.Enqueue("ipfs", relPath(dstPath)) }
+	if ffprobePath != "" && isVideo(dstPath) { jobs.Enqueue("video", relPath(dstPath)) }
+	if hlsEnabled() && isVideo(dstPath) && info.Size() >= hlsMinMB<<20 { jobs.Enqueue("hls", relPath(dstPath)) }
+	return info, sum, nil
+}
+
+// Bytes de campos que se leen como mucho antes de encontrar la clave
+const maxPreAuthBytes = 16 << 10
+
+// receiveFile copia el cuerpo a un temporal junto al destino y lo renombra
+// solo si llegó completo; una subida cortada nunca pisa el archivo anterior.
+// Devuelve el SHA-256 calculado al vuelo, sin releer el archivo.
+func receiveFile(ctx context.Context, src io.Reader, dstPath string) (string, error) {
+	return receiveChecked(ctx, src, dstPath, "")
+}
+
+// errChecksumMismatch: el contenido recibido no tiene el SHA-256 que anunció
+// el cliente (X-Content-SHA256), así que se descarta sin tocar el destino
+var errChecksumMismatch = errors.New("El archivo llegó dañado: su SHA-256 no coincide con X-Content-SHA256")
+
+// contentSHA256 lee el SHA-256 que anuncia el cliente (en hexadecimal); vacío
+// si no lo envía, error si no tiene forma de SHA-256
+func contentSHA256(value string) (string, error) {
+	value = strings.ToLower(strings.Trim(strings.TrimSpace(value), `"`))
+	if value == "" { return "", nil }
+	if len(value) != 64 { return "", errors.New("X-Content-SHA256 no válido") }
+	if _, err := hex.DecodeString(value); err != nil { return "", errors.New("X-Content-SHA256 no válido") }
+	return value, nil
+}
+
+// receiveChecked es receiveFile comprobando antes de publicar que el
+// contenido tiene el SHA-256 want (si no está vacío)
+func receiveChecked(ctx context.Context, src io.Reader, dstPath, want string) (string, error) {
+	_, span := startSpan(ctx, "storage.write")
+	defer span.End()
+	span.SetAttr("file.name", filepath.Base(dstPath))
+
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), ".cerbero-upload-*")
+	if err != nil {
+		span.SetError(err)
+		return "", err
+	}
+	h := sha256.New()
+	n, err := copyBuffered(io.MultiWriter(&diskGuardWriter{w: tmp, dir: filepath.Dir(dstPath)}, h), src)
+	span.SetAttr("file.size", n)
+	if cerr := tmp.Close(); err == nil { err = cerr }
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err == nil && want != "" && sum != want { err = errChecksumMismatch }
+	if err == nil { err = preUploadHook(ctx, tmp.Name(), dstPath, n, sum) }
+	if err == nil { err = os.Chmod(tmp.Name(), 0644) }
+	if err == nil { err = os.Rename(tmp.Name(), dstPath) }
+	if err != nil {
+		os.Remove(tmp.Name())
+		span.SetError(err)
+		return "", err
+	}
+	return sum, nil
+}
+
+// copyBufPool reutiliza búferes de 1 MB para las copias que no pueden ir por
+// sendfile/splice (subidas, hashes, ZIP): io.Copy reservaría 32 KB cada vez
+// y haría 32 veces más llamadas al sistema
+var copyBufPool = sync.Pool{New: func() any { b := make([]byte, copyBufSize); return &b }}
+
+var copyBufSize = 1 << 20
+
+// copyBuffered es io.Copy con un búfer del pool; si dst o src saben copiarse
+// solos (ReadFrom/WriteTo) io.CopyBuffer los sigue prefiriendo
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil { return "", err }
+	defer f.Close()
+	h := sha256.New()
+	if _, err := copyBuffered(h, f); err != nil { return "", err }
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, r, "download") { return }
+	if opaqueDenied(w, r) { return }
+	abs, err := existingPath(r.PathValue("path"))
+	if errors.Is(err, errNotFound) && reports.Quarantined(r.PathValue("path")) { quarantineError(w); return }
+	if err != nil { pathError(w, err); return }
+	if m := lockedMount(r, abs); m != nil { mountLocked(w, r, m); return }
+	if aclDenied(w, r, abs, aclRead) { return }
+	serveDownload(w, r, abs)
+}
+
+// opaqueDenied aplica -opaque-ids a las rutas que sirven contenido por su
+// ruta: sin identificarse no se pueden probar, y se responde igual exista o no
+// el archivo
+func opaqueDenied(w http.ResponseWriter, r *http.Request) bool {
+	if ok, _ := authorizedByIdentity(r, roleRead); !opaqueIDs || ok { return false }
+	if password != "" { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+	http.Error(w, "Clave errónea", 401)
+	return true
+}
+
+// serveDownload envía un archivo ya autorizado, con rangos, suma SHA-256 y
+// anotación en el historial
+func serveDownload(w http.ResponseWriter, r *http.Request, abs string) {
+	if cspPolicy != "" { w.Header().Set("Content-Security-Policy", downloadCSP) }
+	_, span := startSpan(r.Context(), "storage.read")
+	defer span.End()
+	span.SetAttr("file.name", filepath.Base(abs))
+	rel := relPath(abs)
+	info, err := os.Stat(abs)
+	if err != nil || info.IsDir() {
+		http.ServeFile(w, r, abs)
+		return
+	}
+	if downloadHookDenied(w, r, abs, info) { return }
+	// Al historial van las descargas completas (200); los rangos de un vídeo
+	// o de cerbero get lo llenarían de trozos
+	if r.Method == "GET" {
+		cw, start := &countingWriter{ResponseWriter: w}, time.Now()
+		defer func() {
+			if cw.status == 200 { transfers.Record(r, "descarga", rel, cw.n, time.Since(start), nil) }
+		}()
+		w = cw
+	}
+	if forceDownload && isRiskyContent(abs) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(abs)}))
+	} else {
+		// El tipo detectado al subir (contenido + extensión) en lugar del que
+		// ServeFile deduciría solo por la extensión
+		w.Header().Set("Content-Type", withCharset(fileMIME(rel)))
+		meta.Flush()
+	}
+	if sum, ok := knownSHA256(rel, info); ok {
+		setDigestHeaders(w.Header(), sum)
+		// El mismo valor sirve para If-Match al borrar o en /batch
+		w.Header().Set("ETag", `"`+sum+`"`)
+		http.ServeFile(w, r, abs)
+		return
+	}
+	// Sin suma guardada, a quien acepta trailers (TE: trailers) se le calcula
+	// durante el envío y se manda al final. Los trailers solo viajan sin
+	// Content-Length, así que al resto se le sirve el archivo tal cual
+	if r.Method != "GET" || r.Header.Get("Range") != "" || !strings.Contains(strings.ToLower(r.Header.Get("TE")), "trailers") {
+		http.ServeFile(w, r, abs)
+		return
+	}
+	w.Header().Set("Trailer", "X-Cerbero-SHA256")
+	hw := &hashingWriter{ResponseWriter: w, h: sha256.New()}
+	http.ServeFile(hw, r, abs)
+	if hw.n != info.Size() { return }
+	sum := hex.EncodeToString(hw.h.Sum(nil))
+	w.Header().Set("X-Cerbero-SHA256", sum)
+	meta.Fill(rel, func(m *FileMeta) { m.SHA256, m.HashSize, m.HashMTime = sum, info.Size(), info.ModTime().UnixNano() })
+	meta.Flush()
+}
+
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	path, token, ok := removeFile(w, r, r.FormValue("path"), !wantsJSON(r))
+	if !ok { return }
+	http.Redirect(w, r, withUndo(listingURL(filepath.Dir(path)), token), 303)
+}
+
+// restDeleteHandler es DELETE /download/{path}: lo mismo que /delete para
+// clientes REST, con 204 en lugar de volver al listado
+func restDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if _, _, ok := removeFile(w, r, r.PathValue("path"), false); !ok { return }
+	w.WriteHeader(204)
+}
+
+// removeFile borra un archivo (o una carpeta vacía) tras comprobar permisos y
+// versión; si no puede, ya ha respondido. Con undo (borrados desde el
+// listado) lo aparta durante -undo-seconds y devuelve el token para deshacerlo.
+// Una carpeta con contenido necesita recursive=1 (ver treeSummary)
+func removeFile(w http.ResponseWriter, r *http.Request, requested string, undo bool) (string, string, bool) {
+	if !enableDelete { http.Error(w, "Borrado deshabilitado", 403); return "", "", false }
+	if !authorizedDelete(r) { http.Error(w, "Clave errónea", 401); return "", "", false }
+	path, err := existingPath(requested)
+	if err != nil { pathError(w, err); return "", "", false }
+	if relPath(path) == "." { http.Error(w, "No se puede borrar la raíz", 403); return "", "", false }
+	if isMountDir(path) { http.Error(w, "No se puede borrar una carpeta compartida", 403); return "", "", false }
+	if m := lockedMount(r, path); m != nil { mountLocked(w, r, m); return "", "", false }
+	if err := checkMountWrite(path, -1); err != nil { mountWriteError(w, err); return "", "", false }
+	if aclDenied(w, r, path, aclDelete) { return "", "", false }
+	// Con mtime (el listado lo envía), If-Match o If-Unmodified-Since solo se
+	// borra si nadie lo ha reemplazado desde que el cliente lo vio
+	unlock, err := pathLocks.TryLock(path)
+	if err != nil { failWith(w, "path_busy", "Se está escribiendo ese archivo", 409); return "", "", false }
+	defer unlock()
+	info, err := os.Lstat(path)
+	if err != nil { http.Error(w, "No encontrado", 404); return "", "", false }
+	changed := !unchangedVersion(path, info, r.FormValue("mtime"), r.Header.Get("If-Match"))
+	if t, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && info.ModTime().Truncate(time.Second).After(t) { changed = true }
+	if changed { http.Error(w, "El archivo ha cambiado desde que se listó; recarga la página", 412); return "", "", false }
+	if entries, err := os.ReadDir(path); info.IsDir() && (err != nil || len(entries) > 0) {
+		sum, denied := summarizeTree(r, path)
+		if denied != "" { failWith(w, "acl_denied", "Sin permiso de borrado en "+denied, 403); return "", "", false }
+		if r.FormValue("recursive") != "1" || r.FormValue("dry_run") == "1" { confirmTreeDelete(w, r, sum); return "", "", false }
+		// Toda la carpeta pasa por la papelera: desaparece de golpe y, sin
+		// -undo-seconds, se vacía enseguida en segundo plano
+		autoSnapshot("delete")
+		token, err := deletions.Stage(r, []string{path})
+		if err != nil { http.Error(w, "No se pudo borrar", 500); return "", "", false }
+		audit(r, "delete_tree", map[string]string{"path": sum.Path, "files": strconv.Itoa(sum.Files), "bytes": strconv.FormatInt(sum.Bytes, 10)})
+		if !undo || undoSeconds == 0 { token = "" }
+		return path, token, true
+	}
+	if undo && undoSeconds > 0 {
+		token, err := deletions.Stage(r, []string{path})
+		if err != nil { http.Error(w, "No se pudo borrar", 500); return "", "", false }
+		return path, token, true
+	}
+	if err := os.Remove(path); err != nil { http.Error(w, "No se pudo borrar", 500); return "", "", false }
+	forgetPath(relPath(path))
+	postDeleteHook(relPath(path), undoOwner(r))
+	contentChanged()
+	return path, "", true
+}
+
+// treeSummary es lo que se borraría con una carpeta: se muestra (o se
+// devuelve con dry_run=1) antes de pedir confirmación
+type treeSummary struct {
+	Path  string `json:"path"`
+	Files int    `json:"files"`
+	Dirs  int    `json:"dirs"`
+	Bytes int64  `json:"bytes"`
+}
+
+// summarizeTree cuenta el contenido de la carpeta (también lo oculto, que se
+// borra con ella) y devuelve la primera subcarpeta en la que las listas de
+// permisos no dejan borrar
+func summarizeTree(r *http.Request, dir string) (treeSummary, string) {
+	sum := treeSummary{Path: relPath(dir)}
+	denied := ""
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || p == dir { return nil }
+		if d.IsDir() {
+			sum.Dirs++
+			if !aclAllows(r, relPath(p), aclDelete) { denied = relPath(p); return filepath.SkipAll }
+			return nil
+		}
+		sum.Files++
+		if info, err := d.Info(); err == nil && d.Type().IsRegular() { sum.Bytes += info.Size() }
+		return nil
+	})
+	return sum, denied
+}
+
+var deleteTreeTmpl *template.Template
+
+// confirmTreeDelete responde a un borrado de carpeta sin confirmar: la página
+// de confirmación en el navegador, el resumen en JSON con dry_run=1 o, a un
+// DELETE sin recursive=1, un 409 con el resumen
+func confirmTreeDelete(w http.ResponseWriter, r *http.Request, sum treeSummary) {
+	if r.FormValue("dry_run") == "1" || wantsJSON(r) || r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		if r.FormValue("dry_run") != "1" {
+			w.Header().Set(errorCodeHeader, "not_empty")
+			w.WriteHeader(409)
+		}
+		json.NewEncoder(w).Encode(sum)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	deleteTreeTmpl.Execute(w, map[string]interface{}{
+		"Sum":             sum,
+		"MTime":           r.FormValue("mtime"),
+		"PasswordEnabled": password != "" && sessionFor(r) == nil && r.Header.Get("Authorization") == "",
+		"Back":            listingURL(filepath.Dir(absPath(sum.Path))),
+	})
+}
+
+// forgetPath quita de los almacenes lo que se refería a una ruta borrada
+func forgetPath(rel string) {
+	pins.Forget(rel)
+	forgetHLS(rel)
+	meta.Delete(rel)
+	shares.Forget(rel)
+	acls.Forget(rel)
+	folderLinks.Forget(rel)
+}
+
+// putHandler es PUT /download/{path}: crea o reemplaza el archivo con el
+// cuerpo tal cual (curl -T, agentes de copia), sin formulario multipart.
+// Responde 201 si es nuevo y 200 si reemplazó otro
+func putHandler(w http.ResponseWriter, r *http.Request) {
+	putFile(w, r, r.PathValue("path"))
+}
+
+// streamHandler es POST /api/v1/stream?name=...&dir=...: el cuerpo en bruto,
+// normalmente sin longitud (Transfer-Encoding: chunked), para volcar la salida
+// de un comando con "cerbero put". El archivo aparece al cerrarse el cuerpo
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	dir := r.URL.Query().Get("dir")
+	if name != "" { dir = routeUpload(r, dir, name, max(r.ContentLength, 0)) }
+	if dir = strings.Trim(dir, "/"); dir != "" && name != "" { name = dir + "/" + name }
+	putFile(w, r, name)
+}
+
+// putFile guarda el cuerpo de la petición en original (ruta relativa a la raíz)
+func putFile(w http.ResponseWriter, r *http.Request, original string) {
+	if rateLimited(w, r, "upload") { return }
+	// La clave va en cabeceras (Basic, X-Cerbero-Password o Bearer): el cuerpo es el archivo
+	if ok, _ := authorizedByIdentity(r, roleWrite); !ok {
+		if !loginEnabled() { w.Header().Set("WWW-Authenticate", `Basic realm="Cerbero-Go"`) }
+		http.Error(w, "Clave errónea", 401)
+		return
+	}
+	if original == "" || strings.HasSuffix(original, "/") { http.Error(w, "Falta el nombre del archivo", 400); return }
+	name, err := sanitizeRelPath(original)
+	if err != nil { http.Error(w, "Nombre de archivo no válido: "+err.Error(), 400); return }
+	result := uploadResult{Original: original, Renamed: name != original}
+	if r.ContentLength > int64(maxUploadMB)<<20 { http.Error(w, "Archivo demasiado grande", 413); return }
+	if _, err := quotas.Check(r, r.ContentLength); err != nil { quotaFail(w, r, r.ContentLength, err); return }
+	dstPath, err := securePath(name)
+	if err != nil { http.Error(w, "Denegado", 403); return }
+	if m := lockedMount(r, dstPath); m != nil { mountLocked(w, r, m); return }
+	if err := checkMountWrite(dstPath, max(r.ContentLength, 0)); err != nil { mountWriteError(w, err); return }
+	if aclDenied(w, r, dstPath, aclWrite) { return }
+	unlock, err := pathLocks.TryLock(dstPath)
+	if err != nil { failWith(w, "path_busy", "Otra subida está escribiendo "+name+"; vuelve a intentarlo", 409); return }
+	defer unlock()
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil { http.Error(w, "No se pudo crear la carpeta", 409); return }
+	if err := checkDirCapacity(dstPath); err != nil { http.Error(w, err.Error(), 507); return }
+	if r.ContentLength > 0 && checkFreeSpace(filepath.Dir(dstPath), r.ContentLength) != nil {
+		http.Error(w, "No hay espacio en disco para este archivo", 507)
+		return
+	}
+	info, err := os.Lstat(dstPath)
+	if err == nil {
+		if info.IsDir() { http.Error(w, "Ya existe una carpeta llamada "+name, 409); return }
+		result.Replaced = true
+	}
+	// If-Match con el SHA-256 (o "*") exige que el archivo siga como lo vio el
+	// cliente, para que dos escritores no se pisen; If-None-Match como en /upload
+	if im := r.Header.Get("If-Match"); im != "" && (err != nil || !unchangedVersion(dstPath, info, "", im)) {
+		failWith(w, "precondition_failed", "El archivo ha cambiado: "+name, 412)
+		return
+	}
+	if unchangedUpload(r, dstPath) { failWith(w, "precondition_failed", "Sin cambios: "+name, 412); return }
+	want, err := contentSHA256(r.Header.Get("X-Content-SHA256"))
+	if err != nil { http.Error(w, err.Error(), 400); return }
+	if cr := r.Header.Get("Content-Range"); cr != "" { putRange(w, r, cr, dstPath, want, result); return }
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxUploadMB)<<20)
+	start, counted := time.Now(), &countingReader{r: quotas.Reader(r, r.Body)}
+	result.SHA256, err = receiveChecked(hookContext(r), counted, dstPath, want)
+	transfers.Record(r, "subida", name, counted.n, time.Since(start), err)
+	quotas.Charge(r, counted.n)
+	if err != nil {
+		log.Printf("PUT de %s interrumpido: %v", name, err)
+		putError(w, r, err)
+		return
+	}
+	putDone(w, r, dstPath, result)
+}
+
+// putError traduce el fallo al guardar el cuerpo de un PUT
+func putError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooBig *http.MaxBytesError
+	var rejected *hookRejected
+	switch {
+	case errors.As(err, &rejected):
+		failWith(w, "hook_rejected", rejected.Message, 403)
+	case errors.Is(err, errChecksumMismatch):
+		failWith(w, "checksum_mismatch", err.Error(), 422)
+	case errors.Is(err, errQuotaExceeded):
+		quotaFail(w, r, 1, err)
+	case errors.As(err, &tooBig):
+		http.Error(w, "Archivo demasiado grande", 413)
+	case errors.Is(err, errDiskFull):
+		http.Error(w, "No hay espacio en disco para este archivo", 507)
+	default:
+		http.Error(w, "Error guardando el archivo", 400)
+	}
+}
+
+// putDone registra el archivo ya publicado y responde 201 si es nuevo o 200
+// si reemplazó otro
+func putDone(w http.ResponseWriter, r *http.Request, dstPath string, result uploadResult) {
+	fields := map[string]string{"uploader": r.Header.Get("X-Cerbero-Sender"), "message": r.Header.Get("X-Cerbero-Message")}
+	if err := finishUpload(r, dstPath, fields, &result); err != nil {
+		http.Error(w, "Imagen no válida", 422)
+		return
+	}
+	contentChanged()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", result.URL)
+	if result.Replaced { w.WriteHeader(200) } else { w.WriteHeader(201) }
+	json.NewEncoder(w).Encode(map[string]interface{}{"files": []uploadResult{result}})
+}
+
+// Un PUT reanudable manda el archivo en trozos con "Content-Range: bytes
+// inicio-fin/total". Los trozos se añaden a un temporal junto al destino
+// (".cerbero-put-*", que no se lista) y el archivo solo se publica al llegar
+// el último byte. Cada trozo tiene que empezar donde acabó lo recibido; si
+// no, 416 con lo que hay en Range para que el cliente siga desde ahí. Un
+// trozo intermedio responde 308 con ese mismo Range, y "bytes */total" sin
+// cuerpo solo consulta el progreso. Empezar en 0 descarta lo anterior.
+
+var rangePuts = struct {
+	m  map[string]time.Time
+	mu sync.Mutex
+}{m: make(map[string]time.Time)}
+
+// partialPath es el temporal fijo de un PUT reanudable hacia dstPath, para
+// poder continuar aunque el servidor se haya reiniciado entre trozos
+func partialPath(dstPath string) string {
+	sum := sha256.Sum256([]byte(filepath.Base(dstPath)))
+	return filepath.Join(filepath.Dir(dstPath), ".cerbero-put-"+hex.EncodeToString(sum[:8]))
+}
+
+// parseContentRange interpreta "bytes inicio-fin/total" y "bytes */total";
+// start es -1 en la consulta de progreso y total -1 si aún es "*"
+func parseContentRange(h string) (start, end, total int64, err error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(h), "bytes ")
+	rng, size, ok2 := strings.Cut(spec, "/")
+	if !ok || !ok2 { return 0, 0, 0, errors.New("formato") }
+	total = -1
+	if size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil || total < 0 { return 0, 0, 0, errors.New("total") }
+	}
+	if rng == "*" {
+		if total < 0 { return 0, 0, 0, errors.New("total") }
+		return -1, -1, total, nil
+	}
+	a, b, ok := strings.Cut(rng, "-")
+	if !ok { return 0, 0, 0, errors.New("formato") }
+	start, err1 := strconv.ParseInt(a, 10, 64)
+	end, err2 := strconv.ParseInt(b, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start || total >= 0 && end >= total { return 0, 0, 0, errors.New("rango") }
+	return start, end, total, nil
+}
+
+// putRange recibe un trozo de un PUT reanudable; el destino ya está
+// bloqueado y validado por putHandler. want (X-Content-SHA256 del último
+// trozo) es el SHA-256 del archivo completo
+func putRange(w http.ResponseWriter, r *http.Request, header, dstPath, want string, result uploadResult) {
+	start, end, total, err := parseContentRange(header)
+	if err != nil { failWith(w, "bad_request", "Content-Range no válido: "+header, 400); return }
+	if total > int64(maxUploadMB)<<20 { http.Error(w, "Archivo demasiado grande", 413); return }
+	partial := partialPath(dstPath)
+	var have int64
+	if info, err := os.Stat(partial); err == nil { have = info.Size() }
+	received := func() {
+		if have > 0 { w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", have-1)) }
+	}
+	if start < 0 { received(); w.WriteHeader(308); return }
+	if start == 0 { have = 0 }
+	if start != have {
+		received()
+		failWith(w, "range_not_satisfiable", fmt.Sprintf("Se esperaba el byte %d", have), 416)
+		return
+	}
+	length := end - start + 1
+	if r.ContentLength >= 0 && r.ContentLength != length { failWith(w, "bad_request", "El cuerpo no coincide con Content-Range", 400); return }
+	if checkFreeSpace(filepath.Dir(dstPath), length) != nil { http.Error(w, "No hay espacio en disco para este archivo", 507); return }
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if start == 0 { flags |= os.O_TRUNC }
+	f, err := os.OpenFile(partial, flags, 0644)
+	if err != nil { http.Error(w, "Error creando el temporal", 500); return }
+	rangePuts.mu.Lock()
+	rangePuts.m[partial] = time.Now()
+	rangePuts.mu.Unlock()
+	began, counted := time.Now(), &countingReader{r: quotas.Reader(r, io.LimitReader(r.Body, length))}
+	n, err := copyBuffered(&diskGuardWriter{w: f, dir: filepath.Dir(dstPath)}, counted)
+	if cerr := f.Close(); err == nil { err = cerr }
+	if err == nil && n != length { err = io.ErrUnexpectedEOF }
+	transfers.Record(r, "subida", relPath(dstPath)+" (trozo)", counted.n, time.Since(began), err)
+	quotas.Charge(r, counted.n)
+	if err != nil {
+		// Se deja lo que había antes del trozo: el cliente lo reintenta entero
+		os.Truncate(partial, start)
+		log.Printf("PUT por trozos de %s interrumpido: %v", relPath(dstPath), err)
+		putError(w, r, err)
+		return
+	}
+	have = end + 1
+	if total < 0 || have < total { received(); w.WriteHeader(308); return }
+
+	result.SHA256, err = fileSHA256(partial)
+	if err == nil && want != "" && result.SHA256 != want { err = errChecksumMismatch }
+	if err == nil { err = preUploadHook(hookContext(r), partial, dstPath, have, result.SHA256) }
+	if err == nil { err = os.Rename(partial, dstPath) }
+	rangePuts.mu.Lock()
+	delete(rangePuts.m, partial)
+	rangePuts.mu.Unlock()
+	if errors.Is(err, errChecksumMismatch) { os.Remove(partial); failWith(w, "checksum_mismatch", err.Error(), 422); return }
+	var rejected *hookRejected
+	if errors.As(err, &rejected) { os.Remove(partial); failWith(w, "hook_rejected", rejected.Message, 403); return }
+	if err != nil { os.Remove(partial); http.Error(w, "Error guardando el archivo", 500); return }
+	putDone(w, r, dstPath, result)
+}
+
+func pinHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, roleWrite) { http.Error(w, "Clave errónea", 401); return }
+	abs, err := existingPath(r.FormValue("path"))
+	if err != nil { pathError(w, err); return }
+	name := relPath(abs)
+	if _, err := pins.Toggle(currentUser(r), name); err != nil {
+		http.Error(w, "Error guardando", 500)
+		return
+	}
+	http.Redirect(w, r, listingURL(filepath.Dir(abs)), 303)
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "send" {
+		if err := runSend(os.Args[2:]); err != nil { log.Fatal(err) }
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "get" {
+		if err := runGet(os.Args[2:]); err != nil { log.Fatal(err) }
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "put" {
+		if err := runPut(os.Args[2:]); err != nil { log.Fatal(err) }
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "index" {
+		if err := runIndex(os.Args[2:]); err != nil { log.Fatal(err) }
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "tenants" {
+		if err := runTenants(os.Args[2:]); err != nil { log.Fatal(err) }
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil { log.Fatal(err) }
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := runImport(os.Args[2:]); err != nil { log.Fatal(err) }
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "watch" {
+		if err := runWatch(os.Args[2:]); err != nil { log.Fatal(err) }
+		return
+	}
+	flag.StringVar(&listenAddr, "listen", ":8080", "Puerto")
+	flag.StringVar(&rootDir, "root", "./shared", "Carpeta")
+	flag.IntVar(&maxUploadMB, "maxmb", 512, "Límite")
+	flag.IntVar(&uploadBufferMB, "upload-buffer-mb", 32, "Memoria por formulario multipart antes de pasar a disco")
+	flag.IntVar(&uploadBufferTotalMB, "upload-buffer-total-mb", 128, "Memoria total para formularios multipart simultáneos")
+	flag.StringVar(&rateLimits, "rate-limits", defaultRateLimits, "Límites por IP: clase=eventos/periodo[:ráfaga] (upload, auth, download)")
+	flag.Var(&shareSpecs, "share", "Carpeta adicional nombre=/ruta[,ro][,password=clave][,quota-mb=N][,symlinks=none|inside|allowlist] (se puede repetir; el nombre puede ser una ruta como descargas/peliculas)")
+	flag.StringVar(&shareAllow, "share-allow", "", "Carpetas separadas por comas fuera de las cuales no se puede montar un -share")
+	flag.IntVar(&undoSeconds, "undo-seconds", 30, "Segundos para deshacer un borrado hecho desde el listado (0 = se borra al momento)")
+	flag.BoolVar(&opaqueIDs, "opaque-ids", false, "Enlazar los archivos por identificadores opacos (/id/...) en lugar de por su ruta")
+	flag.IntVar(&appendMaxMB, "append-max-mb", 64, "Tamaño en MB a partir del cual /append rota el archivo (0 = no rota)")
+	flag.IntVar(&appendKeep, "append-keep", 5, "Archivos rotados que /append conserva (.1, .2...; 0 = ninguno)")
+	flag.StringVar(&excludePatterns, "exclude", "", "Patrones (sintaxis .gitignore) separados por comas que no se listan, ej. node_modules/,*.tmp")
+	flag.BoolVar(&showHidden, "show-hidden", false, "Listar y servir los archivos y carpetas que empiezan por punto")
+	flag.StringVar(&termsFile, "terms-file", "", "Archivo de texto con las condiciones de uso que hay que aceptar antes de subir")
+	flag.Var(&hookSpecs, "hook", "Gancho evento=comando, evento=URL o evento=plugin.wasm (pre-upload, post-upload, pre-download, post-delete; se puede repetir)")
+	flag.DurationVar(&hookTimeout, "hook-timeout", 10*time.Second, "Tiempo máximo de los ganchos pre-upload y pre-download")
+	flag.IntVar(&pluginMemoryMB, "plugin-memory-mb", 64, "Memoria máxima de cada ejecución de un plugin .wasm de -hook")
+	flag.StringVar(&rulesFile, "rules", "", "Archivo de reglas de subida (allow, reject y route); se recarga al cambiar")
+	flag.StringVar(&redisURL, "redis", "", "Compartir límites, enlaces y sesiones entre réplicas: redis://[:clave@]host:6379[/bd]")
+	flag.StringVar(&redisPrefix, "redis-prefix", "cerbero:", "Prefijo de las claves en Redis")
+	flag.IntVar(&rootQuotaMB, "quota-mb", 0, "MB que puede ocupar la carpeta principal (0 = sin límite)")
+	flag.IntVar(&clientQuotaMB, "client-quota-mb", 0, "MB que cada usuario o IP puede subir al día (0 = sin cuota)")
+	flag.BoolVar(&userHomes, "user-homes", false, "Dar a cada usuario una carpeta privada homes/<usuario> como raíz")
+	flag.IntVar(&homeQuotaMB, "home-quota-mb", 0, "MB que puede ocupar cada carpeta personal de -user-homes (0 = sin límite)")
+	flag.StringVar(&scheduleSpec, "schedule", defaultSchedule, "Tareas de mantenimiento y cuándo se ejecutan: tarea=horario cron;...")
+	flag.StringVar(&snapshotFS, "snapshots", "", "Instantáneas antes de los borrados en bloque: btrfs o zfs (vacío = sin instantáneas)")
+	flag.IntVar(&snapshotKeep, "snapshot-keep", 20, "Instantáneas automáticas que se conservan")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", 30*time.Second, "Cada cuánto se buscan cambios hechos fuera de Cerbero (0 = nunca)")
+	flag.IntVar(&scrubMBps, "scrub-mbps", 0, "MB/s que puede leer la verificación de integridad (0 = sin límite)")
+	flag.IntVar(&jobWorkers, "job-workers", 2, "Trabajos en segundo plano que se ejecutan a la vez")
+	flag.IntVar(&transferHistory, "transfer-history", 200, "Transferencias recientes que se guardan (0 = ninguna)")
+	flag.BoolVar(&lowMem, "low-mem", false, "Perfil para equipos con poca memoria (Raspberry Pi, routers)")
+	flag.StringVar(&assetsDir, "assets-dir", "", "Carpeta con plantillas o recursos estáticos que sustituyen a los integrados")
+	flag.StringVar(&tmpDir, "tmp-dir", "", "Carpeta para los temporales de formularios (por defecto la del sistema)")
+	flag.StringVar(&password, "password", "", "Clave")
+	flag.BoolVar(&enableDelete, "delete", true, "Borrado")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "Emisor OIDC (activa el login SSO)")
+	flag.StringVar(&oidcClientID, "oidc-client-id", "", "Client ID OIDC")
+	flag.StringVar(&oidcClientSecret, "oidc-client-secret", "", "Client secret OIDC")
+	flag.StringVar(&oidcRedirectURL, "oidc-redirect-url", "http://localhost:8080/oidc/callback", "URL de retorno OIDC")
+	flag.StringVar(&oidcRolesClaim, "oidc-roles-claim", "groups", "Claim con roles/grupos")
+	flag.StringVar(&oidcRoleMap, "oidc-role-map", "", "Mapeo grupo=rol (read, write, admin), separado por comas")
+	flag.StringVar(&oidcDefaultRole, "oidc-default-role", roleRead, "Rol para usuarios sin grupo mapeado")
+	flag.StringVar(&ldapURL, "ldap-url", "", "Servidor LDAP (ldap:// o ldaps://)")
+	flag.StringVar(&ldapBaseDN, "ldap-base-dn", "", "DN base de búsqueda de usuarios")
+	flag.StringVar(&ldapBindDN, "ldap-bind-dn", "", "DN de la cuenta de servicio (vacío = anónimo)")
+	flag.StringVar(&ldapBindPassword, "ldap-bind-password", "", "Clave de la cuenta de servicio")
+	flag.StringVar(&ldapUserAttr, "ldap-user-attr", "uid", "Atributo del usuario (sAMAccountName en AD)")
+	flag.StringVar(&ldapRoleMap, "ldap-role-map", "", "Mapeo grupo=rol (read, write, admin), separado por comas")
+	flag.StringVar(&ldapDefaultRole, "ldap-default-role", roleRead, "Rol para usuarios sin grupo mapeado")
+	flag.IntVar(&ldapPoolSize, "ldap-pool", 4, "Conexiones LDAP reutilizables")
+	flag.StringVar(&cspPolicy, "csp", defaultCSP, "Content-Security-Policy (vacío = desactivada)")
+	flag.StringVar(&frameOptions, "frame-options", "DENY", "X-Frame-Options (DENY, SAMEORIGIN o vacío)")
+	flag.StringVar(&referrerPolicy, "referrer-policy", "no-referrer", "Referrer-Policy (vacío = desactivada)")
+	flag.IntVar(&hstsMaxAge, "hsts-max-age", 31536000, "Segundos de HSTS bajo TLS (0 = desactivado)")
+	flag.BoolVar(&forceDownload, "force-download", true, "Forzar descarga de HTML/SVG/JS subidos")
+	flag.StringVar(&mimeTypes, "mime-types", "", "Tipos por extensión que mandan sobre la detección, ej. \".log=text/plain,.nfo=text/plain; charset=cp437\"")
+	flag.BoolVar(&stripExif, "strip-exif", false, "Quitar EXIF/GPS de JPEG y PNG subidos")
+	flag.StringVar(&pdfPreviewCmd, "pdf-preview-cmd", "", "Conversor de PDF a PNG, ej. \"pdftoppm -png -singlefile -f 1 -scale-to 800 {in} {out}\"")
+	flag.StringVar(&officePreviewCmd, "office-preview-cmd", "", "Conversor de docx/xlsx/odt a PNG con {in} y {out}")
+	flag.StringVar(&ffprobePath, "ffprobe", "ffprobe", "ffprobe para sacar duración y resolución de los vídeos (vacío = no)")
+	flag.StringVar(&ffmpegPath, "ffmpeg", "ffmpeg", "ffmpeg para sacar el cartel de los vídeos (vacío = no)")
+	flag.StringVar(&hlsSpec, "hls", "", "Alturas de la versión HLS de los vídeos grandes, ej. 1080,720,360 (vacío = no se convierten)")
+	flag.Int64Var(&hlsMinMB, "hls-min-mb", 100, "Tamaño a partir del cual un vídeo se convierte a HLS")
+	flag.StringVar(&watermarkText, "watermark-text", "", "Texto de la marca de agua en las imágenes de los enlaces (/s/, /f/)")
+	flag.StringVar(&watermarkImage, "watermark-image", "", "PNG de la marca de agua en las imágenes de los enlaces (/s/, /f/)")
+	flag.Float64Var(&watermarkOpacity, "watermark-opacity", 0.4, "Opacidad de la marca de agua, de 0 a 1")
+	flag.IntVar(&viewRows, "view-rows", 1000, "Filas de un CSV o TSV que se muestran en /view")
+	flag.IntVar(&maxNameLen, "max-name-len", 200, "Longitud máxima de nombre de archivo en bytes")
+	flag.BoolVar(&asciiNames, "ascii-names", false, "Transliterar nombres a ASCII (á -> a)")
+	flag.BoolVar(&rejectBadUTF, "reject-bad-utf8", false, "Rechazar nombres con UTF-8 inválido en vez de corregirlos")
+	flag.BoolVar(&noSymlinks, "no-symlinks", false, "No servir enlaces simbólicos dentro de la carpeta")
+	flag.IntVar(&maxDirFiles, "max-files", 0, "Máximo de archivos por carpeta (0 = sin límite)")
+	flag.IntVar(&minFreeMB, "min-free-mb", 100, "Espacio libre que las subidas deben respetar (y mínimo para /readyz)")
+	flag.IntVar(&zipMaxMB, "zip-max-mb", 0, "Tamaño máximo de una descarga ZIP en MB (0 = sin límite)")
+	flag.IntVar(&listPageSize, "page-size", 500, "Elementos por página en el listado")
+	flag.IntVar(&statWorkers, "stat-workers", 8, "Consultas de stat simultáneas al listar (útil en NFS/SMB)")
+	flag.BoolVar(&lazyStat, "lazy-stat", false, "Listar sin stat y cargar tamaños y fechas después desde el navegador")
+	flag.DurationVar(&listCacheTTL, "list-cache", 5*time.Second, "Tiempo que se reutiliza el listado de una carpeta sin cambios (0 = sin caché)")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", 10*time.Second, "Tiempo máximo para recibir las cabeceras")
+	flag.DurationVar(&readTimeout, "read-timeout", time.Minute, "Tiempo máximo para leer una petición (salvo subidas)")
+	flag.DurationVar(&writeTimeout, "write-timeout", time.Minute, "Tiempo máximo para responder (salvo descargas)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 2*time.Minute, "Tiempo de conexiones keep-alive inactivas")
+	flag.DurationVar(&streamTimeout, "stream-timeout", 0, "Tiempo máximo de una subida o descarga (0 = sin límite)")
+	flag.IntVar(&maxHeaderKB, "max-header-kb", 64, "Tamaño máximo de cabeceras en KB")
+	flag.StringVar(&s3Listen, "s3-listen", "", "Dirección de la API compatible con S3 (vacío = desactivada)")
+	flag.StringVar(&s3AccessKey, "s3-access-key", "", "Access key de la API S3")
+	flag.StringVar(&s3SecretKey, "s3-secret-key", "", "Secret key de la API S3")
+	flag.StringVar(&s3Bucket, "s3-bucket", "cerbero", "Nombre del bucket S3")
+	flag.StringVar(&s3Region, "s3-region", "us-east-1", "Región que se anuncia en la API S3")
+	flag.StringVar(&dropDirs, "drop-dirs", "", "Carpetas de entrada separadas por comas (origen o origen=subcarpeta)")
+	flag.DurationVar(&dropInterval, "drop-interval", 30*time.Second, "Cada cuánto se revisan las carpetas de entrada")
+	flag.BoolVar(&dropCopy, "drop-copy", false, "Copiar en vez de mover los archivos de las carpetas de entrada")
+	flag.BoolVar(&enableP2P, "p2p", false, "Habilitar envíos directos entre navegadores (WebRTC)")
+	flag.StringVar(&p2pICE, "p2p-ice", "", "Servidores STUN/TURN para WebRTC separados por comas, ej. stun:stun.example.org:3478")
+	flag.StringVar(&ipfsAPI, "ipfs-api", "", "API RPC de un nodo IPFS (Kubo) donde publicar las subidas, ej. http://127.0.0.1:5001")
+	flag.StringVar(&ipfsGateway, "ipfs-gateway", "", "Pasarela HTTP para los enlaces IPFS, ej. https://ipfs.io")
+	flag.StringVar(&ipfsPinService, "ipfs-pin-service", "", "Servicio de fijado remoto (Pinning Service API)")
+	flag.StringVar(&ipfsPinToken, "ipfs-pin-token", "", "Token del servicio de fijado")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "Exportar trazas OTLP/HTTP, ej. http://collector:4318/v1/traces")
+	flag.StringVar(&traceService, "trace-service", "cerbero-go", "service.name de las trazas")
+	flag.BoolVar(&enableIndex, "index", false, "Indexar el contenido de los documentos para la búsqueda")
+	flag.DurationVar(&indexInterval, "index-interval", 10*time.Minute, "Cada cuánto se revisa el índice")
+	flag.DurationVar(&duInterval, "du-interval", 10*time.Minute, "Cada cuánto se recalcula el tamaño de las carpetas (0 = no se calcula)")
+	flag.StringVar(&pdfTextCmd, "pdf-text-cmd", "", "Extractor de texto de PDF, ej. \"pdftotext -q {in} -\"")
+	flag.StringVar(&ocrCmd, "ocr-cmd", "", "OCR de imágenes, ej. \"tesseract {in} stdout\"")
+	flag.BoolVar(&keepOriginals, "keep-originals", false, "Guardar el original sin limpiar en .cerbero/quarantine")
+	flag.Parse()
+	if listPageSize < 1 { log.Fatal("-page-size debe ser al menos 1") }
+	// Un extractor solo con espacios cuenta como no configurado
+	pdfTextCmd, ocrCmd = strings.TrimSpace(pdfTextCmd), strings.TrimSpace(ocrCmd)
+	hiddenRevealed.Store(showHidden)
+	ignores.flagRules = parseIgnore(strings.Split(excludePatterns, ","))
+	loadAssets()
+	if err := limiter.Configure(defaultRateLimits + "," + rateLimits); err != nil { log.Fatalf("-rate-limits: %v", err) }
+	if tmpDir != "" {
+		if err := os.MkdirAll(tmpDir, 0700); err != nil { log.Fatalf("-tmp-dir: %v", err) }
+		// mime/multipart crea sus temporales en os.TempDir()
+		os.Setenv("TMPDIR", tmpDir)
+	}
+	if lowMem { applyLowMem() }
+
+	abs, _ := filepath.Abs(rootDir)
+	rootDir = abs
+	os.MkdirAll(rootDir, 0755)
+	warnTempSpace()
+	resolvedRoot, err := filepath.EvalSymlinks(rootDir)
+	if err != nil { log.Fatalf("No se puede usar %s: %v", rootDir, err) }
+	realRoot = resolvedRoot
+	setupMounts()
+	stateDir = filepath.Join(rootDir, stateDirName)
+	if rootQuotaMB > 0 { rootQuota = &mount{dir: rootDir, real: realRoot, quota: int64(rootQuotaMB) << 20} }
+	os.MkdirAll(stateDir, 0700)
+	recordServerArgs()
+	pins.load(filepath.Join(stateDir, "pins.json"))
+	loadSessionKey(filepath.Join(stateDir, "session.key"))
+	meta.load(filepath.Join(stateDir, "meta.json"))
+	apiKeys.load(filepath.Join(stateDir, "apikeys.json"))
+	sendTokens.load(filepath.Join(stateDir, "sendtokens.json"))
+	fileRequests.load(filepath.Join(stateDir, "requests.json"))
+	localShares.load(filepath.Join(stateDir, "shares.json"))
+	transfers.load(filepath.Join(stateDir, "transfers.json"))
+	jobs.load(filepath.Join(stateDir, "jobs.json"))
+	if err := scheduler.Configure(scheduleSpec); err != nil { log.Fatalf("-schedule: %v", err) }
+	scheduler.load(filepath.Join(stateDir, "schedule.json"))
+	scrub.load(filepath.Join(stateDir, "scrub.json"))
+	if err := initSnapshots(); err != nil { log.Fatalf("-snapshots: %v", err) }
+	reports.load(filepath.Join(stateDir, "reports.json"))
+	acls.load(filepath.Join(stateDir, "acl.json"))
+	folderLinks.load(filepath.Join(stateDir, "folder-links.json"))
+	auditPath = filepath.Join(stateDir, "audit.log")
+	if termsFile != "" { loadTerms(termsFile) }
+	quotas.load(filepath.Join(stateDir, "quotas.json"))
+	if redisURL != "" {
+		if err := setupRedis(); err != nil { log.Fatalf("-redis: %v", err) }
+	}
+	removeExpired()
+	sweepTrash(context.Background())
+	if enableIndex {
+		textIndex.load(filepath.Join(stateDir, "textindex.json"))
+		go textIndex.run()
+	}
+	if duInterval > 0 { go dirSizes.run() }
+	jobs.Start(max(jobWorkers, 1))
+	scheduler.Start()
+	if reconcileInterval > 0 { go reconciler.run() }
+	if dropDirs != "" {
+		for _, spec := range strings.Split(dropDirs, ",") {
+			src, target, _ := strings.Cut(strings.TrimSpace(spec), "=")
+			abs, _ := filepath.Abs(src)
+			resolved, err := filepath.EvalSymlinks(abs)
+			if err != nil { log.Fatalf("Carpeta de entrada %s: %v", src, err) }
+			// Dentro de rootDir se volvería a ingerir lo ya ingerido
+			if within(realRoot, resolved) || within(resolved, realRoot) { log.Fatalf("La carpeta de entrada %s no puede contener ni estar dentro de -root", src) }
+			if target != "" {
+				if target, err = sanitizeRelPath(target); err != nil { log.Fatalf("Subcarpeta de %s: %v", src, err) }
+			}
+			dropFolders = append(dropFolders, dropFolder{Source: resolved, Target: target})
+		}
+		dropState.load(filepath.Join(stateDir, "drop.json"))
+		go dropState.run()
+	}
+	if oidcEnabled() && oidcClientID == "" { log.Fatal("-oidc-issuer requiere -oidc-client-id") }
+	if _, ok := roleRank[oidcDefaultRole]; !ok { log.Fatalf("Rol desconocido: %s", oidcDefaultRole) }
+	if maxNameLen < 16 || maxNameLen > 255 { log.Fatal("-max-name-len debe estar entre 16 y 255") }
+	if err := parseMIMEOverrides(mimeTypes); err != nil { log.Fatalf("-mime-types: %v", err) }
+	if err := parseHooks(); err != nil { log.Fatalf("-hook: %v", err) }
+	if err := rules.Load(); err != nil { log.Fatalf("-rules: %v", err) }
+	if err := loadWatermark(); err != nil { log.Fatalf("Marca de agua: %v", err) }
+	resolveVideoTools()
+	if err := parseHLS(); err != nil { log.Fatalf("-hls: %v", err) }
+	if len(hlsHeights) > 0 && ffmpegPath == "" { log.Printf("-hls necesita ffmpeg: los vídeos no se convertirán") }
+	if _, ok := roleRank[ldapDefaultRole]; !ok { log.Fatalf("Rol desconocido: %s", ldapDefaultRole) }
+	if ldapEnabled() && ldapBaseDN == "" { log.Fatal("-ldap-url requiere -ldap-base-dn") }
+	ldapPool = make(chan *ldapConn, ldapPoolSize)
+
+	// Cada ruta declara sus métodos; con otro método el mux responde 405 y
+	// la cabecera Allow. GET incluye HEAD.
+	http.HandleFunc("GET /{$}", renderIndex)
+	http.HandleFunc("POST /upload", streaming(needsTerms(uploadHandler)))
+	http.HandleFunc("GET /download/{path...}", streaming(downloadHandler))
+	http.HandleFunc("GET /id/{id}", streaming(idHandler))
+	http.HandleFunc("GET /api/v1/du", duHandler)
+	http.HandleFunc("GET /api/v1/jobs", jobsHandler)
+	http.HandleFunc("GET /schedule", scheduleHandler)
+	http.HandleFunc("POST /schedule", form(scheduleHandler))
+	http.HandleFunc("GET /api/v1/schedule", scheduleHandler)
+	http.HandleFunc("GET /api/v1/rules", rulesHandler)
+	http.HandleFunc("POST /api/v1/rules/test", rulesHandler)
+	http.HandleFunc("GET /api/v1/scrub", scrubHandler)
+	http.HandleFunc("POST /backfill", form(backfillHandler))
+	http.HandleFunc("GET /snapshots", snapshotsHandler)
+	http.HandleFunc("POST /snapshots", form(snapshotsHandler))
+	http.HandleFunc("GET /api/v1/snapshots", snapshotsHandler)
+	http.HandleFunc("POST /scrub", form(scrubHandler))
+	http.HandleFunc("GET /api/v1/jobs/{id}", jobsHandler)
+	http.HandleFunc("POST /api/v1/jobs/{id}/retry", jobsHandler)
+	http.HandleFunc("GET /usage", usageHandler)
+	http.HandleFunc("PUT /download/{path...}", streaming(needsTerms(putHandler)))
+	http.HandleFunc("DELETE /download/{path...}", restDeleteHandler)
+	http.HandleFunc("POST /api/v1/stream", streaming(needsTerms(streamHandler)))
+	http.HandleFunc("POST /append/{path...}", streaming(needsTerms(appendHandler)))
+	http.HandleFunc("POST /share", form(shareHandler))
+	http.HandleFunc("GET /edit/{path...}", editHandler)
+	http.HandleFunc("GET /view/{path...}", viewHandler)
+	http.HandleFunc("POST /edit/{path...}", form(editSaveHandler))
+	http.HandleFunc("GET /s/{token}", streaming(shareDownloadHandler))
+	http.HandleFunc("GET /s/{token}/preview", sharePreviewHandler)
+	http.HandleFunc("GET /s/{token}/report", reportHandler)
+	http.HandleFunc("POST /s/{token}/report", form(reportHandler))
+	http.HandleFunc("POST /hidden", form(hiddenToggleHandler))
+	http.HandleFunc("GET /shares/{name...}", mountHandler)
+	http.HandleFunc("POST /shares/{name...}", form(mountHandler))
+	http.HandleFunc("GET /terms", termsHandler)
+	http.HandleFunc("POST /terms", form(termsHandler))
+	http.HandleFunc("GET /reports", reportsHandler)
+	http.HandleFunc("POST /reports", form(reportsHandler))
+	http.HandleFunc("GET /api/v1/reports", reportsHandler)
+	http.HandleFunc("GET /acl", aclHandler)
+	http.HandleFunc("POST /acl", form(aclHandler))
+	http.HandleFunc("GET /api/v1/acl", aclHandler)
+	http.HandleFunc("GET /homes", homesHandler)
+	http.HandleFunc("GET /api/v1/homes", homesHandler)
+	http.HandleFunc("GET /favicon.ico", iconHandler(32))
+	http.HandleFunc("POST /chunk", needsTerms(form(chunkInitHandler)))
+	http.HandleFunc("GET /chunk/{id}", chunkStatusHandler)
+	http.HandleFunc("PUT /chunk/{id}/{n}", streaming(chunkPutHandler))
+	http.HandleFunc("POST /chunk/{id}", streaming(chunkCompleteHandler))
+	http.HandleFunc("DELETE /chunk/{id}", chunkAbortHandler)
+	http.HandleFunc("POST /delete", form(deleteHandler))
+	http.HandleFunc("POST /pin", form(pinHandler))
+	http.HandleFunc("POST /undo", form(undoHandler))
+	http.HandleFunc("POST /visibility", form(visibilityHandler))
+	http.HandleFunc("GET /preview/{path...}", previewHandler)
+	http.HandleFunc("GET /play/{path...}", playHandler)
+	http.HandleFunc("GET /hls/{path...}", hlsHandler)
+	http.HandleFunc("GET /playlist", playlistHandler)
+	http.HandleFunc("GET /playlist.m3u", playlistHandler)
+	http.HandleFunc("GET /photos", photosHandler)
+	http.HandleFunc("GET /index-status", indexStatusHandler)
+	http.HandleFunc("GET /api/v1/files", apiFilesHandler)
+	http.HandleFunc("GET /api/v1/manifest", manifestHandler)
+	http.HandleFunc("GET /api/v1/stat", apiStatHandler)
+	http.HandleFunc("GET /api/v1/checksums/{path...}", streaming(checksumsHandler))
+	http.HandleFunc("POST /api/v1/send-tokens", form(sendTokenCreateHandler))
+	http.HandleFunc("POST /api/v1/notes", needsTerms(apiNotesHandler))
+	http.HandleFunc("POST /notes", needsTerms(form(notesHandler)))
+	http.HandleFunc("POST /batch", form(batchHandler))
+	http.HandleFunc("POST /copy", form(copyHandler))
+	http.HandleFunc("GET /zip", streaming(zipHandler))
+	http.HandleFunc("POST /zip", streaming(form(zipHandler)))
+	http.HandleFunc("GET /zip/estimate", zipEstimateHandler)
+	http.HandleFunc("GET /static/{file}", staticAssetHandler)
+	http.HandleFunc("GET /manifest.json", staticHandler("application/manifest+json", pwaManifest))
+	http.HandleFunc("GET /sw.js", serviceWorkerHandler)
+	http.HandleFunc("GET /icon-192.png", iconHandler(192))
+	http.HandleFunc("GET /icon-512.png", iconHandler(512))
+	http.HandleFunc("GET /share-target", shareTargetPageHandler)
+	http.HandleFunc("POST /share-target", streaming(needsTerms(uploadHandler)))
+	http.HandleFunc("PUT /send/{token}", streaming(sendReceiveHandler))
+	http.HandleFunc("GET /requests", fileRequestsHandler)
+	http.HandleFunc("POST /requests", form(fileRequestsHandler))
+	http.HandleFunc("GET /r/{token}", needsTerms(fileRequestPageHandler))
+	http.HandleFunc("POST /r/{token}", streaming(needsTerms(fileRequestUploadHandler)))
+	http.HandleFunc("GET /f/{token}", folderLinkHandler)
+	http.HandleFunc("POST /f/{token}", streaming(needsTerms(folderLinkUploadHandler)))
+	http.HandleFunc("GET /f/{token}/dl/{path...}", folderLinkDownloadHandler)
+	http.HandleFunc("GET /f/{token}/playlist", folderLinkPlaylistHandler)
+	http.HandleFunc("GET /f/{token}/playlist.m3u", folderLinkPlaylistHandler)
+	http.HandleFunc("GET /folder-links", folderLinksHandler)
+	http.HandleFunc("POST /folder-links", form(folderLinksHandler))
+	if enableP2P {
+		http.HandleFunc("GET /p2p", p2pPageHandler)
+		http.HandleFunc("POST /p2p", form(p2pCreateHandler))
+		http.HandleFunc("GET /p2p/{room}", p2pPageHandler)
+		http.HandleFunc("POST /p2p/{room}/{role}/signal", p2pSignalHandler)
+		http.HandleFunc("GET /p2p/{room}/{role}/events", streaming(p2pEventsHandler))
+		http.HandleFunc("PUT /p2p/{room}/relay", streaming(p2pRelayPutHandler))
+		http.HandleFunc("GET /p2p/{room}/relay", streaming(p2pRelayGetHandler))
+		go sweepP2PRooms()
+	}
+	http.HandleFunc("GET /healthz", healthzHandler)
+	http.HandleFunc("GET /readyz", readyzHandler)
+	http.HandleFunc("GET /metrics", metricsHandler)
+	http.HandleFunc("GET /transfers", transfersHandler)
+	http.HandleFunc("GET /api/v1/transfers", transfersHandler)
+	http.HandleFunc("GET /login", loginHandler)
+	http.HandleFunc("POST /login", form(loginHandler))
+	http.HandleFunc("GET /oidc/login", oidcLoginHandler)
+	http.HandleFunc("GET /oidc/callback", oidcCallbackHandler)
+	http.HandleFunc("GET /logout", logoutHandler)
+	http.HandleFunc("POST /logout", form(logoutHandler))
+	http.HandleFunc("GET /settings", settingsHandler)
+	http.HandleFunc("POST /settings", form(settingsHandler))
+
+	if tracingEnabled() {
+		spanQueue = make(chan *Span, 2048)
+		go exportSpans()
+	}
+	go sweepChunkUploads()
+	go rateLimitSweeper()
+
+	server := &http.Server{
+		Addr:              listenAddr,
+		Handler:           tracing(securityHeaders(errorPages(memoIdentity(http.DefaultServeMux)))),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderKB << 10,
+	}
+	if s3Enabled() {
+		if s3AccessKey == "" || s3SecretKey == "" { log.Fatal("-s3-listen requiere -s3-access-key y -s3-secret-key") }
+		// Todo el puerto S3 transfiere archivos: usa -stream-timeout
+		s3Server := &http.Server{
+			Addr:              s3Listen,
+			Handler:           tracing(memoIdentity(http.HandlerFunc(s3Handler))),
+			ReadHeaderTimeout: readHeaderTimeout,
+			ReadTimeout:       streamTimeout,
+			WriteTimeout:      streamTimeout,
+			IdleTimeout:       idleTimeout,
+			MaxHeaderBytes:    maxHeaderKB << 10,
+		}
+		log.Printf("API S3 en %s (bucket %s)", s3Listen, s3Bucket)
+		go func() { log.Fatal(s3Server.ListenAndServe()) }()
+	}
 	log.Printf("Cerbero-Go en puerto %s protegiendo %s", listenAddr, rootDir)
-	log.Fatal(http.ListenAndServe(listenAddr, nil))
+	log.Fatal(server.ListenAndServe())
 }
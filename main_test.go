@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sessionRequest prepara una petición con la cookie de sesión de user
+func sessionRequest(t *testing.T, user, role string) *http.Request {
+	t.Helper()
+	payload, err := json.Marshal(Session{User: user, Role: role, Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil { t.Fatal(err) }
+	r := httptest.NewRequest("GET", "/files/equipo/a.txt", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: signValue(payload)})
+	return r
+}
+
+func TestACLAdminCheckSkipsPassword(t *testing.T) {
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+	oldPassword, oldFolders := password, acls.Folders
+	password = "secreta"
+	acls.Folders = map[string][]ACLEntry{"equipo": {{Who: "user:ana", Perms: "r"}}}
+	t.Cleanup(func() { password, acls.Folders = oldPassword, oldFolders })
+	if err := limiter.Configure("auth=10/m:5"); err != nil { t.Fatal(err) }
+
+	r := sessionRequest(t, "luis", roleWrite)
+	for i := 0; i < 20; i++ {
+		if aclAllows(r, "equipo/a.txt", aclRead) { t.Fatal("luis no está en la lista y no es administrador") }
+	}
+	if limiter.Exhausted("auth", clientIP(r)) { t.Fatal("la comprobación de administrador ha gastado intentos de la clave compartida") }
+
+	if !aclAllows(sessionRequest(t, "eva", roleAdmin), "equipo/a.txt", aclRead) { t.Fatal("un administrador con sesión debería pasar") }
+
+	// La clave compartida no convierte a nadie en administrador de las listas
+	r = sessionRequest(t, "luis", roleWrite)
+	r.Header.Set("X-Cerbero-Password", "secreta")
+	if aclAllows(r, "equipo/a.txt", aclRead) { t.Fatal("la clave compartida no debería saltarse la lista") }
+}
+
+func TestIdentifiedAdminOncePerRequest(t *testing.T) {
+	sessionKey = []byte("0123456789abcdef0123456789abcdef")
+	var first, again bool
+	h := memoIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		first = identifiedAdmin(r)
+		// Si se volviera a evaluar, la cookie ya no valdría
+		r.Header.Del("Cookie")
+		again = identifiedAdmin(r)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), sessionRequest(t, "eva", roleAdmin))
+	if !first || !again { t.Fatalf("identifiedAdmin = %v, %v; se esperaba true en las dos", first, again) }
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	write := &APIKey{Scopes: []string{scopeWrite}}
+	if !write.Allows(roleRead) || !write.Allows(roleWrite) { t.Fatal("write debería incluir read") }
+	del := &APIKey{Scopes: []string{scopeDelete}}
+	if del.Allows(roleAdmin) || del.Allows(roleWrite) { t.Fatal("delete no equivale a admin ni a write") }
+
+	oldPath := apiKeys.path
+	apiKeys.path = filepath.Join(t.TempDir(), "keys.json")
+	t.Cleanup(func() { apiKeys.path = oldPath })
+	bearer := func(scopes ...string) *http.Request {
+		token, err := apiKeys.Create("ana", "prueba", scopes)
+		if err != nil { t.Fatal(err) }
+		r := httptest.NewRequest("DELETE", "/download/a.txt", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return r
+	}
+	if !authorizedDelete(bearer(scopeRead, scopeDelete)) { t.Fatal("una clave con delete debería poder borrar") }
+	if authorizedDelete(bearer(scopeWrite)) { t.Fatal("una clave sin delete no debería poder borrar") }
+	if authorized(bearer(scopeDelete), roleAdmin) { t.Fatal("una clave con delete no debería pasar por administrador") }
+}